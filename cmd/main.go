@@ -2,44 +2,323 @@ package main
 
 import (
 	"context"
-	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"simplecrud/pkg/auth"
 	"simplecrud/pkg/database"
+	"simplecrud/pkg/health"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/metrics"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/notify"
+	"simplecrud/pkg/ratelimit"
+	"simplecrud/pkg/redact"
+	"simplecrud/pkg/tenant"
+	"simplecrud/pkg/tracing"
+	"simplecrud/pkg/user"
 	"simplecrud/pkg/vault"
 	"simplecrud/pkg/web"
+	"simplecrud/utils"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
+	// Configure the logs before anything is logged. Personal data and credentials are masked in the logs
+	// and in the error messages returned to clients.
+	redact.SetDefault(redact.New(redact.ParseFields(utils.GetEnv(redact.FieldsKey, redact.DefaultFields))...))
+	if err := logging.Setup(
+		utils.GetEnv(logging.LevelKey, logging.DefaultLevel),
+		utils.GetEnv(logging.FormatKey, logging.DefaultFormat),
+		utils.GetEnv(logging.OutputKey, logging.DefaultOutput),
+		utils.GetEnvBool(logging.RedactKey, logging.DefaultRedact),
+	); err != nil {
+		logging.Default().WithError(err).Fatal("Failed to configure logging")
+	}
+	logger := logging.Default()
+
+	// Collect metrics of the API, MongoDB and Vault, unless the admin port is disabled.
+	var appMetrics *metrics.Metrics
+	var instrumentVault func(http.RoundTripper) http.RoundTripper
+	var commandMonitors []*event.CommandMonitor
+	var poolMonitor *event.PoolMonitor
+	metricsPort := utils.GetEnv(metrics.AdminPortKey, metrics.DefaultAdminPort)
+	if metricsPort != "" {
+		appMetrics = metrics.New()
+		instrumentVault = appMetrics.InstrumentVault
+		commandMonitors = append(commandMonitors, appMetrics.CommandMonitor())
+		poolMonitor = appMetrics.PoolMonitor()
+	}
+
+	// Trace requests through the handlers, the services and MongoDB, if a trace exporter is configured.
+	tracerProvider, err := tracing.Setup(context.Background(),
+		utils.GetEnv(tracing.ExporterKey, tracing.DefaultExporter), utils.GetEnv(tracing.FileKey, tracing.DefaultFile))
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to configure tracing")
+	}
+	var tracer trace.TracerProvider // Left nil when tracing is disabled, so requests are not traced
+	if tracerProvider != nil {
+		tracer = tracerProvider
+		commandMonitors = append(commandMonitors, otelmongo.NewMonitor(otelmongo.WithTracerProvider(tracerProvider)))
+	}
+	mongoOptions := options.Client().SetMonitor(database.CombineMonitors(commandMonitors...)).SetPoolMonitor(poolMonitor)
+
 	// Create a new client for interacting with Vault.
-	vaultClient := vault.NewVaultClient()
+	vaultClient := vault.NewInstrumentedVaultClient(instrumentVault)
 
 	// Connect to MongoDB using credentials retrieved from Vault.
-	mongoClient, dbName, err := database.ConnectWithRetries(vaultClient)
+	mongoClient, dbName, err := database.ConnectWithRetries(vaultClient, mongoOptions)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to connect to database")
+	}
+
+	// Serve the metrics on the admin port, apart from the API.
+	var metricsServer *http.Server
+	if appMetrics != nil {
+		if metricsServer, err = appMetrics.StartServer(metricsPort); err != nil {
+			logger.WithError(err).Fatal("Failed to start metrics server")
+		}
+	}
+
+	// Choose where users are stored: in the DB_NAME database, or in a database per organization.
+	var users database.DatabaseResolver = database.SingleDatabase(dbName)
+	var registry *database.TenantRegistry
+	var tenants tenant.Registry // Left nil when tenants share the database, so requests are not isolated
+	switch mode := utils.GetEnv(database.TenancyModeKey, database.DefaultTenancyMode); mode {
+	case database.TenancyModeShared:
+	case database.TenancyModeDatabase:
+		registry = database.NewTenantRegistry(mongoClient, dbName)
+		tenants = registry
+		users = database.NewTenantDatabases(dbName, registry)
+	default:
+		logger.WithField(database.TenancyModeKey, mode).Fatal("Unknown tenancy mode")
+	}
+
+	// Initialize the repositories.
+	userRepo := database.NewUserRepository(mongoClient, users)
+	sessionRepo := database.NewSessionRepository(mongoClient, dbName)
+	attemptRepo := database.NewAttemptRepository(mongoClient, dbName)
+	auditRepo := database.NewAuditRepository(mongoClient, dbName)
+	tokenRepo := database.NewActionTokenRepository(mongoClient, dbName)
+	apiKeyRepo := database.NewAPIKeyRepository(mongoClient, dbName)
+	orgRepo := database.NewOrganizationRepository(mongoClient, dbName)
+
+	// Create the indexes, including the TTL indexes that remove expired tokens and old login attempts.
+	indexCtx, indexCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer indexCancel()
+	if err = sessionRepo.EnsureIndexes(indexCtx); err != nil {
+		logger.WithError(err).Fatal("Failed to create session indexes")
+	}
+	if err = attemptRepo.EnsureIndexes(indexCtx); err != nil {
+		logger.WithError(err).Fatal("Failed to create login attempt indexes")
+	}
+	if err = tokenRepo.EnsureIndexes(indexCtx); err != nil {
+		logger.WithError(err).Fatal("Failed to create action token indexes")
+	}
+	if err = apiKeyRepo.EnsureIndexes(indexCtx); err != nil {
+		logger.WithError(err).Fatal("Failed to create api key indexes")
+	}
+	if err = database.EnsureUserIndexes(indexCtx, mongoClient, dbName); err != nil {
+		logger.WithError(err).Fatal("Failed to create user indexes")
+	}
+	// Rate limit buckets are kept in memory unless they must be shared by every instance of the API.
+	var rateLimits ratelimit.Store
+	switch store := utils.GetEnv(ratelimit.StoreKey, ratelimit.DefaultStore); store {
+	case ratelimit.StoreMemory:
+	case ratelimit.StoreMongoDB:
+		rateLimitRepo := database.NewRateLimitRepository(mongoClient, dbName)
+		if err = rateLimitRepo.EnsureIndexes(indexCtx); err != nil {
+			logger.WithError(err).Fatal("Failed to create rate limit indexes")
+		}
+		rateLimits = rateLimitRepo
+	default:
+		logger.WithField(ratelimit.StoreKey, store).Fatal("Unknown rate limit store")
+	}
+	// The indexes of tenant databases are created when each tenant is first used.
+	if registry != nil {
+		if err = registry.EnsureIndexes(indexCtx); err != nil {
+			logger.WithError(err).Fatal("Failed to create tenant indexes")
+		}
+	}
+
+	// Load the access token signing key from Vault (or a local key file in development).
+	signingKey, err := auth.LoadSigningKey(vaultClient)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to load token signing key")
+	}
+	tokens, err := auth.NewTokenManager(signingKey, utils.GetEnvDuration(auth.AccessTokenTTLKey, auth.DefaultAccessTokenTTL))
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to create token manager")
+	}
+
+	// Load the key encrypting TOTP secrets at rest, from Vault (or a local key file in development).
+	encryptionKey, err := auth.LoadEncryptionKey(vaultClient)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to load MFA encryption key")
+	}
+	secretBox, err := auth.NewSecretBox(encryptionKey)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		logger.WithError(err).Fatal("Failed to create MFA secret box")
 	}
 
-	// Initialize the user repository.
-	userRepo := database.NewUserRepository(mongoClient, dbName)
+	// Configure how passwords are hashed. Hashes of the other supported algorithm are upgraded on login.
+	hasher, err := user.PasswordHasherFromEnv()
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to configure password hashing")
+	}
+
+	// Configure the rules new passwords must follow, including the optional breached password corpus.
+	policy, err := user.PasswordPolicyFromEnv()
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to configure password policy")
+	}
+
+	// Create the first admin account if one is configured and no admin exists yet.
+	if err = bootstrapAdmin(userRepo, hasher, policy); err != nil {
+		logger.WithError(err).Fatal("Failed to bootstrap admin")
+	}
+
+	// Send emails through SMTP if a server is configured; otherwise they are only written to the log.
+	var notifier notify.Notifier = notify.LogNotifier{}
+	if host := utils.GetEnv(notify.SMTPHostKey, ""); host != "" {
+		notifier = notify.NewSMTPNotifier(notify.SMTPConfig{
+			Host:     host,
+			Port:     utils.GetEnv(notify.SMTPPortKey, notify.DefaultSMTPPort),
+			Username: utils.GetEnv(notify.SMTPUsernameKey, ""),
+			Password: utils.GetEnv(notify.SMTPPasswordKey, ""),
+			From:     utils.GetEnv(notify.SMTPFromKey, ""),
+		})
+	}
+
+	// Enable the login with an OpenID Connect identity provider if one is configured.
+	oidcConfig, err := auth.OIDCConfigFromEnv()
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to configure OIDC login")
+	}
+	var oidc *auth.OIDCService
+	if oidcConfig.Issuer != "" {
+		oidc = auth.NewOIDCService(oidcConfig, userRepo, signingKey, auditRepo)
+	}
+
+	// Report MongoDB and the Vault token in /readyz. The API cannot serve requests without MongoDB; Vault is
+	// only read at startup, so an expired token is reported without taking the API out of rotation.
+	monitor := health.NewMonitor(
+		utils.GetEnvDuration(health.CacheTTLKey, health.DefaultCacheTTL),
+		utils.GetEnvDuration(health.TimeoutKey, health.DefaultTimeout),
+		health.Dependency{Name: "mongodb", Critical: true, Checker: health.CheckerFunc(func(ctx context.Context) error {
+			return mongoClient.Ping(ctx, readpref.Primary())
+		})},
+		health.Dependency{Name: "vault", Checker: health.CheckerFunc(func(ctx context.Context) error {
+			ttl, err := vault.CheckToken(ctx, vaultClient)
+			if err == nil && appMetrics != nil {
+				appMetrics.SetVaultTokenTTL(ttl)
+			}
+			return err
+		})},
+	)
+
+	sessions := auth.NewSessionService(sessionRepo, utils.GetEnvDuration(auth.RefreshTokenTTLKey, auth.DefaultRefreshTokenTTL))
+
+	// Start the web server; it serves in the background so we can listen for shutdown signals.
+	server, err := web.StartServer(web.Dependencies{
+		UserRepo:       userRepo,
+		Organizations:  orgRepo,
+		Members:        userRepo,
+		Hasher:         hasher,
+		PasswordPolicy: policy,
+		Tokens:         tokens,
+		Sessions:       sessions,
+		Guard:          auth.NewLoginGuard(attemptRepo, auth.DefaultLockoutPolicy(), auditRepo),
+		MFA:            auth.NewMFAService(userRepo, secretBox),
+		Resets: auth.NewPasswordResetService(userRepo, tokenRepo, notifier,
+			utils.GetEnvDuration(auth.PasswordResetTTLKey, auth.DefaultPasswordResetTTL),
+			utils.GetEnv(auth.PasswordResetURLKey, "")),
+		Verification: auth.NewVerificationService(userRepo, tokenRepo, notifier,
+			utils.GetEnvDuration(auth.EmailVerificationTTLKey, auth.DefaultEmailVerificationTTL),
+			utils.GetEnvDuration(auth.VerificationResendIntervalKey, auth.DefaultVerificationResendInterval),
+			utils.GetEnv(auth.EmailVerificationURLKey, auth.DefaultEmailVerificationURL)),
+		APIKeys: auth.NewAPIKeyService(apiKeyRepo, auditRepo),
+		OIDC:    oidc,
+		Impersonation: auth.NewImpersonationService(tokens, userRepo, auditRepo,
+			utils.GetEnvDuration(auth.ImpersonationMaxTTLKey, auth.DefaultImpersonationMaxTTL),
+			utils.GetEnvBool(auth.ImpersonateAdminsKey, auth.DefaultImpersonateAdmins)),
+		Audit:      auditRepo,
+		Tenants:    tenants,
+		Health:     monitor,
+		Metrics:    appMetrics,
+		Tracer:     tracer,
+		RateLimits: rateLimits,
+	})
 
-	// Start the web server in a goroutine so we can listen for shutdown signals.
-	go web.StartServer(userRepo)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to start server")
+	}
 
 	// Listen for termination signals.
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	select {
+	case <-sig:
+	case err = <-server.Done():
+		logger.WithError(err).Fatal("Server stopped")
+	}
+
+	// Fail readiness, then let the in-flight requests complete before the database goes away.
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), utils.GetEnvDuration(web.ShutdownTimeoutKey, web.DefaultShutdownTimeout))
+	defer shutdownCancel()
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		logger.WithError(err).Error("Failed to drain in-flight requests")
+	}
+	if metricsServer != nil {
+		if err = metricsServer.Shutdown(shutdownCtx); err != nil {
+			logger.WithError(err).Error("Failed to stop metrics server")
+		}
+	}
+	// Export the spans still buffered.
+	if tracerProvider != nil {
+		if err = tracerProvider.Shutdown(shutdownCtx); err != nil {
+			logger.WithError(err).Error("Failed to flush traces")
+		}
+	}
 
 	// Disconnect the MongoDB client.
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err = mongoClient.Disconnect(ctx); err != nil {
-		log.Fatalf("Failed to disconnect from database: %v", err)
+		logger.WithError(err).Fatal("Failed to disconnect from database")
+	}
+
+	logger.Info("Shutdown complete")
+}
+
+// bootstrapAdmin creates the first admin from the BOOTSTRAP_ADMIN_* environment variables.
+// It does nothing when BOOTSTRAP_ADMIN_EMAIL is not set or when an admin already exists.
+func bootstrapAdmin(userRepo user.Repository, hasher user.PasswordHasher, policy user.PasswordPolicy) error {
+	email := utils.GetEnv("BOOTSTRAP_ADMIN_EMAIL", "")
+	if email == "" {
+		return nil
 	}
 
-	log.Println("Shutdown complete.")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	created, err := user.NewService(userRepo, nil, hasher, policy).BootstrapAdmin(ctx, models.User{
+		Name:     utils.GetEnv("BOOTSTRAP_ADMIN_NAME", "Administrator"),
+		Email:    email,
+		Password: utils.GetEnv("BOOTSTRAP_ADMIN_PASSWORD", ""),
+	})
+	if err != nil {
+		return err
+	}
+	if created {
+		logging.Default().WithField("email", email).Info("Created bootstrap admin")
+	}
+	return nil
 }
@@ -38,6 +38,12 @@ export VAULT_TOKEN=$ROOT_TOKEN
 docker exec -e VAULT_TOKEN=$ROOT_TOKEN docker_vault_1 vault secrets enable -path=secret kv
 docker exec -e VAULT_TOKEN=$ROOT_TOKEN docker_vault_1 vault kv put secret/data/mongodb data='{"username":"thaisdev","password":"DevEnv123"}'
 
+# Store a random key for signing JWT access tokens in Vault
+docker exec -e VAULT_TOKEN=$ROOT_TOKEN docker_vault_1 vault kv put secret/data/jwt key="$(openssl rand -base64 48)"
+
+# Store a random key for encrypting MFA secrets at rest in Vault
+docker exec -e VAULT_TOKEN=$ROOT_TOKEN docker_vault_1 vault kv put secret/data/mfa key="$(openssl rand -base64 48)"
+
 # Start the MongoDB Docker container
 docker-compose -f ../docker/docker-compose.yml up -d mongodb
 
@@ -0,0 +1,65 @@
+package audit
+
+import (
+	"context"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/models"
+	"time"
+)
+
+// Event types recorded by the application.
+const (
+	EventAccountLocked   = "account.locked"
+	EventAccountUnlocked = "account.unlocked"
+	EventAPIKeyCreated   = "api_key.created"
+	EventAPIKeyRevoked   = "api_key.revoked"
+	EventIdentityLinked  = "identity.linked"
+	EventUserProvisioned = "user.provisioned"
+	// EventImpersonationStarted is recorded when an admin gets a token to act as a user.
+	EventImpersonationStarted = "impersonation.started"
+	// EventImpersonatedRequest is recorded for every request made with an impersonation token.
+	EventImpersonatedRequest = "impersonation.request"
+)
+
+// Recorder stores audit events.
+type Recorder interface {
+	Record(ctx context.Context, event models.AuditEvent) error
+}
+
+// impersonatorKey is the context key under which the ID of an impersonating admin is stored.
+type impersonatorKey struct{}
+
+// WithImpersonator returns a copy of ctx marking every event recorded with it as performed
+// by the admin with the given ID while impersonating a user.
+func WithImpersonator(ctx context.Context, actorID string) context.Context {
+	return context.WithValue(ctx, impersonatorKey{}, actorID)
+}
+
+// ImpersonatorFromContext returns the ID of the admin impersonating the caller, if any.
+func ImpersonatorFromContext(ctx context.Context) (string, bool) {
+	actorID, ok := ctx.Value(impersonatorKey{}).(string)
+	return actorID, ok && actorID != ""
+}
+
+// Record stores the event with the given recorder, filling in the time if it is missing.
+// Events recorded while an admin impersonates a user carry the admin's ID in the "impersonator_id" detail.
+// Audit failures must never break the action being audited, so errors are only logged.
+func Record(ctx context.Context, recorder Recorder, event models.AuditEvent) {
+	if recorder == nil {
+		return
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now().UTC()
+	}
+	if actorID, ok := ImpersonatorFromContext(ctx); ok {
+		details := make(map[string]string, len(event.Details)+1)
+		for k, v := range event.Details {
+			details[k] = v
+		}
+		details["impersonator_id"] = actorID
+		event.Details = details
+	}
+	if err := recorder.Record(ctx, event); err != nil {
+		logging.FromContext(ctx).WithError(err).WithField("event", event.Type).Error("Failed to record audit event")
+	}
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"simplecrud/pkg/audit"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/user"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Scopes an API key can be granted. Each route callable with an API key requires one of them.
+const (
+	ScopeUsersRead  = "users:read"  // Read users
+	ScopeUsersWrite = "users:write" // Create, update and delete users
+)
+
+const (
+	// apiKeyPrefix starts every API key, so leaked keys are easy to recognize.
+	apiKeyPrefix = "sck_"
+	// apiKeyIDBytes is the amount of randomness in the public part of an API key.
+	apiKeyIDBytes = 6
+	// apiKeySecretBytes is the amount of randomness in the secret part of an API key.
+	apiKeySecretBytes = 32
+	// lastUsedResolution limits how often the last use of a key is written.
+	lastUsedResolution = time.Minute
+)
+
+var (
+	// ErrAPIKeyNotFound is returned by an APIKeyRepository when no key matches.
+	ErrAPIKeyNotFound error = &user.Error{Kind: user.KindNotFound, Message: "api key not found", Detail: "API key not found"}
+	// ErrInvalidAPIKey is returned when an API key is unknown, expired or revoked.
+	ErrInvalidAPIKey = errors.New("invalid, expired or revoked api key")
+	// ErrUnknownScope is returned when an API key is created with a scope that does not exist.
+	ErrUnknownScope error = &user.Error{Kind: user.KindInvalid, Message: "unknown api key scope",
+		Detail: "scopes must only list " + ScopeUsersRead + " and " + ScopeUsersWrite}
+	// ErrInvalidExpiry is returned when an API key is created with an expiry in the past.
+	ErrInvalidExpiry error = &user.Error{Kind: user.KindInvalid, Message: "api key expiry must be in the future",
+		Detail: "expires_at must be in the future"}
+)
+
+// knownScopes are the scopes that may be granted to API keys.
+var knownScopes = map[string]bool{
+	ScopeUsersRead:  true,
+	ScopeUsersWrite: true,
+}
+
+// APIKeyRepository defines the storage operations needed for API keys.
+type APIKeyRepository interface {
+	Create(ctx context.Context, key models.APIKey) error
+	FindByHash(ctx context.Context, keyHash string) (models.APIKey, error)
+	FindAll(ctx context.Context) ([]models.APIKey, error)
+	// Revoke marks the key as revoked. It returns ErrAPIKeyNotFound if there is no unrevoked key with the ID.
+	Revoke(ctx context.Context, id primitive.ObjectID, at time.Time) error
+	TouchLastUsed(ctx context.Context, id primitive.ObjectID, at time.Time) error
+}
+
+// APIKeyService creates, authenticates and revokes API keys for service-to-service access.
+type APIKeyService struct {
+	repo     APIKeyRepository
+	recorder audit.Recorder
+	now      func() time.Time
+}
+
+// NewAPIKeyService creates a new APIKeyService. Creating and revoking keys is recorded with the given audit recorder.
+func NewAPIKeyService(repo APIKeyRepository, recorder audit.Recorder) *APIKeyService {
+	return &APIKeyService{
+		repo:     repo,
+		recorder: recorder,
+		now:      time.Now,
+	}
+}
+
+// Create makes a new API key with the given scopes on behalf of an admin. It returns the key,
+// which cannot be retrieved again, and the stored key details. A nil expiresAt means the key never expires.
+func (s *APIKeyService) Create(ctx context.Context, name string, scopes []string, expiresAt *time.Time, actorID string) (string, models.APIKey, error) {
+	for _, scope := range scopes {
+		if !knownScopes[scope] {
+			return "", models.APIKey{}, fmt.Errorf("%w: %s", ErrUnknownScope, scope)
+		}
+	}
+	now := s.now().UTC()
+	if expiresAt != nil && !expiresAt.After(now) {
+		return "", models.APIKey{}, ErrInvalidExpiry
+	}
+
+	id := make([]byte, apiKeyIDBytes)
+	if _, err := rand.Read(id); err != nil {
+		return "", models.APIKey{}, fmt.Errorf("failed to generate api key: %w", err)
+	}
+	secret, err := randomToken(apiKeySecretBytes)
+	if err != nil {
+		return "", models.APIKey{}, err
+	}
+	prefix := apiKeyPrefix + hex.EncodeToString(id)
+	key := prefix + "_" + secret
+
+	apiKey := models.APIKey{
+		ID:        primitive.NewObjectID(),
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   HashToken(key),
+		Scopes:    scopes,
+		CreatedBy: actorID,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.repo.Create(ctx, apiKey); err != nil {
+		return "", models.APIKey{}, err
+	}
+	audit.Record(ctx, s.recorder, models.AuditEvent{
+		Type:      audit.EventAPIKeyCreated,
+		ActorID:   actorID,
+		SubjectID: apiKey.ID.Hex(),
+		Details:   map[string]string{"name": name, "prefix": prefix, "scopes": strings.Join(scopes, " ")},
+	})
+	return key, apiKey, nil
+}
+
+// List returns every API key, including revoked and expired ones.
+func (s *APIKeyService) List(ctx context.Context) ([]models.APIKey, error) {
+	return s.repo.FindAll(ctx)
+}
+
+// Revoke stops the API key with the given ID from working on behalf of an admin.
+func (s *APIKeyService) Revoke(ctx context.Context, id primitive.ObjectID, actorID string) error {
+	if err := s.repo.Revoke(ctx, id, s.now().UTC()); err != nil {
+		return err
+	}
+	audit.Record(ctx, s.recorder, models.AuditEvent{
+		Type:      audit.EventAPIKeyRevoked,
+		ActorID:   actorID,
+		SubjectID: id.Hex(),
+	})
+	return nil
+}
+
+// Authenticate returns the details of a valid API key and records its use.
+// It returns ErrInvalidAPIKey if the key is unknown, expired or revoked.
+func (s *APIKeyService) Authenticate(ctx context.Context, key string) (models.APIKey, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return models.APIKey{}, ErrInvalidAPIKey
+	}
+	apiKey, err := s.repo.FindByHash(ctx, HashToken(key))
+	if err != nil {
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			return models.APIKey{}, ErrInvalidAPIKey
+		}
+		return models.APIKey{}, err
+	}
+
+	now := s.now().UTC()
+	if apiKey.RevokedAt != nil || (apiKey.ExpiresAt != nil && !now.Before(*apiKey.ExpiresAt)) {
+		return models.APIKey{}, ErrInvalidAPIKey
+	}
+
+	// The last use is only tracked to the minute, so busy keys do not cause a write per request.
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= lastUsedResolution {
+		if err := s.repo.TouchLastUsed(ctx, apiKey.ID, now); err != nil {
+			logging.FromContext(ctx).WithError(err).Warn("Failed to record api key use")
+		} else {
+			apiKey.LastUsedAt = &now
+		}
+	}
+	return apiKey, nil
+}
+
+// HasScope reports whether the API key was granted the scope.
+func HasScope(key models.APIKey, scope string) bool {
+	for _, granted := range key.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyContextKey is the context key under which the API key of the caller is stored.
+type apiKeyContextKey struct{}
+
+// WithAPIKey returns a copy of ctx carrying the API key the caller authenticated with.
+func WithAPIKey(ctx context.Context, key models.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// APIKeyFromContext returns the API key the caller authenticated with, if any.
+func APIKeyFromContext(ctx context.Context) (models.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey{}).(models.APIKey)
+	return key, ok
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"context"
+	"simplecrud/pkg/audit"
+	"simplecrud/pkg/models"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryAPIKeyRepository is an in-memory APIKeyRepository used by the tests.
+type memoryAPIKeyRepository struct {
+	mu      sync.Mutex
+	keys    []models.APIKey
+	touches int
+}
+
+// Create stores a new API key.
+func (m *memoryAPIKeyRepository) Create(ctx context.Context, key models.APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys = append(m.keys, key)
+	return nil
+}
+
+// FindByHash returns the API key with the given hash.
+func (m *memoryAPIKeyRepository) FindByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range m.keys {
+		if key.KeyHash == keyHash {
+			return key, nil
+		}
+	}
+	return models.APIKey{}, ErrAPIKeyNotFound
+}
+
+// FindAll returns every API key.
+func (m *memoryAPIKeyRepository) FindAll(ctx context.Context) ([]models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]models.APIKey(nil), m.keys...), nil
+}
+
+// Revoke marks an unrevoked API key as revoked.
+func (m *memoryAPIKeyRepository) Revoke(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, key := range m.keys {
+		if key.ID == id && key.RevokedAt == nil {
+			m.keys[i].RevokedAt = &at
+			return nil
+		}
+	}
+	return ErrAPIKeyNotFound
+}
+
+// TouchLastUsed records the last use of an API key.
+func (m *memoryAPIKeyRepository) TouchLastUsed(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.touches++
+	for i, key := range m.keys {
+		if key.ID == id {
+			m.keys[i].LastUsedAt = &at
+		}
+	}
+	return nil
+}
+
+// TestAPIKeyLifecycle checks creating, using and revoking an API key.
+func TestAPIKeyLifecycle(t *testing.T) {
+	repo := &memoryAPIKeyRepository{}
+	recorder := &memoryRecorder{}
+	service := NewAPIKeyService(repo, recorder)
+	now := time.Now()
+	service.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	key, created, err := service.Create(ctx, "batch", []string{ScopeUsersRead}, nil, "admin-id")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, created.Prefix+"_"), "the key starts with its public prefix")
+	assert.NotContains(t, created.KeyHash, key, "keys are stored hashed")
+	assert.Equal(t, HashToken(key), repo.keys[0].KeyHash)
+
+	authenticated, err := service.Authenticate(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, created.ID, authenticated.ID)
+	assert.True(t, HasScope(authenticated, ScopeUsersRead))
+	assert.False(t, HasScope(authenticated, ScopeUsersWrite))
+
+	// The last use is written at most once a minute
+	_, err = service.Authenticate(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, 1, repo.touches)
+	now = now.Add(time.Minute)
+	_, err = service.Authenticate(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, 2, repo.touches)
+
+	_, err = service.Authenticate(ctx, key+"x")
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+	_, err = service.Authenticate(ctx, "not-a-key")
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+
+	require.NoError(t, service.Revoke(ctx, created.ID, "admin-id"))
+	_, err = service.Authenticate(ctx, key)
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+	assert.ErrorIs(t, service.Revoke(ctx, created.ID, "admin-id"), ErrAPIKeyNotFound)
+
+	require.Len(t, recorder.events, 2)
+	assert.Equal(t, audit.EventAPIKeyCreated, recorder.events[0].Type)
+	assert.Equal(t, audit.EventAPIKeyRevoked, recorder.events[1].Type)
+	assert.Equal(t, "admin-id", recorder.events[1].ActorID)
+}
+
+// TestAPIKeyValidation checks scopes and expiry of new and expired keys.
+func TestAPIKeyValidation(t *testing.T) {
+	service := NewAPIKeyService(&memoryAPIKeyRepository{}, nil)
+	now := time.Now()
+	service.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	_, _, err := service.Create(ctx, "batch", []string{"users:everything"}, nil, "admin-id")
+	assert.ErrorIs(t, err, ErrUnknownScope)
+	past := now.Add(-time.Second)
+	_, _, err = service.Create(ctx, "batch", []string{ScopeUsersRead}, &past, "admin-id")
+	assert.ErrorIs(t, err, ErrInvalidExpiry)
+
+	expiresAt := now.Add(time.Hour)
+	key, _, err := service.Create(ctx, "batch", []string{ScopeUsersRead}, &expiresAt, "admin-id")
+	require.NoError(t, err)
+	_, err = service.Authenticate(ctx, key)
+	assert.NoError(t, err)
+	now = expiresAt
+	_, err = service.Authenticate(ctx, key)
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"simplecrud/pkg/audit"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/user"
+	"time"
+)
+
+const (
+	// DefaultImpersonationMaxTTL is the longest lifetime of an impersonation token when IMPERSONATION_MAX_TTL is not set.
+	DefaultImpersonationMaxTTL = 15 * time.Minute
+	// ImpersonationMaxTTLKey is the environment variable used to configure the longest impersonation token lifetime.
+	ImpersonationMaxTTLKey = "IMPERSONATION_MAX_TTL"
+	// ImpersonateAdminsKey is the environment variable allowing admins to impersonate other admins.
+	ImpersonateAdminsKey = "IMPERSONATION_ALLOW_ADMINS"
+	// DefaultImpersonateAdmins forbids impersonating admins unless configured otherwise.
+	DefaultImpersonateAdmins = false
+)
+
+var (
+	// ErrImpersonateAdmin is returned when impersonating an admin while that is not allowed.
+	ErrImpersonateAdmin error = &user.Error{Kind: user.KindForbidden, Message: "admins cannot be impersonated",
+		Detail: "Admins cannot be impersonated"}
+	// ErrImpersonateSelf is returned when an admin tries to impersonate themselves.
+	ErrImpersonateSelf error = &user.Error{Kind: user.KindInvalid, Message: "cannot impersonate yourself",
+		Detail: "You cannot impersonate yourself"}
+	// ErrNestedImpersonation is returned when starting an impersonation with an impersonation token.
+	ErrNestedImpersonation error = &user.Error{Kind: user.KindForbidden, Message: "cannot impersonate while impersonating",
+		Detail: "You cannot impersonate while impersonating"}
+	// ErrInvalidImpersonationTTL is returned when the requested lifetime is not positive or above the maximum.
+	ErrInvalidImpersonationTTL error = &user.Error{Kind: user.KindInvalid, Message: "invalid impersonation lifetime",
+		Detail: "expires_in must be positive and at most the maximum impersonation lifetime"}
+)
+
+// ImpersonationRepository defines the user storage operations needed for impersonation.
+type ImpersonationRepository interface {
+	FindById(ctx context.Context, id string) (models.User, error)
+}
+
+// ImpersonationService issues short-lived tokens letting an admin act as another user.
+// The tokens carry both identities, and issuing them is recorded in the audit log.
+type ImpersonationService struct {
+	tokens      *TokenManager
+	users       ImpersonationRepository
+	recorder    audit.Recorder
+	maxTTL      time.Duration
+	allowAdmins bool
+}
+
+// NewImpersonationService creates a new ImpersonationService. Tokens live at most maxTTL;
+// unless allowAdmins is set, admins cannot be impersonated.
+func NewImpersonationService(tokens *TokenManager, users ImpersonationRepository, recorder audit.Recorder, maxTTL time.Duration, allowAdmins bool) *ImpersonationService {
+	return &ImpersonationService{
+		tokens:      tokens,
+		users:       users,
+		recorder:    recorder,
+		maxTTL:      maxTTL,
+		allowAdmins: allowAdmins,
+	}
+}
+
+// Start issues a token for the admin with actorID to act as the user with subjectID, for the given reason.
+// A zero ttl issues a token with the maximum lifetime. It returns the token and when it expires.
+// Impersonation tokens cannot be refreshed, and cannot be used to start another impersonation.
+func (s *ImpersonationService) Start(ctx context.Context, actorID, subjectID, reason string, ttl time.Duration) (string, time.Time, error) {
+	if claims, ok := ClaimsFromContext(ctx); ok && claims.Actor != nil {
+		return "", time.Time{}, ErrNestedImpersonation
+	}
+	if _, ok := audit.ImpersonatorFromContext(ctx); ok {
+		return "", time.Time{}, ErrNestedImpersonation
+	}
+	if actorID == subjectID {
+		return "", time.Time{}, ErrImpersonateSelf
+	}
+	if ttl == 0 {
+		ttl = s.maxTTL
+	}
+	if ttl < 0 || ttl > s.maxTTL {
+		return "", time.Time{}, ErrInvalidImpersonationTTL
+	}
+
+	subject, err := s.users.FindById(ctx, subjectID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if subject.Role == user.RoleAdmin && !s.allowAdmins {
+		return "", time.Time{}, ErrImpersonateAdmin
+	}
+
+	token, expiresAt, err := s.tokens.IssueImpersonation(subject, actorID, OrganizationFor(ctx, subject), ttl)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	audit.Record(ctx, s.recorder, models.AuditEvent{
+		Type:      audit.EventImpersonationStarted,
+		ActorID:   actorID,
+		SubjectID: subjectID,
+		Details:   map[string]string{"reason": reason, "expires_at": expiresAt.UTC().Format(time.RFC3339)},
+	})
+	return token, expiresAt, nil
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"simplecrud/pkg/audit"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/user"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestImpersonation checks the tokens issued to impersonate users and the rules around them.
+func TestImpersonation(t *testing.T) {
+	tokens, err := NewTokenManager(testKey, time.Minute)
+	require.NoError(t, err)
+	adminID := primitive.NewObjectID().Hex()
+	alice := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com", Role: user.RoleUser, EmailVerified: true}
+	otherAdmin := models.User{ID: primitive.NewObjectID(), Email: "root@example.com", Role: user.RoleAdmin}
+	recorder := &memoryRecorder{}
+	service := NewImpersonationService(tokens, memoryUserFinder{alice, otherAdmin}, recorder, 15*time.Minute, false)
+	ctx := context.Background()
+
+	token, expiresAt, err := service.Start(ctx, adminID, alice.ID.Hex(), "ticket 42", 0)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(15*time.Minute), expiresAt, 2*time.Second)
+
+	// The token acts as the user and names the admin
+	claims, err := tokens.Parse(token)
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID.Hex(), claims.Subject)
+	assert.Equal(t, alice.Role, claims.Role)
+	assert.Equal(t, adminID, claims.ImpersonatorID())
+
+	require.Len(t, recorder.events, 1)
+	assert.Equal(t, audit.EventImpersonationStarted, recorder.events[0].Type)
+	assert.Equal(t, adminID, recorder.events[0].ActorID)
+	assert.Equal(t, alice.ID.Hex(), recorder.events[0].SubjectID)
+	assert.Equal(t, "ticket 42", recorder.events[0].Details["reason"])
+
+	// Shorter lifetimes are allowed, longer ones are not
+	_, expiresAt, err = service.Start(ctx, adminID, alice.ID.Hex(), "ticket 42", time.Minute)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt, 2*time.Second)
+	_, _, err = service.Start(ctx, adminID, alice.ID.Hex(), "ticket 42", time.Hour)
+	assert.ErrorIs(t, err, ErrInvalidImpersonationTTL)
+
+	_, _, err = service.Start(ctx, adminID, otherAdmin.ID.Hex(), "ticket 42", 0)
+	assert.ErrorIs(t, err, ErrImpersonateAdmin)
+	_, _, err = service.Start(ctx, adminID, adminID, "ticket 42", 0)
+	assert.ErrorIs(t, err, ErrImpersonateSelf)
+	_, _, err = service.Start(ctx, adminID, primitive.NewObjectID().Hex(), "ticket 42", 0)
+	assert.ErrorIs(t, err, user.ErrNotFound)
+
+	// Impersonation tokens cannot start another impersonation
+	_, _, err = service.Start(WithClaims(ctx, claims), adminID, alice.ID.Hex(), "ticket 42", 0)
+	assert.ErrorIs(t, err, ErrNestedImpersonation)
+
+	// Admins can be impersonated when allowed
+	service = NewImpersonationService(tokens, memoryUserFinder{otherAdmin}, nil, 15*time.Minute, true)
+	_, _, err = service.Start(ctx, adminID, otherAdmin.ID.Hex(), "ticket 42", 0)
+	assert.NoError(t, err)
+}
+
+// TestAuditMarksImpersonation checks that events recorded while impersonating name the admin.
+func TestAuditMarksImpersonation(t *testing.T) {
+	recorder := &memoryRecorder{}
+	details := map[string]string{"name": "batch"}
+	ctx := audit.WithImpersonator(context.Background(), "admin-id")
+
+	audit.Record(ctx, recorder, models.AuditEvent{Type: audit.EventAPIKeyCreated, ActorID: "user-id", Details: details})
+	audit.Record(context.Background(), recorder, models.AuditEvent{Type: audit.EventAPIKeyCreated, ActorID: "user-id"})
+
+	require.Len(t, recorder.events, 2)
+	assert.Equal(t, map[string]string{"name": "batch", "impersonator_id": "admin-id"}, recorder.events[0].Details)
+	assert.Equal(t, map[string]string{"name": "batch"}, details, "the caller's details are not modified")
+	assert.Empty(t, recorder.events[1].Details)
+}
@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"simplecrud/pkg/logging"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// discoveryPath is where an OpenID provider publishes its configuration, relative to the issuer.
+	discoveryPath = "/.well-known/openid-configuration"
+	// jwksMinRefreshInterval limits how often an unknown key ID makes the key set be fetched again.
+	jwksMinRefreshInterval = time.Minute
+	// maxProviderResponseSize bounds the responses read from the identity provider, in bytes.
+	maxProviderResponseSize = 1 << 20
+)
+
+// ErrUnknownSigningKey is returned when an ID token is signed with a key the provider does not publish.
+var ErrUnknownSigningKey = errors.New("unknown id token signing key")
+
+// providerMetadata is the part of the OpenID provider configuration used by the login flow.
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// jsonWebKey is a public key of the provider's JSON Web Key Set. Only RSA and EC keys are supported.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// providerCache fetches and caches the configuration and signing keys of an OpenID provider.
+// Both are kept for the cache TTL. A token signed with an unknown key makes the keys be fetched
+// again early, at most once per jwksMinRefreshInterval, so key rotations are picked up quickly.
+type providerCache struct {
+	issuer string
+	client *http.Client
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu           sync.Mutex
+	metadata     *providerMetadata
+	discoveredAt time.Time
+	keys         map[string]crypto.PublicKey
+	keysAt       time.Time
+}
+
+// newProviderCache creates a providerCache for the provider with the given issuer.
+func newProviderCache(issuer string, client *http.Client, ttl time.Duration) *providerCache {
+	return &providerCache{
+		issuer: issuer,
+		client: client,
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+// discover returns the provider configuration, fetching it if it is missing or older than the TTL.
+// If the provider cannot be reached, a stale configuration is used rather than failing the login.
+func (p *providerCache) discover(ctx context.Context) (providerMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.discoverLocked(ctx)
+}
+
+// discoverLocked implements discover; p.mu must be held.
+func (p *providerCache) discoverLocked(ctx context.Context) (providerMetadata, error) {
+	if p.metadata != nil && p.now().Sub(p.discoveredAt) < p.ttl {
+		return *p.metadata, nil
+	}
+
+	var metadata providerMetadata
+	err := p.getJSON(ctx, strings.TrimSuffix(p.issuer, "/")+discoveryPath, &metadata)
+	if err == nil && metadata.Issuer != p.issuer {
+		err = fmt.Errorf("discovery document is for issuer %q", metadata.Issuer)
+	}
+	if err == nil && (metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "") {
+		err = errors.New("discovery document is missing endpoints")
+	}
+	if err != nil {
+		if p.metadata != nil {
+			logging.FromContext(ctx).WithError(err).Warn("Failed to refresh OpenID provider configuration")
+			return *p.metadata, nil
+		}
+		return providerMetadata{}, fmt.Errorf("failed to discover openid provider: %w", err)
+	}
+
+	p.metadata = &metadata
+	p.discoveredAt = p.now()
+	return metadata, nil
+}
+
+// key returns the public key with the given key ID. An empty ID matches the only key of a single key set.
+func (p *providerCache) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	age := p.now().Sub(p.keysAt)
+	if p.keys != nil && age < p.ttl {
+		if key, ok := lookupKey(p.keys, kid); ok {
+			return key, nil
+		}
+		if age < jwksMinRefreshInterval {
+			return nil, ErrUnknownSigningKey
+		}
+	}
+
+	if err := p.refreshKeysLocked(ctx); err != nil {
+		// Keep using the keys we have if the provider cannot be reached.
+		if key, ok := lookupKey(p.keys, kid); ok {
+			logging.FromContext(ctx).WithError(err).Warn("Failed to refresh OpenID provider keys")
+			return key, nil
+		}
+		return nil, err
+	}
+	if key, ok := lookupKey(p.keys, kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownSigningKey
+}
+
+// refreshKeysLocked fetches the provider's key set; p.mu must be held.
+func (p *providerCache) refreshKeysLocked(ctx context.Context) error {
+	metadata, err := p.discoverLocked(ctx)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, metadata.JWKSURI, &set); err != nil {
+		return fmt.Errorf("failed to fetch openid provider keys: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// A key we cannot use must not stop the others from working.
+			logging.FromContext(ctx).WithError(err).WithField("kid", jwk.Kid).Warn("Skipping OpenID provider key")
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	p.keys = keys
+	p.keysAt = p.now()
+	return nil
+}
+
+// lookupKey finds the key with the given ID. An empty ID matches the only key of a single key set.
+func lookupKey(keys map[string]crypto.PublicKey, kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+// getJSON fetches the URL and decodes its JSON body into v.
+func (p *providerCache) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxProviderResponseSize)).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", url, err)
+	}
+	return nil
+}
+
+// publicKey decodes the RSA or EC public key described by the JSON Web Key.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeKeyParam(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeKeyParam(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.Sign() == 0 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeKeyParam(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeKeyParam(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid ec key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// decodeKeyParam decodes a base64url encoded big-endian integer of a JSON Web Key.
+func decodeKeyParam(param string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(param)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key parameter: %w", err)
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"simplecrud/pkg/vault"
+	"simplecrud/utils"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// Environment variables pointing to local key files.
+// They are meant for development; when they are not set the keys are read from Vault.
+const (
+	KeyFileKey    = "JWT_KEY_FILE"
+	MFAKeyFileKey = "MFA_KEY_FILE"
+)
+
+// LoadSigningKey returns the key used to sign access tokens.
+// If JWT_KEY_FILE is set, the key is read from that file, otherwise it is retrieved from Vault.
+func LoadSigningKey(vaultClient *api.Client) ([]byte, error) {
+	return loadKey(vaultClient, KeyFileKey, vault.GetJWTSigningKey)
+}
+
+// LoadEncryptionKey returns the key used to encrypt MFA secrets at rest.
+// If MFA_KEY_FILE is set, the key is read from that file, otherwise it is retrieved from Vault.
+func LoadEncryptionKey(vaultClient *api.Client) ([]byte, error) {
+	return loadKey(vaultClient, MFAKeyFileKey, vault.GetMFAEncryptionKey)
+}
+
+// loadKey reads the key from the file named by the fileKey environment variable if it is set,
+// or else from Vault with fromVault.
+func loadKey(vaultClient *api.Client, fileKey string, fromVault func(*api.Client) ([]byte, error)) ([]byte, error) {
+	if path := utils.GetEnv(fileKey, ""); path != "" {
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		// Ignore the trailing newline most editors and shells add to the file.
+		return bytes.TrimSpace(key), nil
+	}
+
+	key, err := fromVault(vaultClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key from vault: %w", err)
+	}
+	return key, nil
+}
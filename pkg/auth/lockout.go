@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"simplecrud/pkg/audit"
+	"simplecrud/pkg/models"
+	"simplecrud/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables used to configure the lockout policy.
+const (
+	LockoutThresholdKey = "LOGIN_LOCKOUT_THRESHOLD"
+	LockoutDurationKey  = "LOGIN_LOCKOUT_DURATION"
+	LoginDelayBaseKey   = "LOGIN_DELAY_BASE"
+	LoginDelayMaxKey    = "LOGIN_DELAY_MAX"
+)
+
+var (
+	// ErrAttemptNotFound is returned by an AttemptRepository when an account has no recorded failures.
+	ErrAttemptNotFound = errors.New("login attempts not found")
+	// ErrAccountLocked is returned while an account is locked after too many failed logins.
+	ErrAccountLocked = errors.New("account temporarily locked")
+	// ErrLoginThrottled is returned when a login is attempted before the progressive delay has passed.
+	ErrLoginThrottled = errors.New("too many login attempts")
+)
+
+// RetryError wraps ErrAccountLocked or ErrLoginThrottled with the time the caller has to wait.
+type RetryError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+// Error returns the message of the wrapped error.
+func (e *RetryError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error, so errors.Is works with the sentinel errors.
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// LockoutPolicy controls how failed logins slow down and lock an account.
+type LockoutPolicy struct {
+	Threshold       int           // Failed attempts after which the account is locked
+	LockoutDuration time.Duration // How long the account stays locked
+	BaseDelay       time.Duration // Delay required after the first failed attempt
+	MaxDelay        time.Duration // Upper bound for the progressive delay
+}
+
+// DefaultLockoutPolicy returns the lockout policy configured through the environment,
+// falling back to 5 attempts, a 15 minute lockout and delays between 1 and 30 seconds.
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		Threshold:       utils.GetEnvInt(LockoutThresholdKey, 5),
+		LockoutDuration: utils.GetEnvDuration(LockoutDurationKey, 15*time.Minute),
+		BaseDelay:       utils.GetEnvDuration(LoginDelayBaseKey, time.Second),
+		MaxDelay:        utils.GetEnvDuration(LoginDelayMaxKey, 30*time.Second),
+	}
+}
+
+// delay returns how long to wait after the given number of consecutive failures.
+// The delay doubles with every failure, up to MaxDelay.
+func (p LockoutPolicy) delay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// AttemptRepository defines the storage operations needed to track failed logins.
+type AttemptRepository interface {
+	Get(ctx context.Context, key string) (models.LoginAttempt, error)
+	// RecordFailure increments the failure counter of the key and returns the updated attempts.
+	RecordFailure(ctx context.Context, key string, at time.Time) (models.LoginAttempt, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+// LoginGuard protects accounts against password guessing.
+// It enforces a progressive delay between failed logins and locks the account
+// once the policy threshold is reached.
+type LoginGuard struct {
+	repo     AttemptRepository
+	policy   LockoutPolicy
+	recorder audit.Recorder
+	now      func() time.Time
+}
+
+// NewLoginGuard creates a new LoginGuard. Lockouts are recorded with the given audit recorder.
+func NewLoginGuard(repo AttemptRepository, policy LockoutPolicy, recorder audit.Recorder) *LoginGuard {
+	return &LoginGuard{
+		repo:     repo,
+		policy:   policy,
+		recorder: recorder,
+		now:      time.Now,
+	}
+}
+
+// Check returns a *RetryError if a login for the email must not be attempted right now.
+func (g *LoginGuard) Check(ctx context.Context, email string) error {
+	attempt, err := g.repo.Get(ctx, normalizeKey(email))
+	if err != nil {
+		if errors.Is(err, ErrAttemptNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	now := g.now()
+	if attempt.LockedUntil != nil && now.Before(*attempt.LockedUntil) {
+		return &RetryError{Err: ErrAccountLocked, RetryAfter: attempt.LockedUntil.Sub(now)}
+	}
+	if attempt.LockedUntil == nil {
+		if next := attempt.LastFailedAt.Add(g.policy.delay(attempt.FailedCount)); now.Before(next) {
+			return &RetryError{Err: ErrLoginThrottled, RetryAfter: next.Sub(now)}
+		}
+	}
+	return nil
+}
+
+// Failure records a failed login for the email and locks the account when the threshold is reached.
+func (g *LoginGuard) Failure(ctx context.Context, email, ip string) error {
+	key := normalizeKey(email)
+	now := g.now()
+
+	// A lockout that has run out starts a fresh count.
+	attempt, err := g.repo.Get(ctx, key)
+	if err != nil && !errors.Is(err, ErrAttemptNotFound) {
+		return err
+	}
+	if attempt.LockedUntil != nil && !now.Before(*attempt.LockedUntil) {
+		if err := g.repo.Reset(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	attempt, err = g.repo.RecordFailure(ctx, key, now)
+	if err != nil {
+		return err
+	}
+	if attempt.FailedCount < g.policy.Threshold {
+		return nil
+	}
+
+	until := now.Add(g.policy.LockoutDuration)
+	if err := g.repo.Lock(ctx, key, until); err != nil {
+		return fmt.Errorf("failed to lock account: %w", err)
+	}
+	audit.Record(ctx, g.recorder, models.AuditEvent{
+		Type:      audit.EventAccountLocked,
+		SubjectID: key,
+		IP:        ip,
+		Details: map[string]string{
+			"failed_attempts": strconv.Itoa(attempt.FailedCount),
+			"locked_until":    until.UTC().Format(time.RFC3339),
+		},
+		OccurredAt: now.UTC(),
+	})
+	return nil
+}
+
+// Success clears the failed attempts of the email after a successful login.
+func (g *LoginGuard) Success(ctx context.Context, email string) error {
+	return g.repo.Reset(ctx, normalizeKey(email))
+}
+
+// Unlock clears the lockout and failed attempts of the email on behalf of an admin.
+func (g *LoginGuard) Unlock(ctx context.Context, email, actorID string) error {
+	key := normalizeKey(email)
+	if err := g.repo.Reset(ctx, key); err != nil {
+		return err
+	}
+	audit.Record(ctx, g.recorder, models.AuditEvent{
+		Type:      audit.EventAccountUnlocked,
+		ActorID:   actorID,
+		SubjectID: key,
+	})
+	return nil
+}
+
+// normalizeKey turns an email into the key attempts are tracked under.
+func normalizeKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"simplecrud/pkg/audit"
+	"simplecrud/pkg/models"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryAttemptRepository is an in-memory AttemptRepository used by the tests.
+type memoryAttemptRepository struct {
+	mu       sync.Mutex
+	attempts map[string]models.LoginAttempt
+}
+
+// newMemoryAttemptRepository creates an empty memoryAttemptRepository.
+func newMemoryAttemptRepository() *memoryAttemptRepository {
+	return &memoryAttemptRepository{attempts: map[string]models.LoginAttempt{}}
+}
+
+// Get returns the attempts recorded for the key.
+func (m *memoryAttemptRepository) Get(ctx context.Context, key string) (models.LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attempt, ok := m.attempts[key]
+	if !ok {
+		return models.LoginAttempt{}, ErrAttemptNotFound
+	}
+	return attempt, nil
+}
+
+// RecordFailure increments the failure counter of the key.
+func (m *memoryAttemptRepository) RecordFailure(ctx context.Context, key string, at time.Time) (models.LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attempt := m.attempts[key]
+	attempt.Key = key
+	attempt.FailedCount++
+	attempt.LastFailedAt = at
+	m.attempts[key] = attempt
+	return attempt, nil
+}
+
+// Lock locks the key until the given time.
+func (m *memoryAttemptRepository) Lock(ctx context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attempt := m.attempts[key]
+	attempt.LockedUntil = &until
+	m.attempts[key] = attempt
+	return nil
+}
+
+// Reset forgets the key.
+func (m *memoryAttemptRepository) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+// memoryRecorder is an audit.Recorder keeping events in memory.
+type memoryRecorder struct {
+	events []models.AuditEvent
+}
+
+// Record appends the event.
+func (m *memoryRecorder) Record(ctx context.Context, event models.AuditEvent) error {
+	m.events = append(m.events, event)
+	return nil
+}
+
+// testPolicy locks after 3 failures for an hour, with delays of 1s, 2s and so on.
+var testPolicy = LockoutPolicy{Threshold: 3, LockoutDuration: time.Hour, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+// TestLockoutPolicyDelay checks that the delay doubles and is capped.
+func TestLockoutPolicyDelay(t *testing.T) {
+	assert.Equal(t, time.Duration(0), testPolicy.delay(0))
+	assert.Equal(t, time.Second, testPolicy.delay(1))
+	assert.Equal(t, 2*time.Second, testPolicy.delay(2))
+	assert.Equal(t, 8*time.Second, testPolicy.delay(4))
+	assert.Equal(t, 10*time.Second, testPolicy.delay(10))
+}
+
+// TestLoginGuard checks progressive delays, lockout, audit and unlock.
+func TestLoginGuard(t *testing.T) {
+	recorder := &memoryRecorder{}
+	guard := NewLoginGuard(newMemoryAttemptRepository(), testPolicy, recorder)
+	now := time.Now()
+	guard.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	require.NoError(t, guard.Check(ctx, "Alice@Example.com"))
+
+	// A failure requires waiting before the next attempt
+	require.NoError(t, guard.Failure(ctx, "alice@example.com", "10.0.0.1"))
+	var retry *RetryError
+	err := guard.Check(ctx, " ALICE@example.com ")
+	require.True(t, errors.As(err, &retry))
+	assert.ErrorIs(t, err, ErrLoginThrottled)
+	assert.Equal(t, time.Second, retry.RetryAfter)
+
+	// Reaching the threshold locks the account and records an audit event
+	now = now.Add(time.Minute)
+	require.NoError(t, guard.Failure(ctx, "alice@example.com", "10.0.0.1"))
+	now = now.Add(time.Minute)
+	require.NoError(t, guard.Failure(ctx, "alice@example.com", "10.0.0.1"))
+	err = guard.Check(ctx, "alice@example.com")
+	require.True(t, errors.As(err, &retry))
+	assert.ErrorIs(t, err, ErrAccountLocked)
+	assert.Equal(t, time.Hour, retry.RetryAfter)
+	require.Len(t, recorder.events, 1)
+	assert.Equal(t, audit.EventAccountLocked, recorder.events[0].Type)
+	assert.Equal(t, "alice@example.com", recorder.events[0].SubjectID)
+
+	// An admin can unlock the account
+	require.NoError(t, guard.Unlock(ctx, "alice@example.com", "admin-id"))
+	assert.NoError(t, guard.Check(ctx, "alice@example.com"))
+	require.Len(t, recorder.events, 2)
+	assert.Equal(t, audit.EventAccountUnlocked, recorder.events[1].Type)
+	assert.Equal(t, "admin-id", recorder.events[1].ActorID)
+}
+
+// TestLoginGuardLockExpires checks that the count starts over once a lockout has run out.
+func TestLoginGuardLockExpires(t *testing.T) {
+	guard := NewLoginGuard(newMemoryAttemptRepository(), testPolicy, nil)
+	now := time.Now()
+	guard.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < testPolicy.Threshold; i++ {
+		require.NoError(t, guard.Failure(ctx, "bob@example.com", ""))
+	}
+	assert.ErrorIs(t, guard.Check(ctx, "bob@example.com"), ErrAccountLocked)
+
+	now = now.Add(2 * time.Hour)
+	assert.NoError(t, guard.Check(ctx, "bob@example.com"))
+
+	// One more failure after the lockout is a first failure, not an immediate relock
+	require.NoError(t, guard.Failure(ctx, "bob@example.com", ""))
+	assert.ErrorIs(t, guard.Check(ctx, "bob@example.com"), ErrLoginThrottled)
+
+	// A successful login clears the counter
+	require.NoError(t, guard.Success(ctx, "bob@example.com"))
+	assert.NoError(t, guard.Check(ctx, "bob@example.com"))
+}
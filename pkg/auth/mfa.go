@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"simplecrud/pkg/models"
+	"strings"
+	"time"
+)
+
+// recoveryCodeCount is the number of one-time recovery codes handed out when MFA is enabled.
+const recoveryCodeCount = 10
+
+var (
+	// ErrMFAAlreadyEnabled is returned when enrolling a user whose MFA is already enabled.
+	ErrMFAAlreadyEnabled = errors.New("multi-factor authentication already enabled")
+	// ErrMFANotEnrolled is returned when confirming MFA for a user who did not start enrollment.
+	ErrMFANotEnrolled = errors.New("multi-factor authentication enrollment not started")
+	// ErrInvalidMFACode is returned when a TOTP or recovery code is wrong or was already used.
+	ErrInvalidMFACode = errors.New("invalid authentication code")
+)
+
+// MFARepository defines the storage operations needed for multi-factor authentication.
+type MFARepository interface {
+	FindById(ctx context.Context, id string) (models.User, error)
+	SetMFA(ctx context.Context, id string, mfa models.MFA) error
+	// ConsumeRecoveryCode removes the recovery code hash from the user and reports whether it was present.
+	ConsumeRecoveryCode(ctx context.Context, id, codeHash string) (bool, error)
+	// MarkMFAStepUsed records the TOTP time step as used, unless the same or a later step was already used.
+	MarkMFAStepUsed(ctx context.Context, id string, step int64) (bool, error)
+}
+
+// MFAService enrolls users in TOTP multi-factor authentication and verifies their codes.
+// TOTP secrets are encrypted with the SecretBox before they are stored.
+type MFAService struct {
+	repo MFARepository
+	box  *SecretBox
+	now  func() time.Time
+}
+
+// NewMFAService creates a new MFAService.
+func NewMFAService(repo MFARepository, box *SecretBox) *MFAService {
+	return &MFAService{
+		repo: repo,
+		box:  box,
+		now:  time.Now,
+	}
+}
+
+// MFAEnabled reports whether the user has to pass a second factor to log in.
+func MFAEnabled(user models.User) bool {
+	return user.MFA != nil && user.MFA.Enabled
+}
+
+// Enroll generates a new TOTP secret for the user and stores it, not yet enabled.
+// It returns the secret and the otpauth:// URI to show to the user.
+// Enrolling again before confirming replaces the pending secret.
+func (s *MFAService) Enroll(ctx context.Context, userID string) (string, string, error) {
+	user, err := s.repo.FindById(ctx, userID)
+	if err != nil {
+		return "", "", err
+	}
+	if MFAEnabled(user) {
+		return "", "", ErrMFAAlreadyEnabled
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := s.box.Seal([]byte(secret))
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.repo.SetMFA(ctx, userID, models.MFA{Secret: sealed}); err != nil {
+		return "", "", err
+	}
+
+	return secret, TOTPURI(Issuer, user.Email, secret), nil
+}
+
+// Confirm enables MFA for the user once they prove their authenticator app produces valid codes.
+// It returns the one-time recovery codes, which are only stored hashed and cannot be shown again.
+func (s *MFAService) Confirm(ctx context.Context, userID, code string) ([]string, error) {
+	user, err := s.repo.FindById(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if MFAEnabled(user) {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if user.MFA == nil {
+		return nil, ErrMFANotEnrolled
+	}
+
+	secret, err := s.box.Open(user.MFA.Secret)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	step, ok := validateTOTP(string(secret), code, now)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	enabledAt := now.UTC()
+	err = s.repo.SetMFA(ctx, userID, models.MFA{
+		Secret:        user.MFA.Secret,
+		Enabled:       true,
+		RecoveryCodes: hashes,
+		LastUsedStep:  step,
+		EnabledAt:     &enabledAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Verify checks the second factor of a login: either a TOTP code or one of the recovery codes.
+// Each TOTP code and each recovery code is accepted only once.
+func (s *MFAService) Verify(ctx context.Context, user models.User, code, recoveryCode string) error {
+	if !MFAEnabled(user) {
+		return ErrMFANotEnrolled
+	}
+	id := user.ID.Hex()
+
+	if recoveryCode != "" {
+		used, err := s.repo.ConsumeRecoveryCode(ctx, id, HashToken(normalizeRecoveryCode(recoveryCode)))
+		if err != nil {
+			return err
+		}
+		if !used {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	secret, err := s.box.Open(user.MFA.Secret)
+	if err != nil {
+		return err
+	}
+	step, ok := validateTOTP(string(secret), code, s.now())
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	// Refuse a code whose time step was already used, so an observed code cannot be replayed.
+	fresh, err := s.repo.MarkMFAStepUsed(ctx, id, step)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// generateRecoveryCodes returns new recovery codes, formatted for display, and their hashes.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 6)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, HashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode removes the formatting users may type along with a recovery code.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+	"simplecrud/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryMFARepository is an in-memory MFARepository holding a single user.
+type memoryMFARepository struct {
+	user models.User
+}
+
+// FindById returns the user.
+func (m *memoryMFARepository) FindById(ctx context.Context, id string) (models.User, error) {
+	return m.user, nil
+}
+
+// SetMFA replaces the MFA settings of the user.
+func (m *memoryMFARepository) SetMFA(ctx context.Context, id string, mfa models.MFA) error {
+	m.user.MFA = &mfa
+	return nil
+}
+
+// ConsumeRecoveryCode removes the code hash if present.
+func (m *memoryMFARepository) ConsumeRecoveryCode(ctx context.Context, id, codeHash string) (bool, error) {
+	for i, hash := range m.user.MFA.RecoveryCodes {
+		if hash == codeHash {
+			m.user.MFA.RecoveryCodes = append(m.user.MFA.RecoveryCodes[:i], m.user.MFA.RecoveryCodes[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MarkMFAStepUsed records the step if it is newer than the last used one.
+func (m *memoryMFARepository) MarkMFAStepUsed(ctx context.Context, id string, step int64) (bool, error) {
+	if step <= m.user.MFA.LastUsedStep {
+		return false, nil
+	}
+	m.user.MFA.LastUsedStep = step
+	return true, nil
+}
+
+// TestMFAEnrollment checks enrollment, confirmation, encryption at rest and verification.
+func TestMFAEnrollment(t *testing.T) {
+	box, err := NewSecretBox(testKey)
+	require.NoError(t, err)
+	repo := &memoryMFARepository{user: models.User{ID: primitive.NewObjectID(), Email: "admin@example.com"}}
+	service := NewMFAService(repo, box)
+	now := time.Now()
+	service.now = func() time.Time { return now }
+	ctx := context.Background()
+	id := repo.user.ID.Hex()
+
+	// Confirming before enrolling fails
+	_, err = service.Confirm(ctx, id, "000000")
+	assert.ErrorIs(t, err, ErrMFANotEnrolled)
+
+	secret, uri, err := service.Enroll(ctx, id)
+	require.NoError(t, err)
+	assert.Contains(t, uri, "secret="+secret)
+	assert.NotEqual(t, secret, repo.user.MFA.Secret, "the secret is encrypted at rest")
+	assert.False(t, MFAEnabled(repo.user))
+
+	// A wrong code does not enable MFA
+	_, err = service.Confirm(ctx, id, "000000")
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+
+	code, err := totpCode(secret, totpStep(now))
+	require.NoError(t, err)
+	recoveryCodes, err := service.Confirm(ctx, id, code)
+	require.NoError(t, err)
+	assert.Len(t, recoveryCodes, recoveryCodeCount)
+	assert.True(t, MFAEnabled(repo.user))
+	assert.NotContains(t, repo.user.MFA.RecoveryCodes, recoveryCodes[0], "recovery codes are stored hashed")
+
+	// Enrolling again is refused
+	_, _, err = service.Enroll(ctx, id)
+	assert.ErrorIs(t, err, ErrMFAAlreadyEnabled)
+
+	// The code used for confirmation cannot be replayed, the next one works once
+	assert.ErrorIs(t, service.Verify(ctx, repo.user, code, ""), ErrInvalidMFACode)
+	now = now.Add(totpPeriod)
+	next, err := totpCode(secret, totpStep(now))
+	require.NoError(t, err)
+	assert.NoError(t, service.Verify(ctx, repo.user, next, ""))
+	assert.ErrorIs(t, service.Verify(ctx, repo.user, next, ""), ErrInvalidMFACode)
+
+	// Recovery codes work once, with or without formatting
+	assert.NoError(t, service.Verify(ctx, repo.user, "", " "+recoveryCodes[0]+" "))
+	assert.ErrorIs(t, service.Verify(ctx, repo.user, "", recoveryCodes[0]), ErrInvalidMFACode)
+	assert.NoError(t, service.Verify(ctx, repo.user, "", normalizeRecoveryCode(recoveryCodes[1])))
+}
@@ -0,0 +1,453 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"simplecrud/pkg/audit"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/user"
+	"simplecrud/utils"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Environment variables configuring login with an OpenID Connect identity provider.
+// The login is only available when OIDC_ISSUER is set.
+const (
+	OIDCIssuerKey       = "OIDC_ISSUER"
+	OIDCClientIDKey     = "OIDC_CLIENT_ID"
+	OIDCClientSecretKey = "OIDC_CLIENT_SECRET"
+	// OIDCRedirectURLKey holds the public URL of GET /auth/oidc/callback, as registered at the provider.
+	OIDCRedirectURLKey = "OIDC_REDIRECT_URL"
+	// OIDCScopesKey holds the space separated scopes requested from the provider.
+	OIDCScopesKey     = "OIDC_SCOPES"
+	DefaultOIDCScopes = "openid email profile"
+	// OIDCProvisioningKey enables creating users on their first login when no account has their email.
+	OIDCProvisioningKey     = "OIDC_JIT_PROVISIONING"
+	DefaultOIDCProvisioning = true
+	// OIDCCacheTTLKey configures how long the provider configuration and keys are cached.
+	OIDCCacheTTLKey     = "OIDC_CACHE_TTL"
+	DefaultOIDCCacheTTL = time.Hour
+)
+
+const (
+	// OIDCFlowTTL is how long a user has to log in at the identity provider.
+	OIDCFlowTTL = 10 * time.Minute
+	// oidcHTTPTimeout bounds every request to the identity provider.
+	oidcHTTPTimeout = 10 * time.Second
+	// oidcClockSkew is the clock difference with the identity provider tolerated when checking ID tokens.
+	oidcClockSkew = time.Minute
+	// oidcFlowAudience marks the tokens carrying the state of a login flow, so they cannot be used elsewhere.
+	oidcFlowAudience = "simplecrud-oidc-flow"
+	// oidcFlowBytes is the amount of randomness in the state, nonce and PKCE code verifier.
+	oidcFlowBytes = 32
+	// maxProvisionedNameLength matches the longest name the user service accepts.
+	maxProvisionedNameLength = 50
+)
+
+var (
+	// ErrInvalidOIDCFlow is returned when the callback does not belong to a login started by this API.
+	ErrInvalidOIDCFlow = errors.New("invalid or expired openid connect login")
+	// ErrOIDCExchange is returned when the identity provider refuses the authorization code.
+	ErrOIDCExchange = errors.New("failed to exchange authorization code")
+	// ErrInvalidIDToken is returned when the ID token of the identity provider does not validate.
+	ErrInvalidIDToken = errors.New("invalid id token")
+	// ErrEmailNotVerified is returned when the email of an unlinked identity is not verified, either by the
+	// identity provider or by the owner of the account with that email.
+	ErrEmailNotVerified = errors.New("email address is not verified")
+	// ErrNoLinkedAccount is returned when no account matches the identity and provisioning is disabled.
+	ErrNoLinkedAccount = errors.New("no account matches the external identity")
+	// ErrIdentityConflict is returned when the account with the email is linked to another identity of the provider.
+	ErrIdentityConflict = errors.New("account is linked to another identity of the provider")
+)
+
+// idTokenAlgorithms are the ID token signature algorithms accepted from the identity provider.
+var idTokenAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// OIDCConfig configures the login with an OpenID Connect identity provider.
+type OIDCConfig struct {
+	Issuer       string   // Issuer identifier of the provider; its discovery document is read from there
+	ClientID     string   // Client ID registered at the provider
+	ClientSecret string   // Client secret; empty for a public client relying on PKCE only
+	RedirectURL  string   // Public URL of the callback endpoint
+	Scopes       []string // Scopes requested from the provider; must include "openid"
+	Provisioning bool     // Create users on their first login if no account has their email
+	CacheTTL     time.Duration
+}
+
+// OIDCConfigFromEnv reads the OIDC_* environment variables.
+// It returns an empty config when OIDC_ISSUER is not set, and an error when the config is incomplete.
+func OIDCConfigFromEnv() (OIDCConfig, error) {
+	config := OIDCConfig{
+		Issuer:       utils.GetEnv(OIDCIssuerKey, ""),
+		ClientID:     utils.GetEnv(OIDCClientIDKey, ""),
+		ClientSecret: utils.GetEnv(OIDCClientSecretKey, ""),
+		RedirectURL:  utils.GetEnv(OIDCRedirectURLKey, ""),
+		Scopes:       strings.Fields(utils.GetEnv(OIDCScopesKey, DefaultOIDCScopes)),
+		Provisioning: utils.GetEnvBool(OIDCProvisioningKey, DefaultOIDCProvisioning),
+		CacheTTL:     utils.GetEnvDuration(OIDCCacheTTLKey, DefaultOIDCCacheTTL),
+	}
+	if config.Issuer == "" {
+		return OIDCConfig{}, nil
+	}
+	if config.ClientID == "" || config.RedirectURL == "" {
+		return OIDCConfig{}, fmt.Errorf("%s and %s are required with %s", OIDCClientIDKey, OIDCRedirectURLKey, OIDCIssuerKey)
+	}
+	return config, nil
+}
+
+// IdentityRepository defines the user storage operations needed to log in with an identity provider.
+type IdentityRepository interface {
+	UserFinder
+	// FindByIdentity returns the user linked to the identity. It returns user.ErrNotFound when no user matches.
+	FindByIdentity(ctx context.Context, issuer, subject string) (models.User, error)
+	// LinkIdentity adds the identity to the user if their email is verified, or returns user.ErrNotFound.
+	LinkIdentity(ctx context.Context, id string, identity models.ExternalIdentity) error
+	Create(ctx context.Context, user models.User) (models.User, error)
+}
+
+// OIDCService logs users in with an OpenID Connect identity provider, using the authorization code flow with PKCE.
+// Identities are linked to existing users by their verified email; unknown users can be provisioned on their first login.
+type OIDCService struct {
+	config   OIDCConfig
+	provider *providerCache
+	users    IdentityRepository
+	recorder audit.Recorder
+	flowKey  []byte
+	client   *http.Client
+	now      func() time.Time
+}
+
+// oidcFlowClaims carry the state of a login flow between its start and the callback.
+// They are signed and kept by the browser in a cookie, so no server-side storage is needed.
+type oidcFlowClaims struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	jwt.RegisteredClaims
+}
+
+// idTokenClaims are the claims of an ID token used to identify the user.
+type idTokenClaims struct {
+	Nonce           string       `json:"nonce"`
+	Email           string       `json:"email"`
+	EmailVerified   flexibleBool `json:"email_verified"`
+	Name            string       `json:"name"`
+	AuthorizedParty string       `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// flexibleBool decodes booleans that some providers send as the strings "true" and "false".
+type flexibleBool bool
+
+// UnmarshalJSON accepts a JSON boolean or a string holding one.
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = flexibleBool(v)
+	case string:
+		*b = flexibleBool(strings.EqualFold(v, "true"))
+	default:
+		*b = false
+	}
+	return nil
+}
+
+// NewOIDCService creates a new OIDCService. The login flow state is signed with a key derived from signingKey.
+// Linking identities and provisioning users is recorded with the given audit recorder.
+func NewOIDCService(config OIDCConfig, users IdentityRepository, signingKey []byte, recorder audit.Recorder) *OIDCService {
+	client := &http.Client{Timeout: oidcHTTPTimeout}
+	// Derive a separate key, so flow tokens can never be mistaken for access tokens.
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(oidcFlowAudience))
+	return &OIDCService{
+		config:   config,
+		provider: newProviderCache(config.Issuer, client, config.CacheTTL),
+		users:    users,
+		recorder: recorder,
+		flowKey:  mac.Sum(nil),
+		client:   client,
+		now:      time.Now,
+	}
+}
+
+// SecureCookies reports whether the callback is served over HTTPS, so the flow cookie can be marked secure.
+func (s *OIDCService) SecureCookies() bool {
+	return strings.HasPrefix(s.config.RedirectURL, "https://")
+}
+
+// Begin starts a login at the identity provider. It returns the authorization URL to send the user to,
+// and a signed flow token that must be presented again, together with the callback parameters, to Complete.
+func (s *OIDCService) Begin(ctx context.Context) (string, string, error) {
+	metadata, err := s.provider.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	var values [3]string
+	for i := range values {
+		if values[i], err = randomToken(oidcFlowBytes); err != nil {
+			return "", "", err
+		}
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	now := s.now()
+	flow, err := jwt.NewWithClaims(jwt.SigningMethodHS256, oidcFlowClaims{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{oidcFlowAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(OIDCFlowTTL)),
+		},
+	}).SignedString(s.flowKey)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to sign login flow: %w", err)
+	}
+
+	authURL, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", s.config.ClientID)
+	query.Set("redirect_uri", s.config.RedirectURL)
+	query.Set("scope", strings.Join(s.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), flow, nil
+}
+
+// Complete finishes a login started with Begin: it checks the state, exchanges the authorization code
+// for an ID token, validates it and returns the user linked to the identity, provisioning one if allowed.
+func (s *OIDCService) Complete(ctx context.Context, flowToken, state, code string) (models.User, error) {
+	flow := &oidcFlowClaims{}
+	_, err := jwt.ParseWithClaims(flowToken, flow, func(token *jwt.Token) (interface{}, error) {
+		return s.flowKey, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithAudience(oidcFlowAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(s.now),
+	)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%w: %v", ErrInvalidOIDCFlow, err)
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(flow.State)) != 1 {
+		return models.User{}, fmt.Errorf("%w: state mismatch", ErrInvalidOIDCFlow)
+	}
+
+	rawIDToken, err := s.exchange(ctx, code, flow.CodeVerifier)
+	if err != nil {
+		return models.User{}, err
+	}
+	claims, err := s.verifyIDToken(ctx, rawIDToken, flow.Nonce)
+	if err != nil {
+		return models.User{}, err
+	}
+	return s.resolveUser(ctx, claims)
+}
+
+// exchange redeems the authorization code at the token endpoint and returns the ID token.
+func (s *OIDCService) exchange(ctx context.Context, code, verifier string) (string, error) {
+	metadata, err := s.provider.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {s.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if s.config.ClientSecret == "" {
+		form.Set("client_id", s.config.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if s.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(s.config.ClientID), url.QueryEscape(s.config.ClientSecret))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrOIDCExchange, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxProviderResponseSize)).Decode(&body); err != nil {
+		return "", fmt.Errorf("%w: unreadable response with status %s", ErrOIDCExchange, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: %s %s", ErrOIDCExchange, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("%w: no id token in response", ErrOIDCExchange)
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token.
+func (s *OIDCService) verifyIDToken(ctx context.Context, rawIDToken, nonce string) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return s.provider.key(ctx, kid)
+	},
+		jwt.WithValidMethods(idTokenAlgorithms),
+		jwt.WithIssuer(s.config.Issuer),
+		jwt.WithAudience(s.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(oidcClockSkew),
+		jwt.WithTimeFunc(s.now),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != s.config.ClientID {
+		return nil, fmt.Errorf("%w: issued to another party", ErrInvalidIDToken)
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	return claims, nil
+}
+
+// resolveUser returns the user linked to the identity of the ID token. An unlinked identity is linked to
+// the user with the same email if both the provider and the user verified it, or else a new user is
+// provisioned if allowed.
+func (s *OIDCService) resolveUser(ctx context.Context, claims *idTokenClaims) (models.User, error) {
+	usuario, err := s.users.FindByIdentity(ctx, s.config.Issuer, claims.Subject)
+	if err == nil {
+		return usuario, nil
+	}
+	if !errors.Is(err, user.ErrNotFound) {
+		return models.User{}, err
+	}
+
+	// Only an email the provider vouches for may be trusted to link or create an account.
+	if claims.Email == "" || !bool(claims.EmailVerified) {
+		return models.User{}, ErrEmailNotVerified
+	}
+	identity := models.ExternalIdentity{
+		Issuer:   s.config.Issuer,
+		Subject:  claims.Subject,
+		LinkedAt: s.now().UTC(),
+	}
+
+	usuario, err = s.users.FindByEmail(ctx, claims.Email)
+	if err == nil {
+		// Anyone can sign up with an email they do not own and wait for its owner to log in with the
+		// provider. Linking such an account would hand it, with the password they chose, to the owner's
+		// identity while they keep access.
+		if !usuario.EmailVerified {
+			return models.User{}, ErrEmailNotVerified
+		}
+		for _, linked := range usuario.Identities {
+			if linked.Issuer == identity.Issuer {
+				return models.User{}, ErrIdentityConflict
+			}
+		}
+		if err := s.users.LinkIdentity(ctx, usuario.ID.Hex(), identity); err != nil {
+			if errors.Is(err, user.ErrNotFound) {
+				return models.User{}, ErrEmailNotVerified
+			}
+			return models.User{}, err
+		}
+		usuario.Identities = append(usuario.Identities, identity)
+		audit.Record(ctx, s.recorder, models.AuditEvent{
+			Type:      audit.EventIdentityLinked,
+			ActorID:   usuario.ID.Hex(),
+			SubjectID: usuario.ID.Hex(),
+			Details:   map[string]string{"issuer": identity.Issuer, "subject": identity.Subject},
+		})
+		return usuario, nil
+	}
+	if !errors.Is(err, user.ErrNotFound) {
+		return models.User{}, err
+	}
+
+	if !s.config.Provisioning {
+		return models.User{}, ErrNoLinkedAccount
+	}
+	// Provisioned users have no password; they can set one with a password reset.
+	usuario, err = s.users.Create(ctx, models.User{
+		Name:          provisionedName(claims.Name, claims.Email),
+		Email:         claims.Email,
+		Role:          user.RoleUser,
+		EmailVerified: true,
+		Identities:    []models.ExternalIdentity{identity},
+	})
+	if err != nil {
+		return models.User{}, err
+	}
+	audit.Record(ctx, s.recorder, models.AuditEvent{
+		Type:      audit.EventUserProvisioned,
+		ActorID:   usuario.ID.Hex(),
+		SubjectID: usuario.ID.Hex(),
+		Details:   map[string]string{"issuer": identity.Issuer, "subject": identity.Subject},
+	})
+	return usuario, nil
+}
+
+// provisionedName turns the name from the identity provider into one the user service accepts:
+// only ASCII letters and spaces, between 3 and 50 characters. Names with other letters would be
+// mangled, so they fall back to the local part of the email.
+func provisionedName(name, email string) string {
+	for _, candidate := range []string{name, strings.SplitN(email, "@", 2)[0]} {
+		if strings.IndexFunc(candidate, func(r rune) bool { return r > unicode.MaxASCII }) >= 0 {
+			continue
+		}
+		cleaned := strings.Join(strings.FieldsFunc(candidate, func(r rune) bool {
+			return !unicode.IsLetter(r)
+		}), " ")
+		if len(cleaned) > maxProvisionedNameLength {
+			cleaned = strings.TrimSpace(cleaned[:maxProvisionedNameLength])
+		}
+		if len(cleaned) >= 3 {
+			return cleaned
+		}
+	}
+	return "User"
+}
+
+// codeChallenge derives the S256 PKCE code challenge of a code verifier.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
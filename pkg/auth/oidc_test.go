@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"context"
+	"simplecrud/pkg/audit"
+	"simplecrud/pkg/auth/oidctest"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/user"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryIdentityRepository is an in-memory IdentityRepository used by the tests.
+type memoryIdentityRepository struct {
+	mu    sync.Mutex
+	users []models.User
+}
+
+// FindByEmail returns the user with the given email.
+func (m *memoryIdentityRepository) FindByEmail(ctx context.Context, email string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return models.User{}, user.ErrNotFound
+}
+
+// FindByIdentity returns the user linked to the identity.
+func (m *memoryIdentityRepository) FindByIdentity(ctx context.Context, issuer, subject string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		for _, identity := range u.Identities {
+			if identity.Issuer == issuer && identity.Subject == subject {
+				return u, nil
+			}
+		}
+	}
+	return models.User{}, user.ErrNotFound
+}
+
+// LinkIdentity adds the identity to the user if their email is verified.
+func (m *memoryIdentityRepository) LinkIdentity(ctx context.Context, id string, identity models.ExternalIdentity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, u := range m.users {
+		if u.ID.Hex() == id && u.EmailVerified {
+			m.users[i].Identities = append(m.users[i].Identities, identity)
+			return nil
+		}
+	}
+	return user.ErrNotFound
+}
+
+// Create stores a new user.
+func (m *memoryIdentityRepository) Create(ctx context.Context, u models.User) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u.ID = primitive.NewObjectID()
+	m.users = append(m.users, u)
+	return u, nil
+}
+
+// newTestOIDCService creates an OIDCService for the fake provider.
+func newTestOIDCService(provider *oidctest.Provider, repo IdentityRepository, recorder audit.Recorder, provisioning bool) *OIDCService {
+	return NewOIDCService(OIDCConfig{
+		Issuer:       provider.URL,
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  oidctest.RedirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		Provisioning: provisioning,
+		CacheTTL:     time.Hour,
+	}, repo, []byte("0123456789abcdef0123456789abcdef"), recorder)
+}
+
+// login runs a full login of the subject with the fake provider.
+func login(t *testing.T, service *OIDCService, provider *oidctest.Provider, subject, email string, extra jwt.MapClaims) (models.User, error) {
+	authURL, flow, err := service.Begin(context.Background())
+	require.NoError(t, err)
+	code, state := provider.Authorize(t, authURL, subject, email, extra)
+	return service.Complete(context.Background(), flow, state, code)
+}
+
+// TestOIDCProvisioning checks that a first login provisions a user and later logins find them by identity.
+func TestOIDCProvisioning(t *testing.T) {
+	provider := oidctest.NewProvider(t)
+	repo := &memoryIdentityRepository{}
+	recorder := &memoryRecorder{}
+	service := newTestOIDCService(provider, repo, recorder, true)
+
+	created, err := login(t, service, provider, "sub-1", "alice@example.com", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Alice Doe", created.Name)
+	assert.Equal(t, user.RoleUser, created.Role)
+	assert.True(t, created.EmailVerified)
+	assert.Empty(t, created.Password, "provisioned users have no password")
+	require.Len(t, created.Identities, 1)
+	assert.Equal(t, provider.URL, created.Identities[0].Issuer)
+
+	// The identity is found again even if the email changed at the provider
+	again, err := login(t, service, provider, "sub-1", "alice@new.example.com", jwt.MapClaims{"email_verified": "false"})
+	require.NoError(t, err)
+	assert.Equal(t, created.ID, again.ID)
+	assert.Len(t, repo.users, 1)
+
+	// The configuration and keys are cached
+	assert.Equal(t, 1, provider.DiscoveryHits())
+	assert.Equal(t, 1, provider.JWKSHits())
+
+	require.Len(t, recorder.events, 1)
+	assert.Equal(t, audit.EventUserProvisioned, recorder.events[0].Type)
+}
+
+// TestOIDCLinking checks linking identities to existing users by verified email.
+func TestOIDCLinking(t *testing.T) {
+	provider := oidctest.NewProvider(t)
+	existing := models.User{ID: primitive.NewObjectID(), Name: "Alice", Email: "alice@example.com", Role: user.RoleAdmin, EmailVerified: true}
+	repo := &memoryIdentityRepository{users: []models.User{existing}}
+	recorder := &memoryRecorder{}
+	service := newTestOIDCService(provider, repo, recorder, false)
+
+	// An unverified email is not enough to take over an account
+	_, err := login(t, service, provider, "sub-1", "alice@example.com", jwt.MapClaims{"email_verified": false})
+	assert.ErrorIs(t, err, ErrEmailNotVerified)
+
+	linked, err := login(t, service, provider, "sub-1", "alice@example.com", jwt.MapClaims{"email_verified": "true"})
+	require.NoError(t, err)
+	assert.Equal(t, existing.ID, linked.ID)
+	assert.Equal(t, user.RoleAdmin, linked.Role)
+	require.Len(t, repo.users[0].Identities, 1)
+	assert.Equal(t, "sub-1", repo.users[0].Identities[0].Subject)
+	require.Len(t, recorder.events, 1)
+	assert.Equal(t, audit.EventIdentityLinked, recorder.events[0].Type)
+
+	// Another identity of the same provider cannot claim the account
+	_, err = login(t, service, provider, "sub-2", "alice@example.com", nil)
+	assert.ErrorIs(t, err, ErrIdentityConflict)
+
+	// Without provisioning, unknown users are refused
+	_, err = login(t, service, provider, "sub-3", "bob@example.com", nil)
+	assert.ErrorIs(t, err, ErrNoLinkedAccount)
+	assert.Len(t, repo.users, 1)
+}
+
+// TestOIDCLinkingUnverifiedAccount checks that identities are not linked to accounts whose owner never
+// verified the email, so an account registered with someone else's email cannot be taken over.
+func TestOIDCLinkingUnverifiedAccount(t *testing.T) {
+	provider := oidctest.NewProvider(t)
+	squatter := models.User{ID: primitive.NewObjectID(), Name: "Mallory", Email: "alice@example.com", Role: user.RoleUser, Password: "hash"}
+	repo := &memoryIdentityRepository{users: []models.User{squatter}}
+	recorder := &memoryRecorder{}
+	service := newTestOIDCService(provider, repo, recorder, true)
+
+	_, err := login(t, service, provider, "sub-1", "alice@example.com", nil)
+	assert.ErrorIs(t, err, ErrEmailNotVerified)
+	assert.Empty(t, repo.users[0].Identities)
+	assert.Len(t, repo.users, 1, "no second account is provisioned for the email")
+	assert.Empty(t, recorder.events)
+}
+
+// TestOIDCRejectsInvalidLogins checks the state, PKCE, nonce, audience and signature checks.
+func TestOIDCRejectsInvalidLogins(t *testing.T) {
+	provider := oidctest.NewProvider(t)
+	service := newTestOIDCService(provider, &memoryIdentityRepository{}, nil, true)
+	ctx := context.Background()
+
+	// A callback with another state, or without the flow of this browser
+	authURL, flow, err := service.Begin(ctx)
+	require.NoError(t, err)
+	code, _ := provider.Authorize(t, authURL, "sub-1", "alice@example.com", nil)
+	_, err = service.Complete(ctx, flow, "forged-state", code)
+	assert.ErrorIs(t, err, ErrInvalidOIDCFlow)
+	_, err = service.Complete(ctx, "not-a-flow", "forged-state", code)
+	assert.ErrorIs(t, err, ErrInvalidOIDCFlow)
+
+	// A code obtained in another flow fails the PKCE check
+	authURL, _, err = service.Begin(ctx)
+	require.NoError(t, err)
+	code, _ = provider.Authorize(t, authURL, "sub-1", "alice@example.com", nil)
+	_, flow, err = service.Begin(ctx)
+	require.NoError(t, err)
+	flowClaims := &oidcFlowClaims{}
+	_, _, err = jwt.NewParser().ParseUnverified(flow, flowClaims)
+	require.NoError(t, err)
+	_, err = service.Complete(ctx, flow, flowClaims.State, code)
+	assert.ErrorIs(t, err, ErrOIDCExchange)
+
+	// Expired flows are refused
+	authURL, flow, err = service.Begin(ctx)
+	require.NoError(t, err)
+	code, state := provider.Authorize(t, authURL, "sub-1", "alice@example.com", nil)
+	service.now = func() time.Time { return time.Now().Add(OIDCFlowTTL) }
+	_, err = service.Complete(ctx, flow, state, code)
+	assert.ErrorIs(t, err, ErrInvalidOIDCFlow)
+	service.now = time.Now
+
+	for name, extra := range map[string]jwt.MapClaims{
+		"nonce":    {"nonce": "replayed"},
+		"audience": {"aud": "another-client"},
+		"azp":      {"aud": []string{oidctest.ClientID, "another-client"}, "azp": "another-client"},
+		"issuer":   {"iss": "https://evil.example.com"},
+		"expired":  {"exp": time.Now().Add(-time.Hour).Unix()},
+		"subject":  {"sub": ""},
+	} {
+		_, err := login(t, service, provider, "sub-1", "alice@example.com", extra)
+		assert.ErrorIs(t, err, ErrInvalidIDToken, name)
+	}
+}
+
+// TestOIDCKeyRotation checks that tokens signed with a new key are accepted once the keys are fetched again.
+func TestOIDCKeyRotation(t *testing.T) {
+	provider := oidctest.NewProvider(t)
+	service := newTestOIDCService(provider, &memoryIdentityRepository{}, nil, true)
+	now := time.Now()
+	service.provider.now = func() time.Time { return now }
+
+	_, err := login(t, service, provider, "sub-1", "alice@example.com", nil)
+	require.NoError(t, err)
+
+	provider.RotateKey(t)
+
+	// Unknown keys only trigger a new fetch once the minimum refresh interval passed
+	_, err = login(t, service, provider, "sub-1", "alice@example.com", nil)
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+	assert.Equal(t, 1, provider.JWKSHits())
+
+	now = now.Add(jwksMinRefreshInterval)
+	_, err = login(t, service, provider, "sub-1", "alice@example.com", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, provider.JWKSHits())
+}
+
+// TestProvisionedName checks that provider names are turned into valid user names.
+func TestProvisionedName(t *testing.T) {
+	assert.Equal(t, "Alice Doe", provisionedName("Alice Doe", "alice@example.com"))
+	assert.Equal(t, "jose", provisionedName("José García", "jose@example.com"))
+	assert.Equal(t, "alice smith", provisionedName("", "alice.smith42@example.com"))
+	assert.Equal(t, "User", provisionedName("李", "li@example.com"))
+}
@@ -0,0 +1,180 @@
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// The client registration the fake provider accepts.
+const (
+	ClientID     = "simplecrud-test"
+	ClientSecret = "client-secret"
+	RedirectURL  = "https://api.example.com/auth/oidc/callback"
+)
+
+// grant is an authorization code issued by the fake provider.
+type grant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+// Provider is a minimal OpenID provider serving discovery, keys and the token endpoint.
+type Provider struct {
+	// URL is the issuer identifier of the provider.
+	URL    string
+	server *httptest.Server
+
+	mu            sync.Mutex
+	key           *rsa.PrivateKey
+	kid           string
+	keys          int
+	grants        map[string]grant
+	discoveryHits int
+	jwksHits      int
+}
+
+// NewProvider starts a fake provider that is stopped at the end of the test.
+func NewProvider(t *testing.T) *Provider {
+	p := &Provider{grants: map[string]grant{}}
+	p.RotateKey(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.discoveryHits++
+		p.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.jwksHits++
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": p.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	p.URL = p.server.URL
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// RotateKey replaces the signing key of the provider with a new one under a new key ID.
+func (p *Provider) RotateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys++
+	p.key, p.kid = key, fmt.Sprintf("key-%d", p.keys)
+}
+
+// DiscoveryHits returns how often the discovery document was fetched.
+func (p *Provider) DiscoveryHits() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.discoveryHits
+}
+
+// JWKSHits returns how often the keys were fetched.
+func (p *Provider) JWKSHits() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.jwksHits
+}
+
+// Authorize plays the user logging in at the provider: it reads the authorization URL and returns
+// the code and state the provider would redirect back with. Extra claims override the defaults.
+func (p *Provider) Authorize(t *testing.T, authURL, subject, email string, extra jwt.MapClaims) (string, string) {
+	parsed, err := url.Parse(authURL)
+	require.NoError(t, err)
+	query := parsed.Query()
+	require.Equal(t, p.URL+"/authorize", parsed.Scheme+"://"+parsed.Host+parsed.Path)
+	require.Equal(t, "code", query.Get("response_type"))
+	require.Equal(t, "S256", query.Get("code_challenge_method"))
+	require.Equal(t, RedirectURL, query.Get("redirect_uri"))
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            p.URL,
+		"sub":            subject,
+		"aud":            ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          query.Get("nonce"),
+		"email":          email,
+		"email_verified": true,
+		"name":           "Alice Doe",
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	random := make([]byte, 16)
+	_, err = rand.Read(random)
+	require.NoError(t, err)
+	code := hex.EncodeToString(random)
+	p.mu.Lock()
+	p.grants[code] = grant{challenge: query.Get("code_challenge"), claims: claims}
+	p.mu.Unlock()
+	return code, query.Get("state")
+}
+
+// token redeems an authorization code, checking the client credentials and the PKCE code verifier.
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != ClientID || secret != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	grant, found := p.grants[r.PostFormValue("code")]
+	delete(p.grants, r.PostFormValue("code"))
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !found || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != RedirectURL ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+	token.Header["kid"] = p.kid
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"id_token": signed, "token_type": "Bearer"})
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/notify"
+	"simplecrud/pkg/tenant"
+	"simplecrud/pkg/user"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// DefaultPasswordResetTTL is how long a password reset token stays valid when PASSWORD_RESET_TTL is not set.
+	DefaultPasswordResetTTL = time.Hour
+	// PasswordResetTTLKey is the environment variable used to configure the password reset token lifetime.
+	PasswordResetTTLKey = "PASSWORD_RESET_TTL"
+	// PasswordResetURLKey is the environment variable holding the page users open to choose a new password.
+	// The token is appended as the "token" query parameter. When it is empty, only the token is sent.
+	PasswordResetURLKey = "PASSWORD_RESET_URL"
+	// PurposePasswordReset is the purpose of action tokens used to reset a password.
+	PurposePasswordReset = "password_reset"
+	// actionTokenBytes is the amount of randomness in each action token.
+	actionTokenBytes = 32
+)
+
+var (
+	// ErrActionTokenNotFound is returned by an ActionTokenRepository when no usable token matches.
+	ErrActionTokenNotFound = errors.New("action token not found")
+	// ErrInvalidResetToken is returned when a password reset token is unknown, expired or already used.
+	ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+)
+
+// ActionTokenRepository defines the storage operations needed for single-use action tokens.
+type ActionTokenRepository interface {
+	Create(ctx context.Context, token models.ActionToken) error
+	// Consume marks the unused, unexpired token with the given hash and purpose as used and returns it.
+	// It returns ErrActionTokenNotFound if there is no such token, so a token can be used only once.
+	Consume(ctx context.Context, tokenHash, purpose string, at time.Time) (models.ActionToken, error)
+	// Release marks the used token with the given hash and purpose as unused again, when the action
+	// it was consumed for failed.
+	Release(ctx context.Context, tokenHash, purpose string) error
+	// DeleteForUser removes every token of the user with the given purpose.
+	DeleteForUser(ctx context.Context, userID primitive.ObjectID, purpose string) error
+	// LatestForUser returns the most recently created token of the user with the given purpose,
+	// or ErrActionTokenNotFound if there is none.
+	LatestForUser(ctx context.Context, userID primitive.ObjectID, purpose string) (models.ActionToken, error)
+}
+
+// UserFinder looks up users by email. It returns user.ErrNotFound when no user matches.
+type UserFinder interface {
+	FindByEmail(ctx context.Context, email string) (models.User, error)
+}
+
+// PasswordResetService issues password reset tokens, delivers them with a Notifier and redeems them.
+type PasswordResetService struct {
+	users    UserFinder
+	tokens   ActionTokenRepository
+	notifier notify.Notifier
+	ttl      time.Duration
+	resetURL string
+	now      func() time.Time
+}
+
+// NewPasswordResetService creates a new PasswordResetService.
+func NewPasswordResetService(users UserFinder, tokens ActionTokenRepository, notifier notify.Notifier, ttl time.Duration, resetURL string) *PasswordResetService {
+	return &PasswordResetService{
+		users:    users,
+		tokens:   tokens,
+		notifier: notifier,
+		ttl:      ttl,
+		resetURL: resetURL,
+		now:      time.Now,
+	}
+}
+
+// Request sends a password reset token to the user with the given email.
+// Unknown emails are silently ignored, so the response does not reveal which accounts exist.
+func (s *PasswordResetService) Request(ctx context.Context, email string) error {
+	usuario, err := s.users.FindByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, user.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	token, err := randomToken(actionTokenBytes)
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	err = s.tokens.Create(ctx, models.ActionToken{
+		UserID:    usuario.ID,
+		Purpose:   PurposePasswordReset,
+		TokenHash: HashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.notifier.Send(ctx, s.message(ctx, usuario.Email, token)); err != nil {
+		return fmt.Errorf("failed to send password reset: %w", err)
+	}
+	return nil
+}
+
+// Confirm redeems a password reset token and calls setPassword with the ID of the user it was issued to.
+// The token is used up before setPassword is called, so two requests with the same token cannot both set
+// a password. If setPassword fails, for example because the password breaks the policy, the token is
+// released so it can be used again. Otherwise every other outstanding reset token of the user stops
+// being valid too.
+func (s *PasswordResetService) Confirm(ctx context.Context, token string, setPassword func(userID primitive.ObjectID) error) (primitive.ObjectID, error) {
+	tokenHash := HashToken(token)
+	actionToken, err := s.tokens.Consume(ctx, tokenHash, PurposePasswordReset, s.now())
+	if err != nil {
+		if errors.Is(err, ErrActionTokenNotFound) {
+			return primitive.NilObjectID, ErrInvalidResetToken
+		}
+		return primitive.NilObjectID, err
+	}
+
+	if err := setPassword(actionToken.UserID); err != nil {
+		if releaseErr := s.tokens.Release(ctx, tokenHash, PurposePasswordReset); releaseErr != nil {
+			logging.FromContext(ctx).WithError(releaseErr).Error("Failed to release password reset token")
+		}
+		return primitive.NilObjectID, err
+	}
+
+	if err := s.tokens.DeleteForUser(ctx, actionToken.UserID, PurposePasswordReset); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return actionToken.UserID, nil
+}
+
+// message builds the notification carrying the reset token.
+func (s *PasswordResetService) message(ctx context.Context, to, token string) notify.Message {
+	body := fmt.Sprintf("Someone asked to reset the password of your account. "+
+		"If it was not you, ignore this message.\n\nYour password reset code, valid for %s:\n\n%s\n", s.ttl, token)
+	if s.resetURL != "" {
+		body += "\nOr open this link to choose a new password:\n\n" + s.resetURL + "?token=" + url.QueryEscape(token) + tenantQuery(ctx) + "\n"
+	}
+	return notify.Message{To: to, Subject: "Reset your password", Body: body}
+}
+
+// tenantQuery returns the query parameter naming the tenant the request is bound to, to be appended to
+// emailed links, or an empty string outside tenants. The token alone would be looked up in the platform
+// database, since opening a link sends no access token.
+func tenantQuery(ctx context.Context) string {
+	if id, ok := tenant.FromContext(ctx); ok {
+		return "&" + tenant.QueryParam + "=" + url.QueryEscape(id)
+	}
+	return ""
+}
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/notify"
+	"simplecrud/pkg/tenant"
+	"simplecrud/pkg/user"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryActionTokenRepository is an in-memory ActionTokenRepository used by the tests.
+type memoryActionTokenRepository struct {
+	mu     sync.Mutex
+	tokens []models.ActionToken
+}
+
+// Create stores a new token with a fresh ID.
+func (m *memoryActionTokenRepository) Create(ctx context.Context, token models.ActionToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token.ID = primitive.NewObjectID()
+	m.tokens = append(m.tokens, token)
+	return nil
+}
+
+// Consume marks a matching unused and unexpired token as used.
+func (m *memoryActionTokenRepository) Consume(ctx context.Context, tokenHash, purpose string, at time.Time) (models.ActionToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, token := range m.tokens {
+		if token.TokenHash == tokenHash && token.Purpose == purpose && token.UsedAt == nil && at.Before(token.ExpiresAt) {
+			m.tokens[i].UsedAt = &at
+			return m.tokens[i], nil
+		}
+	}
+	return models.ActionToken{}, ErrActionTokenNotFound
+}
+
+// Release marks a matching used token as unused.
+func (m *memoryActionTokenRepository) Release(ctx context.Context, tokenHash, purpose string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, token := range m.tokens {
+		if token.TokenHash == tokenHash && token.Purpose == purpose && token.UsedAt != nil {
+			m.tokens[i].UsedAt = nil
+		}
+	}
+	return nil
+}
+
+// DeleteForUser removes the tokens of the user with the given purpose.
+func (m *memoryActionTokenRepository) DeleteForUser(ctx context.Context, userID primitive.ObjectID, purpose string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.tokens[:0]
+	for _, token := range m.tokens {
+		if token.UserID != userID || token.Purpose != purpose {
+			kept = append(kept, token)
+		}
+	}
+	m.tokens = kept
+	return nil
+}
+
+// LatestForUser returns the last created token of the user with the given purpose.
+func (m *memoryActionTokenRepository) LatestForUser(ctx context.Context, userID primitive.ObjectID, purpose string) (models.ActionToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.tokens) - 1; i >= 0; i-- {
+		if m.tokens[i].UserID == userID && m.tokens[i].Purpose == purpose {
+			return m.tokens[i], nil
+		}
+	}
+	return models.ActionToken{}, ErrActionTokenNotFound
+}
+
+// memoryUserFinder finds users in a fixed list.
+type memoryUserFinder []models.User
+
+// FindByEmail returns the user with the given email.
+func (m memoryUserFinder) FindByEmail(ctx context.Context, email string) (models.User, error) {
+	for _, u := range m {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return models.User{}, user.ErrNotFound
+}
+
+// FindById returns the user with the given ID.
+func (m memoryUserFinder) FindById(ctx context.Context, id string) (models.User, error) {
+	for _, u := range m {
+		if u.ID.Hex() == id {
+			return u, nil
+		}
+	}
+	return models.User{}, user.ErrNotFound
+}
+
+// memoryNotifier keeps the messages it is asked to send.
+type memoryNotifier struct {
+	mu       sync.Mutex
+	messages []notify.Message
+}
+
+// Send records the message.
+func (m *memoryNotifier) Send(ctx context.Context, msg notify.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// lastLine returns the last line of the last message, which holds the token or link.
+func (m *memoryNotifier) lastLine(t *testing.T) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.NotEmpty(t, m.messages)
+	lines := strings.Split(strings.TrimSpace(m.messages[len(m.messages)-1].Body), "\n")
+	return lines[len(lines)-1]
+}
+
+// TestPasswordReset checks that reset tokens are delivered, single-use, hashed at rest and expire.
+func TestPasswordReset(t *testing.T) {
+	alice := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com"}
+	repo := &memoryActionTokenRepository{}
+	notifier := &memoryNotifier{}
+	service := NewPasswordResetService(memoryUserFinder{alice}, repo, notifier, time.Hour, "")
+	now := time.Now()
+	service.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// Unknown emails are ignored without error
+	require.NoError(t, service.Request(ctx, "nobody@example.com"))
+	assert.Empty(t, notifier.messages)
+
+	require.NoError(t, service.Request(ctx, alice.Email))
+	require.Len(t, notifier.messages, 1)
+	assert.Equal(t, alice.Email, notifier.messages[0].To)
+	token := notifier.lastLine(t)
+	assert.NotEqual(t, token, repo.tokens[0].TokenHash, "tokens are stored hashed")
+
+	// A second request is outstanding too, until one of them is used
+	require.NoError(t, service.Request(ctx, alice.Email))
+	other := notifier.lastLine(t)
+
+	// A rejected password gives the token back
+	rejected := errors.New("password rejected")
+	_, err := service.Confirm(ctx, token, func(primitive.ObjectID) error { return rejected })
+	assert.ErrorIs(t, err, rejected)
+	_, err = service.Confirm(ctx, "unknown", setPassword(t, alice.ID))
+	assert.ErrorIs(t, err, ErrInvalidResetToken)
+
+	// The token is used up before the password is set, so a concurrent confirmation fails
+	userID, err := service.Confirm(ctx, token, func(userID primitive.ObjectID) error {
+		_, err := service.Confirm(ctx, token, setPassword(t, alice.ID))
+		assert.ErrorIs(t, err, ErrInvalidResetToken)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID, userID)
+
+	_, err = service.Confirm(ctx, token, setPassword(t, alice.ID))
+	assert.ErrorIs(t, err, ErrInvalidResetToken, "tokens are single-use")
+	_, err = service.Confirm(ctx, other, setPassword(t, alice.ID))
+	assert.ErrorIs(t, err, ErrInvalidResetToken, "other outstanding tokens are invalidated")
+
+	// Expired tokens are rejected
+	require.NoError(t, service.Request(ctx, alice.Email))
+	token = notifier.lastLine(t)
+	now = now.Add(time.Hour)
+	_, err = service.Confirm(ctx, token, setPassword(t, alice.ID))
+	assert.ErrorIs(t, err, ErrInvalidResetToken)
+}
+
+// setPassword returns a function setting the password that fails the test unless called for the user.
+func setPassword(t *testing.T, want primitive.ObjectID) func(primitive.ObjectID) error {
+	return func(userID primitive.ObjectID) error {
+		assert.Equal(t, want, userID)
+		return nil
+	}
+}
+
+// TestPasswordResetLink checks that the reset URL carries the token when it is configured, and the
+// tenant of the request when it has one.
+func TestPasswordResetLink(t *testing.T) {
+	alice := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com"}
+	notifier := &memoryNotifier{}
+	service := NewPasswordResetService(memoryUserFinder{alice}, &memoryActionTokenRepository{}, notifier, time.Hour, "https://app.example.com/reset")
+
+	require.NoError(t, service.Request(context.Background(), alice.Email))
+	assert.Contains(t, notifier.messages[0].Body, "https://app.example.com/reset?token=")
+	assert.NotContains(t, notifier.messages[0].Body, "tenant=")
+
+	ctx := tenant.Isolate(context.Background(), "acme")
+	require.NoError(t, service.Request(ctx, alice.Email))
+	link, err := url.Parse(notifier.lastLine(t))
+	require.NoError(t, err)
+	assert.Equal(t, "acme", link.Query().Get(tenant.QueryParam))
+	assert.NotEmpty(t, link.Query().Get("token"))
+}
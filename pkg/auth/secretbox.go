@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// SecretBox encrypts small secrets, such as TOTP secrets, before they are stored in the database.
+// It uses AES-256-GCM with a key derived from the configured key material.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox creates a new SecretBox from key material of at least 32 bytes.
+func NewSecretBox(key []byte) (*SecretBox, error) {
+	if len(key) < minKeyLength {
+		return nil, fmt.Errorf("encryption key must be at least %d bytes", minKeyLength)
+	}
+
+	// Derive a fixed size AES-256 key, so any key material of sufficient length can be used.
+	derived := sha256.Sum256(key)
+	block, err := aes.NewCipher(derived[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// Seal encrypts the plaintext and returns the nonce and ciphertext encoded as base64.
+func (b *SecretBox) Seal(plaintext []byte) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := b.aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal.
+func (b *SecretBox) Open(sealed string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode sealed value: %w", err)
+	}
+	if len(data) < b.aead.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+	nonce, ciphertext := data[:b.aead.NonceSize()], data[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt sealed value: %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"simplecrud/pkg/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// DefaultRefreshTokenTTL is how long a refresh token stays valid when REFRESH_TOKEN_TTL is not set.
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+	// RefreshTokenTTLKey is the environment variable used to configure the refresh token lifetime.
+	RefreshTokenTTLKey = "REFRESH_TOKEN_TTL"
+	// refreshTokenBytes is the amount of randomness in each refresh token.
+	refreshTokenBytes = 32
+)
+
+var (
+	// ErrSessionNotFound is returned by a SessionRepository when no session matches.
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrInvalidRefreshToken is returned when a refresh token is unknown, expired or revoked.
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	// ErrRefreshTokenReused is returned when an already rotated refresh token is presented again.
+	// The whole token family is revoked when this happens.
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+)
+
+// SessionRepository defines the storage operations needed for refresh token sessions.
+type SessionRepository interface {
+	Create(ctx context.Context, session models.Session) error
+	FindByTokenHash(ctx context.Context, tokenHash string) (models.Session, error)
+	// MarkRotated marks the session as rotated only if it was neither rotated nor revoked yet.
+	// It reports whether the session was updated, so concurrent refreshes cannot both succeed.
+	MarkRotated(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error)
+	RevokeFamily(ctx context.Context, familyID string, at time.Time) error
+	RevokeAllForUser(ctx context.Context, userID primitive.ObjectID, at time.Time) error
+}
+
+// SessionService issues, rotates and revokes opaque refresh tokens.
+type SessionService struct {
+	repo SessionRepository
+	ttl  time.Duration
+	now  func() time.Time
+}
+
+// NewSessionService creates a new SessionService storing sessions in the given repository.
+func NewSessionService(repo SessionRepository, ttl time.Duration) *SessionService {
+	return &SessionService{
+		repo: repo,
+		ttl:  ttl,
+		now:  time.Now,
+	}
+}
+
+// Start creates a new token family for the user, typically right after login,
+// and returns its first refresh token.
+func (s *SessionService) Start(ctx context.Context, userID primitive.ObjectID) (string, error) {
+	familyID, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	return s.issue(ctx, userID, familyID)
+}
+
+// Rotate exchanges a refresh token for a new one in the same family and returns the user it belongs to.
+// If the token was already rotated, the family is revoked and ErrRefreshTokenReused is returned.
+func (s *SessionService) Rotate(ctx context.Context, token string) (primitive.ObjectID, string, error) {
+	session, err := s.repo.FindByTokenHash(ctx, HashToken(token))
+	if err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return primitive.NilObjectID, "", ErrInvalidRefreshToken
+		}
+		return primitive.NilObjectID, "", err
+	}
+
+	now := s.now()
+	if session.RevokedAt != nil || !now.Before(session.ExpiresAt) {
+		return primitive.NilObjectID, "", ErrInvalidRefreshToken
+	}
+	if session.RotatedAt != nil {
+		return primitive.NilObjectID, "", s.revokeReused(ctx, session, now)
+	}
+
+	// Claim the session atomically; losing the race means another request already used this token.
+	rotated, err := s.repo.MarkRotated(ctx, session.ID, now)
+	if err != nil {
+		return primitive.NilObjectID, "", err
+	}
+	if !rotated {
+		return primitive.NilObjectID, "", s.revokeReused(ctx, session, now)
+	}
+
+	newToken, err := s.issue(ctx, session.UserID, session.FamilyID)
+	if err != nil {
+		return primitive.NilObjectID, "", err
+	}
+	return session.UserID, newToken, nil
+}
+
+// Revoke revokes the family of the given refresh token, ending the login session it belongs to.
+// Unknown tokens are ignored so that logout is idempotent.
+func (s *SessionService) Revoke(ctx context.Context, token string) error {
+	session, err := s.repo.FindByTokenHash(ctx, HashToken(token))
+	if err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return nil
+		}
+		return err
+	}
+	return s.repo.RevokeFamily(ctx, session.FamilyID, s.now())
+}
+
+// RevokeAll revokes every session of the user, for example after their password changed.
+func (s *SessionService) RevokeAll(ctx context.Context, userID primitive.ObjectID) error {
+	return s.repo.RevokeAllForUser(ctx, userID, s.now())
+}
+
+// issue generates a refresh token, stores its hash and returns the token.
+func (s *SessionService) issue(ctx context.Context, userID primitive.ObjectID, familyID string) (string, error) {
+	token, err := randomToken(refreshTokenBytes)
+	if err != nil {
+		return "", err
+	}
+
+	now := s.now()
+	err = s.repo.Create(ctx, models.Session{
+		FamilyID:  familyID,
+		UserID:    userID,
+		TokenHash: HashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// revokeReused revokes the family of a session whose token was presented after rotation.
+func (s *SessionService) revokeReused(ctx context.Context, session models.Session, now time.Time) error {
+	if err := s.repo.RevokeFamily(ctx, session.FamilyID, now); err != nil {
+		return fmt.Errorf("failed to revoke token family: %w", err)
+	}
+	return ErrRefreshTokenReused
+}
+
+// HashToken returns the hex encoded SHA-256 hash of an opaque token, as stored in the database.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns n random bytes encoded as URL safe base64 without padding.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"context"
+	"simplecrud/pkg/models"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memorySessionRepository is an in-memory SessionRepository used by the tests.
+type memorySessionRepository struct {
+	mu       sync.Mutex
+	sessions []models.Session
+}
+
+// Create stores a new session with a fresh ID.
+func (m *memorySessionRepository) Create(ctx context.Context, session models.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session.ID = primitive.NewObjectID()
+	m.sessions = append(m.sessions, session)
+	return nil
+}
+
+// FindByTokenHash returns the session with the given token hash.
+func (m *memorySessionRepository) FindByTokenHash(ctx context.Context, tokenHash string) (models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, session := range m.sessions {
+		if session.TokenHash == tokenHash {
+			return session, nil
+		}
+	}
+	return models.Session{}, ErrSessionNotFound
+}
+
+// MarkRotated marks the session as rotated if it is still active.
+func (m *memorySessionRepository) MarkRotated(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i].ID == id && m.sessions[i].RotatedAt == nil && m.sessions[i].RevokedAt == nil {
+			m.sessions[i].RotatedAt = &at
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RevokeFamily revokes every session in the family.
+func (m *memorySessionRepository) RevokeFamily(ctx context.Context, familyID string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i].FamilyID == familyID && m.sessions[i].RevokedAt == nil {
+			m.sessions[i].RevokedAt = &at
+		}
+	}
+	return nil
+}
+
+// RevokeAllForUser revokes every session of the user.
+func (m *memorySessionRepository) RevokeAllForUser(ctx context.Context, userID primitive.ObjectID, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i].UserID == userID && m.sessions[i].RevokedAt == nil {
+			m.sessions[i].RevokedAt = &at
+		}
+	}
+	return nil
+}
+
+// TestRotate checks that a refresh token can be exchanged once for a new, working token.
+func TestRotate(t *testing.T) {
+	service := NewSessionService(&memorySessionRepository{}, time.Hour)
+	userID := primitive.NewObjectID()
+
+	first, err := service.Start(context.Background(), userID)
+	require.NoError(t, err)
+
+	gotUserID, second, err := service.Rotate(context.Background(), first)
+	require.NoError(t, err)
+	assert.Equal(t, userID, gotUserID)
+	assert.NotEqual(t, first, second)
+
+	// The rotated token keeps working
+	_, _, err = service.Rotate(context.Background(), second)
+	assert.NoError(t, err)
+}
+
+// TestRotateDetectsReuse checks that presenting a rotated token revokes the whole family.
+func TestRotateDetectsReuse(t *testing.T) {
+	service := NewSessionService(&memorySessionRepository{}, time.Hour)
+
+	first, err := service.Start(context.Background(), primitive.NewObjectID())
+	require.NoError(t, err)
+	_, second, err := service.Rotate(context.Background(), first)
+	require.NoError(t, err)
+
+	// Replaying the first token is detected as reuse
+	_, _, err = service.Rotate(context.Background(), first)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+
+	// The legitimate successor was revoked together with the family
+	_, _, err = service.Rotate(context.Background(), second)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
+
+// TestRotateRejectsExpiredAndUnknownTokens checks expired and unknown refresh tokens.
+func TestRotateRejectsExpiredAndUnknownTokens(t *testing.T) {
+	service := NewSessionService(&memorySessionRepository{}, time.Hour)
+
+	token, err := service.Start(context.Background(), primitive.NewObjectID())
+	require.NoError(t, err)
+
+	service.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, _, err = service.Rotate(context.Background(), token)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	_, _, err = service.Rotate(context.Background(), "unknown")
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
+
+// TestRevoke checks that logout revokes the family and is idempotent.
+func TestRevoke(t *testing.T) {
+	service := NewSessionService(&memorySessionRepository{}, time.Hour)
+
+	token, err := service.Start(context.Background(), primitive.NewObjectID())
+	require.NoError(t, err)
+
+	require.NoError(t, service.Revoke(context.Background(), token))
+	_, _, err = service.Rotate(context.Background(), token)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	assert.NoError(t, service.Revoke(context.Background(), token))
+	assert.NoError(t, service.Revoke(context.Background(), "unknown"))
+}
+
+// TestRevokeAll checks that every session of a user is revoked, and only theirs.
+func TestRevokeAll(t *testing.T) {
+	repo := &memorySessionRepository{}
+	service := NewSessionService(repo, time.Hour)
+	ctx := context.Background()
+	alice, bob := primitive.NewObjectID(), primitive.NewObjectID()
+
+	first, err := service.Start(ctx, alice)
+	require.NoError(t, err)
+	second, err := service.Start(ctx, alice)
+	require.NoError(t, err)
+	bobs, err := service.Start(ctx, bob)
+	require.NoError(t, err)
+
+	require.NoError(t, service.RevokeAll(ctx, alice))
+	_, _, err = service.Rotate(ctx, first)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	_, _, err = service.Rotate(ctx, second)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	_, _, err = service.Rotate(ctx, bobs)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/tenant"
+	pkguser "simplecrud/pkg/user"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// Issuer is the value of the "iss" claim in every access token issued by this API.
+	Issuer = "simplecrud"
+	// DefaultAccessTokenTTL is how long an access token stays valid when ACCESS_TOKEN_TTL is not set.
+	DefaultAccessTokenTTL = 15 * time.Minute
+	// AccessTokenTTLKey is the environment variable used to configure the access token lifetime.
+	AccessTokenTTLKey = "ACCESS_TOKEN_TTL"
+	// MFAChallengeTTL is how long a user has to complete the second login step.
+	MFAChallengeTTL = 5 * time.Minute
+	// minKeyLength is the smallest HMAC key accepted for signing tokens, in bytes.
+	minKeyLength = 32
+	// purposeMFA marks tokens that only allow completing an MFA login.
+	purposeMFA = "mfa"
+)
+
+var (
+	// ErrInvalidToken is returned when an access token is malformed, expired or has a bad signature.
+	ErrInvalidToken = errors.New("invalid or expired token")
+	// ErrNotMember is returned when issuing a token for an organization the user does not belong to.
+	ErrNotMember error = &pkguser.Error{Kind: pkguser.KindForbidden, Message: "user is not a member of the organization",
+		Detail: "The user is not a member of the organization"}
+)
+
+// Claims represents the payload of an access token.
+// The user ID is carried in the standard "sub" claim.
+type Claims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Role          string `json:"role"`
+	// OrgID is the organization the user acts in, and OrgRole their role in it. Both are empty
+	// for users outside organizations.
+	OrgID   string `json:"org,omitempty"`
+	OrgRole string `json:"org_role,omitempty"`
+	// Purpose is empty for access tokens. Other values restrict what the token can be used for.
+	Purpose string `json:"purpose,omitempty"`
+	// Actor is set on impersonation tokens and identifies the admin acting as the user.
+	Actor *Actor `json:"act,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Actor identifies who is acting on behalf of the subject of a token, as in the "act" claim of RFC 8693.
+type Actor struct {
+	Subject string `json:"sub"` // ID of the acting admin
+}
+
+// ImpersonatorID returns the ID of the admin impersonating the subject, or "" for regular tokens.
+func (c *Claims) ImpersonatorID() string {
+	if c.Actor == nil {
+		return ""
+	}
+	return c.Actor.Subject
+}
+
+// TokenManager issues and validates HMAC-SHA256 signed JWT access tokens.
+type TokenManager struct {
+	key    []byte        // Secret key used to sign and verify tokens
+	issuer string        // Value for the "iss" claim
+	ttl    time.Duration // Lifetime of issued tokens
+	now    func() time.Time
+}
+
+// NewTokenManager creates a new TokenManager that signs tokens with the given key.
+// It returns an error if the key is too short to be used safely with HS256.
+func NewTokenManager(key []byte, ttl time.Duration) (*TokenManager, error) {
+	if len(key) < minKeyLength {
+		return nil, fmt.Errorf("signing key must be at least %d bytes", minKeyLength)
+	}
+	return &TokenManager{
+		key:    key,
+		issuer: Issuer,
+		ttl:    ttl,
+		now:    time.Now,
+	}, nil
+}
+
+// TTL returns the lifetime of the access tokens issued by this manager.
+func (m *TokenManager) TTL() time.Duration {
+	return m.ttl
+}
+
+// Issue creates a signed access token for the user, acting in their first organization if they belong to any.
+// It returns the token string and the time at which it expires.
+func (m *TokenManager) Issue(user models.User) (string, time.Time, error) {
+	return m.issue(user, "", m.ttl)
+}
+
+// IssueForOrganization creates a signed access token for the user acting in the organization with the given ID.
+// An empty ID issues a token acting outside any organization. It returns ErrNotMember if the user
+// does not belong to the organization.
+func (m *TokenManager) IssueForOrganization(user models.User, orgID string) (string, time.Time, error) {
+	if orgID != "" {
+		if _, ok := pkguser.MembershipIn(user, orgID); !ok {
+			return "", time.Time{}, ErrNotMember
+		}
+	}
+	return m.sign(user, "", nil, orgID, m.ttl)
+}
+
+// IssueMFAChallenge creates a short-lived token proving the user passed the password step of a login.
+// It can only be exchanged for real tokens together with a valid second factor.
+func (m *TokenManager) IssueMFAChallenge(user models.User) (string, error) {
+	token, _, err := m.issue(user, purposeMFA, MFAChallengeTTL)
+	return token, err
+}
+
+// IssueImpersonation creates an access token for the user on behalf of the admin with the given ID,
+// acting in the organization with the given ID. The token works like the user's own access token,
+// but carries the admin in its "act" claim. It returns ErrNotMember if the user does not belong
+// to the organization.
+func (m *TokenManager) IssueImpersonation(user models.User, actorID, orgID string, ttl time.Duration) (string, time.Time, error) {
+	if orgID != "" {
+		if _, ok := pkguser.MembershipIn(user, orgID); !ok {
+			return "", time.Time{}, ErrNotMember
+		}
+	}
+	return m.sign(user, "", &Actor{Subject: actorID}, orgID, ttl)
+}
+
+// issue signs a token for the user in their default organization with the given purpose and lifetime.
+func (m *TokenManager) issue(user models.User, purpose string, ttl time.Duration) (string, time.Time, error) {
+	return m.sign(user, purpose, nil, defaultOrganization(user), ttl)
+}
+
+// defaultOrganization returns the ID of the organization users act in after logging in: their first one.
+func defaultOrganization(user models.User) string {
+	if len(user.Memberships) == 0 {
+		return ""
+	}
+	return user.Memberships[0].OrganizationID.Hex()
+}
+
+// OrganizationFor returns the ID of the organization the user acts in with the tokens issued for a request.
+// When tenants are isolated it is the tenant the request is bound to, so that the tokens keep working on
+// the database the user was found in; otherwise it is the user's first organization.
+func OrganizationFor(ctx context.Context, user models.User) string {
+	if tenant.Isolated(ctx) {
+		id, _ := tenant.FromContext(ctx)
+		return id
+	}
+	return defaultOrganization(user)
+}
+
+// sign signs a token for the user acting in the organization with the given ID, with the given purpose,
+// actor and lifetime. The user must be a member of the organization.
+func (m *TokenManager) sign(user models.User, purpose string, actor *Actor, orgID string, ttl time.Duration) (string, time.Time, error) {
+	now := m.now()
+	expiresAt := now.Add(ttl)
+
+	membership, _ := pkguser.MembershipIn(user, orgID)
+	claims := Claims{
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+		OrgID:         orgID,
+		OrgRole:       membership.Role,
+		Purpose:       purpose,
+		Actor:         actor,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.issuer,
+			Subject:   user.ID.Hex(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(m.key)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign token: %w", err)
+	}
+	return token, expiresAt, nil
+}
+
+// Parse validates the signature, issuer and expiry of the given access token and returns its claims.
+func (m *TokenManager) Parse(tokenString string) (*Claims, error) {
+	return m.parse(tokenString, "")
+}
+
+// ParseMFAChallenge validates a token issued by IssueMFAChallenge and returns its claims.
+func (m *TokenManager) ParseMFAChallenge(tokenString string) (*Claims, error) {
+	return m.parse(tokenString, purposeMFA)
+}
+
+// parse validates the token and checks it was issued for the given purpose.
+func (m *TokenManager) parse(tokenString, purpose string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return m.key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(m.issuer),
+		jwt.WithTimeFunc(m.now),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+	if claims.Purpose != purpose {
+		return nil, fmt.Errorf("%w: wrong token purpose", ErrInvalidToken)
+	}
+	if claims.Actor != nil && claims.Actor.Subject == "" {
+		return nil, fmt.Errorf("%w: missing actor", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// claimsKey is the context key under which validated claims are stored.
+type claimsKey struct{}
+
+// WithClaims returns a copy of ctx carrying the claims of the authenticated caller.
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims of the authenticated caller, if any.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"simplecrud/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// TestNewTokenManagerRejectsShortKey checks that keys shorter than 32 bytes are refused.
+func TestNewTokenManagerRejectsShortKey(t *testing.T) {
+	_, err := NewTokenManager([]byte("short"), time.Minute)
+	assert.Error(t, err)
+}
+
+// TestIssueAndParse checks that an issued token round-trips through Parse with the same subject and email.
+func TestIssueAndParse(t *testing.T) {
+	manager, err := NewTokenManager(testKey, time.Minute)
+	require.NoError(t, err)
+	user := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com", Role: "admin"}
+
+	token, expiresAt, err := manager.Issue(user)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt, 2*time.Second)
+
+	claims, err := manager.Parse(token)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID.Hex(), claims.Subject)
+	assert.Equal(t, user.Email, claims.Email)
+	assert.Equal(t, user.Role, claims.Role)
+	assert.Equal(t, Issuer, claims.Issuer)
+}
+
+// TestParseRejectsInvalidTokens checks expired tokens, tokens signed with another key and garbage input.
+func TestParseRejectsInvalidTokens(t *testing.T) {
+	manager, err := NewTokenManager(testKey, time.Minute)
+	require.NoError(t, err)
+	user := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com"}
+
+	// Expired token
+	manager.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	expired, _, err := manager.Issue(user)
+	require.NoError(t, err)
+	manager.now = time.Now
+	_, err = manager.Parse(expired)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// Token signed with a different key
+	other, err := NewTokenManager([]byte("fedcba9876543210fedcba9876543210"), time.Minute)
+	require.NoError(t, err)
+	forged, _, err := other.Issue(user)
+	require.NoError(t, err)
+	_, err = manager.Parse(forged)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// Garbage
+	_, err = manager.Parse("not-a-token")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+// TestMFAChallenge checks that challenge tokens and access tokens cannot be used in place of each other.
+func TestMFAChallenge(t *testing.T) {
+	manager, err := NewTokenManager(testKey, time.Minute)
+	require.NoError(t, err)
+	user := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com"}
+
+	challenge, err := manager.IssueMFAChallenge(user)
+	require.NoError(t, err)
+	claims, err := manager.ParseMFAChallenge(challenge)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID.Hex(), claims.Subject)
+	_, err = manager.Parse(challenge)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	access, _, err := manager.Issue(user)
+	require.NoError(t, err)
+	_, err = manager.ParseMFAChallenge(access)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+// TestOrganizationClaims checks that tokens act in the first organization of the user by default,
+// and only in organizations the user belongs to.
+func TestOrganizationClaims(t *testing.T) {
+	manager, err := NewTokenManager(testKey, time.Minute)
+	require.NoError(t, err)
+	acme, globex := primitive.NewObjectID(), primitive.NewObjectID()
+	user := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com", Memberships: []models.Membership{
+		{OrganizationID: acme, Role: "member"},
+		{OrganizationID: globex, Role: "admin"},
+	}}
+
+	token, _, err := manager.Issue(user)
+	require.NoError(t, err)
+	claims, err := manager.Parse(token)
+	require.NoError(t, err)
+	assert.Equal(t, acme.Hex(), claims.OrgID)
+	assert.Equal(t, "member", claims.OrgRole)
+
+	token, _, err = manager.IssueForOrganization(user, globex.Hex())
+	require.NoError(t, err)
+	claims, err = manager.Parse(token)
+	require.NoError(t, err)
+	assert.Equal(t, globex.Hex(), claims.OrgID)
+	assert.Equal(t, "admin", claims.OrgRole)
+
+	// Leaving every organization is allowed, joining another one is not
+	token, _, err = manager.IssueForOrganization(user, "")
+	require.NoError(t, err)
+	claims, err = manager.Parse(token)
+	require.NoError(t, err)
+	assert.Empty(t, claims.OrgID)
+	assert.Empty(t, claims.OrgRole)
+	_, _, err = manager.IssueForOrganization(user, primitive.NewObjectID().Hex())
+	assert.ErrorIs(t, err, ErrNotMember)
+}
+
+// TestLoadSigningKeyFromFile checks that the key file configured by JWT_KEY_FILE is used and trimmed.
+func TestLoadSigningKeyFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt.key")
+	require.NoError(t, os.WriteFile(path, append(testKey, '\n'), 0o600))
+	t.Setenv(KeyFileKey, path)
+
+	key, err := LoadSigningKey(nil)
+	require.NoError(t, err)
+	assert.Equal(t, testKey, key)
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rfcSecret is the base32 encoding of the SHA-1 test secret "12345678901234567890" from RFC 6238.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestTOTPCodeRFCVectors checks the code computation against the RFC 6238 test vectors (last 6 digits).
+func TestTOTPCodeRFCVectors(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		code, err := totpCode(rfcSecret, totpStep(time.Unix(test.unix, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, test.code, code, "time %d", test.unix)
+	}
+}
+
+// TestValidateTOTP checks the accepted clock skew and rejection of wrong codes.
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, err := totpCode(rfcSecret, totpStep(now))
+	require.NoError(t, err)
+
+	step, ok := validateTOTP(rfcSecret, code, now)
+	assert.True(t, ok)
+	assert.Equal(t, totpStep(now), step)
+
+	_, ok = validateTOTP(rfcSecret, code, now.Add(totpPeriod))
+	assert.True(t, ok, "one period of skew is accepted")
+	_, ok = validateTOTP(rfcSecret, code, now.Add(3*totpPeriod))
+	assert.False(t, ok, "older codes are rejected")
+	_, ok = validateTOTP(rfcSecret, "12345", now)
+	assert.False(t, ok)
+}
+
+// TestTOTPURI checks the otpauth URI contains the label and parameters authenticator apps expect.
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("simplecrud", "alice@example.com", rfcSecret)
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/simplecrud:alice@example.com?"))
+	assert.Contains(t, uri, "secret="+rfcSecret)
+	assert.Contains(t, uri, "issuer=simplecrud")
+	assert.Contains(t, uri, "digits=6")
+}
+
+// TestSecretBox checks that sealed values round-trip and cannot be opened with another key.
+func TestSecretBox(t *testing.T) {
+	box, err := NewSecretBox(testKey)
+	require.NoError(t, err)
+
+	sealed, err := box.Seal([]byte(rfcSecret))
+	require.NoError(t, err)
+	assert.NotContains(t, sealed, rfcSecret)
+
+	opened, err := box.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, rfcSecret, string(opened))
+
+	other, err := NewSecretBox([]byte("fedcba9876543210fedcba9876543210"))
+	require.NoError(t, err)
+	_, err = other.Open(sealed)
+	assert.Error(t, err)
+
+	_, err = NewSecretBox([]byte("short"))
+	assert.Error(t, err)
+}
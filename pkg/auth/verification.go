@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/notify"
+	"simplecrud/pkg/user"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// DefaultEmailVerificationTTL is how long a verification token stays valid when EMAIL_VERIFICATION_TTL is not set.
+	DefaultEmailVerificationTTL = 24 * time.Hour
+	// EmailVerificationTTLKey is the environment variable used to configure the verification token lifetime.
+	EmailVerificationTTLKey = "EMAIL_VERIFICATION_TTL"
+	// DefaultEmailVerificationURL is the verification endpoint of a local development server.
+	DefaultEmailVerificationURL = "http://localhost:8080/auth/verify"
+	// EmailVerificationURLKey is the environment variable holding the public URL of GET /auth/verify.
+	// The token is appended as the "token" query parameter.
+	EmailVerificationURLKey = "EMAIL_VERIFICATION_URL"
+	// DefaultVerificationResendInterval is the minimum time between two verification emails to the same user.
+	DefaultVerificationResendInterval = time.Minute
+	// VerificationResendIntervalKey is the environment variable used to configure the resend interval.
+	VerificationResendIntervalKey = "EMAIL_VERIFICATION_RESEND_INTERVAL"
+	// PurposeEmailVerification is the purpose of action tokens used to verify an email address.
+	PurposeEmailVerification = "email_verification"
+)
+
+var (
+	// ErrInvalidVerificationToken is returned when a verification token is unknown, expired or already used.
+	ErrInvalidVerificationToken = errors.New("invalid or expired email verification token")
+	// ErrEmailAlreadyVerified is returned when sending a verification email to a verified user.
+	ErrEmailAlreadyVerified = errors.New("email already verified")
+	// ErrVerificationResendTooSoon is returned when a verification email was sent to the user too recently.
+	ErrVerificationResendTooSoon = errors.New("verification email sent too recently")
+)
+
+// VerificationRepository defines the user storage operations needed for email verification.
+type VerificationRepository interface {
+	UserFinder
+	// MarkEmailVerified records that the user verified their email address, if it still is the given one.
+	// It returns user.ErrNotFound if the user does not exist or has another address.
+	MarkEmailVerified(ctx context.Context, id, email string) error
+}
+
+// VerificationService sends email verification tokens with a Notifier and redeems them.
+type VerificationService struct {
+	users          VerificationRepository
+	tokens         ActionTokenRepository
+	notifier       notify.Notifier
+	ttl            time.Duration
+	resendInterval time.Duration
+	verifyURL      string
+	now            func() time.Time
+}
+
+// NewVerificationService creates a new VerificationService.
+// At most one verification email is sent to a user per resendInterval.
+func NewVerificationService(users VerificationRepository, tokens ActionTokenRepository, notifier notify.Notifier, ttl, resendInterval time.Duration, verifyURL string) *VerificationService {
+	return &VerificationService{
+		users:          users,
+		tokens:         tokens,
+		notifier:       notifier,
+		ttl:            ttl,
+		resendInterval: resendInterval,
+		verifyURL:      verifyURL,
+		now:            time.Now,
+	}
+}
+
+// Send emails a new verification link to the user. Previously sent links stop working.
+// It returns a RetryError wrapping ErrVerificationResendTooSoon if the last link was sent too recently.
+func (s *VerificationService) Send(ctx context.Context, usuario models.User) error {
+	if usuario.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+
+	now := s.now()
+	latest, err := s.tokens.LatestForUser(ctx, usuario.ID, PurposeEmailVerification)
+	if err != nil && !errors.Is(err, ErrActionTokenNotFound) {
+		return err
+	}
+	if err == nil {
+		if wait := latest.CreatedAt.Add(s.resendInterval).Sub(now); wait > 0 {
+			return &RetryError{Err: ErrVerificationResendTooSoon, RetryAfter: wait}
+		}
+	}
+
+	if err := s.tokens.DeleteForUser(ctx, usuario.ID, PurposeEmailVerification); err != nil {
+		return err
+	}
+	token, err := randomToken(actionTokenBytes)
+	if err != nil {
+		return err
+	}
+	err = s.tokens.Create(ctx, models.ActionToken{
+		UserID:    usuario.ID,
+		Purpose:   PurposeEmailVerification,
+		TokenHash: HashToken(token),
+		Email:     usuario.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.notifier.Send(ctx, s.message(ctx, usuario.Email, token)); err != nil {
+		return fmt.Errorf("failed to send verification email: %w", err)
+	}
+	return nil
+}
+
+// Resend emails a new verification link to the user with the given email.
+// Unknown and already verified emails are silently ignored, so the response does not reveal which accounts exist.
+func (s *VerificationService) Resend(ctx context.Context, email string) error {
+	usuario, err := s.users.FindByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, user.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err := s.Send(ctx, usuario); err != nil && !errors.Is(err, ErrEmailAlreadyVerified) {
+		return err
+	}
+	return nil
+}
+
+// Verify redeems a verification token, marks the email of its user as verified and returns the user ID.
+// A token only verifies the address it was sent to: once the user changes their email, it stops working.
+func (s *VerificationService) Verify(ctx context.Context, token string) (primitive.ObjectID, error) {
+	actionToken, err := s.tokens.Consume(ctx, HashToken(token), PurposeEmailVerification, s.now())
+	if err != nil {
+		if errors.Is(err, ErrActionTokenNotFound) {
+			return primitive.NilObjectID, ErrInvalidVerificationToken
+		}
+		return primitive.NilObjectID, err
+	}
+
+	if err := s.users.MarkEmailVerified(ctx, actionToken.UserID.Hex(), actionToken.Email); err != nil {
+		if errors.Is(err, user.ErrNotFound) {
+			return primitive.NilObjectID, ErrInvalidVerificationToken
+		}
+		return primitive.NilObjectID, err
+	}
+	return actionToken.UserID, nil
+}
+
+// message builds the email carrying the verification link.
+func (s *VerificationService) message(ctx context.Context, to, token string) notify.Message {
+	link := s.verifyURL + "?token=" + url.QueryEscape(token) + tenantQuery(ctx)
+	body := fmt.Sprintf("Please confirm your email address by opening this link within %s:\n\n%s\n", s.ttl, link)
+	return notify.Message{To: to, Subject: "Verify your email address", Body: body}
+}
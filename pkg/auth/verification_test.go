@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"context"
+	"net/url"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/tenant"
+	"simplecrud/pkg/user"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryVerificationRepository is an in-memory VerificationRepository used by the tests.
+type memoryVerificationRepository struct {
+	memoryUserFinder
+}
+
+// MarkEmailVerified sets the verified flag of the user if they still have the email.
+func (m *memoryVerificationRepository) MarkEmailVerified(ctx context.Context, id, email string) error {
+	for i := range m.memoryUserFinder {
+		if m.memoryUserFinder[i].ID.Hex() == id && m.memoryUserFinder[i].Email == email {
+			m.memoryUserFinder[i].EmailVerified = true
+			return nil
+		}
+	}
+	return user.ErrNotFound
+}
+
+// TestEmailVerification checks sending, resend rate limiting and redeeming verification links.
+func TestEmailVerification(t *testing.T) {
+	alice := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com"}
+	users := &memoryVerificationRepository{memoryUserFinder{alice}}
+	notifier := &memoryNotifier{}
+	service := NewVerificationService(users, &memoryActionTokenRepository{}, notifier, time.Hour, time.Minute, "https://api.example.com/auth/verify")
+	now := time.Now()
+	service.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	require.NoError(t, service.Send(ctx, alice))
+	require.Len(t, notifier.messages, 1)
+	assert.Equal(t, alice.Email, notifier.messages[0].To)
+	first := notifier.lastLine(t)
+	assert.Contains(t, first, "https://api.example.com/auth/verify?token=")
+
+	// Resending right away is refused, unknown emails are ignored
+	err := service.Send(ctx, alice)
+	var retryErr *RetryError
+	require.ErrorAs(t, err, &retryErr)
+	assert.ErrorIs(t, err, ErrVerificationResendTooSoon)
+	assert.Equal(t, time.Minute, retryErr.RetryAfter)
+	require.NoError(t, service.Resend(ctx, "nobody@example.com"))
+	assert.Len(t, notifier.messages, 1)
+
+	// Later a new link is sent and the previous one stops working
+	now = now.Add(time.Minute)
+	require.NoError(t, service.Resend(ctx, alice.Email))
+	require.Len(t, notifier.messages, 2)
+	second := notifier.lastLine(t)
+	_, err = service.Verify(ctx, tokenFromLink(first))
+	assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+
+	userID, err := service.Verify(ctx, tokenFromLink(second))
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID, userID)
+	assert.True(t, users.memoryUserFinder[0].EmailVerified)
+
+	// The link works only once, and verified users get no more emails
+	_, err = service.Verify(ctx, tokenFromLink(second))
+	assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+	now = now.Add(time.Minute)
+	require.NoError(t, service.Resend(ctx, alice.Email))
+	assert.Len(t, notifier.messages, 2)
+}
+
+// TestEmailVerificationAfterEmailChange checks that a link only verifies the address it was sent to.
+func TestEmailVerificationAfterEmailChange(t *testing.T) {
+	alice := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com"}
+	users := &memoryVerificationRepository{memoryUserFinder{alice}}
+	notifier := &memoryNotifier{}
+	service := NewVerificationService(users, &memoryActionTokenRepository{}, notifier, time.Hour, time.Minute, "https://api.example.com/auth/verify")
+	ctx := context.Background()
+
+	require.NoError(t, service.Send(ctx, alice))
+	users.memoryUserFinder[0].Email = "mallory@example.com"
+	_, err := service.Verify(ctx, tokenFromLink(notifier.lastLine(t)))
+	assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+	assert.False(t, users.memoryUserFinder[0].EmailVerified)
+}
+
+// TestEmailVerificationTenantLink checks that links sent to users of a tenant name the tenant, so
+// opening them looks the token up in the tenant's database.
+func TestEmailVerificationTenantLink(t *testing.T) {
+	alice := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com"}
+	users := &memoryVerificationRepository{memoryUserFinder{alice}}
+	notifier := &memoryNotifier{}
+	service := NewVerificationService(users, &memoryActionTokenRepository{}, notifier, time.Hour, time.Minute, "https://api.example.com/auth/verify")
+
+	require.NoError(t, service.Send(tenant.Isolate(context.Background(), "acme"), alice))
+	link, err := url.Parse(notifier.lastLine(t))
+	require.NoError(t, err)
+	assert.Equal(t, "acme", link.Query().Get(tenant.QueryParam))
+	_, err = service.Verify(context.Background(), tokenFromLink(link.String()))
+	assert.NoError(t, err)
+}
+
+// tokenFromLink returns the token query parameter of a verification link.
+func tokenFromLink(link string) string {
+	parsed, _ := url.Parse(link)
+	return parsed.Query().Get("token")
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const apiKeysCollection = "api_keys" // The MongoDB collection for API keys
+
+// APIKeyRepository represents the MongoDB repository for API keys
+type APIKeyRepository struct {
+	client     *mongo.Client // MongoDB client
+	database   string        // MongoDB database name
+	collection string        // MongoDB collection name
+}
+
+// NewAPIKeyRepository creates a new API key repository instance
+func NewAPIKeyRepository(client *mongo.Client, database string) *APIKeyRepository {
+	return &APIKeyRepository{
+		client:     client,
+		database:   database,
+		collection: apiKeysCollection,
+	}
+}
+
+// EnsureIndexes creates the indexes used by the API key repository.
+// Revoked and expired keys are kept, so they still show up when listing keys.
+func (r *APIKeyRepository) EnsureIndexes(ctx context.Context) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "key_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create api key indexes: %w", err)
+	}
+	return nil
+}
+
+// Create inserts a new API key into the MongoDB collection
+func (r *APIKeyRepository) Create(ctx context.Context, key models.APIKey) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	if _, err := collection.InsertOne(ctx, key); err != nil {
+		return fmt.Errorf("failed to create api key: %w", err)
+	}
+	return nil
+}
+
+// FindByHash finds an API key by the hash of the key
+func (r *APIKeyRepository) FindByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	var key models.APIKey
+	collection := r.client.Database(r.database).Collection(r.collection)
+	err := collection.FindOne(ctx, bson.M{"key_hash": keyHash}).Decode(&key)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.APIKey{}, auth.ErrAPIKeyNotFound
+		}
+		return models.APIKey{}, fmt.Errorf("failed to find api key: %w", err)
+	}
+
+	return key, nil
+}
+
+// FindAll returns every API key, newest first
+func (r *APIKeyRepository) FindAll(ctx context.Context) ([]models.APIKey, error) {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find api keys: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	keys := []models.APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, fmt.Errorf("failed to decode api keys: %w", err)
+	}
+	return keys, nil
+}
+
+// Revoke marks an API key as revoked, unless it already is
+func (r *APIKeyRepository) Revoke(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"_id":        id,
+		"revoked_at": bson.M{"$exists": false},
+	}, bson.M{
+		"$set": bson.M{"revoked_at": at},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return auth.ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// TouchLastUsed records when an API key was last used
+func (r *APIKeyRepository) TouchLastUsed(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"last_used_at": at},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record api key use: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	attemptsCollection = "login_attempts" // The MongoDB collection for failed login attempts
+	attemptsRetention  = 24 * time.Hour   // How long failed attempts are kept after the last one
+)
+
+// AttemptRepository represents the MongoDB repository for failed login attempts
+type AttemptRepository struct {
+	client     *mongo.Client // MongoDB client
+	database   string        // MongoDB database name
+	collection string        // MongoDB collection name
+}
+
+// NewAttemptRepository creates a new login attempt repository instance
+func NewAttemptRepository(client *mongo.Client, database string) *AttemptRepository {
+	return &AttemptRepository{
+		client:     client,
+		database:   database,
+		collection: attemptsCollection,
+	}
+}
+
+// EnsureIndexes creates the TTL index that forgets failed attempts after a quiet period
+func (r *AttemptRepository) EnsureIndexes(ctx context.Context) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "last_failed_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(attemptsRetention.Seconds())),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create login attempt indexes: %w", err)
+	}
+	return nil
+}
+
+// Get finds the failed attempts recorded for the key
+func (r *AttemptRepository) Get(ctx context.Context, key string) (models.LoginAttempt, error) {
+	var attempt models.LoginAttempt
+	collection := r.client.Database(r.database).Collection(r.collection)
+	err := collection.FindOne(ctx, bson.M{"_id": key}).Decode(&attempt)
+	if err != nil {
+		// Check if the error is a "not found" error.
+		if err == mongo.ErrNoDocuments {
+			return models.LoginAttempt{}, auth.ErrAttemptNotFound
+		}
+		return models.LoginAttempt{}, fmt.Errorf("failed to find login attempts: %w", err)
+	}
+
+	return attempt, nil
+}
+
+// RecordFailure atomically increments the failure counter of the key, creating it if needed,
+// and returns the updated document
+func (r *AttemptRepository) RecordFailure(ctx context.Context, key string, at time.Time) (models.LoginAttempt, error) {
+	var attempt models.LoginAttempt
+	collection := r.client.Database(r.database).Collection(r.collection)
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, bson.M{
+		"$inc": bson.M{"failed_count": 1},
+		"$set": bson.M{"last_failed_at": at},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&attempt)
+	if err != nil {
+		return models.LoginAttempt{}, fmt.Errorf("failed to record login attempt: %w", err)
+	}
+
+	return attempt, nil
+}
+
+// Lock locks the account of the key until the given time
+func (r *AttemptRepository) Lock(ctx context.Context, key string, until time.Time) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": key}, bson.M{
+		"$set": bson.M{"locked_until": until},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to lock account: %w", err)
+	}
+
+	return nil
+}
+
+// Reset removes the failed attempts and any lockout of the key
+func (r *AttemptRepository) Reset(ctx context.Context, key string) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	if _, err := collection.DeleteOne(ctx, bson.M{"_id": key}); err != nil {
+		return fmt.Errorf("failed to reset login attempts: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"simplecrud/pkg/models"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const auditCollection = "audit_events" // The MongoDB collection for audit events
+
+// AuditRepository represents the MongoDB repository for audit events
+type AuditRepository struct {
+	client     *mongo.Client // MongoDB client
+	database   string        // MongoDB database name
+	collection string        // MongoDB collection name
+}
+
+// NewAuditRepository creates a new audit repository instance
+func NewAuditRepository(client *mongo.Client, database string) *AuditRepository {
+	return &AuditRepository{
+		client:     client,
+		database:   database,
+		collection: auditCollection,
+	}
+}
+
+// Record inserts an audit event into the MongoDB collection
+func (r *AuditRepository) Record(ctx context.Context, event models.AuditEvent) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	if _, err := collection.InsertOne(ctx, event); err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+	return nil
+}
@@ -4,12 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"simplecrud/pkg/logging"
 	"simplecrud/pkg/vault"
 	"simplecrud/utils"
 	"time"
 
 	"github.com/hashicorp/vault/api"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -24,7 +25,8 @@ const (
 // ConnectWithRetries attempts to connect to MongoDB using credentials from Vault.
 // If the connection attempt fails, it retries up to maxRetries times,
 // using an exponential backoff strategy controlled by initialInterval and maxInterval.
-func ConnectWithRetries(vaultClient *api.Client) (*mongo.Client, string, error) {
+// The given options are applied on top of the connection settings, as in ConnectDB.
+func ConnectWithRetries(vaultClient *api.Client, opts ...*options.ClientOptions) (*mongo.Client, string, error) {
 	var mongoClient *mongo.Client
 	var dbName string
 	var err error
@@ -36,14 +38,18 @@ func ConnectWithRetries(vaultClient *api.Client) (*mongo.Client, string, error)
 		defer cancel()
 
 		// Attempt to connect to the database using Vault credentials.
-		mongoClient, dbName, err = ConnectDB(ctx, vaultClient)
+		mongoClient, dbName, err = ConnectDB(ctx, vaultClient, opts...)
 		if err == nil {
-			log.Printf("Connected to MongoDB! Database name: %s\n", dbName)
+			logging.Default().WithField("database", dbName).Info("Connected to MongoDB")
 			break
 		}
 
 		// Log the failure and prepare for the next attempt.
-		log.Printf("Failed to connect to database (attempt %d of %d): %v. Retrying in %v...\n", i, maxRetries, err, interval)
+		logging.Default().WithError(err).With(logging.Fields{
+			"attempt":     i,
+			"max_retries": maxRetries,
+			"retry_in":    interval.String(),
+		}).Warn("Failed to connect to database, retrying")
 		time.Sleep(interval)
 
 		// Double the delay for the next attempt, without exceeding maxInterval.
@@ -56,8 +62,9 @@ func ConnectWithRetries(vaultClient *api.Client) (*mongo.Client, string, error)
 	return mongoClient, dbName, err
 }
 
-// ConnectDB establishes a connection to the MongoDB database
-func ConnectDB(ctx context.Context, vaultClient *api.Client) (*mongo.Client, string, error) {
+// ConnectDB establishes a connection to the MongoDB database.
+// The given options, such as event monitors, are applied on top of the connection settings.
+func ConnectDB(ctx context.Context, vaultClient *api.Client, opts ...*options.ClientOptions) (*mongo.Client, string, error) {
 	// Get the secrets from vault
 	secretValues := vault.GetMongoDBSecret(vaultClient)
 
@@ -89,7 +96,7 @@ func ConnectDB(ctx context.Context, vaultClient *api.Client) (*mongo.Client, str
 		SetMaxConnIdleTime(30 * time.Minute) // Maximum idle time for a connection
 
 	// Connect to MongoDB with the specified settings
-	client, err := mongo.Connect(ctx, connectionOptions)
+	client, err := mongo.Connect(ctx, append([]*options.ClientOptions{connectionOptions}, opts...)...)
 	if err != nil {
 		return nil, "", fmt.Errorf("%s: %w", ErrDBConnection, err)
 	}
@@ -102,3 +109,31 @@ func ConnectDB(ctx context.Context, vaultClient *api.Client) (*mongo.Client, str
 
 	return client, dbName, nil
 }
+
+// CombineMonitors returns a command monitor passing every event to each of the given monitors, as the
+// MongoDB client accepts a single one. Nil monitors are skipped.
+func CombineMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				if m != nil && m.Started != nil {
+					m.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				if m != nil && m.Succeeded != nil {
+					m.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				if m != nil && m.Failed != nil {
+					m.Failed(ctx, e)
+				}
+			}
+		},
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"simplecrud/pkg/models"
 	pkguser "simplecrud/pkg/user"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const (
@@ -21,24 +23,64 @@ const (
 	ErrDBConnection = "failed to connect to MongoDB" // Error message for connection failure
 )
 
+// emailIndex is the name of the unique index on the email addresses of users.
+const emailIndex = "email_unique"
+
+// userProjection leaves the password history out of every user read; only FindPasswordHistory returns it.
+var userProjection = bson.M{"password_history": 0}
+
 // UserRepository represents the MongoDB repository for user operations
 type UserRepository struct {
 	client     *mongo.Client       // MongoDB client
-	database   string              // MongoDB database name
+	databases  DatabaseResolver    // Resolves the MongoDB database of each request
 	collection string              // MongoDB collection name
 	validate   *validator.Validate // Validator for user struct
 }
 
-// NewUserRepository creates a new user repository instance
-func NewUserRepository(client *mongo.Client, database string) pkguser.Repository {
+// NewUserRepository creates a new user repository instance.
+// Every operation works on the database the resolver returns for its context, so that in the database
+// tenancy mode a request only ever reaches the users of the tenant it is bound to. Besides user.Repository,
+// it implements the user storage needed by the MFA, email verification, OpenID Connect login and
+// organization membership services.
+func NewUserRepository(client *mongo.Client, databases DatabaseResolver) *UserRepository {
 	return &UserRepository{
 		client:     client,
-		database:   database,
+		databases:  databases,
 		collection: usersCollection,
 		validate:   validator.New(), // Initialize validator for user input validation
 	}
 }
 
+// EnsureUserIndexes creates the indexes of the user collection.
+// Email addresses are unique; they are stored normalized, see user.NormalizeEmail.
+// An external identity can only be linked to one user; users without identities are left out of the index.
+// Members are looked up by organization for the queries scoped to an organization.
+func EnsureUserIndexes(ctx context.Context, client *mongo.Client, database string) error {
+	collection := client.Database(database).Collection(usersCollection)
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true).SetName(emailIndex)},
+		{
+			Keys: bson.D{{Key: "identities.issuer", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"identities.subject": bson.M{"$exists": true}}),
+		},
+		{Keys: bson.D{{Key: "memberships.organization_id", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create user indexes: %w", err)
+	}
+	return nil
+}
+
+// users returns the user collection in the database of the request.
+func (r *UserRepository) users(ctx context.Context) (*mongo.Collection, error) {
+	database, err := r.databases.Resolve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve user database: %w", err)
+	}
+	return r.client.Database(database).Collection(r.collection), nil
+}
+
 // FindById finds a user by ID in the MongoDB collection
 func (r *UserRepository) FindById(ctx context.Context, id string) (models.User, error) {
 	objID, err := primitive.ObjectIDFromHex(id)
@@ -47,8 +89,11 @@ func (r *UserRepository) FindById(ctx context.Context, id string) (models.User,
 	}
 
 	var user models.User
-	collection := r.client.Database(r.database).Collection(r.collection)
-	err = collection.FindOne(ctx, bson.M{"_id": objID}).Decode(&user)
+	collection, err := r.users(ctx)
+	if err != nil {
+		return models.User{}, err
+	}
+	err = collection.FindOne(ctx, bson.M{"_id": objID}, options.FindOne().SetProjection(userProjection)).Decode(&user)
 	if err != nil {
 		// Check if the error is a "not found" error.
 		if err == mongo.ErrNoDocuments {
@@ -60,14 +105,77 @@ func (r *UserRepository) FindById(ctx context.Context, id string) (models.User,
 	return user, nil
 }
 
-// Create inserts a new user into the MongoDB collection
+// FindByEmail finds a user by email address in the MongoDB collection
+func (r *UserRepository) FindByEmail(ctx context.Context, email string) (models.User, error) {
+	var user models.User
+	collection, err := r.users(ctx)
+	if err != nil {
+		return models.User{}, err
+	}
+	err = collection.FindOne(ctx, bson.M{"email": pkguser.NormalizeEmail(email)}, options.FindOne().SetProjection(userProjection)).Decode(&user)
+	if err != nil {
+		// Check if the error is a "not found" error.
+		if err == mongo.ErrNoDocuments {
+			return models.User{}, pkguser.ErrNotFound
+		}
+		return models.User{}, fmt.Errorf("failed to find user: %w", err)
+	}
+
+	return user, nil
+}
+
+// validationError converts the field errors of the struct validator into a user.ValidationError,
+// so clients are told which fields were rejected. Other errors are returned unchanged.
+func validationError(err error) error {
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		return err
+	}
+	validationErr := &pkguser.ValidationError{}
+	for _, fieldErr := range fieldErrs {
+		code, message := pkguser.ViolationInvalid, "is invalid"
+		switch fieldErr.Tag() {
+		case "email":
+			message = "must be a valid email address"
+		case "min":
+			code, message = pkguser.ViolationTooShort, "must be at least "+fieldErr.Param()+" characters long"
+		case "gte":
+			message = "must be at least " + fieldErr.Param()
+		case "oneof":
+			message = "must be one of " + fieldErr.Param()
+		}
+		validationErr.Errors = append(validationErr.Errors, pkguser.FieldError{
+			Field: strings.ToLower(fieldErr.Field()), Code: code, Message: message,
+		})
+	}
+	return validationErr
+}
+
+// isDuplicateEmail reports whether the write failed because another user has the email address.
+func isDuplicateEmail(err error) bool {
+	return mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), emailIndex)
+}
+
+// Create inserts a new user into the MongoDB collection.
+// It returns user.ErrEmailTaken if another user has the email address.
 func (r *UserRepository) Create(ctx context.Context, user models.User) (models.User, error) {
+	user.Email = pkguser.NormalizeEmail(user.Email)
 	err := r.validate.Struct(user)
 	if err != nil {
-		return user, err
+		return user, validationError(err)
+	}
+	// Generate the ID here rather than in MongoDB, so it can be returned to the caller.
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	collection, err := r.users(ctx)
+	if err != nil {
+		return models.User{}, err
 	}
-	collection := r.client.Database(r.database).Collection(r.collection)
 	_, err = collection.InsertOne(ctx, user)
+	if isDuplicateEmail(err) {
+		return models.User{}, pkguser.ErrEmailTaken
+	}
 	if err != nil {
 		return models.User{}, fmt.Errorf("failed to create user: %w", err)
 	}
@@ -76,11 +184,15 @@ func (r *UserRepository) Create(ctx context.Context, user models.User) (models.U
 }
 
 // Update updates a user's details in the MongoDB collection.
+// It returns user.ErrEmailTaken if another user has the new email address.
 func (r *UserRepository) Update(ctx context.Context, id string, user models.User) (models.User, error) {
+	if user.Email != "" {
+		user.Email = pkguser.NormalizeEmail(user.Email)
+	}
 	// Validate the user struct to ensure it meets the required constraints.
 	err := r.validate.Struct(user)
 	if err != nil {
-		return user, err
+		return user, validationError(err)
 	}
 
 	// Convert the string ID to MongoDB's ObjectID type. Return an error if the conversion fails.
@@ -98,7 +210,9 @@ func (r *UserRepository) Update(ctx context.Context, id string, user models.User
 		updateMap["age"] = user.Age
 	}
 	if user.Email != "" {
+		// The verification state belongs to the address, so it is always written along with it.
 		updateMap["email"] = user.Email
+		updateMap["email_verified"] = user.EmailVerified
 	}
 	if user.Password != "" {
 		updateMap["password"] = user.Password
@@ -106,15 +220,24 @@ func (r *UserRepository) Update(ctx context.Context, id string, user models.User
 	if user.Address != "" {
 		updateMap["address"] = user.Address
 	}
+	if user.Role != "" {
+		updateMap["role"] = user.Role
+	}
 
 	// Get the user collection from the MongoDB client.
-	collection := r.client.Database(r.database).Collection(r.collection)
+	collection, err := r.users(ctx)
+	if err != nil {
+		return models.User{}, err
+	}
 
 	// Perform the update operation using MongoDB's UpdateOne method.
 	// The "$set" operator replaces the value of a field with the specified value.
 	_, err = collection.UpdateOne(ctx, bson.M{"_id": objID}, bson.M{
 		"$set": updateMap,
 	})
+	if isDuplicateEmail(err) {
+		return models.User{}, pkguser.ErrEmailTaken
+	}
 	if err != nil {
 		// Return an error if the update operation fails.
 		return models.User{}, fmt.Errorf("failed to update user: %w", err)
@@ -133,7 +256,10 @@ func (r *UserRepository) Delete(ctx context.Context, id string) error {
 	}
 
 	// Get the user collection from the MongoDB client.
-	collection := r.client.Database(r.database).Collection(r.collection)
+	collection, err := r.users(ctx)
+	if err != nil {
+		return err
+	}
 
 	// Perform the delete operation using MongoDB's DeleteOne method, targeting the user with the given ObjectID.
 	_, err = collection.DeleteOne(ctx, bson.M{"_id": objID})
@@ -148,14 +274,31 @@ func (r *UserRepository) Delete(ctx context.Context, id string) error {
 
 // FindAll retrieves all users from the MongoDB collection and returns them in a slice.
 func (r *UserRepository) FindAll(ctx context.Context) ([]models.User, error) {
+	return r.find(ctx, bson.M{})
+}
+
+// FindAllInOrganization retrieves the members of an organization.
+func (r *UserRepository) FindAllInOrganization(ctx context.Context, orgID string) ([]models.User, error) {
+	objID, err := primitive.ObjectIDFromHex(orgID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+	return r.find(ctx, bson.M{"memberships.organization_id": objID})
+}
+
+// find retrieves the users matching the filter and returns them in a slice.
+func (r *UserRepository) find(ctx context.Context, filter bson.M) ([]models.User, error) {
 	// Get the user collection from the MongoDB client.
-	collection := r.client.Database(r.database).Collection(r.collection)
+	collection, err := r.users(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	// Initialize an empty slice to hold the retrieved users.
 	var users []models.User
 
-	// Perform the find operation to retrieve all users from the collection.
-	cursor, err := collection.Find(ctx, bson.M{})
+	// Perform the find operation to retrieve the matching users from the collection.
+	cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(userProjection))
 	if err != nil {
 		// Return an error if the find operation fails.
 		return users, fmt.Errorf("failed to find users: %w", err)
@@ -183,3 +326,353 @@ func (r *UserRepository) FindAll(ctx context.Context) ([]models.User, error) {
 	// Return the users slice containing all retrieved users.
 	return users, nil
 }
+
+// SetMembership adds a user to the organization of the membership, or changes their role in it.
+func (r *UserRepository) SetMembership(ctx context.Context, userID string, membership models.Membership) error {
+	objID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+
+	collection, err := r.users(ctx)
+	if err != nil {
+		return err
+	}
+	// Change the role of an existing membership first; the filters keep a user from getting two
+	// memberships in the same organization if requests race.
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"_id":                         objID,
+		"memberships.organization_id": membership.OrganizationID,
+	}, bson.M{
+		"$set": bson.M{"memberships.$.role": membership.Role},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update membership: %w", err)
+	}
+	if result.MatchedCount == 1 {
+		return nil
+	}
+
+	result, err = collection.UpdateOne(ctx, bson.M{
+		"_id":                         objID,
+		"memberships.organization_id": bson.M{"$ne": membership.OrganizationID},
+	}, bson.M{
+		"$push": bson.M{"memberships": membership},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add membership: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return pkguser.ErrNotFound
+	}
+
+	return nil
+}
+
+// RemoveMembership removes a user from an organization.
+func (r *UserRepository) RemoveMembership(ctx context.Context, userID, orgID string) error {
+	objID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+	orgObjID, err := primitive.ObjectIDFromHex(orgID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+
+	collection, err := r.users(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": objID}, bson.M{
+		"$pull": bson.M{"memberships": bson.M{"organization_id": orgObjID}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove membership: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return pkguser.ErrNotFound
+	}
+
+	return nil
+}
+
+// RemoveOrganization removes every membership in an organization.
+func (r *UserRepository) RemoveOrganization(ctx context.Context, orgID string) error {
+	orgObjID, err := primitive.ObjectIDFromHex(orgID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+
+	collection, err := r.users(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = collection.UpdateMany(ctx, bson.M{"memberships.organization_id": orgObjID}, bson.M{
+		"$pull": bson.M{"memberships": bson.M{"organization_id": orgObjID}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove memberships: %w", err)
+	}
+
+	return nil
+}
+
+// CountByRole counts the users that have the given role.
+func (r *UserRepository) CountByRole(ctx context.Context, role string) (int64, error) {
+	// Get the user collection from the MongoDB client.
+	collection, err := r.users(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := collection.CountDocuments(ctx, bson.M{"role": role})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+
+	return count, nil
+}
+
+// MarkEmailVerified records that a user verified their email address, unless they changed it since.
+func (r *UserRepository) MarkEmailVerified(ctx context.Context, id, email string) error {
+	// Convert the string ID to MongoDB's ObjectID type. Return an error if the conversion fails.
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+
+	collection, err := r.users(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": objID, "email": email}, bson.M{
+		"$set": bson.M{"email_verified": true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify email: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return pkguser.ErrNotFound
+	}
+
+	return nil
+}
+
+// UpdatePassword replaces the password hash of a user.
+func (r *UserRepository) UpdatePassword(ctx context.Context, id, passwordHash string) error {
+	// Convert the string ID to MongoDB's ObjectID type. Return an error if the conversion fails.
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+
+	collection, err := r.users(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": objID}, bson.M{
+		"$set": bson.M{"password": passwordHash},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return pkguser.ErrNotFound
+	}
+
+	return nil
+}
+
+// ReplacePassword sets a new password hash and moves the current one to the front of the
+// password history, keeping at most historySize hashes. Both happen in one atomic update.
+func (r *UserRepository) ReplacePassword(ctx context.Context, id, passwordHash string, historySize int) error {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+
+	var update interface{} = bson.M{
+		"$set":   bson.M{"password": passwordHash},
+		"$unset": bson.M{"password_history": ""},
+	}
+	if historySize > 0 {
+		// An update pipeline lets the new history be computed from the current password.
+		// Field paths in a stage refer to the document before the stage, so "$password" is the old hash.
+		update = bson.A{bson.M{"$set": bson.M{
+			"password": passwordHash,
+			"password_history": bson.M{"$slice": bson.A{
+				bson.M{"$concatArrays": bson.A{
+					bson.A{"$password"},
+					bson.M{"$ifNull": bson.A{"$password_history", bson.A{}}},
+				}},
+				historySize,
+			}},
+		}}}
+	}
+
+	collection, err := r.users(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": objID}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return pkguser.ErrNotFound
+	}
+
+	return nil
+}
+
+// FindPasswordHistory returns the previous password hashes of a user, most recent first.
+func (r *UserRepository) FindPasswordHistory(ctx context.Context, id string) ([]string, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+
+	var document struct {
+		PasswordHistory []string `bson:"password_history"`
+	}
+	collection, err := r.users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = collection.FindOne(ctx, bson.M{"_id": objID},
+		options.FindOne().SetProjection(bson.M{"password_history": 1})).Decode(&document)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, pkguser.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to find password history: %w", err)
+	}
+
+	return document.PasswordHistory, nil
+}
+
+// FindByIdentity finds the user linked to an external identity
+func (r *UserRepository) FindByIdentity(ctx context.Context, issuer, subject string) (models.User, error) {
+	var user models.User
+	collection, err := r.users(ctx)
+	if err != nil {
+		return models.User{}, err
+	}
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": subject}}}
+	err = collection.FindOne(ctx, filter, options.FindOne().SetProjection(userProjection)).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.User{}, pkguser.ErrNotFound
+		}
+		return models.User{}, fmt.Errorf("failed to find user by identity: %w", err)
+	}
+
+	return user, nil
+}
+
+// LinkIdentity adds an external identity to a user whose email is verified. It returns ErrNotFound if
+// no such user exists, so an email that stopped being verified since it was checked is not linked.
+func (r *UserRepository) LinkIdentity(ctx context.Context, id string, identity models.ExternalIdentity) error {
+	// Convert the string ID to MongoDB's ObjectID type. Return an error if the conversion fails.
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+
+	collection, err := r.users(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": objID, "email_verified": true}, bson.M{
+		"$push": bson.M{"identities": identity},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to link identity: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return pkguser.ErrNotFound
+	}
+
+	return nil
+}
+
+// SetMFA replaces the multi-factor authentication settings of a user.
+func (r *UserRepository) SetMFA(ctx context.Context, id string, mfa models.MFA) error {
+	// Convert the string ID to MongoDB's ObjectID type. Return an error if the conversion fails.
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+
+	collection, err := r.users(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": objID}, bson.M{
+		"$set": bson.M{"mfa": mfa},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update mfa: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return pkguser.ErrNotFound
+	}
+
+	return nil
+}
+
+// ConsumeRecoveryCode atomically removes a recovery code hash from an enabled MFA configuration.
+// It reports whether the code was present.
+func (r *UserRepository) ConsumeRecoveryCode(ctx context.Context, id, codeHash string) (bool, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+
+	// Matching on the hash and pulling it in one update ensures a code is only ever used once.
+	collection, err := r.users(ctx)
+	if err != nil {
+		return false, err
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"_id":                objID,
+		"mfa.enabled":        true,
+		"mfa.recovery_codes": codeHash,
+	}, bson.M{
+		"$pull": bson.M{"mfa.recovery_codes": codeHash},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to consume recovery code: %w", err)
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+// MarkMFAStepUsed records the TOTP time step of an accepted code, unless the same or a later
+// step was already recorded. It reports whether the step was recorded.
+func (r *UserRepository) MarkMFAStepUsed(ctx context.Context, id string, step int64) (bool, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", ErrInvalidID, err)
+	}
+
+	collection, err := r.users(ctx)
+	if err != nil {
+		return false, err
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"_id": objID,
+		"$or": bson.A{
+			bson.M{"mfa.last_used_step": bson.M{"$exists": false}},
+			bson.M{"mfa.last_used_step": bson.M{"$lt": step}},
+		},
+	}, bson.M{
+		"$set": bson.M{"mfa.last_used_step": step},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to record mfa code: %w", err)
+	}
+
+	return result.ModifiedCount == 1, nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"os"
 	"simplecrud/pkg/models"
+	pkguser "simplecrud/pkg/user"
 	"testing"
 
 	"github.com/hashicorp/vault/api"
@@ -28,7 +29,7 @@ func setup() (*mongo.Client, string, error) {
 func TestCRUDOperations(t *testing.T) {
 	client, dbName, err := setup() // Setup database connection
 	require.NoError(t, err)
-	repo := NewUserRepository(client, dbName)
+	repo := NewUserRepository(client, SingleDatabase(dbName))
 
 	// Test Create
 	// Prepare a user object to be used in the CRUD operations test
@@ -76,3 +77,59 @@ func TestCRUDOperations(t *testing.T) {
 	err = repo.Delete(context.Background(), userIDFromDatabase)
 	require.NoError(t, err)
 }
+
+// TestPasswordHistory checks that replaced password hashes are kept, pruned and left out of user reads
+func TestPasswordHistory(t *testing.T) {
+	client, dbName, err := setup()
+	require.NoError(t, err)
+	repo := NewUserRepository(client, SingleDatabase(dbName))
+	ctx := context.Background()
+
+	user, err := repo.Create(ctx, models.User{Name: "HistoryUser", Email: "history@example.com", Password: "hash-0000"})
+	require.NoError(t, err)
+	id := user.ID.Hex()
+	defer repo.Delete(ctx, id)
+
+	for _, hash := range []string{"hash-1111", "hash-2222", "hash-3333"} {
+		require.NoError(t, repo.ReplacePassword(ctx, id, hash, 2))
+	}
+	history, err := repo.FindPasswordHistory(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, []string{"hash-2222", "hash-1111"}, history)
+
+	found, err := repo.FindById(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, "hash-3333", found.Password)
+
+	// A size of 0 drops the history
+	require.NoError(t, repo.ReplacePassword(ctx, id, "hash-4444", 0))
+	history, err = repo.FindPasswordHistory(ctx, id)
+	require.NoError(t, err)
+	require.Empty(t, history)
+}
+
+// TestUniqueEmails checks that email addresses are stored normalized and cannot be shared by two users
+func TestUniqueEmails(t *testing.T) {
+	client, dbName, err := setup()
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, EnsureUserIndexes(ctx, client, dbName))
+	repo := NewUserRepository(client, SingleDatabase(dbName))
+
+	alice, err := repo.Create(ctx, models.User{Name: "Alice", Email: " Alice@Example.com", Password: "hash-0000"})
+	require.NoError(t, err)
+	defer repo.Delete(ctx, alice.ID.Hex())
+	require.Equal(t, "alice@example.com", alice.Email)
+	found, err := repo.FindByEmail(ctx, "ALICE@example.com")
+	require.NoError(t, err)
+	require.Equal(t, alice.ID, found.ID)
+
+	// The same address in another case is taken, on creation and on update
+	_, err = repo.Create(ctx, models.User{Name: "Mallory", Email: "alice@EXAMPLE.com", Password: "hash-1111"})
+	require.ErrorIs(t, err, pkguser.ErrEmailTaken)
+	mallory, err := repo.Create(ctx, models.User{Name: "Mallory", Email: "mallory@example.com", Password: "hash-1111"})
+	require.NoError(t, err)
+	defer repo.Delete(ctx, mallory.ID.Hex())
+	_, err = repo.Update(ctx, mallory.ID.Hex(), models.User{Email: "Alice@example.com"})
+	require.ErrorIs(t, err, pkguser.ErrEmailTaken)
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/organization"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const organizationsCollection = "organizations" // The MongoDB collection for organizations
+
+// OrganizationRepository represents the MongoDB repository for organizations
+type OrganizationRepository struct {
+	client     *mongo.Client // MongoDB client
+	database   string        // MongoDB database name
+	collection string        // MongoDB collection name
+}
+
+// NewOrganizationRepository creates a new organization repository instance
+func NewOrganizationRepository(client *mongo.Client, database string) *OrganizationRepository {
+	return &OrganizationRepository{
+		client:     client,
+		database:   database,
+		collection: organizationsCollection,
+	}
+}
+
+// FindAll returns every organization, sorted by name
+func (r *OrganizationRepository) FindAll(ctx context.Context) ([]models.Organization, error) {
+	return r.find(ctx, bson.M{})
+}
+
+// FindByIds returns the organizations with the given IDs, sorted by name. Invalid IDs are skipped.
+func (r *OrganizationRepository) FindByIds(ctx context.Context, ids []string) ([]models.Organization, error) {
+	objIDs := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+			objIDs = append(objIDs, objID)
+		}
+	}
+	return r.find(ctx, bson.M{"_id": bson.M{"$in": objIDs}})
+}
+
+// find returns the organizations matching the filter, sorted by name
+func (r *OrganizationRepository) find(ctx context.Context, filter bson.M) ([]models.Organization, error) {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find organizations: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	orgs := []models.Organization{}
+	if err := cursor.All(ctx, &orgs); err != nil {
+		return nil, fmt.Errorf("failed to decode organizations: %w", err)
+	}
+	return orgs, nil
+}
+
+// FindById finds an organization by ID
+func (r *OrganizationRepository) FindById(ctx context.Context, id string) (models.Organization, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return models.Organization{}, organization.ErrNotFound
+	}
+
+	var org models.Organization
+	collection := r.client.Database(r.database).Collection(r.collection)
+	err = collection.FindOne(ctx, bson.M{"_id": objID}).Decode(&org)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.Organization{}, organization.ErrNotFound
+		}
+		return models.Organization{}, fmt.Errorf("failed to find organization: %w", err)
+	}
+
+	return org, nil
+}
+
+// Create inserts a new organization
+func (r *OrganizationRepository) Create(ctx context.Context, org models.Organization) (models.Organization, error) {
+	// Generate the ID here rather than in MongoDB, so it can be returned to the caller.
+	if org.ID.IsZero() {
+		org.ID = primitive.NewObjectID()
+	}
+	collection := r.client.Database(r.database).Collection(r.collection)
+	if _, err := collection.InsertOne(ctx, org); err != nil {
+		return models.Organization{}, fmt.Errorf("failed to create organization: %w", err)
+	}
+
+	return org, nil
+}
+
+// Update replaces the name and settings of an organization and returns the updated organization
+func (r *OrganizationRepository) Update(ctx context.Context, id string, org models.Organization) (models.Organization, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return models.Organization{}, organization.ErrNotFound
+	}
+
+	var updated models.Organization
+	collection := r.client.Database(r.database).Collection(r.collection)
+	err = collection.FindOneAndUpdate(ctx, bson.M{"_id": objID}, bson.M{
+		"$set": bson.M{"name": org.Name, "settings": org.Settings},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.Organization{}, organization.ErrNotFound
+		}
+		return models.Organization{}, fmt.Errorf("failed to update organization: %w", err)
+	}
+
+	return updated, nil
+}
+
+// Delete removes an organization
+func (r *OrganizationRepository) Delete(ctx context.Context, id string) error {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return organization.ErrNotFound
+	}
+
+	collection := r.client.Database(r.database).Collection(r.collection)
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": objID})
+	if err != nil {
+		return fmt.Errorf("failed to delete organization: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return organization.ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/ratelimit"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const rateLimitsCollection = "rate_limits" // The MongoDB collection for rate limit token buckets
+
+// RateLimitRepository represents the MongoDB repository for rate limit token buckets, so every
+// instance of the API takes tokens from the same buckets
+type RateLimitRepository struct {
+	client     *mongo.Client // MongoDB client
+	database   string        // MongoDB database name
+	collection string        // MongoDB collection name
+}
+
+// NewRateLimitRepository creates a new rate limit repository instance
+func NewRateLimitRepository(client *mongo.Client, database string) *RateLimitRepository {
+	return &RateLimitRepository{
+		client:     client,
+		database:   database,
+		collection: rateLimitsCollection,
+	}
+}
+
+// EnsureIndexes creates the TTL index that forgets the buckets once they are full again
+func (r *RateLimitRepository) EnsureIndexes(ctx context.Context) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create rate limit indexes: %w", err)
+	}
+	return nil
+}
+
+// Take refills the bucket of the key and takes a token from it in a single atomic update, creating
+// the bucket full if needed. Time is measured by the clock of the MongoDB server, so instances whose
+// clocks drift apart still agree on the tokens left.
+func (r *RateLimitRepository) Take(ctx context.Context, key string, policy ratelimit.Policy) (ratelimit.Result, error) {
+	burst := float64(policy.Burst)
+	elapsed := bson.M{"$divide": bson.A{
+		bson.M{"$subtract": bson.A{"$$NOW", bson.M{"$ifNull": bson.A{"$updated_at", "$$NOW"}}}},
+		1000,
+	}}
+	refilled := bson.M{"$min": bson.A{burst, bson.M{"$add": bson.A{
+		bson.M{"$ifNull": bson.A{"$tokens", burst}},
+		bson.M{"$multiply": bson.A{elapsed, policy.Rate}},
+	}}}}
+	fullAfter := bson.M{"$multiply": bson.A{bson.M{"$subtract": bson.A{burst, "$tokens"}}, 1000 / policy.Rate}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"tokens": refilled, "updated_at": "$$NOW"}}},
+		{{Key: "$set", Value: bson.M{"allowed": bson.M{"$gte": bson.A{"$tokens", 1}}}}},
+		{{Key: "$set", Value: bson.M{"tokens": bson.M{"$cond": bson.A{"$allowed", bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}}}}},
+		{{Key: "$set", Value: bson.M{"expires_at": bson.M{"$add": bson.A{"$$NOW", bson.M{"$toLong": fullAfter}}}}}},
+	}
+
+	var bucket models.RateLimitBucket
+	collection := r.client.Database(r.database).Collection(r.collection)
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&bucket)
+	if err != nil {
+		return ratelimit.Result{}, fmt.Errorf("failed to take rate limit token: %w", err)
+	}
+
+	return ratelimit.NewResult(policy, bucket.Tokens, bucket.Allowed), nil
+}
@@ -0,0 +1,44 @@
+package database
+
+import (
+	"context"
+	"simplecrud/pkg/ratelimit"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestRateLimitBuckets checks that instances sharing the database take tokens from the same buckets
+func TestRateLimitBuckets(t *testing.T) {
+	client, dbName, err := setup() // Setup database connection
+	require.NoError(t, err)
+	ctx := context.Background()
+	first, second := NewRateLimitRepository(client, dbName), NewRateLimitRepository(client, dbName)
+	require.NoError(t, first.EnsureIndexes(ctx))
+
+	// A slow policy, so the bucket does not refill during the test
+	policy, err := ratelimit.NewPolicy("test", 0.01, 2)
+	require.NoError(t, err)
+	key := "test|ip:192.0.2.1"
+	collection := client.Database(dbName).Collection(rateLimitsCollection)
+	_, err = collection.DeleteOne(ctx, bson.M{"_id": key})
+	require.NoError(t, err)
+	defer collection.DeleteOne(ctx, bson.M{"_id": key})
+
+	result, err := first.Take(ctx, key, policy)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 1, result.Remaining)
+
+	result, err = second.Take(ctx, key, policy)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+
+	result, err = first.Take(ctx, key, policy)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Positive(t, result.RetryAfter)
+}
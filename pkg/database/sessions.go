@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const sessionsCollection = "sessions" // The MongoDB collection for refresh token sessions
+
+// SessionRepository represents the MongoDB repository for refresh token sessions
+type SessionRepository struct {
+	client     *mongo.Client // MongoDB client
+	database   string        // MongoDB database name
+	collection string        // MongoDB collection name
+}
+
+// NewSessionRepository creates a new session repository instance
+func NewSessionRepository(client *mongo.Client, database string) *SessionRepository {
+	return &SessionRepository{
+		client:     client,
+		database:   database,
+		collection: sessionsCollection,
+	}
+}
+
+// EnsureIndexes creates the indexes used by the session repository.
+// The TTL index on expires_at lets MongoDB delete expired sessions on its own.
+func (r *SessionRepository) EnsureIndexes(ctx context.Context) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "family_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create session indexes: %w", err)
+	}
+	return nil
+}
+
+// Create inserts a new session into the MongoDB collection
+func (r *SessionRepository) Create(ctx context.Context, session models.Session) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	if _, err := collection.InsertOne(ctx, session); err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	return nil
+}
+
+// FindByTokenHash finds a session by the hash of its refresh token
+func (r *SessionRepository) FindByTokenHash(ctx context.Context, tokenHash string) (models.Session, error) {
+	var session models.Session
+	collection := r.client.Database(r.database).Collection(r.collection)
+	err := collection.FindOne(ctx, bson.M{"token_hash": tokenHash}).Decode(&session)
+	if err != nil {
+		// Check if the error is a "not found" error.
+		if err == mongo.ErrNoDocuments {
+			return models.Session{}, auth.ErrSessionNotFound
+		}
+		return models.Session{}, fmt.Errorf("failed to find session: %w", err)
+	}
+
+	return session, nil
+}
+
+// MarkRotated marks a session as rotated, but only if it is neither rotated nor revoked yet.
+// It reports whether a session was updated.
+func (r *SessionRepository) MarkRotated(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error) {
+	collection := r.client.Database(r.database).Collection(r.collection)
+
+	// The filter makes the check and the update a single atomic operation.
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"_id":        id,
+		"rotated_at": bson.M{"$exists": false},
+		"revoked_at": bson.M{"$exists": false},
+	}, bson.M{
+		"$set": bson.M{"rotated_at": at},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to rotate session: %w", err)
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+// RevokeFamily revokes every session that belongs to the given token family
+func (r *SessionRepository) RevokeFamily(ctx context.Context, familyID string, at time.Time) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	_, err := collection.UpdateMany(ctx, bson.M{
+		"family_id":  familyID,
+		"revoked_at": bson.M{"$exists": false},
+	}, bson.M{
+		"$set": bson.M{"revoked_at": at},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeAllForUser revokes every session of the given user
+func (r *SessionRepository) RevokeAllForUser(ctx context.Context, userID primitive.ObjectID, at time.Time) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	_, err := collection.UpdateMany(ctx, bson.M{
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+	}, bson.M{
+		"$set": bson.M{"revoked_at": at},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/organization"
+	"simplecrud/pkg/tenant"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	tenantsCollection    = "tenants" // The MongoDB collection for tenants
+	tenantDatabasePrefix = "tenant_" // Prefix of the names of tenant databases
+	// tenantCacheTTL is how long a tenant is used without checking that its organization still exists, so
+	// instances stop serving an organization deleted through another instance within this time.
+	tenantCacheTTL = time.Minute
+
+	// TenancyModeKey selects where users are stored: TenancyModeShared keeps every user in the
+	// DB_NAME database, TenancyModeDatabase gives every organization a database of its own.
+	TenancyModeKey      = "TENANCY_MODE"
+	TenancyModeShared   = "shared"
+	TenancyModeDatabase = "database"
+	DefaultTenancyMode  = TenancyModeShared
+)
+
+// ErrTenantIsolation is returned when a request would reach a database it is not allowed to use.
+var ErrTenantIsolation = errors.New("tenant isolation violated")
+
+// DatabaseResolver resolves the name of the database holding the users a request works on.
+type DatabaseResolver interface {
+	Resolve(ctx context.Context) (string, error)
+}
+
+// SingleDatabase keeps the users of every organization in the database with this name.
+type SingleDatabase string
+
+// Resolve returns the name of the database.
+func (d SingleDatabase) Resolve(ctx context.Context) (string, error) {
+	return string(d), nil
+}
+
+// TenantDatabases keeps the users of every organization in a database of its own, and the users
+// outside organizations in the platform database.
+type TenantDatabases struct {
+	platform string          // Name of the platform database
+	registry tenant.Registry // Maps tenants to their databases
+}
+
+// NewTenantDatabases creates a resolver using the tenant databases of the registry, and the platform
+// database for requests bound to no tenant.
+func NewTenantDatabases(platform string, registry tenant.Registry) *TenantDatabases {
+	return &TenantDatabases{platform: platform, registry: registry}
+}
+
+// Resolve returns the database of the tenant the request is bound to, or the platform database for
+// requests bound to no tenant. A tenant is never given the platform database.
+func (d *TenantDatabases) Resolve(ctx context.Context) (string, error) {
+	id, ok := tenant.FromContext(ctx)
+	if !ok {
+		return d.platform, nil
+	}
+	name, err := d.registry.Database(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if name == "" || name == d.platform {
+		return "", fmt.Errorf("%w: tenant %s resolved to database %q", ErrTenantIsolation, id, name)
+	}
+	return name, nil
+}
+
+// TenantRegistry stores the database of every tenant in the platform database. Every organization is a
+// tenant; it is registered, and its database provisioned, the first time it is used.
+type TenantRegistry struct {
+	client     *mongo.Client           // MongoDB client
+	database   string                  // MongoDB database name of the platform
+	collection string                  // MongoDB collection name
+	orgs       *OrganizationRepository // Organizations that may become tenants
+
+	mu        sync.Mutex
+	databases map[string]cachedTenant // Tenants whose indexes exist, by tenant ID
+}
+
+// cachedTenant is the database of a tenant, known to exist until the entry expires.
+type cachedTenant struct {
+	database string
+	expires  time.Time
+}
+
+// NewTenantRegistry creates a new tenant registry instance
+func NewTenantRegistry(client *mongo.Client, database string) *TenantRegistry {
+	return &TenantRegistry{
+		client:     client,
+		database:   database,
+		collection: tenantsCollection,
+		orgs:       NewOrganizationRepository(client, database),
+		databases:  make(map[string]cachedTenant),
+	}
+}
+
+// EnsureIndexes creates the index keeping two tenants from sharing a database.
+func (r *TenantRegistry) EnsureIndexes(ctx context.Context) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "database", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create tenant indexes: %w", err)
+	}
+	return nil
+}
+
+// Database returns the name of the database of the tenant with the given ID. Organizations used for the
+// first time are registered, and the indexes of their database created. It returns tenant.ErrUnknownTenant
+// if no organization has the ID, including organizations deleted since they were registered.
+func (r *TenantRegistry) Database(ctx context.Context, id string) (string, error) {
+	r.mu.Lock()
+	cached, indexed := r.databases[id]
+	r.mu.Unlock()
+	if indexed && time.Now().Before(cached.expires) {
+		return cached.database, nil
+	}
+
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return "", tenant.ErrUnknownTenant
+	}
+	t, err := r.register(ctx, objID)
+	if err != nil {
+		return "", err
+	}
+
+	// Concurrent first requests may both create the indexes; creating existing indexes does nothing.
+	if !indexed {
+		if err := EnsureUserIndexes(ctx, r.client, t.Database); err != nil {
+			return "", err
+		}
+	}
+	r.mu.Lock()
+	r.databases[id] = cachedTenant{database: t.Database, expires: time.Now().Add(tenantCacheTTL)}
+	r.mu.Unlock()
+	return t.Database, nil
+}
+
+// Remove forgets the tenant with the given ID, once its organization is deleted. Its database is kept.
+func (r *TenantRegistry) Remove(ctx context.Context, id string) error {
+	r.mu.Lock()
+	delete(r.databases, id)
+	r.mu.Unlock()
+
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return tenant.ErrUnknownTenant
+	}
+	collection := r.client.Database(r.database).Collection(r.collection)
+	if _, err := collection.DeleteOne(ctx, bson.M{"_id": objID}); err != nil {
+		return fmt.Errorf("failed to remove tenant: %w", err)
+	}
+	return nil
+}
+
+// register returns the tenant of the organization with the given ID, recording its database unless
+// another request did first. It returns tenant.ErrUnknownTenant if the organization does not exist.
+func (r *TenantRegistry) register(ctx context.Context, id primitive.ObjectID) (models.Tenant, error) {
+	if _, err := r.orgs.FindById(ctx, id.Hex()); err != nil {
+		if errors.Is(err, organization.ErrNotFound) {
+			return models.Tenant{}, tenant.ErrUnknownTenant
+		}
+		return models.Tenant{}, err
+	}
+
+	t := models.Tenant{ID: id, Database: tenantDatabasePrefix + id.Hex(), CreatedAt: time.Now()}
+	collection := r.client.Database(r.database).Collection(r.collection)
+	var registered models.Tenant
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$setOnInsert": t},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&registered)
+	if err != nil {
+		return models.Tenant{}, fmt.Errorf("failed to register tenant: %w", err)
+	}
+	return registered, nil
+}
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/tenant"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryRegistry is an in-memory tenant.Registry.
+type memoryRegistry map[string]string
+
+func (m memoryRegistry) Database(ctx context.Context, id string) (string, error) {
+	name, ok := m[id]
+	if !ok {
+		return "", tenant.ErrUnknownTenant
+	}
+	return name, nil
+}
+
+func (m memoryRegistry) Remove(ctx context.Context, id string) error {
+	delete(m, id)
+	return nil
+}
+
+// TestTenantDatabases checks that requests only resolve to the database of the tenant they are bound to.
+func TestTenantDatabases(t *testing.T) {
+	resolver := NewTenantDatabases("platform", memoryRegistry{"acme": "tenant_acme", "rogue": "platform"})
+
+	// Requests bound to no tenant, isolated or not, use the platform database
+	name, err := resolver.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "platform", name)
+	name, err = resolver.Resolve(tenant.Isolate(context.Background(), ""))
+	require.NoError(t, err)
+	assert.Equal(t, "platform", name)
+
+	acme := tenant.Isolate(context.Background(), "acme")
+	name, err = resolver.Resolve(acme)
+	require.NoError(t, err)
+	assert.Equal(t, "tenant_acme", name)
+
+	// A request bound to a tenant cannot be moved to another one
+	_, err = tenant.Bind(acme, "globex")
+	assert.ErrorIs(t, err, tenant.ErrTenantMismatch)
+	_, err = tenant.Bind(acme, "")
+	assert.ErrorIs(t, err, tenant.ErrTenantMismatch)
+
+	_, err = resolver.Resolve(tenant.Isolate(context.Background(), "globex"))
+	assert.ErrorIs(t, err, tenant.ErrUnknownTenant)
+	_, err = resolver.Resolve(tenant.Isolate(context.Background(), "rogue"))
+	assert.ErrorIs(t, err, ErrTenantIsolation, "a tenant never gets the platform database")
+}
+
+// TestTenantRegistry checks that organizations become tenants when first used, and stop being tenants
+// once they are deleted.
+func TestTenantRegistry(t *testing.T) {
+	client, dbName, err := setup()
+	require.NoError(t, err)
+	ctx := context.Background()
+	registry := NewTenantRegistry(client, dbName)
+	orgs := NewOrganizationRepository(client, dbName)
+
+	acme, err := orgs.Create(ctx, models.Organization{Name: "Acme"})
+	require.NoError(t, err)
+	defer orgs.Delete(ctx, acme.ID.Hex())
+	name, err := registry.Database(ctx, acme.ID.Hex())
+	require.NoError(t, err)
+	defer client.Database(name).Drop(ctx)
+	assert.Equal(t, "tenant_"+acme.ID.Hex(), name)
+
+	_, err = registry.Database(ctx, primitive.NewObjectID().Hex())
+	assert.ErrorIs(t, err, tenant.ErrUnknownTenant)
+
+	require.NoError(t, orgs.Delete(ctx, acme.ID.Hex()))
+	require.NoError(t, registry.Remove(ctx, acme.ID.Hex()))
+	_, err = registry.Database(ctx, acme.ID.Hex())
+	assert.ErrorIs(t, err, tenant.ErrUnknownTenant)
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const actionTokensCollection = "action_tokens" // The MongoDB collection for single-use action tokens
+
+// ActionTokenRepository represents the MongoDB repository for single-use action tokens
+type ActionTokenRepository struct {
+	client     *mongo.Client // MongoDB client
+	database   string        // MongoDB database name
+	collection string        // MongoDB collection name
+}
+
+// NewActionTokenRepository creates a new action token repository instance
+func NewActionTokenRepository(client *mongo.Client, database string) *ActionTokenRepository {
+	return &ActionTokenRepository{
+		client:     client,
+		database:   database,
+		collection: actionTokensCollection,
+	}
+}
+
+// EnsureIndexes creates the indexes used by the action token repository.
+// The TTL index on expires_at lets MongoDB delete expired tokens on its own.
+func (r *ActionTokenRepository) EnsureIndexes(ctx context.Context) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "purpose", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create action token indexes: %w", err)
+	}
+	return nil
+}
+
+// Create inserts a new action token into the MongoDB collection
+func (r *ActionTokenRepository) Create(ctx context.Context, token models.ActionToken) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	if _, err := collection.InsertOne(ctx, token); err != nil {
+		return fmt.Errorf("failed to create action token: %w", err)
+	}
+	return nil
+}
+
+// Consume atomically marks an unused and unexpired token as used and returns it
+func (r *ActionTokenRepository) Consume(ctx context.Context, tokenHash, purpose string, at time.Time) (models.ActionToken, error) {
+	collection := r.client.Database(r.database).Collection(r.collection)
+
+	var token models.ActionToken
+	err := collection.FindOneAndUpdate(ctx, bson.M{
+		"token_hash": tokenHash,
+		"purpose":    purpose,
+		"used_at":    bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": at},
+	}, bson.M{
+		"$set": bson.M{"used_at": at},
+	}).Decode(&token)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return token, auth.ErrActionTokenNotFound
+		}
+		return token, fmt.Errorf("failed to consume action token: %w", err)
+	}
+
+	return token, nil
+}
+
+// Release marks a used token as unused again
+func (r *ActionTokenRepository) Release(ctx context.Context, tokenHash, purpose string) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	_, err := collection.UpdateOne(ctx, bson.M{
+		"token_hash": tokenHash,
+		"purpose":    purpose,
+		"used_at":    bson.M{"$exists": true},
+	}, bson.M{
+		"$unset": bson.M{"used_at": ""},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release action token: %w", err)
+	}
+	return nil
+}
+
+// DeleteForUser removes every token of the user with the given purpose
+func (r *ActionTokenRepository) DeleteForUser(ctx context.Context, userID primitive.ObjectID, purpose string) error {
+	collection := r.client.Database(r.database).Collection(r.collection)
+	_, err := collection.DeleteMany(ctx, bson.M{"user_id": userID, "purpose": purpose})
+	if err != nil {
+		return fmt.Errorf("failed to delete action tokens: %w", err)
+	}
+	return nil
+}
+
+// LatestForUser returns the most recently created token of the user with the given purpose
+func (r *ActionTokenRepository) LatestForUser(ctx context.Context, userID primitive.ObjectID, purpose string) (models.ActionToken, error) {
+	collection := r.client.Database(r.database).Collection(r.collection)
+
+	var token models.ActionToken
+	opts := options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	err := collection.FindOne(ctx, bson.M{"user_id": userID, "purpose": purpose}, opts).Decode(&token)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return token, auth.ErrActionTokenNotFound
+		}
+		return token, fmt.Errorf("failed to find action token: %w", err)
+	}
+
+	return token, nil
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/problem"
+	user "simplecrud/pkg/user"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APIKeyHandler handles the admin requests to manage API keys
+type APIKeyHandler struct {
+	keys *auth.APIKeyService
+}
+
+// apiKeyCreateRequest is the expected body of an API key creation
+type apiKeyCreateRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required,min=1"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// apiKeyCreateResponse is returned once when an API key is created; the key cannot be retrieved later
+type apiKeyCreateResponse struct {
+	Key    string        `json:"key"`
+	APIKey models.APIKey `json:"api_key"`
+}
+
+// NewAPIKeyHandler initializes a new APIKeyHandler
+func NewAPIKeyHandler(keys *auth.APIKeyService) *APIKeyHandler {
+	return &APIKeyHandler{keys: keys}
+}
+
+// CreateAPIKey handles the HTTP request to create an API key. The key is only part of this response.
+func (a *APIKeyHandler) CreateAPIKey(c *gin.Context) {
+	var req apiKeyCreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	principal, _ := user.PrincipalFromContext(c)
+	key, apiKey, err := a.keys.Create(c, req.Name, req.Scopes, req.ExpiresAt, principal.UserID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, apiKeyCreateResponse{Key: key, APIKey: apiKey})
+}
+
+// ListAPIKeys handles the HTTP request to list every API key, without the keys themselves
+func (a *APIKeyHandler) ListAPIKeys(c *gin.Context) {
+	keys, err := a.keys.List(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// RevokeAPIKey handles the HTTP request to revoke an API key
+func (a *APIKeyHandler) RevokeAPIKey(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.Error(problem.New(http.StatusBadRequest, "Invalid API key ID"))
+		return
+	}
+
+	principal, _ := user.PrincipalFromContext(c)
+	if err := a.keys.Revoke(c, id, principal.UserID); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/middleware"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/user"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// apiKeyRepoMock is an in-memory auth.APIKeyRepository for handler tests
+type apiKeyRepoMock struct {
+	keys []models.APIKey
+}
+
+// Create stores the API key
+func (m *apiKeyRepoMock) Create(ctx context.Context, key models.APIKey) error {
+	m.keys = append(m.keys, key)
+	return nil
+}
+
+// FindByHash returns the API key with the given hash
+func (m *apiKeyRepoMock) FindByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	for _, key := range m.keys {
+		if key.KeyHash == keyHash {
+			return key, nil
+		}
+	}
+	return models.APIKey{}, auth.ErrAPIKeyNotFound
+}
+
+// FindAll returns every API key
+func (m *apiKeyRepoMock) FindAll(ctx context.Context) ([]models.APIKey, error) {
+	return m.keys, nil
+}
+
+// Revoke marks an unrevoked API key as revoked
+func (m *apiKeyRepoMock) Revoke(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	for i, key := range m.keys {
+		if key.ID == id && key.RevokedAt == nil {
+			m.keys[i].RevokedAt = &at
+			return nil
+		}
+	}
+	return auth.ErrAPIKeyNotFound
+}
+
+// TouchLastUsed does nothing
+func (m *apiKeyRepoMock) TouchLastUsed(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	return nil
+}
+
+// TestAPIKeys defines the tests for creating, listing and revoking API keys
+func TestAPIKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	repo := &apiKeyRepoMock{}
+	apiKeyHandler := NewAPIKeyHandler(auth.NewAPIKeyService(repo, nil))
+	router := gin.Default()
+	router.Use(middleware.Errors())
+	router.ContextWithFallback = true
+	router.POST("/api-keys", withPrincipal("507f1f77bcf86cd799439011"), apiKeyHandler.CreateAPIKey)
+	router.GET("/api-keys", apiKeyHandler.ListAPIKeys)
+	router.DELETE("/api-keys/:id", withPrincipal("507f1f77bcf86cd799439011"), apiKeyHandler.RevokeAPIKey)
+
+	// Unknown scopes and missing fields are rejected
+	response := postJSON(router, "/api-keys", gin.H{"name": "batch", "scopes": []string{"users:everything"}})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = postJSON(router, "/api-keys", gin.H{"name": "batch"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	// The key is returned once, along with its details
+	response = postJSON(router, "/api-keys", gin.H{"name": "batch", "scopes": []string{auth.ScopeUsersRead}})
+	require.Equal(t, http.StatusCreated, response.Code)
+	var created struct {
+		Key    string        `json:"key"`
+		APIKey models.APIKey `json:"api_key"`
+	}
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &created))
+	assert.NotEmpty(t, created.Key)
+	assert.Equal(t, "507f1f77bcf86cd799439011", created.APIKey.CreatedBy)
+
+	// Listing never shows the key or its hash
+	response = httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/api-keys", nil)
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), created.APIKey.Prefix)
+	assert.NotContains(t, response.Body.String(), created.Key)
+	assert.NotContains(t, response.Body.String(), repo.keys[0].KeyHash)
+
+	revoke := func(id string) int {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodDelete, "/api-keys/"+id, nil)
+		router.ServeHTTP(response, request)
+		return response.Code
+	}
+	assert.Equal(t, http.StatusNoContent, revoke(created.APIKey.ID.Hex()))
+	assert.Equal(t, http.StatusNotFound, revoke(created.APIKey.ID.Hex()))
+	assert.Equal(t, http.StatusBadRequest, revoke("not-an-id"))
+}
+
+// userRepoMock is an in-memory user.Repository holding the users needed by API key tests.
+// Methods the tests do not need are left to the embedded nil interface.
+type userRepoMock struct {
+	user.Repository
+	users map[string]models.User
+}
+
+// FindById returns the user with the given ID
+func (m *userRepoMock) FindById(ctx context.Context, id string) (models.User, error) {
+	u, ok := m.users[id]
+	if !ok {
+		return models.User{}, user.ErrNotFound
+	}
+	return u, nil
+}
+
+// Create stores the user with a new ID
+func (m *userRepoMock) Create(ctx context.Context, u models.User) (models.User, error) {
+	u.ID = primitive.NewObjectID()
+	m.users[u.ID.Hex()] = u
+	return u, nil
+}
+
+// Update replaces the name of the user
+func (m *userRepoMock) Update(ctx context.Context, id string, u models.User) (models.User, error) {
+	existing := m.users[id]
+	existing.Name = u.Name
+	m.users[id] = existing
+	return existing, nil
+}
+
+// TestAPIKeyPermissions defines the tests for what a key with the users:write scope may do: it manages
+// regular users, but cannot assign roles or lift lockouts
+func TestAPIKeyPermissions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keys := auth.NewAPIKeyService(&apiKeyRepoMock{}, nil)
+	key, _, err := keys.Create(context.Background(), "provisioning", []string{auth.ScopeUsersWrite}, nil, "507f1f77bcf86cd799439011")
+	require.NoError(t, err)
+	alice := models.User{ID: primitive.NewObjectID(), Name: "Alice", Email: "alice@example.com", Role: user.RoleUser}
+	repo := &userRepoMock{users: map[string]models.User{alice.ID.Hex(): alice}}
+	service := user.NewService(repo, nil, user.BcryptHasher{Cost: 4}, user.DefaultPasswordPolicy())
+	userHandler := NewUserHandler(service, nil)
+	authHandler := NewAuthHandler(service, newTestTokenManager(t), newTestSessionService(), newTestLoginGuard(), nil)
+
+	router := gin.New()
+	router.Use(middleware.Errors())
+	router.ContextWithFallback = true
+	writeUsers := middleware.RequireAuthOrAPIKey(newTestTokenManager(t), keys, auth.ScopeUsersWrite)
+	router.POST("/users", writeUsers, userHandler.CreateUser)
+	router.PUT("/users/:id", writeUsers, userHandler.UpdateUser)
+	router.POST("/users/:id/unlock", writeUsers, authHandler.UnlockUser)
+	request := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		response := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "ApiKey "+key)
+		router.ServeHTTP(response, req)
+		return response
+	}
+	newUser := gin.H{"name": "Bob", "age": 30, "email": "bob@example.com", "password": "Correct-Horse-42", "address": "1 Main St"}
+
+	// Regular users can be created and updated
+	response := request(http.MethodPost, "/users", newUser)
+	assert.Equal(t, http.StatusCreated, response.Code, response.Body.String())
+	response = request(http.MethodPut, "/users/"+alice.ID.Hex(), gin.H{"name": "Alicia"})
+	assert.Equal(t, http.StatusOK, response.Code, response.Body.String())
+
+	// Roles cannot be assigned, on creation or afterwards
+	newUser["role"] = user.RoleAdmin
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/users", newUser).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPut, "/users/"+alice.ID.Hex(), gin.H{"role": user.RoleAdmin}).Code)
+	assert.Equal(t, user.RoleUser, repo.users[alice.ID.Hex()].Role)
+
+	// Lockouts can only be lifted by admins
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/users/"+alice.ID.Hex()+"/unlock", nil).Code)
+}
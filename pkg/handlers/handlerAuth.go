@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/problem"
+	"simplecrud/pkg/tenant"
+	user "simplecrud/pkg/user"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuthHandler struct holds the services needed to authenticate users and issue tokens
+type AuthHandler struct {
+	userService user.Service
+	tokens      *auth.TokenManager
+	sessions    *auth.SessionService
+	guard       *auth.LoginGuard
+	mfa         *auth.MFAService
+}
+
+// loginRequest is the expected body of a login request
+type loginRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+}
+
+// refreshRequest is the expected body of refresh and logout requests
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// switchOrganizationRequest is the expected body when switching organization.
+// An empty organization ID switches to acting outside any organization.
+type switchOrganizationRequest struct {
+	OrganizationID string `json:"organization_id"`
+}
+
+// accessTokenResponse is the body returned with a new access token for the same session
+type accessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"` // Lifetime of the access token in seconds
+}
+
+// tokenResponse is the body returned after a successful login or refresh
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"` // Lifetime of the access token in seconds
+	RefreshToken string `json:"refresh_token"`
+}
+
+// NewAuthHandler initializes a new AuthHandler
+func NewAuthHandler(userService user.Service, tokens *auth.TokenManager, sessions *auth.SessionService, guard *auth.LoginGuard, mfa *auth.MFAService) *AuthHandler {
+	return &AuthHandler{
+		userService: userService,
+		tokens:      tokens,
+		sessions:    sessions,
+		guard:       guard,
+		mfa:         mfa,
+	}
+}
+
+// Login handles the HTTP request to authenticate a user with email and password.
+// On success it returns a short-lived signed access token and a refresh token starting a new session.
+// If the user has MFA enabled, it instead returns an MFA token to complete the login with LoginMFA.
+// Repeated failures for the same account are slowed down and eventually lock the account.
+func (a *AuthHandler) Login(c *gin.Context) {
+	var req loginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	// Refuse the attempt while the account is locked or still in its delay period.
+	if err := a.guard.Check(c, req.Email); err != nil {
+		respondRetry(c, err)
+		return
+	}
+
+	usuario, err := a.userService.Authenticate(c, req.Email, req.Password)
+	if err != nil {
+		if errors.Is(err, user.ErrInvalidCredentials) {
+			if err := a.guard.Failure(c, req.Email, c.ClientIP()); err != nil {
+				logging.FromContext(c).WithError(err).Error("Failed to record failed login")
+			}
+			c.Error(problem.New(http.StatusUnauthorized, "Invalid email or password"))
+		} else {
+			c.Error(err)
+		}
+		return
+	}
+
+	// With MFA enabled the password alone is not enough; the failed attempts are only
+	// cleared once the second factor is verified too.
+	if auth.MFAEnabled(usuario) {
+		challenge, err := a.tokens.IssueMFAChallenge(usuario)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, mfaChallengeResponse{MFARequired: true, MFAToken: challenge})
+		return
+	}
+
+	if err := a.guard.Success(c, req.Email); err != nil {
+		logging.FromContext(c).WithError(err).Error("Failed to reset failed logins")
+	}
+
+	refreshToken, err := a.sessions.Start(c, usuario.ID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	a.respondWithTokens(c, usuario, refreshToken)
+}
+
+// Refresh handles the HTTP request to exchange a refresh token for a new access token.
+// The refresh token is rotated: the old one stops working and a new one is returned.
+// Presenting a token that was already rotated revokes every token of that session.
+func (a *AuthHandler) Refresh(c *gin.Context) {
+	var req refreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	userID, refreshToken, err := a.sessions.Rotate(c, req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidRefreshToken) || errors.Is(err, auth.ErrRefreshTokenReused) {
+			c.Error(problem.New(http.StatusUnauthorized, "Invalid or expired refresh token"))
+		} else {
+			c.Error(err)
+		}
+		return
+	}
+
+	// The refresh token proves the caller is this user, so look them up as themselves.
+	ctx := user.WithPrincipal(c, user.Principal{UserID: userID.Hex()})
+	usuario, err := a.userService.GetUser(ctx, userID.Hex())
+	if err != nil {
+		if errors.Is(err, user.ErrNotFound) {
+			c.Error(problem.New(http.StatusUnauthorized, "Invalid or expired refresh token"))
+		} else {
+			c.Error(err)
+		}
+		return
+	}
+
+	a.respondWithTokens(c, usuario, refreshToken)
+}
+
+// Logout handles the HTTP request to end a session.
+// Every refresh token of the session is revoked; access tokens already issued expire on their own.
+func (a *AuthHandler) Logout(c *gin.Context) {
+	var req refreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	if err := a.sessions.Revoke(c, req.RefreshToken); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// SwitchOrganization handles the HTTP request to act in another organization of the caller.
+// It returns a new access token for that organization; the refresh token is unchanged, and refreshing
+// returns to the caller's first organization.
+func (a *AuthHandler) SwitchOrganization(c *gin.Context) {
+	var req switchOrganizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	// When tenants are isolated, the caller cannot leave the tenant their request is bound to.
+	if _, err := tenant.Bind(c, req.OrganizationID); err != nil {
+		c.Error(problem.New(http.StatusForbidden, "Organizations cannot be switched when tenants are isolated"))
+		return
+	}
+
+	// Read the caller's current memberships as themselves, outside the organization they act in.
+	principal, _ := user.PrincipalFromContext(c)
+	ctx := user.WithPrincipal(c, user.Principal{UserID: principal.UserID})
+	usuario, err := a.userService.GetUser(ctx, principal.UserID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	token, _, err := a.tokens.IssueForOrganization(usuario, req.OrganizationID)
+	if err != nil {
+		if errors.Is(err, auth.ErrNotMember) {
+			c.Error(problem.New(http.StatusForbidden, "You are not a member of this organization"))
+		} else {
+			c.Error(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, accessTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(a.tokens.TTL().Seconds()),
+	})
+}
+
+// respondWithTokens issues an access token for the user and writes it together with the refresh token.
+func (a *AuthHandler) respondWithTokens(c *gin.Context, usuario models.User, refreshToken string) {
+	writeTokens(c, a.tokens, usuario, refreshToken)
+}
+
+// writeTokens issues an access token for the user with the token manager and writes it together with the refresh token.
+// When tenants are isolated, the token acts in the tenant of the request, which the user must be a member of.
+func writeTokens(c *gin.Context, tokens *auth.TokenManager, usuario models.User, refreshToken string) {
+	token, _, err := tokens.IssueForOrganization(usuario, auth.OrganizationFor(c, usuario))
+	if err != nil {
+		if errors.Is(err, auth.ErrNotMember) {
+			c.Error(problem.New(http.StatusForbidden, "You are not a member of this organization"))
+		} else {
+			c.Error(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, tokenResponse{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(tokens.TTL().Seconds()),
+		RefreshToken: refreshToken,
+	})
+}
+
+// UnlockUser handles the HTTP request from an admin to lift the lockout of a user's account.
+// API keys are refused even with the users:write scope.
+func (a *AuthHandler) UnlockUser(c *gin.Context) {
+	principal, _ := user.PrincipalFromContext(c)
+	if !principal.IsAdmin() {
+		c.Error(user.ErrForbidden)
+		return
+	}
+	id := c.Param("id")
+	if id == "" {
+		c.Error(problem.New(http.StatusBadRequest, "User ID is required in the request"))
+		return
+	}
+
+	usuario, err := a.userService.GetUser(c, id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if err := a.guard.Unlock(c, usuario.Email, principal.UserID); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// respondRetry writes a 429 response with a Retry-After header for a locked or throttled login.
+func respondRetry(c *gin.Context, err error) {
+	var retry *auth.RetryError
+	if !errors.As(err, &retry) {
+		c.Error(err)
+		return
+	}
+
+	// Round up so clients never retry a moment too early.
+	seconds := int64(math.Ceil(retry.RetryAfter.Seconds()))
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	if errors.Is(err, auth.ErrAccountLocked) {
+		c.Error(problem.New(http.StatusTooManyRequests, "Account temporarily locked after too many failed logins"))
+	} else {
+		c.Error(problem.New(http.StatusTooManyRequests, "Too many login attempts, try again later"))
+	}
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/middleware"
+	"simplecrud/pkg/models"
+	user "simplecrud/pkg/user"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sessionRepoMock is an in-memory session repository used for the auth handler tests
+type sessionRepoMock struct {
+	mu       sync.Mutex
+	sessions []models.Session
+}
+
+// Create stores a new session with a fresh ID
+func (m *sessionRepoMock) Create(ctx context.Context, session models.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session.ID = primitive.NewObjectID()
+	m.sessions = append(m.sessions, session)
+	return nil
+}
+
+// FindByTokenHash returns the session with the given token hash
+func (m *sessionRepoMock) FindByTokenHash(ctx context.Context, tokenHash string) (models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, session := range m.sessions {
+		if session.TokenHash == tokenHash {
+			return session, nil
+		}
+	}
+	return models.Session{}, auth.ErrSessionNotFound
+}
+
+// MarkRotated marks the session as rotated if it is still active
+func (m *sessionRepoMock) MarkRotated(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i].ID == id && m.sessions[i].RotatedAt == nil && m.sessions[i].RevokedAt == nil {
+			m.sessions[i].RotatedAt = &at
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RevokeFamily revokes every session in the family
+func (m *sessionRepoMock) RevokeFamily(ctx context.Context, familyID string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i].FamilyID == familyID {
+			m.sessions[i].RevokedAt = &at
+		}
+	}
+	return nil
+}
+
+// RevokeAllForUser revokes every session of the user
+func (m *sessionRepoMock) RevokeAllForUser(ctx context.Context, userID primitive.ObjectID, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i].UserID == userID {
+			m.sessions[i].RevokedAt = &at
+		}
+	}
+	return nil
+}
+
+// attemptRepoMock is an in-memory login attempt repository used for the auth handler tests
+type attemptRepoMock struct {
+	mu       sync.Mutex
+	attempts map[string]models.LoginAttempt
+}
+
+// Get returns the attempts recorded for the key
+func (m *attemptRepoMock) Get(ctx context.Context, key string) (models.LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attempt, ok := m.attempts[key]
+	if !ok {
+		return models.LoginAttempt{}, auth.ErrAttemptNotFound
+	}
+	return attempt, nil
+}
+
+// RecordFailure increments the failure counter of the key
+func (m *attemptRepoMock) RecordFailure(ctx context.Context, key string, at time.Time) (models.LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attempt := m.attempts[key]
+	attempt.FailedCount++
+	attempt.LastFailedAt = at
+	m.attempts[key] = attempt
+	return attempt, nil
+}
+
+// Lock locks the key until the given time
+func (m *attemptRepoMock) Lock(ctx context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attempt := m.attempts[key]
+	attempt.LockedUntil = &until
+	m.attempts[key] = attempt
+	return nil
+}
+
+// Reset forgets the key
+func (m *attemptRepoMock) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+// newTestLoginGuard creates a LoginGuard that locks after two failures, without delays between attempts
+func newTestLoginGuard() *auth.LoginGuard {
+	policy := auth.LockoutPolicy{Threshold: 2, LockoutDuration: time.Minute}
+	return auth.NewLoginGuard(&attemptRepoMock{attempts: map[string]models.LoginAttempt{}}, policy, nil)
+}
+
+// newTestSessionService creates a SessionService backed by an in-memory repository
+func newTestSessionService() *auth.SessionService {
+	return auth.NewSessionService(&sessionRepoMock{}, time.Hour)
+}
+
+// newTestTokenManager creates a TokenManager with a fixed key for handler tests
+func newTestTokenManager(t *testing.T) *auth.TokenManager {
+	tokens, err := auth.NewTokenManager([]byte("0123456789abcdef0123456789abcdef"), 15*time.Minute)
+	require.NoError(t, err)
+	return tokens
+}
+
+// TestLoginSuccess defines the tests for a successful Login request
+func TestLoginSuccess(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockUserService := new(userServiceMock)
+	tokens := newTestTokenManager(t)
+	authHandler := NewAuthHandler(mockUserService, tokens, newTestSessionService(), newTestLoginGuard(), nil)
+	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	usuario := models.User{ID: objectID, Name: "JohnDoe", Email: "john@example.com"}
+
+	mockUserService.On("Authenticate", "john@example.com", "P@ssword123").Return(usuario, nil)
+	router := gin.Default()
+	router.Use(middleware.Errors())
+	router.POST("/auth/login", authHandler.Login)
+	payload, _ := json.Marshal(gin.H{"email": "john@example.com", "password": "P@ssword123"})
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(payload))
+	request.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	mockUserService.AssertExpectations(t)
+
+	// The returned token must be valid and issued for the authenticated user
+	var body tokenResponse
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+	assert.Equal(t, "Bearer", body.TokenType)
+	assert.Equal(t, int64(900), body.ExpiresIn)
+	claims, err := tokens.Parse(body.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, objectID.Hex(), claims.Subject)
+	assert.NotEmpty(t, body.RefreshToken)
+}
+
+// TestLoginError defines the tests for rejected Login requests
+func TestLoginError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockUserService := new(userServiceMock)
+	authHandler := NewAuthHandler(mockUserService, newTestTokenManager(t), newTestSessionService(), newTestLoginGuard(), nil)
+
+	mockUserService.On("Authenticate", "john@example.com", "wrong").Return(models.User{}, user.ErrInvalidCredentials)
+	router := gin.Default()
+	router.Use(middleware.Errors())
+	router.POST("/auth/login", authHandler.Login)
+
+	// Wrong credentials
+	payload, _ := json.Marshal(gin.H{"email": "john@example.com", "password": "wrong"})
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(payload))
+	request.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	mockUserService.AssertExpectations(t)
+
+	// Missing password
+	payload, _ = json.Marshal(gin.H{"email": "john@example.com"})
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(payload))
+	request.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+// postJSON sends a JSON POST request to the router and returns the recorded response
+func postJSON(router *gin.Engine, path string, body interface{}) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+	request.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(response, request)
+	return response
+}
+
+// TestRefreshAndLogout defines the tests for rotating refresh tokens, reuse detection and logout
+func TestRefreshAndLogout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockUserService := new(userServiceMock)
+	authHandler := NewAuthHandler(mockUserService, newTestTokenManager(t), newTestSessionService(), newTestLoginGuard(), nil)
+	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	usuario := models.User{ID: objectID, Name: "JohnDoe", Email: "john@example.com"}
+
+	mockUserService.On("Authenticate", "john@example.com", "P@ssword123").Return(usuario, nil)
+	mockUserService.On("GetUser", objectID.Hex()).Return(usuario, nil)
+	router := gin.Default()
+	router.Use(middleware.Errors())
+	router.POST("/auth/login", authHandler.Login)
+	router.POST("/auth/refresh", authHandler.Refresh)
+	router.POST("/auth/logout", authHandler.Logout)
+
+	// Login to get the first refresh token
+	response := postJSON(router, "/auth/login", gin.H{"email": "john@example.com", "password": "P@ssword123"})
+	assert.Equal(t, http.StatusOK, response.Code)
+	var login tokenResponse
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &login))
+
+	// Refresh returns a new access token and a rotated refresh token
+	response = postJSON(router, "/auth/refresh", gin.H{"refresh_token": login.RefreshToken})
+	assert.Equal(t, http.StatusOK, response.Code)
+	var refreshed tokenResponse
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &refreshed))
+	assert.NotEmpty(t, refreshed.AccessToken)
+	assert.NotEqual(t, login.RefreshToken, refreshed.RefreshToken)
+
+	// Reusing the first refresh token is rejected and revokes the rotated one too
+	response = postJSON(router, "/auth/refresh", gin.H{"refresh_token": login.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	response = postJSON(router, "/auth/refresh", gin.H{"refresh_token": refreshed.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// Logout revokes a fresh session
+	response = postJSON(router, "/auth/login", gin.H{"email": "john@example.com", "password": "P@ssword123"})
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &login))
+	response = postJSON(router, "/auth/logout", gin.H{"refresh_token": login.RefreshToken})
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = postJSON(router, "/auth/refresh", gin.H{"refresh_token": login.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	mockUserService.AssertExpectations(t)
+}
+
+// TestLoginLockout defines the tests for locking an account after failed logins and unlocking it
+func TestLoginLockout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockUserService := new(userServiceMock)
+	authHandler := NewAuthHandler(mockUserService, newTestTokenManager(t), newTestSessionService(), newTestLoginGuard(), nil)
+	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	usuario := models.User{ID: objectID, Name: "JohnDoe", Email: "john@example.com"}
+
+	mockUserService.On("Authenticate", "john@example.com", "wrong").Return(models.User{}, user.ErrInvalidCredentials)
+	mockUserService.On("GetUser", objectID.Hex()).Return(usuario, nil)
+	router := gin.Default()
+	router.Use(middleware.Errors())
+	router.ContextWithFallback = true
+	router.POST("/auth/login", authHandler.Login)
+	router.POST("/users/:id/unlock", func(c *gin.Context) {
+		c.Request = c.Request.WithContext(user.WithPrincipal(c.Request.Context(), user.Principal{UserID: "507f1f77bcf86cd799439012", Role: user.RoleAdmin}))
+		c.Next()
+	}, authHandler.UnlockUser)
+
+	// Two failures lock the account
+	for i := 0; i < 2; i++ {
+		response := postJSON(router, "/auth/login", gin.H{"email": "john@example.com", "password": "wrong"})
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	}
+	response := postJSON(router, "/auth/login", gin.H{"email": "john@example.com", "password": "wrong"})
+	assert.Equal(t, http.StatusTooManyRequests, response.Code)
+	assert.Equal(t, "60", response.Header().Get("Retry-After"))
+
+	// Unlocking lets the user try again
+	response = postJSON(router, "/users/"+objectID.Hex()+"/unlock", nil)
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = postJSON(router, "/auth/login", gin.H{"email": "john@example.com", "password": "wrong"})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	mockUserService.AssertExpectations(t)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/problem"
+	user "simplecrud/pkg/user"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ImpersonationHandler handles the admin requests to act as another user
+type ImpersonationHandler struct {
+	impersonation *auth.ImpersonationService
+}
+
+// impersonationRequest is the expected body of an impersonation request.
+// ExpiresIn is the lifetime of the token in seconds; it defaults to the maximum lifetime.
+type impersonationRequest struct {
+	Reason    string `json:"reason" binding:"required"`
+	ExpiresIn int64  `json:"expires_in" binding:"gte=0"`
+}
+
+// impersonationResponse is the body returned with an impersonation token. No refresh token is issued.
+type impersonationResponse struct {
+	AccessToken    string    `json:"access_token"`
+	TokenType      string    `json:"token_type"`
+	ExpiresIn      int64     `json:"expires_in"` // Lifetime of the access token in seconds
+	ExpiresAt      time.Time `json:"expires_at"`
+	ImpersonatorID string    `json:"impersonator_id"`
+	SubjectID      string    `json:"subject_id"`
+}
+
+// NewImpersonationHandler initializes a new ImpersonationHandler
+func NewImpersonationHandler(impersonation *auth.ImpersonationService) *ImpersonationHandler {
+	return &ImpersonationHandler{impersonation: impersonation}
+}
+
+// Impersonate handles the HTTP request from an admin to get a short-lived access token acting as another user.
+// The reason is kept in the audit log, and every request made with the token is audited.
+func (i *ImpersonationHandler) Impersonate(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		c.Error(problem.New(http.StatusBadRequest, "Invalid user ID"))
+		return
+	}
+	var req impersonationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	principal, _ := user.PrincipalFromContext(c)
+	token, expiresAt, err := i.impersonation.Start(c, principal.UserID, id, req.Reason, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, impersonationResponse{
+		AccessToken:    token,
+		TokenType:      "Bearer",
+		ExpiresIn:      int64(time.Until(expiresAt).Round(time.Second).Seconds()),
+		ExpiresAt:      expiresAt.UTC(),
+		ImpersonatorID: principal.UserID,
+		SubjectID:      id,
+	})
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/middleware"
+	"simplecrud/pkg/models"
+	user "simplecrud/pkg/user"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestImpersonate defines the tests for issuing impersonation tokens
+func TestImpersonate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	adminID := primitive.NewObjectID().Hex()
+	alice := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com", Role: user.RoleUser}
+	root := models.User{ID: primitive.NewObjectID(), Email: "root@example.com", Role: user.RoleAdmin}
+	tokens := newTestTokenManager(t)
+	handler := NewImpersonationHandler(auth.NewImpersonationService(tokens, userFinderMock{alice, root}, nil, 10*time.Minute, false))
+
+	router := gin.New()
+	router.Use(middleware.Errors())
+	router.ContextWithFallback = true
+	router.POST("/users/:id/impersonate", func(c *gin.Context) {
+		c.Request = c.Request.WithContext(user.WithPrincipal(c.Request.Context(), user.Principal{UserID: adminID, Role: user.RoleAdmin}))
+		c.Next()
+	}, handler.Impersonate)
+
+	response := postJSON(router, "/users/"+alice.ID.Hex()+"/impersonate", gin.H{"reason": "ticket 42"})
+	require.Equal(t, http.StatusCreated, response.Code, response.Body.String())
+	var body impersonationResponse
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+	assert.Equal(t, int64(600), body.ExpiresIn)
+	assert.Equal(t, adminID, body.ImpersonatorID)
+	claims, err := tokens.Parse(body.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID.Hex(), claims.Subject)
+	assert.Equal(t, adminID, claims.ImpersonatorID())
+
+	// A reason is required and the lifetime is capped
+	assert.Equal(t, http.StatusBadRequest, postJSON(router, "/users/"+alice.ID.Hex()+"/impersonate", gin.H{}).Code)
+	assert.Equal(t, http.StatusBadRequest, postJSON(router, "/users/"+alice.ID.Hex()+"/impersonate", gin.H{"reason": "ticket 42", "expires_in": 3600}).Code)
+
+	// Admins, unknown users and oneself cannot be impersonated
+	assert.Equal(t, http.StatusForbidden, postJSON(router, "/users/"+root.ID.Hex()+"/impersonate", gin.H{"reason": "ticket 42"}).Code)
+	assert.Equal(t, http.StatusNotFound, postJSON(router, "/users/"+primitive.NewObjectID().Hex()+"/impersonate", gin.H{"reason": "ticket 42"}).Code)
+	assert.Equal(t, http.StatusBadRequest, postJSON(router, "/users/"+adminID+"/impersonate", gin.H{"reason": "ticket 42"}).Code)
+	assert.Equal(t, http.StatusBadRequest, postJSON(router, "/users/not-an-id/impersonate", gin.H{"reason": "ticket 42"}).Code)
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/problem"
+	user "simplecrud/pkg/user"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mfaChallengeResponse is the body returned by Login when a second factor is required
+type mfaChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// mfaLoginRequest is the expected body of the second login step.
+// Either a TOTP code or a recovery code must be given.
+type mfaLoginRequest struct {
+	MFAToken     string `json:"mfa_token" binding:"required"`
+	Code         string `json:"code" binding:"required_without=RecoveryCode"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// mfaConfirmRequest is the expected body of an enrollment confirmation
+type mfaConfirmRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// LoginMFA handles the second step of a login for users with MFA enabled.
+// It exchanges the MFA token from Login plus a TOTP or recovery code for access and refresh tokens.
+func (a *AuthHandler) LoginMFA(c *gin.Context) {
+	var req mfaLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	claims, err := a.tokens.ParseMFAChallenge(req.MFAToken)
+	if err != nil {
+		c.Error(problem.New(http.StatusUnauthorized, "Invalid or expired MFA token"))
+		return
+	}
+
+	// Wrong codes count as failed logins of the account, just like wrong passwords.
+	if err := a.guard.Check(c, claims.Email); err != nil {
+		respondRetry(c, err)
+		return
+	}
+
+	// The MFA token proves the caller passed the password step as this user.
+	ctx := user.WithPrincipal(c, user.Principal{UserID: claims.Subject})
+	usuario, err := a.userService.GetUser(ctx, claims.Subject)
+	if err != nil {
+		if errors.Is(err, user.ErrNotFound) {
+			c.Error(problem.New(http.StatusUnauthorized, "Invalid or expired MFA token"))
+		} else {
+			c.Error(err)
+		}
+		return
+	}
+
+	if err := a.mfa.Verify(c, usuario, req.Code, req.RecoveryCode); err != nil {
+		if errors.Is(err, auth.ErrInvalidMFACode) || errors.Is(err, auth.ErrMFANotEnrolled) {
+			if err := a.guard.Failure(c, claims.Email, c.ClientIP()); err != nil {
+				logging.FromContext(c).WithError(err).Error("Failed to record failed login")
+			}
+			c.Error(problem.New(http.StatusUnauthorized, "Invalid authentication code"))
+		} else {
+			c.Error(err)
+		}
+		return
+	}
+
+	if err := a.guard.Success(c, claims.Email); err != nil {
+		logging.FromContext(c).WithError(err).Error("Failed to reset failed logins")
+	}
+
+	refreshToken, err := a.sessions.Start(c, usuario.ID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	a.respondWithTokens(c, usuario, refreshToken)
+}
+
+// EnrollMFA handles the HTTP request to start TOTP enrollment for the authenticated user.
+// It returns the secret and an otpauth:// URI to add to an authenticator app.
+// MFA is only enabled once the enrollment is confirmed with ConfirmMFA.
+func (a *AuthHandler) EnrollMFA(c *gin.Context) {
+	principal, ok := user.PrincipalFromContext(c)
+	if !ok {
+		c.Error(problem.New(http.StatusUnauthorized, "Authentication required"))
+		return
+	}
+
+	secret, uri, err := a.mfa.Enroll(c, principal.UserID)
+	if err != nil {
+		if errors.Is(err, auth.ErrMFAAlreadyEnabled) {
+			c.Error(problem.New(http.StatusConflict, "Multi-factor authentication is already enabled"))
+		} else {
+			c.Error(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_uri": uri})
+}
+
+// ConfirmMFA handles the HTTP request to finish TOTP enrollment with a code from the authenticator app.
+// It returns the one-time recovery codes, which are shown only this once.
+func (a *AuthHandler) ConfirmMFA(c *gin.Context) {
+	principal, ok := user.PrincipalFromContext(c)
+	if !ok {
+		c.Error(problem.New(http.StatusUnauthorized, "Authentication required"))
+		return
+	}
+
+	var req mfaConfirmRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	codes, err := a.mfa.Confirm(c, principal.UserID, req.Code)
+	if err != nil {
+		if errors.Is(err, auth.ErrMFAAlreadyEnabled) {
+			c.Error(problem.New(http.StatusConflict, "Multi-factor authentication is already enabled"))
+		} else if errors.Is(err, auth.ErrMFANotEnrolled) {
+			c.Error(problem.New(http.StatusBadRequest, "Start enrollment before confirming it"))
+		} else if errors.Is(err, auth.ErrInvalidMFACode) {
+			c.Error(problem.New(http.StatusBadRequest, "Invalid authentication code"))
+		} else {
+			c.Error(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
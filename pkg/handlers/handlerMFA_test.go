@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/middleware"
+	"simplecrud/pkg/models"
+	user "simplecrud/pkg/user"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// mfaRepoMock is an in-memory MFA repository holding a single user, used for the MFA handler tests
+type mfaRepoMock struct {
+	mu   sync.Mutex
+	user models.User
+}
+
+// FindById returns the user
+func (m *mfaRepoMock) FindById(ctx context.Context, id string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.user, nil
+}
+
+// SetMFA replaces the MFA settings of the user
+func (m *mfaRepoMock) SetMFA(ctx context.Context, id string, mfa models.MFA) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.user.MFA = &mfa
+	return nil
+}
+
+// ConsumeRecoveryCode removes the code hash if present
+func (m *mfaRepoMock) ConsumeRecoveryCode(ctx context.Context, id, codeHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, hash := range m.user.MFA.RecoveryCodes {
+		if hash == codeHash {
+			m.user.MFA.RecoveryCodes = append(m.user.MFA.RecoveryCodes[:i], m.user.MFA.RecoveryCodes[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MarkMFAStepUsed records the step if it is newer than the last used one
+func (m *mfaRepoMock) MarkMFAStepUsed(ctx context.Context, id string, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if step <= m.user.MFA.LastUsedStep {
+		return false, nil
+	}
+	m.user.MFA.LastUsedStep = step
+	return true, nil
+}
+
+// newTestMFAService creates an MFAService with a fixed encryption key backed by the repository
+func newTestMFAService(t *testing.T, repo auth.MFARepository) *auth.MFAService {
+	box, err := auth.NewSecretBox([]byte("fedcba9876543210fedcba9876543210"))
+	require.NoError(t, err)
+	return auth.NewMFAService(repo, box)
+}
+
+// withPrincipal returns a middleware authenticating every request as the given user
+func withPrincipal(id string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(user.WithPrincipal(c.Request.Context(), user.Principal{UserID: id, Role: user.RoleUser}))
+		c.Next()
+	}
+}
+
+// TestMFAEnrollment defines the tests for starting and confirming MFA enrollment
+func TestMFAEnrollment(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	repo := &mfaRepoMock{user: models.User{ID: objectID, Name: "JohnDoe", Email: "john@example.com"}}
+	authHandler := NewAuthHandler(new(userServiceMock), newTestTokenManager(t), newTestSessionService(), newTestLoginGuard(), newTestMFAService(t, repo))
+	router := gin.Default()
+	router.Use(middleware.Errors())
+	router.ContextWithFallback = true
+	router.POST("/auth/mfa/confirm", withPrincipal(objectID.Hex()), authHandler.ConfirmMFA)
+	router.POST("/auth/mfa/enroll", withPrincipal(objectID.Hex()), authHandler.EnrollMFA)
+
+	// Confirming before enrolling is rejected
+	response := postJSON(router, "/auth/mfa/confirm", gin.H{"code": "123456"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	// Enrolling returns the secret and the URI for authenticator apps
+	response = postJSON(router, "/auth/mfa/enroll", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var enrollment struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &enrollment))
+	assert.NotEmpty(t, enrollment.Secret)
+	assert.Contains(t, enrollment.OTPAuthURI, "otpauth://totp/")
+	assert.False(t, auth.MFAEnabled(repo.user))
+
+	// A wrong code does not enable MFA
+	response = postJSON(router, "/auth/mfa/confirm", gin.H{"code": "abcdef"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.False(t, auth.MFAEnabled(repo.user))
+
+	// Enrolling again once MFA is enabled is a conflict
+	repo.user.MFA.Enabled = true
+	response = postJSON(router, "/auth/mfa/enroll", nil)
+	assert.Equal(t, http.StatusConflict, response.Code)
+}
+
+// TestLoginMFA defines the tests for the second login step of users with MFA enabled
+func TestLoginMFA(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockUserService := new(userServiceMock)
+	tokens := newTestTokenManager(t)
+	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	usuario := models.User{
+		ID:    objectID,
+		Name:  "JohnDoe",
+		Email: "john@example.com",
+		MFA:   &models.MFA{Enabled: true, RecoveryCodes: []string{auth.HashToken("abcde12345")}},
+	}
+	repo := &mfaRepoMock{user: usuario}
+	authHandler := NewAuthHandler(mockUserService, tokens, newTestSessionService(), newTestLoginGuard(), newTestMFAService(t, repo))
+
+	mockUserService.On("Authenticate", "john@example.com", "P@ssword123").Return(usuario, nil)
+	mockUserService.On("GetUser", objectID.Hex()).Return(usuario, nil)
+	router := gin.Default()
+	router.Use(middleware.Errors())
+	router.POST("/auth/login", authHandler.Login)
+	router.POST("/auth/login/mfa", authHandler.LoginMFA)
+
+	// The password alone only yields an MFA token, which is not an access token
+	response := postJSON(router, "/auth/login", gin.H{"email": "john@example.com", "password": "P@ssword123"})
+	assert.Equal(t, http.StatusOK, response.Code)
+	var challenge mfaChallengeResponse
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &challenge))
+	assert.True(t, challenge.MFARequired)
+	_, err := tokens.Parse(challenge.MFAToken)
+	assert.Error(t, err)
+
+	// Missing code and wrong code are rejected
+	response = postJSON(router, "/auth/login/mfa", gin.H{"mfa_token": challenge.MFAToken})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = postJSON(router, "/auth/login/mfa", gin.H{"mfa_token": challenge.MFAToken, "recovery_code": "wrong"})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// A recovery code completes the login once
+	response = postJSON(router, "/auth/login/mfa", gin.H{"mfa_token": challenge.MFAToken, "recovery_code": "ABCDE-12345"})
+	assert.Equal(t, http.StatusOK, response.Code)
+	var body tokenResponse
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+	claims, err := tokens.Parse(body.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, objectID.Hex(), claims.Subject)
+	assert.NotEmpty(t, body.RefreshToken)
+
+	response = postJSON(router, "/auth/login/mfa", gin.H{"mfa_token": challenge.MFAToken, "recovery_code": "ABCDE-12345"})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// An access token cannot be used as an MFA token
+	response = postJSON(router, "/auth/login/mfa", gin.H{"mfa_token": body.AccessToken, "recovery_code": "abcde12345"})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	mockUserService.AssertExpectations(t)
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/problem"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// oidcFlowCookie keeps the signed state of a login at the identity provider until the callback.
+	oidcFlowCookie = "oidc_flow"
+	// oidcCookiePath limits the flow cookie to the OIDC login routes.
+	oidcCookiePath = "/auth/oidc"
+)
+
+// OIDCHandler handles logins with an OpenID Connect identity provider
+type OIDCHandler struct {
+	oidc     *auth.OIDCService
+	tokens   *auth.TokenManager
+	sessions *auth.SessionService
+}
+
+// NewOIDCHandler initializes a new OIDCHandler
+func NewOIDCHandler(oidc *auth.OIDCService, tokens *auth.TokenManager, sessions *auth.SessionService) *OIDCHandler {
+	return &OIDCHandler{
+		oidc:     oidc,
+		tokens:   tokens,
+		sessions: sessions,
+	}
+}
+
+// Login handles the HTTP request to start a login with the identity provider.
+// It redirects the browser to the provider and keeps the state of the login in a short-lived cookie.
+func (o *OIDCHandler) Login(c *gin.Context) {
+	authURL, flow, err := o.oidc.Begin(c)
+	if err != nil {
+		logging.FromContext(c).WithError(err).Error("Failed to start OIDC login")
+		c.Error(problem.New(http.StatusBadGateway, "Identity provider unavailable"))
+		return
+	}
+
+	// SameSite=Lax still sends the cookie on the top-level redirect back from the provider.
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcFlowCookie, flow, int(auth.OIDCFlowTTL.Seconds()), oidcCookiePath, "", o.oidc.SecureCookies(), true)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// Callback handles the redirect back from the identity provider. It completes the login started by Login
+// and returns access and refresh tokens like a password login, or an MFA token if the user enabled MFA.
+func (o *OIDCHandler) Callback(c *gin.Context) {
+	flow, _ := c.Cookie(oidcFlowCookie)
+	// The flow can only be completed once.
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcFlowCookie, "", -1, oidcCookiePath, "", o.oidc.SecureCookies(), true)
+
+	// The error code comes from the query string, so it is logged but never answered.
+	if providerError := c.Query("error"); providerError != "" {
+		logging.FromContext(c).WithField("provider_error", providerError).Warn("OIDC login refused by the identity provider")
+		c.Error(problem.New(http.StatusUnauthorized, "Login refused by the identity provider"))
+		return
+	}
+	if flow == "" {
+		c.Error(problem.New(http.StatusBadRequest, "Login expired or was started in another browser"))
+		return
+	}
+
+	usuario, err := o.oidc.Complete(c, flow, c.Query("state"), c.Query("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrInvalidOIDCFlow):
+			c.Error(problem.New(http.StatusBadRequest, "Login expired or was started in another browser"))
+		case errors.Is(err, auth.ErrOIDCExchange), errors.Is(err, auth.ErrInvalidIDToken):
+			logging.FromContext(c).WithError(err).Warn("OIDC login failed")
+			c.Error(problem.New(http.StatusUnauthorized, "Login with the identity provider failed"))
+		case errors.Is(err, auth.ErrEmailNotVerified):
+			c.Error(problem.New(http.StatusForbidden, "Your email address must be verified to log in with the identity provider"))
+		case errors.Is(err, auth.ErrNoLinkedAccount):
+			c.Error(problem.New(http.StatusForbidden, "No account exists for this identity"))
+		case errors.Is(err, auth.ErrIdentityConflict):
+			c.Error(problem.New(http.StatusConflict, "The account is linked to another identity of the provider"))
+		default:
+			c.Error(err)
+		}
+		return
+	}
+
+	// The second factor of the API still applies to logins through the identity provider.
+	if auth.MFAEnabled(usuario) {
+		challenge, err := o.tokens.IssueMFAChallenge(usuario)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, mfaChallengeResponse{MFARequired: true, MFAToken: challenge})
+		return
+	}
+
+	refreshToken, err := o.sessions.Start(c, usuario.ID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	writeTokens(c, o.tokens, usuario, refreshToken)
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/auth/oidctest"
+	"simplecrud/pkg/middleware"
+	"simplecrud/pkg/models"
+	user "simplecrud/pkg/user"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// identityRepoMock is an in-memory identity repository used for the OIDC handler tests
+type identityRepoMock struct {
+	mu    sync.Mutex
+	users []models.User
+}
+
+// FindByEmail returns the user with the given email
+func (m *identityRepoMock) FindByEmail(ctx context.Context, email string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return models.User{}, user.ErrNotFound
+}
+
+// FindByIdentity returns the user linked to the identity
+func (m *identityRepoMock) FindByIdentity(ctx context.Context, issuer, subject string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		for _, identity := range u.Identities {
+			if identity.Issuer == issuer && identity.Subject == subject {
+				return u, nil
+			}
+		}
+	}
+	return models.User{}, user.ErrNotFound
+}
+
+// LinkIdentity adds the identity to the user if their email is verified
+func (m *identityRepoMock) LinkIdentity(ctx context.Context, id string, identity models.ExternalIdentity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.users {
+		if m.users[i].ID.Hex() == id && m.users[i].EmailVerified {
+			m.users[i].Identities = append(m.users[i].Identities, identity)
+			return nil
+		}
+	}
+	return user.ErrNotFound
+}
+
+// Create stores a new user with a fresh ID
+func (m *identityRepoMock) Create(ctx context.Context, u models.User) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u.ID = primitive.NewObjectID()
+	m.users = append(m.users, u)
+	return u, nil
+}
+
+// TestOIDCLogin defines the tests for the redirect to the identity provider and the callback
+func TestOIDCLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	provider := oidctest.NewProvider(t)
+	repo := &identityRepoMock{}
+	oidc := auth.NewOIDCService(auth.OIDCConfig{
+		Issuer:       provider.URL,
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  oidctest.RedirectURL,
+		Scopes:       []string{"openid", "email"},
+		Provisioning: true,
+		CacheTTL:     time.Hour,
+	}, repo, []byte("0123456789abcdef0123456789abcdef"), nil)
+	tokens := newTestTokenManager(t)
+	handler := NewOIDCHandler(oidc, tokens, newTestSessionService())
+
+	router := gin.New()
+	router.Use(middleware.Errors())
+	router.GET("/auth/oidc/login", handler.Login)
+	router.GET("/auth/oidc/callback", handler.Callback)
+
+	get := func(path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		for _, cookie := range cookies {
+			request.AddCookie(cookie)
+		}
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	// The login redirects to the provider and keeps the flow in a secure cookie
+	response := get("/auth/oidc/login")
+	assert.Equal(t, http.StatusFound, response.Code)
+	location := response.Header().Get("Location")
+	assert.Contains(t, location, provider.URL+"/authorize?")
+	cookies := response.Result().Cookies()
+	require.Len(t, cookies, 1)
+	flow := cookies[0]
+	assert.Equal(t, "oidc_flow", flow.Name)
+	assert.True(t, flow.HttpOnly)
+	assert.True(t, flow.Secure)
+	assert.Equal(t, http.SameSiteLaxMode, flow.SameSite)
+	assert.Equal(t, "/auth/oidc", flow.Path)
+
+	code, state := provider.Authorize(t, location, "sub-1", "john@example.com", nil)
+
+	// Callbacks without the cookie, with a forged state or refused by the provider fail
+	assert.Equal(t, http.StatusBadRequest, get("/auth/oidc/callback?code="+code+"&state="+url.QueryEscape(state)).Code)
+	assert.Equal(t, http.StatusBadRequest, get("/auth/oidc/callback?code="+code+"&state=forged", flow).Code)
+	response = get("/auth/oidc/callback?error=Call+support+at+evil.example", flow)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.NotContains(t, response.Body.String(), "evil.example", "the provider error is not echoed")
+
+	// A valid callback provisions the user and logs them in
+	response = get("/auth/oidc/callback?code="+code+"&state="+url.QueryEscape(state), flow)
+	require.Equal(t, http.StatusOK, response.Code, response.Body.String())
+	var body tokenResponse
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+	assert.NotEmpty(t, body.RefreshToken)
+	claims, err := tokens.Parse(body.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "john@example.com", claims.Email)
+	assert.True(t, claims.EmailVerified)
+	require.Len(t, repo.users, 1)
+	assert.Equal(t, repo.users[0].ID.Hex(), claims.Subject)
+
+	// The callback clears the flow cookie
+	cleared := response.Result().Cookies()
+	require.Len(t, cleared, 1)
+	assert.True(t, cleared[0].MaxAge < 0)
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"net/http"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/organization"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OrganizationHandler handles the requests to manage organizations and their members
+type OrganizationHandler struct {
+	orgs organization.Service
+}
+
+// organizationRequest is the expected body of an organization creation or update
+type organizationRequest struct {
+	Name     string                      `json:"name" binding:"required"`
+	Settings models.OrganizationSettings `json:"settings"`
+}
+
+// memberRequest is the expected body when setting the role of a member
+type memberRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// NewOrganizationHandler initializes a new OrganizationHandler
+func NewOrganizationHandler(orgs organization.Service) *OrganizationHandler {
+	return &OrganizationHandler{orgs: orgs}
+}
+
+// ListOrganizations handles the HTTP request to list the organizations visible to the caller
+func (o *OrganizationHandler) ListOrganizations(c *gin.Context) {
+	orgs, err := o.orgs.ListOrganizations(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, orgs)
+}
+
+// GetOrganization handles the HTTP request to fetch an organization by ID
+func (o *OrganizationHandler) GetOrganization(c *gin.Context) {
+	org, err := o.orgs.GetOrganization(c, c.Param("id"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, org)
+}
+
+// CreateOrganization handles the HTTP request to create an organization
+func (o *OrganizationHandler) CreateOrganization(c *gin.Context) {
+	var req organizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	org, err := o.orgs.CreateOrganization(c, models.Organization{Name: req.Name, Settings: req.Settings})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusCreated, org)
+}
+
+// UpdateOrganization handles the HTTP request to replace the name and settings of an organization
+func (o *OrganizationHandler) UpdateOrganization(c *gin.Context) {
+	var req organizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	org, err := o.orgs.UpdateOrganization(c, c.Param("id"), models.Organization{Name: req.Name, Settings: req.Settings})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, org)
+}
+
+// DeleteOrganization handles the HTTP request to delete an organization. Its members keep their accounts.
+func (o *OrganizationHandler) DeleteOrganization(c *gin.Context) {
+	if err := o.orgs.DeleteOrganization(c, c.Param("id")); err != nil {
+		c.Error(err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListMembers handles the HTTP request to list the members of an organization
+func (o *OrganizationHandler) ListMembers(c *gin.Context) {
+	members, err := o.orgs.ListMembers(c, c.Param("id"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, newUserResponses(members))
+}
+
+// SetMember handles the HTTP request to add a user to an organization or change their role in it
+func (o *OrganizationHandler) SetMember(c *gin.Context) {
+	var req memberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	if err := o.orgs.SetMember(c, c.Param("id"), c.Param("userId"), req.Role); err != nil {
+		c.Error(err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// RemoveMember handles the HTTP request to remove a user from an organization. The account is kept.
+func (o *OrganizationHandler) RemoveMember(c *gin.Context) {
+	if err := o.orgs.RemoveMember(c, c.Param("id"), c.Param("userId")); err != nil {
+		c.Error(err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
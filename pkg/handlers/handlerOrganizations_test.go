@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"simplecrud/pkg/middleware"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/organization"
+	user "simplecrud/pkg/user"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// organizationServiceMock struct is used for mocking the organization service
+type organizationServiceMock struct {
+	mock.Mock
+}
+
+// ListOrganizations mocks the function to list organizations
+func (m *organizationServiceMock) ListOrganizations(ctx context.Context) ([]models.Organization, error) {
+	args := m.Called()
+	return args.Get(0).([]models.Organization), args.Error(1)
+}
+
+// GetOrganization mocks the function to get an organization by ID
+func (m *organizationServiceMock) GetOrganization(ctx context.Context, id string) (models.Organization, error) {
+	args := m.Called(id)
+	return args.Get(0).(models.Organization), args.Error(1)
+}
+
+// CreateOrganization mocks the function to create an organization
+func (m *organizationServiceMock) CreateOrganization(ctx context.Context, org models.Organization) (models.Organization, error) {
+	args := m.Called(org)
+	return args.Get(0).(models.Organization), args.Error(1)
+}
+
+// UpdateOrganization mocks the function to update an organization
+func (m *organizationServiceMock) UpdateOrganization(ctx context.Context, id string, org models.Organization) (models.Organization, error) {
+	args := m.Called(id, org)
+	return args.Get(0).(models.Organization), args.Error(1)
+}
+
+// DeleteOrganization mocks the function to delete an organization
+func (m *organizationServiceMock) DeleteOrganization(ctx context.Context, id string) error {
+	return m.Called(id).Error(0)
+}
+
+// ListMembers mocks the function to list the members of an organization
+func (m *organizationServiceMock) ListMembers(ctx context.Context, id string) ([]models.User, error) {
+	args := m.Called(id)
+	return args.Get(0).([]models.User), args.Error(1)
+}
+
+// SetMember mocks the function to add a member or change their role
+func (m *organizationServiceMock) SetMember(ctx context.Context, id, userID, role string) error {
+	return m.Called(id, userID, role).Error(0)
+}
+
+// RemoveMember mocks the function to remove a member
+func (m *organizationServiceMock) RemoveMember(ctx context.Context, id, userID string) error {
+	return m.Called(id, userID).Error(0)
+}
+
+// TestOrganizationHandler defines the tests for the organization routes and their error responses
+func TestOrganizationHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := new(organizationServiceMock)
+	handler := NewOrganizationHandler(service)
+	router := gin.New()
+	router.Use(middleware.Errors())
+	router.POST("/organizations", handler.CreateOrganization)
+	router.GET("/organizations/:id", handler.GetOrganization)
+	router.PUT("/organizations/:id/members/:userId", handler.SetMember)
+	router.DELETE("/organizations/:id/members/:userId", handler.RemoveMember)
+	router.GET("/organizations/:id/members", handler.ListMembers)
+
+	acme := models.Organization{ID: primitive.NewObjectID(), Name: "Acme", Settings: models.OrganizationSettings{AllowedEmailDomains: []string{"acme.com"}}}
+	service.On("CreateOrganization", models.Organization{Name: "Acme", Settings: acme.Settings}).Return(acme, nil)
+	service.On("GetOrganization", acme.ID.Hex()).Return(acme, nil)
+	service.On("GetOrganization", "unknown").Return(models.Organization{}, organization.ErrNotFound)
+	service.On("SetMember", acme.ID.Hex(), "bob", user.OrgRoleMember).Return(nil)
+	service.On("SetMember", acme.ID.Hex(), "eve", user.OrgRoleMember).Return(&user.ValidationError{Errors: []user.FieldError{{Field: "email", Code: user.ViolationDomainNotAllowed}}})
+	service.On("RemoveMember", acme.ID.Hex(), "alice").Return(organization.ErrLastAdmin)
+	service.On("RemoveMember", acme.ID.Hex(), "carol").Return(user.ErrForbidden)
+	service.On("ListMembers", acme.ID.Hex()).Return([]models.User{{ID: primitive.NewObjectID(), Name: "Bob", Email: "bob@acme.com", Password: "$2a$12$hash",
+		Memberships: []models.Membership{{OrganizationID: acme.ID, Role: user.OrgRoleMember}}}}, nil)
+
+	response := postJSON(router, "/organizations", gin.H{"name": "Acme", "settings": gin.H{"allowed_email_domains": []string{"acme.com"}}})
+	require.Equal(t, http.StatusCreated, response.Code, response.Body.String())
+	var created models.Organization
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &created))
+	assert.Equal(t, acme.ID, created.ID)
+	assert.Equal(t, http.StatusBadRequest, postJSON(router, "/organizations", gin.H{}).Code)
+
+	request := func(method, path string, body string) int {
+		response := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(response, req)
+		return response.Code
+	}
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/organizations/"+acme.ID.Hex(), ""))
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/organizations/unknown", ""))
+	assert.Equal(t, http.StatusNoContent, request(http.MethodPut, "/organizations/"+acme.ID.Hex()+"/members/bob", `{"role":"member"}`))
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPut, "/organizations/"+acme.ID.Hex()+"/members/eve", `{"role":"member"}`))
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPut, "/organizations/"+acme.ID.Hex()+"/members/bob", `{}`))
+	assert.Equal(t, http.StatusConflict, request(http.MethodDelete, "/organizations/"+acme.ID.Hex()+"/members/alice", ""))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodDelete, "/organizations/"+acme.ID.Hex()+"/members/carol", ""))
+
+	// Members are listed without their password hashes
+	response = httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/organizations/"+acme.ID.Hex()+"/members", nil)
+	router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var members []models.User
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &members))
+	require.Len(t, members, 1)
+	assert.Equal(t, "bob@acme.com", members[0].Email)
+	assert.Equal(t, user.OrgRoleMember, members[0].Memberships[0].Role)
+	assert.NotContains(t, response.Body.String(), "$2a$")
+}
+
+// TestSwitchOrganization defines the tests for getting an access token for another organization
+func TestSwitchOrganization(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	acme, globex := primitive.NewObjectID(), primitive.NewObjectID()
+	usuario := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com", Role: user.RoleUser, Memberships: []models.Membership{
+		{OrganizationID: acme, Role: user.OrgRoleMember},
+		{OrganizationID: globex, Role: user.OrgRoleAdmin},
+	}}
+	mockUserService := new(userServiceMock)
+	mockUserService.On("GetUser", usuario.ID.Hex()).Return(usuario, nil)
+	tokens := newTestTokenManager(t)
+	handler := NewAuthHandler(mockUserService, tokens, newTestSessionService(), newTestLoginGuard(), nil)
+
+	router := gin.New()
+	router.Use(middleware.Errors())
+	router.ContextWithFallback = true
+	router.POST("/auth/organization", func(c *gin.Context) {
+		principal := user.Principal{UserID: usuario.ID.Hex(), Role: user.RoleUser, OrgID: acme.Hex(), OrgRole: user.OrgRoleMember}
+		c.Request = c.Request.WithContext(user.WithPrincipal(c.Request.Context(), principal))
+		c.Next()
+	}, handler.SwitchOrganization)
+
+	response := postJSON(router, "/auth/organization", gin.H{"organization_id": globex.Hex()})
+	require.Equal(t, http.StatusOK, response.Code, response.Body.String())
+	var body accessTokenResponse
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+	claims, err := tokens.Parse(body.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, globex.Hex(), claims.OrgID)
+	assert.Equal(t, user.OrgRoleAdmin, claims.OrgRole)
+
+	assert.Equal(t, http.StatusForbidden, postJSON(router, "/auth/organization", gin.H{"organization_id": primitive.NewObjectID().Hex()}).Code)
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/problem"
+	user "simplecrud/pkg/user"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PasswordHandler handles password change and reset requests
+type PasswordHandler struct {
+	userService user.Service
+	resets      *auth.PasswordResetService
+	sessions    *auth.SessionService
+}
+
+// passwordResetRequest is the expected body of a password reset request
+type passwordResetRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// passwordResetConfirmRequest is the expected body of a password reset confirmation
+type passwordResetConfirmRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// passwordChangeRequest is the expected body of a password change
+type passwordChangeRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	Password        string `json:"password" binding:"required"`
+}
+
+// NewPasswordHandler initializes a new PasswordHandler
+func NewPasswordHandler(userService user.Service, resets *auth.PasswordResetService, sessions *auth.SessionService) *PasswordHandler {
+	return &PasswordHandler{
+		userService: userService,
+		resets:      resets,
+		sessions:    sessions,
+	}
+}
+
+// ChangePassword handles the HTTP request of a user to change their own password.
+// On success every session of the user is revoked, so they have to log in again everywhere.
+func (p *PasswordHandler) ChangePassword(c *gin.Context) {
+	id := c.Param("id")
+	var req passwordChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	if err := p.userService.ChangePassword(c, id, req.CurrentPassword, req.Password); err != nil {
+		// A wrong current password is a bad request here, not a failed authentication of the caller.
+		if errors.Is(err, user.ErrInvalidCredentials) {
+			c.Error(problem.New(http.StatusBadRequest, "Current password is incorrect"))
+		} else {
+			c.Error(err)
+		}
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(id)
+	if err == nil {
+		err = p.sessions.RevokeAll(c, userID)
+	}
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RequestPasswordReset handles the HTTP request to send a password reset token to a user.
+// It always answers 202 Accepted, so it cannot be used to find out which emails have an account.
+func (p *PasswordHandler) RequestPasswordReset(c *gin.Context) {
+	var req passwordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	if err := p.resets.Request(c, req.Email); err != nil {
+		logging.FromContext(c).WithError(err).Error("Failed to send password reset")
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If an account with this email exists, a password reset code has been sent"})
+}
+
+// ConfirmPasswordReset handles the HTTP request to choose a new password with a password reset token.
+// On success every session of the user is revoked, so they have to log in again everywhere.
+func (p *PasswordHandler) ConfirmPasswordReset(c *gin.Context) {
+	var req passwordResetConfirmRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	// The token is redeemed before the password is set, so it sets at most one password. A password
+	// rejected by the policy gives the token back.
+	userID, err := p.resets.Confirm(c, req.Token, func(userID primitive.ObjectID) error {
+		// The token proves the caller may act as this user.
+		ctx := user.WithPrincipal(c, user.Principal{UserID: userID.Hex()})
+		return p.userService.SetPassword(ctx, userID.Hex(), req.Password)
+	})
+	if err != nil {
+		respondResetTokenError(c, err)
+		return
+	}
+
+	if err := p.sessions.RevokeAll(c, userID); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// respondResetTokenError answers with the status matching a password reset token error
+func respondResetTokenError(c *gin.Context, err error) {
+	if errors.Is(err, auth.ErrInvalidResetToken) {
+		c.Error(problem.New(http.StatusBadRequest, "Invalid or expired password reset token"))
+	} else {
+		c.Error(err)
+	}
+}
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/middleware"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/notify"
+	user "simplecrud/pkg/user"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// actionTokenRepoMock is an in-memory action token repository used for the password handler tests
+type actionTokenRepoMock struct {
+	mu     sync.Mutex
+	tokens []models.ActionToken
+}
+
+// Create stores a new token
+func (m *actionTokenRepoMock) Create(ctx context.Context, token models.ActionToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens = append(m.tokens, token)
+	return nil
+}
+
+// Consume marks a matching unused and unexpired token as used
+func (m *actionTokenRepoMock) Consume(ctx context.Context, tokenHash, purpose string, at time.Time) (models.ActionToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, token := range m.tokens {
+		if token.TokenHash == tokenHash && token.Purpose == purpose && token.UsedAt == nil && at.Before(token.ExpiresAt) {
+			m.tokens[i].UsedAt = &at
+			return m.tokens[i], nil
+		}
+	}
+	return models.ActionToken{}, auth.ErrActionTokenNotFound
+}
+
+// Release marks a matching used token as unused
+func (m *actionTokenRepoMock) Release(ctx context.Context, tokenHash, purpose string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, token := range m.tokens {
+		if token.TokenHash == tokenHash && token.Purpose == purpose && token.UsedAt != nil {
+			m.tokens[i].UsedAt = nil
+		}
+	}
+	return nil
+}
+
+// DeleteForUser removes the tokens of the user with the given purpose
+func (m *actionTokenRepoMock) DeleteForUser(ctx context.Context, userID primitive.ObjectID, purpose string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.tokens[:0]
+	for _, token := range m.tokens {
+		if token.UserID != userID || token.Purpose != purpose {
+			kept = append(kept, token)
+		}
+	}
+	m.tokens = kept
+	return nil
+}
+
+// LatestForUser returns the last created token of the user with the given purpose
+func (m *actionTokenRepoMock) LatestForUser(ctx context.Context, userID primitive.ObjectID, purpose string) (models.ActionToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.tokens) - 1; i >= 0; i-- {
+		if m.tokens[i].UserID == userID && m.tokens[i].Purpose == purpose {
+			return m.tokens[i], nil
+		}
+	}
+	return models.ActionToken{}, auth.ErrActionTokenNotFound
+}
+
+// userFinderMock finds users in a fixed list
+type userFinderMock []models.User
+
+// FindByEmail returns the user with the given email
+func (m userFinderMock) FindByEmail(ctx context.Context, email string) (models.User, error) {
+	for _, u := range m {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return models.User{}, user.ErrNotFound
+}
+
+// FindById returns the user with the given ID
+func (m userFinderMock) FindById(ctx context.Context, id string) (models.User, error) {
+	for _, u := range m {
+		if u.ID.Hex() == id {
+			return u, nil
+		}
+	}
+	return models.User{}, user.ErrNotFound
+}
+
+// notifierMock is an in-memory notifier keeping the messages it is asked to send
+type notifierMock struct {
+	mu       sync.Mutex
+	messages []notify.Message
+}
+
+// Send records the message
+func (m *notifierMock) Send(ctx context.Context, msg notify.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// lastLine returns the last line of the last message, which holds the token or link
+func (m *notifierMock) lastLine(t *testing.T) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.NotEmpty(t, m.messages)
+	lines := strings.Split(strings.TrimSpace(m.messages[len(m.messages)-1].Body), "\n")
+	return lines[len(lines)-1]
+}
+
+// TestPasswordReset defines the tests for requesting and confirming a password reset
+func TestPasswordReset(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockUserService := new(userServiceMock)
+	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	usuario := models.User{ID: objectID, Name: "JohnDoe", Email: "john@example.com"}
+	notifier := &notifierMock{}
+	sessions := newTestSessionService()
+	resets := auth.NewPasswordResetService(userFinderMock{usuario}, &actionTokenRepoMock{}, notifier, time.Hour, "")
+	passwordHandler := NewPasswordHandler(mockUserService, resets, sessions)
+
+	mockUserService.On("SetPassword", objectID.Hex(), "N3w@Passw0rd").Return(nil).Once()
+	mockUserService.On("SetPassword", objectID.Hex(), "weak").Return(&user.ValidationError{Errors: []user.FieldError{
+		{Field: "password", Code: "too_short", Message: "Password must be at least 8 characters long"},
+	}}).Once()
+	router := gin.Default()
+	router.Use(middleware.Errors())
+	router.POST("/auth/password-reset", passwordHandler.RequestPasswordReset)
+	router.POST("/auth/password-reset/confirm", passwordHandler.ConfirmPasswordReset)
+
+	// Known and unknown emails get the same answer, only known ones get a message
+	response := postJSON(router, "/auth/password-reset", gin.H{"email": "nobody@example.com"})
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Empty(t, notifier.messages)
+	response = postJSON(router, "/auth/password-reset", gin.H{"email": "john@example.com"})
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	require.Len(t, notifier.messages, 1)
+	assert.Equal(t, "john@example.com", notifier.messages[0].To)
+	token := notifier.lastLine(t)
+
+	// An existing session is revoked by the reset
+	refreshToken, err := sessions.Start(context.Background(), objectID)
+	require.NoError(t, err)
+
+	// A weak password is rejected without using up the token
+	response = postJSON(router, "/auth/password-reset/confirm", gin.H{"token": token, "password": "weak"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Contains(t, response.Body.String(), `"code":"too_short"`)
+
+	// Unknown tokens are rejected
+	response = postJSON(router, "/auth/password-reset/confirm", gin.H{"token": "unknown", "password": "N3w@Passw0rd"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	// The token sets the new password once
+	response = postJSON(router, "/auth/password-reset/confirm", gin.H{"token": token, "password": "N3w@Passw0rd"})
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = postJSON(router, "/auth/password-reset/confirm", gin.H{"token": token, "password": "N3w@Passw0rd"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	mockUserService.AssertExpectations(t)
+
+	_, _, err = sessions.Rotate(context.Background(), refreshToken)
+	assert.True(t, errors.Is(err, auth.ErrInvalidRefreshToken))
+}
+
+// TestChangePassword defines the tests for changing one's own password
+func TestChangePassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockUserService := new(userServiceMock)
+	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	sessions := newTestSessionService()
+	passwordHandler := NewPasswordHandler(mockUserService, nil, sessions)
+
+	mockUserService.On("ChangePassword", objectID.Hex(), "wrong", "N3w@Passw0rd").Return(user.ErrInvalidCredentials).Once()
+	mockUserService.On("ChangePassword", objectID.Hex(), "Old#Passw0rd", "Old#Passw0rd").Return(&user.ValidationError{Errors: []user.FieldError{
+		{Field: "password", Code: "password_reused", Message: "must not be one of your recent passwords"},
+	}}).Once()
+	mockUserService.On("ChangePassword", objectID.Hex(), "Old#Passw0rd", "N3w@Passw0rd").Return(nil).Once()
+	router := gin.Default()
+	router.Use(middleware.Errors())
+	router.PUT("/users/:id/password", passwordHandler.ChangePassword)
+	put := func(body gin.H) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodPut, "/users/"+objectID.Hex()+"/password", bytes.NewReader(payload))
+		request.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	refreshToken, err := sessions.Start(context.Background(), objectID)
+	require.NoError(t, err)
+
+	response := put(gin.H{"password": "N3w@Passw0rd"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = put(gin.H{"current_password": "wrong", "password": "N3w@Passw0rd"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = put(gin.H{"current_password": "Old#Passw0rd", "password": "Old#Passw0rd"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Contains(t, response.Body.String(), `"code":"password_reused"`)
+
+	// A successful change ends every session
+	response = put(gin.H{"current_password": "Old#Passw0rd", "password": "N3w@Passw0rd"})
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	mockUserService.AssertExpectations(t)
+
+	_, _, err = sessions.Rotate(context.Background(), refreshToken)
+	assert.True(t, errors.Is(err, auth.ErrInvalidRefreshToken))
+}
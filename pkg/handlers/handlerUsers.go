@@ -1,25 +1,67 @@
 package handlers
 
 import (
-	"errors"
 	"net/http"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/logging"
 	"simplecrud/pkg/models"
+	"simplecrud/pkg/problem"
 	user "simplecrud/pkg/user"
-	"strings"
 
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // UserHandler struct holds a userService for user operations
+// and a verification service to email new users a verification link
 type UserHandler struct {
-	userService user.Service
+	userService  user.Service
+	verification *auth.VerificationService
 }
 
-// NewUserHandler initializes a new UserHandler
-func NewUserHandler(userService user.Service) *UserHandler {
+// userResponse is a user as answered to clients. Unlike models.User it has no password hash, so no
+// handler can send one by mistake. The fields keep the names clients already rely on.
+type userResponse struct {
+	ID            primitive.ObjectID
+	Name          string
+	Age           int
+	Email         string
+	Address       string
+	Role          string
+	EmailVerified bool
+	Memberships   []models.Membership `json:"memberships,omitempty"`
+}
+
+// newUserResponse returns the response for the user
+func newUserResponse(u models.User) userResponse {
+	return userResponse{
+		ID:            u.ID,
+		Name:          u.Name,
+		Age:           u.Age,
+		Email:         u.Email,
+		Address:       u.Address,
+		Role:          u.Role,
+		EmailVerified: u.EmailVerified,
+		Memberships:   u.Memberships,
+	}
+}
+
+// newUserResponses returns the responses for the users
+func newUserResponses(users []models.User) []userResponse {
+	responses := make([]userResponse, 0, len(users))
+	for _, u := range users {
+		responses = append(responses, newUserResponse(u))
+	}
+	return responses
+}
+
+// NewUserHandler initializes a new UserHandler.
+// If verification is nil, no verification email is sent to new users.
+func NewUserHandler(userService user.Service, verification *auth.VerificationService) *UserHandler {
 	// Returns a new UserHandler with the provided userService
 	return &UserHandler{
-		userService: userService,
+		userService:  userService,
+		verification: verification,
 	}
 }
 
@@ -27,30 +69,26 @@ func NewUserHandler(userService user.Service) *UserHandler {
 func (u *UserHandler) GetAllUsers(c *gin.Context) {
 	users, err := u.userService.GetAllUsers(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error. " + err.Error()})
+		c.Error(err)
 		return
 	}
-	c.JSON(http.StatusOK, users)
+	c.JSON(http.StatusOK, newUserResponses(users))
 }
 
 // GetUser handles the HTTP request to fetch a user by ID
 func (u *UserHandler) GetUser(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required in the request"})
+		c.Error(problem.New(http.StatusBadRequest, "User ID is required in the request"))
 		return
 	}
 
 	usuario, err := u.userService.GetUser(c, id)
 	if err != nil {
-		if errors.Is(err, user.ErrNotFound) {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error. " + err.Error()})
-		}
+		c.Error(err)
 		return
 	}
-	c.JSON(http.StatusOK, usuario)
+	c.JSON(http.StatusOK, newUserResponse(usuario))
 }
 
 // CreateUser handles the HTTP request to create a new user.
@@ -59,45 +97,46 @@ func (u *UserHandler) GetUser(c *gin.Context) {
 func (u *UserHandler) CreateUser(c *gin.Context) {
 	var newUser models.User
 	if err := c.ShouldBindJSON(&newUser); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body. " + err.Error()})
+		c.Error(err).SetType(gin.ErrorTypeBind)
 		return
 	}
 
-	_, err := u.userService.CreateUser(c, newUser)
+	created, err := u.userService.CreateUser(c, newUser)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error. " + err.Error()})
+		c.Error(err)
 		return
 	}
 
+	// The user exists even if the email cannot be sent; they can ask for it again later.
+	if u.verification != nil {
+		if err := u.verification.Send(c, created); err != nil {
+			logging.FromContext(c).WithError(err).Error("Failed to send verification email")
+		}
+	}
+
 	c.JSON(http.StatusCreated, gin.H{"message": "User created successfully"})
 }
 
 // UpdateUser handles the HTTP request to update an existing user.
 // It validates the request parameters and body and then calls the UpdateUser service.
-// If an error occurs (e.g., validation or ID parsing error), an error message is returned.
+// Errors, such as rejected fields or an invalid ID, are answered by the error middleware.
 // Upon successful update, it returns a success message.
 func (u *UserHandler) UpdateUser(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required in the request"})
+		c.Error(problem.New(http.StatusBadRequest, "User ID is required in the request"))
 		return
 	}
 
 	var updatedUser models.User
 	if err := c.ShouldBindJSON(&updatedUser); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body. " + err.Error()})
+		c.Error(err).SetType(gin.ErrorTypeBind)
 		return
 	}
 
 	_, err := u.userService.UpdateUser(c, id, updatedUser)
 	if err != nil {
-		// Identify if it's a validation error or ID parsing error
-		if strings.Contains(err.Error(), "validation failed") ||
-			strings.Contains(err.Error(), "ErrInvalidID") {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request. " + err.Error()})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error. " + err.Error()})
-		}
+		c.Error(err)
 		return
 	}
 
@@ -110,13 +149,13 @@ func (u *UserHandler) UpdateUser(c *gin.Context) {
 func (u *UserHandler) DeleteUser(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required in the request"})
+		c.Error(problem.New(http.StatusBadRequest, "User ID is required in the request"))
 		return
 	}
 
 	err := u.userService.DeleteUser(c, id)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error. " + err.Error()})
+		c.Error(err)
 		return
 	}
 
@@ -8,7 +8,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"simplecrud/pkg/middleware"
 	"simplecrud/pkg/models"
+	"simplecrud/pkg/problem"
+	user "simplecrud/pkg/user"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -52,10 +55,34 @@ func (m *userServiceMock) DeleteUser(c context.Context, id string) error {
 	return args.Error(0)
 }
 
+// Authenticate mocks the function to verify a user's email and password
+func (m *userServiceMock) Authenticate(c context.Context, email, password string) (models.User, error) {
+	args := m.Called(email, password)
+	return args.Get(0).(models.User), args.Error(1)
+}
+
+// BootstrapAdmin mocks the function to create the first admin
+func (m *userServiceMock) BootstrapAdmin(c context.Context, admin models.User) (bool, error) {
+	args := m.Called(admin)
+	return args.Bool(0), args.Error(1)
+}
+
+// SetPassword mocks the function to change a user's password
+func (m *userServiceMock) SetPassword(c context.Context, id, password string) error {
+	args := m.Called(id, password)
+	return args.Error(0)
+}
+
+// ChangePassword mocks the function to change one's own password
+func (m *userServiceMock) ChangePassword(c context.Context, id, currentPassword, newPassword string) error {
+	args := m.Called(id, currentPassword, newPassword)
+	return args.Error(0)
+}
+
 func TestGetAllUsers(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	mockUserService := new(userServiceMock)
-	userHandler := NewUserHandler(mockUserService)
+	userHandler := NewUserHandler(mockUserService, nil)
 
 	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
 	users := []models.User{
@@ -65,19 +92,23 @@ func TestGetAllUsers(t *testing.T) {
 	// Success case
 	mockUserService.On("GetAllUsers").Return(users, nil)
 	router := gin.Default()
+	router.Use(middleware.Errors())
 	router.GET("/users", userHandler.GetAllUsers)
 	response := httptest.NewRecorder()
 	request, _ := http.NewRequest(http.MethodGet, "/users", nil)
 	router.ServeHTTP(response, request)
 	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"Email":"teste@teste.com.br"`)
+	assert.NotContains(t, response.Body.String(), "Password", "password hashes are never sent")
 	mockUserService.AssertExpectations(t)
 
 	// Error case
 	// Handling other cases like when an error occurs
 	mockUserService = new(userServiceMock) // Create a new mock instance
-	userHandler = NewUserHandler(mockUserService)
+	userHandler = NewUserHandler(mockUserService, nil)
 	mockUserService.On("GetAllUsers").Return([]models.User{}, errors.New("Internal Error"))
 	router = gin.Default() // Create a new router instance
+	router.Use(middleware.Errors())
 	router.GET("/users", userHandler.GetAllUsers)
 	response = httptest.NewRecorder()
 	request, _ = http.NewRequest(http.MethodGet, "/users", nil)
@@ -90,12 +121,13 @@ func TestGetAllUsers(t *testing.T) {
 func TestGetUserSuccess(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	mockUserService := new(userServiceMock)
-	userHandler := NewUserHandler(mockUserService)
+	userHandler := NewUserHandler(mockUserService, nil)
 	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
 	user := models.User{ID: objectID, Name: "JohnDoe"}
 
 	mockUserService.On("GetUser", objectID.Hex()).Return(user, nil)
 	router := gin.Default()
+	router.Use(middleware.Errors())
 	router.GET("/users/:id", userHandler.GetUser)
 	response := httptest.NewRecorder()
 	request, _ := http.NewRequest(http.MethodGet, "/users/"+objectID.Hex(), nil)
@@ -108,11 +140,12 @@ func TestGetUserSuccess(t *testing.T) {
 func TestGetUserError(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	mockUserService := new(userServiceMock)
-	userHandler := NewUserHandler(mockUserService)
+	userHandler := NewUserHandler(mockUserService, nil)
 	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
 
 	mockUserService.On("GetUser", objectID.Hex()).Return(models.User{}, errors.New("Not Found"))
 	router := gin.Default()
+	router.Use(middleware.Errors())
 	router.GET("/users/:id", userHandler.GetUser)
 	response := httptest.NewRecorder()
 	request, _ := http.NewRequest(http.MethodGet, "/users/"+objectID.Hex(), nil)
@@ -125,7 +158,7 @@ func TestGetUserError(t *testing.T) {
 func TestCreateUserSuccess(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	mockUserService := new(userServiceMock)
-	userHandler := NewUserHandler(mockUserService)
+	userHandler := NewUserHandler(mockUserService, nil)
 
 	user := models.User{
 		Name:     "JohnDoe",
@@ -143,6 +176,7 @@ func TestCreateUserSuccess(t *testing.T) {
 
 	mockUserService.On("CreateUser", mock.Anything, user).Return(user, nil)
 	router := gin.Default()
+	router.Use(middleware.Errors())
 	router.POST("/users", userHandler.CreateUser)
 	response := httptest.NewRecorder()
 	request, _ := http.NewRequest(http.MethodPost, "/users", body)
@@ -156,7 +190,7 @@ func TestCreateUserSuccess(t *testing.T) {
 func TestCreateUserError(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	mockUserService := new(userServiceMock)
-	userHandler := NewUserHandler(mockUserService)
+	userHandler := NewUserHandler(mockUserService, nil)
 
 	user := models.User{
 		Name:     "JohnDoe",
@@ -174,6 +208,7 @@ func TestCreateUserError(t *testing.T) {
 
 	mockUserService.On("CreateUser", mock.Anything, user).Return(models.User{}, errors.New("Creation Failed"))
 	router := gin.Default()
+	router.Use(middleware.Errors())
 	router.POST("/users", userHandler.CreateUser)
 	response := httptest.NewRecorder()
 	request, _ := http.NewRequest(http.MethodPost, "/users", body)
@@ -183,11 +218,42 @@ func TestCreateUserError(t *testing.T) {
 	mockUserService.AssertExpectations(t)
 }
 
+// TestCreateUserValidationError defines the tests for a CreateUser request rejected by validation
+func TestCreateUserValidationError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockUserService := new(userServiceMock)
+	userHandler := NewUserHandler(mockUserService, nil)
+
+	newUser := models.User{Name: "JohnDoe", Email: "john@example.com", Password: "johnjohn"}
+	payload, _ := json.Marshal(newUser)
+
+	validationErr := &user.ValidationError{Errors: []user.FieldError{
+		{Field: "password", Code: "missing_digit", Message: "Password must contain a digit"},
+		{Field: "password", Code: "contains_personal_info", Message: "Password must not contain your name or email"},
+	}}
+	mockUserService.On("CreateUser", mock.Anything, newUser).Return(models.User{}, validationErr)
+	router := gin.Default()
+	router.Use(middleware.Errors())
+	router.POST("/users", userHandler.CreateUser)
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodPost, "/users", bytes.NewReader(payload))
+	request.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Equal(t, problem.ContentType, response.Header().Get("Content-Type"))
+
+	var body problem.Problem
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+	assert.Equal(t, problem.TypeValidation, body.Type)
+	assert.Equal(t, validationErr.Errors, body.Errors)
+	mockUserService.AssertExpectations(t)
+}
+
 // TestUpdateUserSuccess defines the tests for a successful UpdateUser request
 func TestUpdateUserSuccess(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	mockUserService := new(userServiceMock)
-	userHandler := NewUserHandler(mockUserService)
+	userHandler := NewUserHandler(mockUserService, nil)
 	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
 	user := models.User{ID: objectID, Name: "UpdatedUser"}
 
@@ -196,6 +262,7 @@ func TestUpdateUserSuccess(t *testing.T) {
 
 	mockUserService.On("UpdateUser", mock.AnythingOfType("string"), mock.AnythingOfType("models.User")).Return(user, nil)
 	router := gin.Default()
+	router.Use(middleware.Errors())
 	router.PUT("/users/:id", userHandler.UpdateUser)
 	response := httptest.NewRecorder()
 	request, _ := http.NewRequest(http.MethodPut, "/users/"+objectID.Hex(), body)
@@ -209,7 +276,7 @@ func TestUpdateUserSuccess(t *testing.T) {
 func TestUpdateUserError(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	mockUserService := new(userServiceMock)
-	userHandler := NewUserHandler(mockUserService)
+	userHandler := NewUserHandler(mockUserService, nil)
 	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
 	user := models.User{ID: objectID, Name: "UpdatedUser"}
 
@@ -218,6 +285,7 @@ func TestUpdateUserError(t *testing.T) {
 
 	mockUserService.On("UpdateUser", mock.AnythingOfType("string"), mock.AnythingOfType("models.User")).Return(models.User{}, errors.New("Update Failed"))
 	router := gin.Default()
+	router.Use(middleware.Errors())
 	router.PUT("/users/:id", userHandler.UpdateUser)
 	response := httptest.NewRecorder()
 	request, _ := http.NewRequest(http.MethodPut, "/users/"+objectID.Hex(), body)
@@ -231,12 +299,13 @@ func TestUpdateUserError(t *testing.T) {
 func TestDeleteUser(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	mockUserService := new(userServiceMock)
-	userHandler := NewUserHandler(mockUserService)
+	userHandler := NewUserHandler(mockUserService, nil)
 	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
 
 	// Success case
 	mockUserService.On("DeleteUser", mock.Anything, objectID.Hex()).Return(nil)
 	router := gin.Default()
+	router.Use(middleware.Errors())
 	router.DELETE("/users/:id", userHandler.DeleteUser)
 	response := httptest.NewRecorder()
 	request, _ := http.NewRequest(http.MethodDelete, "/users/"+objectID.Hex(), nil)
@@ -246,9 +315,10 @@ func TestDeleteUser(t *testing.T) {
 
 	// Error case
 	mockUserService = new(userServiceMock)
-	userHandler = NewUserHandler(mockUserService)
+	userHandler = NewUserHandler(mockUserService, nil)
 	mockUserService.On("DeleteUser", mock.Anything, objectID.Hex()).Return(errors.New("Delete Failed"))
 	router = gin.Default()
+	router.Use(middleware.Errors())
 	router.DELETE("/users/:id", userHandler.DeleteUser)
 	response = httptest.NewRecorder()
 	request, _ = http.NewRequest(http.MethodDelete, "/users/"+objectID.Hex(), nil)
@@ -256,3 +326,32 @@ func TestDeleteUser(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, response.Code) // Assuming you return 500 for delete failure
 	mockUserService.AssertExpectations(t)
 }
+
+// TestForbidden defines the tests for requests rejected by the user policy
+func TestForbidden(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockUserService := new(userServiceMock)
+	userHandler := NewUserHandler(mockUserService, nil)
+	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+
+	mockUserService.On("GetAllUsers").Return([]models.User(nil), user.ErrForbidden)
+	mockUserService.On("GetUser", objectID.Hex()).Return(models.User{}, user.ErrForbidden)
+	mockUserService.On("DeleteUser", mock.Anything, objectID.Hex()).Return(user.ErrForbidden)
+	router := gin.Default()
+	router.Use(middleware.Errors())
+	router.GET("/users", userHandler.GetAllUsers)
+	router.GET("/users/:id", userHandler.GetUser)
+	router.DELETE("/users/:id", userHandler.DeleteUser)
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodGet, "/users"},
+		{http.MethodGet, "/users/" + objectID.Hex()},
+		{http.MethodDelete, "/users/" + objectID.Hex()},
+	} {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(req.method, req.path, nil)
+		router.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	}
+	mockUserService.AssertExpectations(t)
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/problem"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VerificationHandler handles email verification requests
+type VerificationHandler struct {
+	verification *auth.VerificationService
+}
+
+// resendVerificationRequest is the expected body of a request to resend the verification email
+type resendVerificationRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// NewVerificationHandler initializes a new VerificationHandler
+func NewVerificationHandler(verification *auth.VerificationService) *VerificationHandler {
+	return &VerificationHandler{
+		verification: verification,
+	}
+}
+
+// VerifyEmail handles the HTTP request sent by the link in a verification email.
+// The token is read from the "token" query parameter.
+// The user has to refresh or log in again for their tokens to reflect the verified email.
+func (v *VerificationHandler) VerifyEmail(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.Error(problem.New(http.StatusBadRequest, "Verification token is required"))
+		return
+	}
+
+	if _, err := v.verification.Verify(c, token); err != nil {
+		if errors.Is(err, auth.ErrInvalidVerificationToken) {
+			c.Error(problem.New(http.StatusBadRequest, "Invalid or expired verification link"))
+		} else {
+			c.Error(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email address verified"})
+}
+
+// ResendVerification handles the HTTP request to send a new verification email.
+// It always answers 202 Accepted, so it cannot be used to find out which emails have an account.
+// Emails are sent at most once per resend interval for each user.
+func (v *VerificationHandler) ResendVerification(c *gin.Context) {
+	var req resendVerificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+
+	if err := v.verification.Resend(c, req.Email); err != nil && !errors.Is(err, auth.ErrVerificationResendTooSoon) {
+		logging.FromContext(c).WithError(err).Error("Failed to resend verification email")
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If an unverified account with this email exists, a verification email has been sent"})
+}
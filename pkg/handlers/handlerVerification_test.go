@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/middleware"
+	"simplecrud/pkg/models"
+	user "simplecrud/pkg/user"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/mock"
+	"github.com/tj/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// verificationRepoMock is an in-memory verification repository used for the verification handler tests
+type verificationRepoMock struct {
+	userFinderMock
+}
+
+// MarkEmailVerified sets the verified flag of the user if they still have the email
+func (m *verificationRepoMock) MarkEmailVerified(ctx context.Context, id, email string) error {
+	for i := range m.userFinderMock {
+		if m.userFinderMock[i].ID.Hex() == id && m.userFinderMock[i].Email == email {
+			m.userFinderMock[i].EmailVerified = true
+			return nil
+		}
+	}
+	return user.ErrNotFound
+}
+
+// verificationPath returns the path and query of the link in the last message
+func verificationPath(t *testing.T, notifier *notifierMock) string {
+	link, err := url.Parse(notifier.lastLine(t))
+	assert.NoError(t, err)
+	return link.RequestURI()
+}
+
+// TestEmailVerification defines the tests for sending verification emails to new users and verifying them
+func TestEmailVerification(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockUserService := new(userServiceMock)
+	objectID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	usuario := models.User{ID: objectID, Name: "JohnDoe", Email: "john@example.com", Password: "P@ssword123"}
+	users := &verificationRepoMock{userFinderMock{usuario}}
+	notifier := &notifierMock{}
+	verification := auth.NewVerificationService(users, &actionTokenRepoMock{}, notifier, time.Hour, time.Hour, auth.DefaultEmailVerificationURL)
+	userHandler := NewUserHandler(mockUserService, verification)
+	verificationHandler := NewVerificationHandler(verification)
+
+	mockUserService.On("CreateUser", mock.Anything, mock.Anything).Return(usuario, nil)
+	router := gin.Default()
+	router.Use(middleware.Errors())
+	router.POST("/users", userHandler.CreateUser)
+	router.GET("/auth/verify", verificationHandler.VerifyEmail)
+	router.POST("/auth/verify/resend", verificationHandler.ResendVerification)
+
+	// Creating a user sends them a verification link
+	response := postJSON(router, "/users", usuario)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	assert.Equal(t, 1, len(notifier.messages))
+	assert.Equal(t, "john@example.com", notifier.messages[0].To)
+	path := verificationPath(t, notifier)
+	assert.True(t, strings.HasPrefix(path, "/auth/verify?token="))
+
+	// Resending within the interval is accepted but sends nothing
+	response = postJSON(router, "/auth/verify/resend", gin.H{"email": "john@example.com"})
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Equal(t, 1, len(notifier.messages))
+
+	// Invalid links are rejected
+	for _, invalid := range []string{"/auth/verify", "/auth/verify?token=unknown"} {
+		response = httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, invalid, nil)
+		router.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	}
+
+	// The link verifies the email once
+	response = httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, path, nil)
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.True(t, users.userFinderMock[0].EmailVerified)
+
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodGet, path, nil)
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	mockUserService.AssertExpectations(t)
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"simplecrud/pkg/logging/logtest"
+)
+
+// testFixtures are the personal data and passwords seeded by the handler tests, which must never
+// appear in the logs.
+var testFixtures = []string{
+	// Emails
+	"alice@example.com", "bob@example.com", "john@example.com", "nobody@example.com", "root@example.com", "teste@teste.com.br",
+	// Addresses
+	"Rua Romao Batista", "1 Main St",
+	// Passwords
+	"P@ssword123", "P@ssword7", "N3w@Passw0rd", "Old#Passw0rd", "P@sswoooord7", "Correct-Horse-42", "johnjohn",
+}
+
+// TestMain runs the handler tests while capturing their logs, and fails the suite if any log line
+// contains one of the test fixtures.
+func TestMain(m *testing.M) {
+	logs, restore := logtest.Capture()
+	code := m.Run()
+	restore()
+
+	if leaks := logs.Leaks(testFixtures...); len(leaks) > 0 {
+		fmt.Fprintln(os.Stderr, "Log lines leaking personal data or credentials:")
+		for _, leak := range leaks {
+			fmt.Fprintln(os.Stderr, "\t"+leak)
+		}
+		code = 1
+	}
+	os.Exit(code)
+}
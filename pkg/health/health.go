@@ -0,0 +1,145 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// CacheTTLKey configures how long the result of the dependency checks is reused.
+	CacheTTLKey     = "HEALTH_CACHE_TTL"
+	DefaultCacheTTL = 2 * time.Second
+	// TimeoutKey configures how long each dependency check may take.
+	TimeoutKey     = "HEALTH_CHECK_TIMEOUT"
+	DefaultTimeout = 2 * time.Second
+)
+
+// Statuses reported for dependencies and for the service as a whole.
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// Checker checks that a dependency works.
+type Checker interface {
+	// Check returns an error if the dependency is unhealthy.
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc adapts a function to the Checker interface.
+type CheckerFunc func(ctx context.Context) error
+
+// Check calls f.
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Dependency is a named dependency of the service. The service is not ready while a critical
+// dependency is unhealthy; other dependencies are only reported.
+type Dependency struct {
+	Name     string
+	Checker  Checker
+	Critical bool
+}
+
+// Result is the outcome of checking one dependency.
+type Result struct {
+	Status    string  `json:"status"`
+	Critical  bool    `json:"critical"`
+	LatencyMS float64 `json:"latency_ms"`      // How long the check took in milliseconds
+	Error     string  `json:"error,omitempty"` // Why the dependency is down
+}
+
+// Report is the outcome of checking every dependency.
+type Report struct {
+	Status    string            `json:"status"`
+	CheckedAt time.Time         `json:"checked_at"`
+	Checks    map[string]Result `json:"checks"`
+}
+
+// Healthy reports whether every critical dependency is up.
+func (r Report) Healthy() bool {
+	return r.Status == StatusUp
+}
+
+// Monitor checks the dependencies of the service. Results are cached for a short time, and concurrent
+// callers share a single round of checks, so frequent probes do not overload the dependencies.
+type Monitor struct {
+	dependencies []Dependency
+	ttl          time.Duration // How long a report is reused
+	timeout      time.Duration // How long each check may take
+	now          func() time.Time
+
+	mu     sync.Mutex
+	cached *Report
+}
+
+// NewMonitor creates a monitor checking the given dependencies, each within the timeout, and reusing
+// its report for ttl.
+func NewMonitor(ttl, timeout time.Duration, dependencies ...Dependency) *Monitor {
+	return &Monitor{
+		dependencies: dependencies,
+		ttl:          ttl,
+		timeout:      timeout,
+		now:          time.Now,
+	}
+}
+
+// Check returns the health of the dependencies, checking them again if the cached report expired.
+// Callers arriving while the dependencies are checked wait for that round and share its report.
+func (m *Monitor) Check() Report {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cached != nil && m.now().Sub(m.cached.CheckedAt) < m.ttl {
+		return *m.cached
+	}
+
+	report := m.run()
+	m.cached = &report
+	return report
+}
+
+// run checks every dependency concurrently and returns the report.
+func (m *Monitor) run() Report {
+	results := make([]Result, len(m.dependencies))
+	var wg sync.WaitGroup
+	for i, dependency := range m.dependencies {
+		wg.Add(1)
+		go func(i int, dependency Dependency) {
+			defer wg.Done()
+			results[i] = m.check(dependency)
+		}(i, dependency)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusUp, CheckedAt: m.now(), Checks: make(map[string]Result, len(results))}
+	for i, dependency := range m.dependencies {
+		report.Checks[dependency.Name] = results[i]
+		if dependency.Critical && results[i].Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+// check checks one dependency within the timeout.
+func (m *Monitor) check(dependency Dependency) Result {
+	// The check does not use the context of the request that triggered it: if that request went away,
+	// the other callers waiting for the report would get its cancellation as the dependency's status.
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := dependency.Checker.Check(ctx)
+	result := Result{
+		Status:    StatusUp,
+		Critical:  dependency.Critical,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = StatusDown
+		result.Error = err.Error()
+	}
+	return result
+}
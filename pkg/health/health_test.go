@@ -0,0 +1,70 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMonitor checks the report of critical and optional dependencies.
+func TestMonitor(t *testing.T) {
+	up := CheckerFunc(func(ctx context.Context) error { return nil })
+	down := CheckerFunc(func(ctx context.Context) error { return errors.New("connection refused") })
+
+	report := NewMonitor(0, time.Second,
+		Dependency{Name: "mongodb", Checker: up, Critical: true},
+		Dependency{Name: "vault", Checker: down},
+	).Check()
+	assert.True(t, report.Healthy(), "optional dependencies do not make the service unhealthy")
+	assert.Equal(t, StatusUp, report.Checks["mongodb"].Status)
+	assert.Equal(t, StatusDown, report.Checks["vault"].Status)
+	assert.Equal(t, "connection refused", report.Checks["vault"].Error)
+
+	report = NewMonitor(0, time.Second, Dependency{Name: "mongodb", Checker: down, Critical: true}).Check()
+	assert.False(t, report.Healthy())
+	assert.Equal(t, StatusDown, report.Status)
+}
+
+// TestMonitorTimeout checks that a dependency not answering in time is reported down.
+func TestMonitorTimeout(t *testing.T) {
+	hanging := CheckerFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	report := NewMonitor(0, 10*time.Millisecond, Dependency{Name: "mongodb", Checker: hanging, Critical: true}).Check()
+	assert.False(t, report.Healthy())
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks["mongodb"].Error)
+}
+
+// TestMonitorCache checks that reports are reused until they expire, and that concurrent callers share one round of checks.
+func TestMonitorCache(t *testing.T) {
+	var calls atomic.Int32
+	slow := CheckerFunc(func(ctx context.Context) error {
+		calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	monitor := NewMonitor(time.Minute, time.Second, Dependency{Name: "mongodb", Checker: slow, Critical: true})
+	now := time.Now()
+	monitor.now = func() time.Time { return now }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.True(t, monitor.Check().Healthy())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+
+	now = now.Add(time.Minute)
+	monitor.Check()
+	assert.Equal(t, int32(2), calls.Load())
+}
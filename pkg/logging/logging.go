@@ -0,0 +1,220 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"simplecrud/pkg/redact"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// LevelKey configures the least severe level logged: debug, info, warn or error.
+	LevelKey     = "LOG_LEVEL"
+	DefaultLevel = "info"
+	// FormatKey configures how log lines are written: FormatJSON or FormatText.
+	FormatKey     = "LOG_FORMAT"
+	FormatJSON    = "json"
+	FormatText    = "text"
+	DefaultFormat = FormatJSON
+	// OutputKey configures where logs are written: OutputStdout, OutputStderr, or the path of a file
+	// the logs are appended to.
+	OutputKey     = "LOG_OUTPUT"
+	OutputStdout  = "stdout"
+	OutputStderr  = "stderr"
+	DefaultOutput = OutputStdout
+	// RedactKey configures whether personal data and credentials are masked in log lines. Disabling it
+	// is only meant for development.
+	RedactKey     = "LOG_REDACT"
+	DefaultRedact = true
+)
+
+// Level is the severity of a log line.
+type Level uint32
+
+// Levels of log lines, from the most to the least severe. Logging at FatalLevel exits the program.
+const (
+	FatalLevel = Level(logrus.FatalLevel)
+	ErrorLevel = Level(logrus.ErrorLevel)
+	WarnLevel  = Level(logrus.WarnLevel)
+	InfoLevel  = Level(logrus.InfoLevel)
+	DebugLevel = Level(logrus.DebugLevel)
+)
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "fatal":
+		return FatalLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "debug":
+		return DebugLevel, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// String returns the name of the level.
+func (l Level) String() string {
+	return logrus.Level(l).String()
+}
+
+// Fields are the key and value pairs added to log lines.
+type Fields map[string]interface{}
+
+// Config configures a logger.
+type Config struct {
+	Level  Level     // Least severe level logged
+	Format string    // FormatJSON or FormatText
+	Output io.Writer // Where log lines are written
+	Redact bool      // Whether the default redactor masks sensitive values in log lines
+}
+
+// Logger writes log lines carrying a set of fields.
+type Logger struct {
+	entry *logrus.Entry
+}
+
+// New creates a logger from the configuration. It returns an error if the format is unknown.
+func New(cfg Config) (*Logger, error) {
+	logger := logrus.New()
+	switch cfg.Format {
+	case FormatJSON:
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	case FormatText:
+		logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	if cfg.Redact {
+		logger.SetFormatter(redactingFormatter{logger.Formatter})
+	}
+	logger.SetOutput(cfg.Output)
+	logger.SetLevel(logrus.Level(cfg.Level))
+	return &Logger{entry: logrus.NewEntry(logger)}, nil
+}
+
+// Setup creates the logger described by the level, format, output and redaction settings, and makes
+// it the default logger.
+func Setup(level, format, output string, redact bool) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	var w io.Writer
+	switch output {
+	case OutputStdout:
+		w = os.Stdout
+	case OutputStderr:
+		w = os.Stderr
+	default:
+		if w, err = os.OpenFile(output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600); err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+	}
+	logger, err := New(Config{Level: lvl, Format: format, Output: w, Redact: redact})
+	if err != nil {
+		return err
+	}
+	SetDefault(logger)
+	return nil
+}
+
+// With returns a logger adding the fields to every log line.
+func (l *Logger) With(fields Fields) *Logger {
+	return &Logger{entry: l.entry.WithFields(logrus.Fields(fields))}
+}
+
+// WithField returns a logger adding the field to every log line.
+func (l *Logger) WithField(key string, value interface{}) *Logger {
+	return &Logger{entry: l.entry.WithField(key, value)}
+}
+
+// WithError returns a logger adding the error to every log line, under the "error" field.
+func (l *Logger) WithError(err error) *Logger {
+	return &Logger{entry: l.entry.WithError(err)}
+}
+
+// Log writes the message at the given level.
+func (l *Logger) Log(level Level, msg string) {
+	if level == FatalLevel {
+		l.entry.Fatal(msg)
+		return
+	}
+	l.entry.Log(logrus.Level(level), msg)
+}
+
+// Debug writes the message at DebugLevel.
+func (l *Logger) Debug(msg string) { l.Log(DebugLevel, msg) }
+
+// Info writes the message at InfoLevel.
+func (l *Logger) Info(msg string) { l.Log(InfoLevel, msg) }
+
+// Warn writes the message at WarnLevel.
+func (l *Logger) Warn(msg string) { l.Log(WarnLevel, msg) }
+
+// Error writes the message at ErrorLevel.
+func (l *Logger) Error(msg string) { l.Log(ErrorLevel, msg) }
+
+// Fatal writes the message at FatalLevel and exits the program.
+func (l *Logger) Fatal(msg string) { l.Log(FatalLevel, msg) }
+
+// redactingFormatter masks the sensitive values of log lines with the default redactor before
+// formatting them.
+type redactingFormatter struct {
+	next logrus.Formatter
+}
+
+// Format masks the message and the fields of the entry, then formats it. Entries are copies made for
+// each line, so their fields can be changed.
+func (f redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	r := redact.Default()
+	entry.Message = r.String(entry.Message)
+	for key, value := range entry.Data {
+		entry.Data[key] = r.Value(key, value)
+	}
+	return f.next.Format(entry)
+}
+
+// defaultLogger is used outside requests, and by requests that carry no logger.
+var defaultLogger atomic.Pointer[Logger]
+
+func init() {
+	logger, _ := New(Config{Level: InfoLevel, Format: DefaultFormat, Output: os.Stdout, Redact: DefaultRedact})
+	SetDefault(logger)
+}
+
+// Default returns the default logger.
+func Default() *Logger {
+	return defaultLogger.Load()
+}
+
+// SetDefault replaces the default logger. It returns the previous one, so tests can restore it.
+func SetDefault(l *Logger) *Logger {
+	return defaultLogger.Swap(l)
+}
+
+// loggerKey is the context key under which the logger of a request is stored.
+type loggerKey struct{}
+
+// NewContext returns a copy of ctx carrying the logger.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger carried by the context, or the default logger if it carries none.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
@@ -0,0 +1,107 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestContextLogger checks that the logger carried by a context adds its fields to every line, and
+// that contexts without a logger use the default one.
+func TestContextLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger, err := New(Config{Level: InfoLevel, Format: FormatJSON, Output: &logs})
+	require.NoError(t, err)
+	defer SetDefault(SetDefault(logger))
+
+	FromContext(context.Background()).Info("Default logger")
+	ctx := NewContext(context.Background(), logger.WithField("request_id", "req-1"))
+	FromContext(ctx).WithError(errors.New("connection refused")).With(Fields{"attempt": 2}).Error("Request logger")
+
+	var lines []map[string]interface{}
+	decoder := json.NewDecoder(&logs)
+	for decoder.More() {
+		var line map[string]interface{}
+		require.NoError(t, decoder.Decode(&line))
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 2)
+	assert.Equal(t, "Default logger", lines[0]["msg"])
+	assert.NotContains(t, lines[0], "request_id")
+	assert.Equal(t, "Request logger", lines[1]["msg"])
+	assert.Equal(t, "error", lines[1]["level"])
+	assert.Equal(t, "req-1", lines[1]["request_id"])
+	assert.Equal(t, "connection refused", lines[1]["error"])
+	assert.Equal(t, float64(2), lines[1]["attempt"])
+}
+
+// TestLevelsAndFormats checks that lines below the configured level are dropped, and that the text
+// format is supported.
+func TestLevelsAndFormats(t *testing.T) {
+	var logs bytes.Buffer
+	logger, err := New(Config{Level: WarnLevel, Format: FormatText, Output: &logs})
+	require.NoError(t, err)
+
+	logger.Debug("debug line")
+	logger.Info("info line")
+	logger.Warn("warn line")
+	assert.NotContains(t, logs.String(), "info line")
+	assert.Contains(t, logs.String(), `level=warning msg="warn line"`)
+
+	_, err = New(Config{Level: InfoLevel, Format: "xml", Output: &logs})
+	assert.Error(t, err)
+
+	level, err := ParseLevel("WARNING")
+	require.NoError(t, err)
+	assert.Equal(t, WarnLevel, level)
+	_, err = ParseLevel("verbose")
+	assert.Error(t, err)
+}
+
+// TestRedaction checks that redacting loggers mask sensitive fields and the sensitive values found
+// in messages and other fields.
+func TestRedaction(t *testing.T) {
+	var logs bytes.Buffer
+	logger, err := New(Config{Level: InfoLevel, Format: FormatJSON, Output: &logs, Redact: true})
+	require.NoError(t, err)
+
+	logger.WithError(errors.New(`dup key: { email: "alice@example.com" }`)).
+		With(Fields{"password": "P@ssword123", "to": "bob@example.com", "status": 409}).
+		Error("Failed to create carol@example.com")
+	line := logs.String()
+	for _, leak := range []string{"alice@example.com", "P@ssword123", "bob@example.com", "carol@example.com"} {
+		assert.NotContains(t, line, leak)
+	}
+	assert.Contains(t, line, `"status":409`)
+	assert.Contains(t, line, `"msg":"Failed to create [REDACTED]"`)
+
+	// Loggers without redaction write values as they are
+	logs.Reset()
+	logger, err = New(Config{Level: InfoLevel, Format: FormatJSON, Output: &logs})
+	require.NoError(t, err)
+	logger.WithField("to", "bob@example.com").Info("Notification logged")
+	assert.Contains(t, logs.String(), "bob@example.com")
+}
+
+// TestSetup checks that Setup replaces the default logger with one writing to the configured file.
+func TestSetup(t *testing.T) {
+	defer SetDefault(Default())
+	file := filepath.Join(t.TempDir(), "api.log")
+	require.NoError(t, Setup("debug", FormatJSON, file, true))
+	Default().Debug("written to the file")
+
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.True(t, strings.Contains(string(content), `"msg":"written to the file"`))
+
+	assert.Error(t, Setup("info", FormatJSON, filepath.Join(t.TempDir(), "missing", "api.log"), true))
+	assert.Error(t, Setup("loud", FormatJSON, OutputStdout, true))
+}
@@ -0,0 +1,85 @@
+package logtest
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"simplecrud/pkg/logging"
+)
+
+// Recorder keeps the log lines written to it. It is safe for concurrent use.
+type Recorder struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write appends log lines to the recorder.
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(p)
+}
+
+// String returns the log lines written so far.
+func (r *Recorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.String()
+}
+
+// Leaks returns the log lines containing any of the given values, such as the emails, addresses and
+// passwords seeded by the tests. It looks for the values themselves rather than for the patterns the
+// redactor masks, so it also catches the personal data the redactor misses.
+func (r *Recorder) Leaks(values ...string) []string {
+	var leaks []string
+	scanner := bufio.NewScanner(strings.NewReader(r.String()))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if containsAny(line, values) {
+			leaks = append(leaks, line)
+		}
+	}
+	return leaks
+}
+
+// containsAny reports whether the line contains one of the non-empty values.
+func containsAny(line string, values []string) bool {
+	for _, value := range values {
+		if value != "" && strings.Contains(line, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Capture makes the default logger write every level to a new recorder, redacting lines as in
+// production. It returns the recorder and a function restoring the previous default logger.
+func Capture() (*Recorder, func()) {
+	recorder := &Recorder{}
+	logger, _ := logging.New(logging.Config{
+		Level:  logging.DebugLevel,
+		Format: logging.FormatJSON,
+		Output: recorder,
+		Redact: logging.DefaultRedact,
+	})
+	previous := logging.SetDefault(logger)
+	return recorder, func() { logging.SetDefault(previous) }
+}
+
+// CheckLeaks captures the logs of the test like Capture, and fails the test when it ends if they
+// contain any of the given values.
+func CheckLeaks(t testing.TB, values ...string) *Recorder {
+	t.Helper()
+	recorder, restore := Capture()
+	t.Cleanup(func() {
+		restore()
+		for _, leak := range recorder.Leaks(values...) {
+			t.Errorf("log line leaks personal data or credentials: %s", leak)
+		}
+	})
+	return recorder
+}
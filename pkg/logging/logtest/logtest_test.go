@@ -0,0 +1,26 @@
+package logtest
+
+import (
+	"testing"
+
+	"simplecrud/pkg/logging"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLeaks checks that captured lines are redacted, and that the lines containing a given value are
+// reported, including values the redactor does not recognize.
+func TestLeaks(t *testing.T) {
+	recorder, restore := Capture()
+	logging.Default().WithField("to", "alice@example.com").Info("Notification logged")
+	logging.Default().WithField("body", "Your password is P@ssword123").Info("Notification logged")
+	logging.Default().WithField("shipping", "Rua Romao Batista").Info("Order shipped")
+	restore()
+
+	assert.NotContains(t, recorder.String(), "alice@example.com")
+	leaks := recorder.Leaks("alice@example.com", "P@ssword123", "Rua Romao Batista")
+	if assert.Len(t, leaks, 2) {
+		assert.Contains(t, leaks[0], `"body":"Your password is P@ssword123"`)
+		assert.Contains(t, leaks[1], `"shipping":"Rua Romao Batista"`)
+	}
+}
@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"simplecrud/pkg/logging"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const (
+	// AdminPortKey configures the admin port serving /metrics, separate from the API port so it is not
+	// exposed with the API. An empty value disables the metrics.
+	AdminPortKey     = "METRICS_PORT"
+	DefaultAdminPort = "9090"
+
+	namespace = "simplecrud" // Prefix of every metric of the API
+)
+
+// unmatchedRoute labels the requests to unregistered paths, so unknown paths do not create a series each.
+const unmatchedRoute = "unmatched"
+
+// Metrics collects the metrics of the API and exposes them to Prometheus.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests  *prometheus.CounterVec
+	httpDuration  *prometheus.HistogramVec
+	rateLimited   *prometheus.CounterVec
+	mongoDuration *prometheus.HistogramVec
+	mongoPool     *prometheus.GaugeVec
+	mongoCheckout *prometheus.CounterVec
+	vaultRequests *prometheus.CounterVec
+	vaultTokenTTL prometheus.Gauge
+}
+
+// New creates the metrics of the API, together with the Go runtime and process metrics.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "http", Name: "requests_total",
+			Help: "HTTP requests handled, by method, route and status.",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "http", Name: "request_duration_seconds",
+			Help:    "Time taken to handle HTTP requests, by method, route and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "http", Name: "rate_limited_total",
+			Help: "HTTP requests rejected by a rate limiter, by limiter.",
+		}, []string{"limiter"}),
+		mongoDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "mongodb", Name: "command_duration_seconds",
+			Help:    "Time taken by MongoDB commands, by command and outcome.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"command", "outcome"}),
+		mongoPool: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "mongodb", Name: "pool_connections",
+			Help: "Connections of the MongoDB pool, by state: open, or in use by an operation.",
+		}, []string{"state"}),
+		mongoCheckout: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "mongodb", Name: "pool_checkout_failures_total",
+			Help: "Failures to get a connection from the MongoDB pool, by reason.",
+		}, []string{"reason"}),
+		vaultRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "vault", Name: "requests_total",
+			Help: "Requests made to Vault, by method, path and status.",
+		}, []string{"method", "path", "status"}),
+		vaultTokenTTL: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "vault", Name: "token_ttl_seconds",
+			Help: "Time left before the Vault token expires, as of the last readiness check; 0 if it never expires.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests, m.httpDuration, m.rateLimited,
+		m.mongoDuration, m.mongoPool, m.mongoCheckout,
+		m.vaultRequests, m.vaultTokenTTL,
+	)
+	return m
+}
+
+// Handler returns the HTTP handler exposing the metrics to Prometheus.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// Middleware returns a gin middleware counting and timing every request by method, route and status.
+// Routes are labelled by their pattern, such as /users/:id, to keep the number of series bounded.
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		m.httpRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+		m.httpDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// RateLimited returns a function counting a request rejected by the rate limiter with the given name.
+func (m *Metrics) RateLimited(limiter string) func() {
+	return m.rateLimited.WithLabelValues(limiter).Inc
+}
+
+// CommandMonitor returns the MongoDB command monitor timing every command.
+func (m *Metrics) CommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			m.mongoDuration.WithLabelValues(e.CommandName, "success").Observe(e.Duration.Seconds())
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			m.mongoDuration.WithLabelValues(e.CommandName, "failure").Observe(e.Duration.Seconds())
+		},
+	}
+}
+
+// PoolMonitor returns the MongoDB pool monitor tracking the connection pool.
+func (m *Metrics) PoolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{Event: m.observePool}
+}
+
+// observePool updates the pool metrics with an event of the MongoDB connection pool.
+func (m *Metrics) observePool(e *event.PoolEvent) {
+	switch e.Type {
+	case event.ConnectionCreated:
+		m.mongoPool.WithLabelValues("open").Inc()
+	case event.ConnectionClosed:
+		m.mongoPool.WithLabelValues("open").Dec()
+	case event.GetSucceeded:
+		m.mongoPool.WithLabelValues("in_use").Inc()
+	case event.ConnectionReturned:
+		m.mongoPool.WithLabelValues("in_use").Dec()
+	case event.GetFailed:
+		m.mongoCheckout.WithLabelValues(e.Reason).Inc()
+	}
+}
+
+// InstrumentVault wraps the transport of the Vault client to count the requests made to Vault.
+func (m *Metrics) InstrumentVault(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		response, err := next.RoundTrip(r)
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(response.StatusCode)
+		}
+		m.vaultRequests.WithLabelValues(r.Method, r.URL.Path, status).Inc()
+		return response, err
+	})
+}
+
+// SetVaultTokenTTL records the time left before the Vault token expires.
+func (m *Metrics) SetVaultTokenTTL(ttl time.Duration) {
+	m.vaultTokenTTL.Set(ttl.Seconds())
+}
+
+// roundTripperFunc adapts a function to the http.RoundTripper interface.
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+// RoundTrip calls f.
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// StartServer serves the metrics on the admin port in the background. It returns the server, to be
+// stopped with Shutdown, or an error if the port cannot be opened.
+func (m *Metrics) StartServer(port string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on admin port %s: %w", port, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Default().WithError(err).Error("Metrics server stopped")
+		}
+	}()
+	return server, nil
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// TestMiddleware checks that requests are counted by route pattern and status, and rate limited requests by limiter.
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := New()
+	limited := false
+	rejected := m.RateLimited("global")
+
+	router := gin.New()
+	router.Use(m.Middleware())
+	router.GET("/users/:id", func(c *gin.Context) {
+		if limited {
+			rejected()
+			c.AbortWithStatus(http.StatusTooManyRequests)
+			return
+		}
+		limited = true
+		c.Next()
+	}, func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	for _, path := range []string{"/users/1", "/users/1", "/unknown"} {
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		request.RemoteAddr = "192.0.2.1:1234"
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.httpRequests.WithLabelValues(http.MethodGet, "/users/:id", "204")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.httpRequests.WithLabelValues(http.MethodGet, "/users/:id", "429")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.httpRequests.WithLabelValues(http.MethodGet, unmatchedRoute, "404")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.rateLimited.WithLabelValues("global")))
+}
+
+// TestMongoAndVault checks the metrics collected from the MongoDB driver events and the Vault transport.
+func TestMongoAndVault(t *testing.T) {
+	m := New()
+	commands, pool := m.CommandMonitor(), m.PoolMonitor()
+	commands.Succeeded(context.Background(), &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "find", Duration: time.Millisecond}})
+	commands.Failed(context.Background(), &event.CommandFailedEvent{CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "insert", Duration: time.Millisecond}})
+	for _, eventType := range []string{event.ConnectionCreated, event.ConnectionCreated, event.GetSucceeded, event.GetSucceeded, event.ConnectionReturned} {
+		pool.Event(&event.PoolEvent{Type: eventType})
+	}
+	pool.Event(&event.PoolEvent{Type: event.GetFailed, Reason: event.ReasonTimedOut})
+
+	assert.Equal(t, 2, testutil.CollectAndCount(m.mongoDuration), "one series per command and outcome")
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.mongoPool.WithLabelValues("open")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.mongoPool.WithLabelValues("in_use")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.mongoCheckout.WithLabelValues(event.ReasonTimedOut)))
+
+	vaultServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer vaultServer.Close()
+	client := &http.Client{Transport: m.InstrumentVault(http.DefaultTransport)}
+	response, err := client.Get(vaultServer.URL + "/v1/auth/token/lookup-self")
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.vaultRequests.WithLabelValues(http.MethodGet, "/v1/auth/token/lookup-self", "403")))
+
+	// Every metric is exposed, together with the Go runtime metrics
+	m.SetVaultTokenTTL(time.Hour)
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	assert.True(t, strings.Contains(string(body), "simplecrud_vault_token_ttl_seconds 3600"))
+	assert.True(t, strings.Contains(string(body), "go_goroutines"))
+}
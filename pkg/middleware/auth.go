@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"simplecrud/pkg/audit"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/problem"
+	"simplecrud/pkg/user"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scheme prefixes expected in the Authorization header.
+const (
+	bearerPrefix = "Bearer "
+	apiKeyPrefix = "ApiKey "
+)
+
+// RequireAuth returns a gin middleware that rejects requests without a valid access token.
+// The token is read from the "Authorization: Bearer <token>" header. On success the token
+// claims and the caller's user.Principal are stored in the request context.
+func RequireAuth(tokens *auth.TokenManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authenticateBearer(c, tokens) {
+			c.Next()
+		}
+	}
+}
+
+// RequireAuthOrAPIKey returns a gin middleware that accepts either a valid access token, like RequireAuth,
+// or an API key granted the given scope, read from the "Authorization: ApiKey <key>" header.
+// API keys act with the user.RoleService role, limited to the routes their scopes allow.
+// If keys is nil, only access tokens are accepted.
+func RequireAuthOrAPIKey(tokens *auth.TokenManager, keys *auth.APIKeyService, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if keys == nil || !strings.HasPrefix(header, apiKeyPrefix) {
+			if authenticateBearer(c, tokens) {
+				c.Next()
+			}
+			return
+		}
+
+		key, err := keys.Authenticate(c.Request.Context(), strings.TrimSpace(strings.TrimPrefix(header, apiKeyPrefix)))
+		if err != nil {
+			if errors.Is(err, auth.ErrInvalidAPIKey) {
+				unauthorized(c, "Invalid, expired or revoked API key")
+			} else {
+				c.Error(err)
+				c.Abort()
+			}
+			return
+		}
+		if !auth.HasScope(key, scope) {
+			c.Error(problem.New(http.StatusForbidden, "API key lacks the "+scope+" scope"))
+			c.Abort()
+			return
+		}
+
+		ctx := auth.WithAPIKey(c.Request.Context(), key)
+		ctx = user.WithPrincipal(ctx, user.Principal{UserID: key.ID.Hex(), Role: user.RoleService})
+		c.Request = c.Request.WithContext(ctx)
+		// API keys belong to the platform, not to a tenant.
+		if bindTenant(c, "") {
+			c.Next()
+		}
+	}
+}
+
+// authenticateBearer validates the access token of the request and stores the caller in the request context.
+// It reports whether the caller was authenticated; otherwise the request has been aborted.
+func authenticateBearer(c *gin.Context, tokens *auth.TokenManager) bool {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		unauthorized(c, "Authorization header with a Bearer token is required")
+		return false
+	}
+
+	claims, err := tokens.Parse(strings.TrimSpace(strings.TrimPrefix(header, bearerPrefix)))
+	if err != nil {
+		unauthorized(c, "Invalid or expired token")
+		return false
+	}
+
+	// Make the claims available to handlers and, through the context, to the service layer.
+	ctx := auth.WithClaims(c.Request.Context(), claims)
+	ctx = user.WithPrincipal(ctx, user.Principal{UserID: claims.Subject, Role: claims.Role, OrgID: claims.OrgID, OrgRole: claims.OrgRole})
+	// Mark everything done with an impersonation token as done by the admin behind it.
+	if actorID := claims.ImpersonatorID(); actorID != "" {
+		ctx = audit.WithImpersonator(ctx, actorID)
+	}
+	c.Request = c.Request.WithContext(ctx)
+	return bindTenant(c, claims.OrgID)
+}
+
+// RequireRole returns a gin middleware that only lets through callers having one of the given roles.
+// It must run after RequireAuth. The service layer enforces the same rules; this check
+// rejects requests early, before any request body is read.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, ok := user.PrincipalFromContext(c.Request.Context())
+		if !ok {
+			unauthorized(c, "Authentication required")
+			return
+		}
+		for _, role := range roles {
+			if p.Role == role {
+				c.Next()
+				return
+			}
+		}
+		c.Error(problem.New(http.StatusForbidden, "You are not allowed to perform this operation"))
+		c.Abort()
+	}
+}
+
+// RequireUserManager returns a gin middleware that only lets through admins, callers acting as admins
+// of an organization, and API keys. It must run after RequireAuth or RequireAuthOrAPIKey. The service
+// layer limits organization admins to the members of their organization, and keeps API keys away from admins.
+func RequireUserManager() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, ok := user.PrincipalFromContext(c.Request.Context())
+		if !ok {
+			unauthorized(c, "Authentication required")
+			return
+		}
+		if !p.IsAdmin() && !p.IsOrgAdmin() && !p.IsService() {
+			c.Error(problem.New(http.StatusForbidden, "You are not allowed to perform this operation"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// unauthorized aborts the request with a 401 response and a WWW-Authenticate challenge.
+func unauthorized(c *gin.Context, msg string) {
+	c.Header("WWW-Authenticate", `Bearer realm="simplecrud"`)
+	c.Error(problem.New(http.StatusUnauthorized, msg))
+	c.Abort()
+}
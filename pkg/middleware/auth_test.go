@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/user"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestTokenManager creates a TokenManager with a fixed key for tests.
+func newTestTokenManager(t *testing.T) *auth.TokenManager {
+	tokens, err := auth.NewTokenManager([]byte("0123456789abcdef0123456789abcdef"), time.Minute)
+	require.NoError(t, err)
+	return tokens
+}
+
+func TestRequireAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newTestTokenManager(t)
+	user := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com"}
+	token, _, err := tokens.Issue(user)
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.Use(Errors())
+	router.GET("/protected", RequireAuth(tokens), func(c *gin.Context) {
+		claims, ok := auth.ClaimsFromContext(c.Request.Context())
+		require.True(t, ok)
+		c.String(http.StatusOK, claims.Subject)
+	})
+
+	// Missing header
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/protected", nil)
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.NotEmpty(t, response.Header().Get("WWW-Authenticate"))
+
+	// Invalid token
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodGet, "/protected", nil)
+	request.Header.Set("Authorization", "Bearer not-a-token")
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// Valid token
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodGet, "/protected", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, user.ID.Hex(), response.Body.String())
+}
+
+func TestRequireRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newTestTokenManager(t)
+	adminToken, _, err := tokens.Issue(models.User{ID: primitive.NewObjectID(), Role: user.RoleAdmin})
+	require.NoError(t, err)
+	userToken, _, err := tokens.Issue(models.User{ID: primitive.NewObjectID(), Role: user.RoleUser})
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.Use(Errors())
+	router.GET("/admin", RequireAuth(tokens), RequireRole(user.RoleAdmin), func(c *gin.Context) {
+		p, ok := user.PrincipalFromContext(c.Request.Context())
+		require.True(t, ok)
+		c.String(http.StatusOK, p.Role)
+	})
+
+	// Regular user is forbidden
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/admin", nil)
+	request.Header.Set("Authorization", "Bearer "+userToken)
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+
+	// Admin is allowed
+	response = httptest.NewRecorder()
+	request, _ = http.NewRequest(http.MethodGet, "/admin", nil)
+	request.Header.Set("Authorization", "Bearer "+adminToken)
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, user.RoleAdmin, response.Body.String())
+}
+
+func TestRequireUserManager(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newTestTokenManager(t)
+	org := primitive.NewObjectID()
+	issue := func(u models.User) string {
+		token, _, err := tokens.Issue(u)
+		require.NoError(t, err)
+		return token
+	}
+	adminToken := issue(models.User{ID: primitive.NewObjectID(), Role: user.RoleAdmin})
+	orgAdminToken := issue(models.User{ID: primitive.NewObjectID(), Role: user.RoleUser,
+		Memberships: []models.Membership{{OrganizationID: org, Role: user.OrgRoleAdmin}}})
+	memberToken := issue(models.User{ID: primitive.NewObjectID(), Role: user.RoleUser,
+		Memberships: []models.Membership{{OrganizationID: org, Role: user.OrgRoleMember}}})
+
+	router := gin.New()
+	router.Use(Errors())
+	router.GET("/users", RequireAuth(tokens), RequireUserManager(), func(c *gin.Context) {
+		p, ok := user.PrincipalFromContext(c.Request.Context())
+		require.True(t, ok)
+		c.String(http.StatusOK, p.OrgID)
+	})
+	request := func(token string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/users", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(response, req)
+		return response
+	}
+
+	assert.Equal(t, http.StatusOK, request(adminToken).Code)
+	response := request(orgAdminToken)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, org.Hex(), response.Body.String(), "the principal acts in the organization of the token")
+	assert.Equal(t, http.StatusForbidden, request(memberToken).Code)
+}
+
+// memoryAPIKeyRepository is an in-memory auth.APIKeyRepository for tests.
+type memoryAPIKeyRepository struct {
+	keys []models.APIKey
+}
+
+func (m *memoryAPIKeyRepository) Create(ctx context.Context, key models.APIKey) error {
+	m.keys = append(m.keys, key)
+	return nil
+}
+
+func (m *memoryAPIKeyRepository) FindByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	for _, key := range m.keys {
+		if key.KeyHash == keyHash {
+			return key, nil
+		}
+	}
+	return models.APIKey{}, auth.ErrAPIKeyNotFound
+}
+
+func (m *memoryAPIKeyRepository) FindAll(ctx context.Context) ([]models.APIKey, error) {
+	return m.keys, nil
+}
+
+func (m *memoryAPIKeyRepository) Revoke(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	for i, key := range m.keys {
+		if key.ID == id {
+			m.keys[i].RevokedAt = &at
+			return nil
+		}
+	}
+	return auth.ErrAPIKeyNotFound
+}
+
+func (m *memoryAPIKeyRepository) TouchLastUsed(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	return nil
+}
+
+func TestRequireAuthOrAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newTestTokenManager(t)
+	keys := auth.NewAPIKeyService(&memoryAPIKeyRepository{}, nil)
+	readKey, _, err := keys.Create(context.Background(), "reader", []string{auth.ScopeUsersRead}, nil, "admin-id")
+	require.NoError(t, err)
+	writeKey, _, err := keys.Create(context.Background(), "writer", []string{auth.ScopeUsersWrite}, nil, "admin-id")
+	require.NoError(t, err)
+	token, _, err := tokens.Issue(models.User{ID: primitive.NewObjectID(), Role: user.RoleUser, EmailVerified: true})
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.Use(Errors())
+	router.GET("/users", RequireAuthOrAPIKey(tokens, keys, auth.ScopeUsersRead), RequireVerifiedEmail(UnverifiedAccessNone), RequireUserManager(), func(c *gin.Context) {
+		_, ok := auth.APIKeyFromContext(c.Request.Context())
+		require.True(t, ok)
+		c.Status(http.StatusOK)
+	})
+	get := func(authorization string) int {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodGet, "/users", nil)
+		request.Header.Set("Authorization", authorization)
+		router.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	// A key with the scope manages users without an email address
+	assert.Equal(t, http.StatusOK, get("ApiKey "+readKey))
+	// A key without the scope is forbidden
+	assert.Equal(t, http.StatusForbidden, get("ApiKey "+writeKey))
+	// Unknown keys are rejected
+	assert.Equal(t, http.StatusUnauthorized, get("ApiKey sck_000000000000_unknown"))
+	// Access tokens are still accepted; this user may not list users
+	assert.Equal(t, http.StatusForbidden, get("Bearer "+token))
+	assert.Equal(t, http.StatusUnauthorized, get(""))
+
+	// Without an API key service, API keys are not accepted at all
+	router = gin.New()
+	router.Use(Errors())
+	router.GET("/users", RequireAuthOrAPIKey(tokens, nil, auth.ScopeUsersRead), func(c *gin.Context) { c.Status(http.StatusOK) })
+	assert.Equal(t, http.StatusUnauthorized, get("ApiKey "+readKey))
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/problem"
+	"simplecrud/pkg/requestid"
+	"simplecrud/pkg/user"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// kindProblems are the problems answered for each kind of error, unless the error has a detail of its own.
+var kindProblems = map[user.Kind]struct {
+	status int
+	detail string
+}{
+	user.KindInvalid:         {http.StatusBadRequest, "The request is invalid"},
+	user.KindUnauthenticated: {http.StatusUnauthorized, "Invalid email or password"},
+	user.KindForbidden:       {http.StatusForbidden, "You are not allowed to perform this operation"},
+	user.KindNotFound:        {http.StatusNotFound, "User not found"},
+	user.KindConflict:        {http.StatusConflict, "The request conflicts with the current state of the resource"},
+}
+
+// jsonFieldNames makes the binding validator name fields after their JSON keys, as clients know them.
+var jsonFieldNames sync.Once
+
+// Errors returns a gin middleware answering the last error recorded with gin.Context.Error as problem
+// details, unless a response was written already. Problems are answered as they are, binding errors
+// list the rejected fields, and errors of a known kind (see user.Error) are answered according to it.
+// Any other error is logged and answered with a 500 Internal Server Error that does not reveal it.
+// It must be installed after the middleware reading the response status, such as AccessLog, and before
+// every middleware recording errors.
+func Errors() gin.HandlerFunc {
+	jsonFieldNames.Do(func() {
+		if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+			v.RegisterTagNameFunc(jsonFieldName)
+		}
+	})
+	return func(c *gin.Context) {
+		c.Next()
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+
+		p := toProblem(c, c.Errors.Last())
+		p.RequestID, _ = requestid.FromContext(c.Request.Context())
+		c.Header("Content-Type", problem.ContentType)
+		c.JSON(p.Status, p)
+	}
+}
+
+// toProblem returns the problem describing the error, logging errors of no known kind.
+func toProblem(c *gin.Context, ginErr *gin.Error) *problem.Problem {
+	err := ginErr.Err
+	var p *problem.Problem
+	if errors.As(err, &p) {
+		return p
+	}
+	if ginErr.IsType(gin.ErrorTypeBind) {
+		return bindingProblem(err)
+	}
+	var validationErr *user.ValidationError
+	if errors.As(err, &validationErr) {
+		return problem.Validation(validationErr.Errors)
+	}
+	if kind, ok := kindProblems[user.KindOf(err)]; ok {
+		detail := kind.detail
+		var kindErr *user.Error
+		if errors.As(err, &kindErr) && kindErr.Detail != "" {
+			detail = kindErr.Detail
+		}
+		return problem.New(kind.status, detail)
+	}
+
+	logging.FromContext(c.Request.Context()).WithError(err).Error("Request failed")
+	return &problem.Problem{
+		Type:   problem.TypeInternal,
+		Title:  http.StatusText(http.StatusInternalServerError),
+		Status: http.StatusInternalServerError,
+		Detail: "The request could not be completed; quote the request ID when reporting the problem",
+	}
+}
+
+// bindingProblem returns the problem describing why the request body could not be bound. Values sent
+// by the client are never echoed back.
+func bindingProblem(err error) *problem.Problem {
+	var fieldErrs validator.ValidationErrors
+	if errors.As(err, &fieldErrs) {
+		errs := make([]user.FieldError, 0, len(fieldErrs))
+		for _, fieldErr := range fieldErrs {
+			errs = append(errs, bindingFieldError(fieldErr))
+		}
+		return problem.Validation(errs)
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return problem.Validation([]user.FieldError{
+			{Field: typeErr.Field, Code: user.ViolationInvalid, Message: "must be of type " + typeErr.Type.String()},
+		})
+	}
+	return &problem.Problem{
+		Type:   problem.TypeInvalidBody,
+		Title:  "Invalid request body",
+		Status: http.StatusBadRequest,
+		Detail: "The request body must be a valid JSON document",
+	}
+}
+
+// bindingFieldError describes a field rejected by a binding tag.
+func bindingFieldError(fieldErr validator.FieldError) user.FieldError {
+	message := "is invalid"
+	switch fieldErr.Tag() {
+	case "required":
+		message = "is required"
+	case "email":
+		message = "must be a valid email address"
+	case "min":
+		message = "must be at least " + fieldErr.Param()
+	case "max":
+		message = "must be at most " + fieldErr.Param()
+	case "oneof":
+		message = "must be one of " + fieldErr.Param()
+	}
+	return user.FieldError{Field: fieldErr.Field(), Code: fieldErr.Tag(), Message: message}
+}
+
+// jsonFieldName returns the JSON key of a struct field, or its Go name if it has none.
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
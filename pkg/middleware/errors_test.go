@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/problem"
+	"simplecrud/pkg/requestid"
+	"simplecrud/pkg/user"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestErrors checks that recorded errors are answered as problem details, with the rejected fields of
+// validation errors, and that internal errors are logged but never sent to the client.
+func TestErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var logs bytes.Buffer
+	logger, err := logging.New(logging.Config{Level: logging.InfoLevel, Format: logging.FormatJSON, Output: &logs})
+	require.NoError(t, err)
+	defer logging.SetDefault(logging.SetDefault(logger))
+
+	router := gin.New()
+	router.Use(RequestID(), Errors())
+	router.GET("/problem", func(c *gin.Context) {
+		c.Error(problem.New(http.StatusConflict, "Already enabled"))
+	})
+	router.GET("/not-found", func(c *gin.Context) {
+		c.Error(fmt.Errorf("failed to find user: %w", user.ErrNotFound))
+	})
+	router.GET("/conflict", func(c *gin.Context) {
+		c.Error(fmt.Errorf("failed to remove member 42: %w", &user.Error{Kind: user.KindConflict, Message: "last admin", Detail: "Keep an admin"}))
+	})
+	router.GET("/invalid", func(c *gin.Context) {
+		c.Error(&user.ValidationError{Errors: []user.FieldError{{Field: "name", Code: user.ViolationInvalid, Message: "must be 3 to 50 letters and spaces"}}})
+	})
+	router.POST("/bind", func(c *gin.Context) {
+		var req struct {
+			Email string `json:"email" binding:"required,email"`
+			Age   int    `json:"age"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.Error(err).SetType(gin.ErrorTypeBind)
+		}
+	})
+	router.GET("/internal", func(c *gin.Context) {
+		c.Error(errors.New("connection to mongodb-0.internal:27017 refused"))
+	})
+	router.GET("/written", func(c *gin.Context) {
+		c.String(http.StatusTeapot, "short and stout")
+		c.Error(errors.New("ignored"))
+	})
+
+	request := func(method, path, body string) (*httptest.ResponseRecorder, problem.Problem) {
+		response := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(requestid.Header, "req-1")
+		router.ServeHTTP(response, req)
+		var p problem.Problem
+		if response.Header().Get("Content-Type") == problem.ContentType {
+			require.NoError(t, json.Unmarshal(response.Body.Bytes(), &p))
+		}
+		return response, p
+	}
+
+	response, p := request(http.MethodGet, "/problem", "")
+	assert.Equal(t, http.StatusConflict, response.Code)
+	assert.Equal(t, problem.Problem{Type: problem.TypeBlank, Title: "Conflict", Status: http.StatusConflict, Detail: "Already enabled", RequestID: "req-1"}, p)
+
+	response, p = request(http.MethodGet, "/not-found", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	assert.Equal(t, http.StatusNotFound, p.Status)
+	assert.Equal(t, "User not found", p.Detail)
+
+	// Errors of a known kind are answered with their own fixed detail, never with their message
+	response, p = request(http.MethodGet, "/conflict", "")
+	assert.Equal(t, http.StatusConflict, response.Code)
+	assert.Equal(t, "Keep an admin", p.Detail)
+	assert.NotContains(t, response.Body.String(), "42")
+
+	response, p = request(http.MethodGet, "/invalid", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Equal(t, problem.TypeValidation, p.Type)
+	assert.Equal(t, []user.FieldError{{Field: "name", Code: user.ViolationInvalid, Message: "must be 3 to 50 letters and spaces"}}, p.Errors)
+
+	// Binding errors name the fields after their JSON keys, without echoing the values
+	response, p = request(http.MethodPost, "/bind", `{"email": "not-an-email"}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Equal(t, []user.FieldError{{Field: "email", Code: "email", Message: "must be a valid email address"}}, p.Errors)
+	assert.NotContains(t, response.Body.String(), "not-an-email")
+	_, p = request(http.MethodPost, "/bind", `{"email": "alice@example.com", "age": "old"}`)
+	assert.Equal(t, []user.FieldError{{Field: "age", Code: user.ViolationInvalid, Message: "must be of type int"}}, p.Errors)
+	_, p = request(http.MethodPost, "/bind", `{"email":`)
+	assert.Equal(t, problem.TypeInvalidBody, p.Type)
+
+	// Internal errors are logged with the request ID, and answered without their message
+	response, p = request(http.MethodGet, "/internal", "")
+	assert.Equal(t, http.StatusInternalServerError, response.Code)
+	assert.Equal(t, problem.TypeInternal, p.Type)
+	assert.Equal(t, "req-1", p.RequestID)
+	assert.NotContains(t, response.Body.String(), "mongodb")
+	assert.Contains(t, logs.String(), `"error":"connection to mongodb-0.internal:27017 refused"`)
+	assert.Contains(t, logs.String(), `"request_id":"req-1"`)
+
+	// Responses written by the handler are left alone
+	response, _ = request(http.MethodGet, "/written", "")
+	assert.Equal(t, http.StatusTeapot, response.Code)
+	assert.Equal(t, "short and stout", response.Body.String())
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"net/http"
+	"simplecrud/pkg/audit"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/problem"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuditImpersonation returns a gin middleware that logs and audits every request made with an
+// impersonation token, naming both the admin and the impersonated user. It must be installed on
+// the router before the authentication middleware, and records the request once it is handled.
+func AuditImpersonation(recorder audit.Recorder) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		claims, ok := auth.ClaimsFromContext(c.Request.Context())
+		if !ok || claims.ImpersonatorID() == "" {
+			return
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		status := strconv.Itoa(c.Writer.Status())
+
+		logging.FromContext(c.Request.Context()).With(logging.Fields{
+			"impersonator_id": claims.ImpersonatorID(),
+			"subject_id":      claims.Subject,
+			"method":          c.Request.Method,
+			"route":           route,
+			"status":          status,
+		}).Info("Impersonated request")
+		audit.Record(c.Request.Context(), recorder, models.AuditEvent{
+			Type:      audit.EventImpersonatedRequest,
+			ActorID:   claims.ImpersonatorID(),
+			SubjectID: claims.Subject,
+			IP:        c.ClientIP(),
+			Details:   map[string]string{"method": c.Request.Method, "route": route, "status": status},
+		})
+	}
+}
+
+// ForbidImpersonation returns a gin middleware rejecting impersonation tokens, for routes that change
+// the credentials of the caller. It must run after RequireAuth.
+func ForbidImpersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := audit.ImpersonatorFromContext(c.Request.Context()); ok {
+			c.Error(problem.New(http.StatusForbidden, "This operation is not allowed while impersonating a user"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
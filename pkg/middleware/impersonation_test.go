@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"simplecrud/pkg/audit"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/user"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryRecorder keeps the audit events it is asked to record.
+type memoryRecorder struct {
+	mu     sync.Mutex
+	events []models.AuditEvent
+}
+
+// Record appends the event.
+func (m *memoryRecorder) Record(ctx context.Context, event models.AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+	return nil
+}
+
+// TestImpersonationMiddleware checks that impersonated requests are logged and audited,
+// and refused on routes forbidding impersonation.
+func TestImpersonationMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newTestTokenManager(t)
+	alice := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com", Role: user.RoleUser}
+	adminID := primitive.NewObjectID().Hex()
+	ownToken, _, err := tokens.Issue(alice)
+	require.NoError(t, err)
+	impersonationToken, _, err := tokens.IssueImpersonation(alice, adminID, "", time.Minute)
+	require.NoError(t, err)
+
+	var logs bytes.Buffer
+	logger, err := logging.New(logging.Config{Level: logging.InfoLevel, Format: logging.FormatJSON, Output: &logs})
+	require.NoError(t, err)
+	defer logging.SetDefault(logging.SetDefault(logger))
+
+	recorder := &memoryRecorder{}
+	router := gin.New()
+	router.Use(AuditImpersonation(recorder), Errors())
+	router.GET("/users/:id", RequireAuth(tokens), func(c *gin.Context) {
+		// Events recorded by the handler name the admin too
+		audit.Record(c.Request.Context(), recorder, models.AuditEvent{Type: "test.event"})
+		c.Status(http.StatusOK)
+	})
+	router.PUT("/users/:id/password", RequireAuth(tokens), ForbidImpersonation(), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	request := func(method, path, token string) int {
+		response := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(response, req)
+		return response.Code
+	}
+
+	// The user's own requests are not marked
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/users/"+alice.ID.Hex(), ownToken))
+	assert.Equal(t, http.StatusNoContent, request(http.MethodPut, "/users/"+alice.ID.Hex()+"/password", ownToken))
+	require.Len(t, recorder.events, 1)
+	assert.Empty(t, recorder.events[0].Details)
+	assert.Empty(t, logs.String())
+
+	recorder.events = nil
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/users/"+alice.ID.Hex(), impersonationToken))
+	require.Len(t, recorder.events, 2)
+	assert.Equal(t, adminID, recorder.events[0].Details["impersonator_id"])
+	event := recorder.events[1]
+	assert.Equal(t, audit.EventImpersonatedRequest, event.Type)
+	assert.Equal(t, adminID, event.ActorID)
+	assert.Equal(t, alice.ID.Hex(), event.SubjectID)
+	assert.Equal(t, map[string]string{"method": "GET", "route": "/users/:id", "status": "200", "impersonator_id": adminID}, event.Details)
+	assert.Contains(t, logs.String(), `"impersonator_id":"`+adminID+`"`)
+	assert.Contains(t, logs.String(), `"subject_id":"`+alice.ID.Hex()+`"`)
+
+	// Changing credentials is refused, and the attempt is audited as well
+	recorder.events = nil
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPut, "/users/"+alice.ID.Hex()+"/password", impersonationToken))
+	require.Len(t, recorder.events, 1)
+	assert.Equal(t, "403", recorder.events[0].Details["status"])
+}
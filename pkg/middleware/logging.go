@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/requestid"
+	"simplecrud/pkg/user"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestID returns a gin middleware giving every request an ID, taken from the X-Request-ID header
+// when the client sent a valid one and generated otherwise. The ID is stored in the request context,
+// together with a logger adding it to every log line of the request, and returned in the X-Request-ID
+// response header.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+		ctx := requestid.NewContext(c.Request.Context(), id)
+		ctx = logging.NewContext(ctx, logging.FromContext(ctx).WithField("request_id", id))
+		c.Request = c.Request.WithContext(ctx)
+		c.Header(requestid.Header, id)
+		c.Next()
+	}
+}
+
+// AccessLog returns a gin middleware writing one log line per request, once it is handled, with its
+// method, route, status, latency, client IP and the ID of the authenticated user. It must be installed
+// after RequestID and before the authentication middleware.
+func AccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		fields := logging.Fields{
+			"method":     c.Request.Method,
+			"route":      route,
+			"status":     c.Writer.Status(),
+			"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip":  c.ClientIP(),
+		}
+		if p, ok := user.PrincipalFromContext(c.Request.Context()); ok {
+			fields["user_id"] = p.UserID
+		}
+		logging.FromContext(c.Request.Context()).With(fields).Info("Request handled")
+	}
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/requestid"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestRequestID checks that valid request IDs sent by clients are kept, that other requests get a
+// generated one, and that the ID reaches the handler and the response.
+func TestRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RequestID())
+	router.GET("/resource", func(c *gin.Context) {
+		id, _ := requestid.FromContext(c.Request.Context())
+		c.String(http.StatusOK, id)
+	})
+
+	request := func(id string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/resource", nil)
+		if id != "" {
+			req.Header.Set(requestid.Header, id)
+		}
+		router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := request("upstream-1234")
+	assert.Equal(t, "upstream-1234", response.Body.String())
+	assert.Equal(t, "upstream-1234", response.Header().Get(requestid.Header))
+
+	for _, id := range []string{"", "not valid\nid"} {
+		response = request(id)
+		generated := response.Header().Get(requestid.Header)
+		assert.Len(t, generated, 32)
+		assert.Equal(t, generated, response.Body.String())
+	}
+	assert.NotEqual(t, request("").Body.String(), request("").Body.String())
+}
+
+// TestAccessLog checks that every request is logged once with the authenticated user, and that the
+// logs written while handling it carry the same request ID.
+func TestAccessLog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newTestTokenManager(t)
+	alice := models.User{ID: primitive.NewObjectID(), Email: "alice@example.com"}
+	token, _, err := tokens.Issue(alice)
+	require.NoError(t, err)
+
+	var logs bytes.Buffer
+	logger, err := logging.New(logging.Config{Level: logging.InfoLevel, Format: logging.FormatJSON, Output: &logs})
+	require.NoError(t, err)
+	defer logging.SetDefault(logging.SetDefault(logger))
+
+	router := gin.New()
+	router.Use(RequestID(), AccessLog())
+	router.GET("/users/:id", RequireAuth(tokens), func(c *gin.Context) {
+		logging.FromContext(c.Request.Context()).Warn("Handler log")
+		c.Status(http.StatusNoContent)
+	})
+	response := httptest.NewRecorder()
+	request, _ := http.NewRequest(http.MethodGet, "/users/"+alice.ID.Hex(), nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set(requestid.Header, "req-1")
+	request.RemoteAddr = "192.0.2.1:1234"
+	router.ServeHTTP(response, request)
+
+	var lines []map[string]interface{}
+	decoder := json.NewDecoder(&logs)
+	for decoder.More() {
+		var line map[string]interface{}
+		require.NoError(t, decoder.Decode(&line))
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 2)
+	assert.Equal(t, "Handler log", lines[0]["msg"])
+	assert.Equal(t, "req-1", lines[0]["request_id"])
+
+	access := lines[1]
+	assert.Equal(t, "req-1", access["request_id"])
+	assert.Equal(t, http.MethodGet, access["method"])
+	assert.Equal(t, "/users/:id", access["route"])
+	assert.Equal(t, float64(http.StatusNoContent), access["status"])
+	assert.Equal(t, "192.0.2.1", access["client_ip"])
+	assert.Equal(t, alice.ID.Hex(), access["user_id"])
+	assert.Contains(t, access, "latency_ms")
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"simplecrud/pkg/problem"
+	"simplecrud/pkg/tenant"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IsolateTenants returns a gin middleware isolating every request to a single tenant, for the database
+// tenancy mode. Requests made before logging in name their tenant in the X-Tenant-ID header or the
+// "tenant" query parameter; the others are bound to the tenant of their access token by the
+// authentication middleware, and rejected if they name another one. It must be installed on the router
+// before the authentication middleware.
+func IsolateTenants(registry tenant.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(tenant.Header)
+		if id == "" {
+			id = c.Query(tenant.QueryParam)
+		}
+		if id != "" {
+			if _, err := registry.Database(c.Request.Context(), id); err != nil {
+				if errors.Is(err, tenant.ErrUnknownTenant) {
+					c.Error(problem.New(http.StatusBadRequest, "Unknown tenant"))
+					c.Abort()
+				} else {
+					c.Error(err)
+					c.Abort()
+				}
+				return
+			}
+		}
+		c.Request = c.Request.WithContext(tenant.Isolate(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+// bindTenant binds the request to the tenant with the given ID, the organization the caller acts in.
+// It reports whether the request was bound; otherwise it named another tenant and has been aborted.
+func bindTenant(c *gin.Context, id string) bool {
+	ctx, err := tenant.Bind(c.Request.Context(), id)
+	if err != nil {
+		c.Error(problem.New(http.StatusForbidden, "You are not allowed to access this tenant"))
+		c.Abort()
+		return false
+	}
+	c.Request = c.Request.WithContext(ctx)
+	return true
+}
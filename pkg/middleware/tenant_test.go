@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/tenant"
+	"simplecrud/pkg/user"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryRegistry is an in-memory tenant.Registry knowing the given tenant IDs.
+type memoryRegistry []string
+
+func (m memoryRegistry) Database(ctx context.Context, id string) (string, error) {
+	for _, known := range m {
+		if known == id {
+			return "tenant_" + id, nil
+		}
+	}
+	return "", tenant.ErrUnknownTenant
+}
+
+func (m memoryRegistry) Remove(ctx context.Context, id string) error {
+	return nil
+}
+
+// TestIsolateTenants checks that requests are bound to the tenant of their token and cannot name another one.
+func TestIsolateTenants(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newTestTokenManager(t)
+	acme, globex := primitive.NewObjectID(), primitive.NewObjectID()
+	alice := models.User{ID: primitive.NewObjectID(), Email: "alice@acme.com", Memberships: []models.Membership{{OrganizationID: acme, Role: user.OrgRoleMember}}}
+	token, _, err := tokens.Issue(alice)
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.Use(Errors())
+	router.Use(IsolateTenants(memoryRegistry{acme.Hex(), globex.Hex()}))
+	tenantOf := func(c *gin.Context) {
+		id, _ := tenant.FromContext(c.Request.Context())
+		c.String(http.StatusOK, id)
+	}
+	router.GET("/public", tenantOf)
+	router.GET("/protected", RequireAuth(tokens), tenantOf)
+
+	request := func(path, tenantID, bearer string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		if tenantID != "" {
+			req.Header.Set(tenant.Header, tenantID)
+		}
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		router.ServeHTTP(response, req)
+		return response
+	}
+
+	// Requests made before logging in name their tenant, which must exist
+	response := request("/public", acme.Hex(), "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, acme.Hex(), response.Body.String())
+	response = request("/public?tenant="+globex.Hex(), "", "")
+	assert.Equal(t, globex.Hex(), response.Body.String())
+	assert.Equal(t, http.StatusBadRequest, request("/public", "unknown", "").Code)
+
+	// Authenticated requests are bound to the organization of their token
+	response = request("/protected", "", token)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, acme.Hex(), response.Body.String())
+	assert.Equal(t, http.StatusOK, request("/protected", acme.Hex(), token).Code)
+	assert.Equal(t, http.StatusForbidden, request("/protected", globex.Hex(), token).Code)
+
+	// Tokens acting outside any organization cannot reach a tenant either
+	outside, _, err := tokens.IssueForOrganization(alice, "")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, request("/protected", "", outside).Code)
+	assert.Equal(t, http.StatusForbidden, request("/protected", acme.Hex(), outside).Code)
+}
+
+// TestTokensWithoutIsolation checks that requests are left unbound when tenants share one database.
+func TestTokensWithoutIsolation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newTestTokenManager(t)
+	alice := models.User{ID: primitive.NewObjectID(), Memberships: []models.Membership{{OrganizationID: primitive.NewObjectID(), Role: user.OrgRoleMember}}}
+	token, _, err := tokens.Issue(alice)
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.Use(Errors())
+	router.GET("/protected", RequireAuth(tokens), func(c *gin.Context) {
+		assert.False(t, tenant.Isolated(c.Request.Context()))
+		assert.Equal(t, alice.Memberships[0].OrganizationID.Hex(), auth.OrganizationFor(c.Request.Context(), alice))
+		c.Status(http.StatusNoContent)
+	})
+	response := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/protected", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(tenant.Header, "ignored")
+	router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusNoContent, response.Code)
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/problem"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Access levels of users who did not verify their email address yet, configured with UNVERIFIED_EMAIL_ACCESS.
+const (
+	UnverifiedAccessKey     = "UNVERIFIED_EMAIL_ACCESS"
+	UnverifiedAccessFull    = "full" // Unverified users may do everything verified users may do
+	UnverifiedAccessRead    = "read" // Unverified users may only read
+	UnverifiedAccessNone    = "none" // Unverified users may not use authenticated routes at all
+	DefaultUnverifiedAccess = UnverifiedAccessRead
+)
+
+// RequireVerifiedEmail returns a gin middleware restricting what callers with an unverified email may do,
+// according to the given access level. It must run after RequireAuth.
+// Unknown access levels are treated as UnverifiedAccessNone. Callers using an API key have no email
+// and are always let through.
+func RequireVerifiedEmail(access string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := auth.APIKeyFromContext(c.Request.Context()); ok {
+			c.Next()
+			return
+		}
+		claims, ok := auth.ClaimsFromContext(c.Request.Context())
+		if !ok {
+			unauthorized(c, "Authentication required")
+			return
+		}
+		if claims.EmailVerified || access == UnverifiedAccessFull {
+			c.Next()
+			return
+		}
+		if access == UnverifiedAccessRead && (c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead) {
+			c.Next()
+			return
+		}
+		c.Error(problem.New(http.StatusForbidden, "Verify your email address to perform this operation"))
+		c.Abort()
+	}
+}
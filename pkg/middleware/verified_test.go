@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"simplecrud/pkg/models"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newTestTokenManager(t)
+	verifiedToken, _, err := tokens.Issue(models.User{ID: primitive.NewObjectID(), EmailVerified: true})
+	require.NoError(t, err)
+	unverifiedToken, _, err := tokens.Issue(models.User{ID: primitive.NewObjectID()})
+	require.NoError(t, err)
+
+	tests := []struct {
+		access string
+		token  string
+		method string
+		status int
+	}{
+		{UnverifiedAccessRead, verifiedToken, http.MethodPost, http.StatusOK},
+		{UnverifiedAccessRead, unverifiedToken, http.MethodGet, http.StatusOK},
+		{UnverifiedAccessRead, unverifiedToken, http.MethodPost, http.StatusForbidden},
+		{UnverifiedAccessNone, verifiedToken, http.MethodGet, http.StatusOK},
+		{UnverifiedAccessNone, unverifiedToken, http.MethodGet, http.StatusForbidden},
+		{UnverifiedAccessFull, unverifiedToken, http.MethodPost, http.StatusOK},
+		{"unknown", unverifiedToken, http.MethodGet, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		router := gin.New()
+		router.Use(Errors())
+		router.Handle(test.method, "/resource", RequireAuth(tokens), RequireVerifiedEmail(test.access), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(test.method, "/resource", nil)
+		request.Header.Set("Authorization", "Bearer "+test.token)
+		router.ServeHTTP(response, request)
+		assert.Equal(t, test.status, response.Code, "access %s, method %s", test.access, test.method)
+	}
+}
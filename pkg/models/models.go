@@ -1,11 +1,13 @@
 package models
 
 import (
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // User represents a user in the system. The struct includes fields for the user's
-// ID, name, age, email, password, and address. The bson tags tell the mongo-driver how to name
+// ID, name, age, email, password, address, and role. The bson tags tell the mongo-driver how to name
 // the properties in BSON when it marshals the data to be stored in MongoDB. The validate tags
 // are used to set constraints on the data when it's being validated.
 type User struct {
@@ -26,4 +28,242 @@ type User struct {
 
 	// Address of the user, must be at least 5 characters long
 	Address string `bson:"address,omitempty" validate:"omitempty,min=5"`
+
+	// Role of the user, either "admin" or "user"
+	Role string `bson:"role,omitempty" validate:"omitempty,oneof=admin user"`
+
+	// EmailVerified is true once the user proved they own the email address
+	EmailVerified bool `bson:"email_verified"`
+
+	// MFA holds the multi-factor authentication settings; it is never sent to clients
+	MFA *MFA `bson:"mfa,omitempty" json:"-"`
+
+	// Identities are the accounts at external identity providers the user can log in with
+	Identities []ExternalIdentity `bson:"identities,omitempty" json:"-"`
+
+	// Memberships lists the organizations the user belongs to and their role in each
+	Memberships []Membership `bson:"memberships,omitempty" json:"memberships,omitempty"`
+}
+
+// Membership places a user in an organization with a role that only applies within it.
+type Membership struct {
+	// OrganizationID is the ID of the organization
+	OrganizationID primitive.ObjectID `bson:"organization_id" json:"organization_id"`
+
+	// Role of the user in the organization, either "admin" or "member"
+	Role string `bson:"role" json:"role"`
+}
+
+// Organization groups users, for example a customer company. Users can belong to several organizations.
+type Organization struct {
+	// ID is the unique identifier of the organization
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+
+	// Name of the organization
+	Name string `bson:"name" json:"name"`
+
+	// Settings holds the rules applying to the members of the organization
+	Settings OrganizationSettings `bson:"settings" json:"settings"`
+
+	// CreatedAt is when the organization was created
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+// OrganizationSettings holds the rules applying to the members of an organization.
+type OrganizationSettings struct {
+	// AllowedEmailDomains restricts members to these email domains; empty allows every domain
+	AllowedEmailDomains []string `bson:"allowed_email_domains,omitempty" json:"allowed_email_domains,omitempty"`
+}
+
+// ExternalIdentity links a user to their account at an OpenID Connect identity provider.
+// Users provisioned through a provider may have no password at all.
+type ExternalIdentity struct {
+	// Issuer is the identifier of the identity provider, the "iss" claim of its ID tokens
+	Issuer string `bson:"issuer"`
+
+	// Subject is the ID of the user at the identity provider, the "sub" claim of its ID tokens
+	Subject string `bson:"subject"`
+
+	// LinkedAt is when the identity was linked to the user
+	LinkedAt time.Time `bson:"linked_at"`
+}
+
+// Session represents a refresh token issued to a user. Only a hash of the token is stored.
+// Every refresh rotates the token: the used session is marked as rotated and a new session
+// in the same family is created. Presenting a rotated token again revokes the whole family.
+type Session struct {
+	// ID is the unique identifier of the session
+	ID primitive.ObjectID `bson:"_id,omitempty"`
+
+	// FamilyID groups every session descending from the same login
+	FamilyID string `bson:"family_id"`
+
+	// UserID is the ID of the user the session belongs to
+	UserID primitive.ObjectID `bson:"user_id"`
+
+	// TokenHash is the hex encoded SHA-256 hash of the refresh token
+	TokenHash string `bson:"token_hash"`
+
+	// CreatedAt is when the refresh token was issued
+	CreatedAt time.Time `bson:"created_at"`
+
+	// ExpiresAt is when the refresh token stops being valid; expired sessions are removed by a TTL index
+	ExpiresAt time.Time `bson:"expires_at"`
+
+	// RotatedAt is set once the refresh token has been exchanged for a new one
+	RotatedAt *time.Time `bson:"rotated_at,omitempty"`
+
+	// RevokedAt is set when the session was revoked by logout or reuse detection
+	RevokedAt *time.Time `bson:"revoked_at,omitempty"`
+}
+
+// LoginAttempt tracks failed login attempts for one account, keyed by normalized email.
+// Documents are removed by a TTL index once the account has been quiet for a while.
+type LoginAttempt struct {
+	// Key is the normalized email the attempts were made for
+	Key string `bson:"_id"`
+
+	// FailedCount is the number of consecutive failed attempts
+	FailedCount int `bson:"failed_count"`
+
+	// LastFailedAt is when the last failed attempt happened
+	LastFailedAt time.Time `bson:"last_failed_at"`
+
+	// LockedUntil is set while the account is temporarily locked
+	LockedUntil *time.Time `bson:"locked_until,omitempty"`
+}
+
+// RateLimitBucket holds the tokens of one client under one rate limit policy, shared by every instance
+// of the API. Documents are removed by a TTL index once the bucket is full again.
+type RateLimitBucket struct {
+	// Key identifies the policy and the client, such as "route:GET /users|user:ID"
+	Key string `bson:"_id"`
+
+	// Tokens is the number of tokens left as of UpdatedAt
+	Tokens float64 `bson:"tokens"`
+
+	// Allowed reports whether the last request took a token
+	Allowed bool `bson:"allowed"`
+
+	// UpdatedAt is when Tokens was last computed, by the clock of the MongoDB server
+	UpdatedAt time.Time `bson:"updated_at"`
+
+	// ExpiresAt is when the bucket is full again
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// AuditEvent records a security relevant action, such as an account lockout.
+type AuditEvent struct {
+	// ID is the unique identifier of the event
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+
+	// Type identifies the kind of event, for example "account.locked"
+	Type string `bson:"type" json:"type"`
+
+	// ActorID is the ID of the user who performed the action, if any
+	ActorID string `bson:"actor_id,omitempty" json:"actor_id,omitempty"`
+
+	// SubjectID is the ID of the user or the key of the account the action applies to
+	SubjectID string `bson:"subject_id,omitempty" json:"subject_id,omitempty"`
+
+	// IP is the client IP address the action came from
+	IP string `bson:"ip,omitempty" json:"ip,omitempty"`
+
+	// Details holds event specific information
+	Details map[string]string `bson:"details,omitempty" json:"details,omitempty"`
+
+	// OccurredAt is when the event happened
+	OccurredAt time.Time `bson:"occurred_at" json:"occurred_at"`
+}
+
+// MFA holds the TOTP multi-factor authentication settings of a user.
+type MFA struct {
+	// Secret is the TOTP secret, encrypted at rest
+	Secret string `bson:"secret"`
+
+	// Enabled is true once the user confirmed enrollment with a valid code
+	Enabled bool `bson:"enabled"`
+
+	// RecoveryCodes holds the SHA-256 hashes of the unused one-time recovery codes
+	RecoveryCodes []string `bson:"recovery_codes,omitempty"`
+
+	// LastUsedStep is the TOTP time step of the last accepted code, so a code cannot be replayed
+	LastUsedStep int64 `bson:"last_used_step,omitempty"`
+
+	// EnabledAt is when enrollment was confirmed
+	EnabledAt *time.Time `bson:"enabled_at,omitempty"`
+}
+
+// ActionToken is a single-use token sent to a user to confirm an action, such as a password reset.
+// Only a hash of the token is stored. Expired tokens are removed by a TTL index.
+type ActionToken struct {
+	// ID is the unique identifier of the token
+	ID primitive.ObjectID `bson:"_id,omitempty"`
+
+	// UserID is the ID of the user the token was issued to
+	UserID primitive.ObjectID `bson:"user_id"`
+
+	// Purpose is the action the token confirms, for example "password_reset" or "email_verification"
+	Purpose string `bson:"purpose"`
+
+	// TokenHash is the hex encoded SHA-256 hash of the token
+	TokenHash string `bson:"token_hash"`
+
+	// Email is the address the token was sent to, for tokens proving that the user owns it
+	Email string `bson:"email,omitempty"`
+
+	// CreatedAt is when the token was issued
+	CreatedAt time.Time `bson:"created_at"`
+
+	// ExpiresAt is when the token stops being valid
+	ExpiresAt time.Time `bson:"expires_at"`
+
+	// UsedAt is set once the token has been used
+	UsedAt *time.Time `bson:"used_at,omitempty"`
+}
+
+// APIKey lets a service call the API without a user login. Only a hash of the key is stored;
+// the key itself is shown once, when it is created.
+type APIKey struct {
+	// ID is the unique identifier of the key
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+
+	// Name describes what the key is used for
+	Name string `bson:"name" json:"name"`
+
+	// Prefix is the public start of the key, used to recognize it
+	Prefix string `bson:"prefix" json:"prefix"`
+
+	// KeyHash is the hex encoded SHA-256 hash of the key; it is never sent to clients
+	KeyHash string `bson:"key_hash" json:"-"`
+
+	// Scopes lists what the key may be used for, for example "users:read"
+	Scopes []string `bson:"scopes" json:"scopes"`
+
+	// CreatedBy is the ID of the admin who created the key
+	CreatedBy string `bson:"created_by" json:"created_by"`
+
+	// CreatedAt is when the key was created
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+
+	// ExpiresAt is when the key stops being valid; keys without it never expire
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+
+	// LastUsedAt is when the key was last used, to the minute
+	LastUsedAt *time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+
+	// RevokedAt is set once the key was revoked
+	RevokedAt *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// Tenant records the database holding the users of an organization when every organization has its own database.
+type Tenant struct {
+	// ID is the ID of the organization
+	ID primitive.ObjectID `bson:"_id"`
+
+	// Database is the name of the MongoDB database of the tenant
+	Database string `bson:"database"`
+
+	// CreatedAt is when the tenant was registered
+	CreatedAt time.Time `bson:"created_at"`
 }
@@ -0,0 +1,33 @@
+package notify
+
+import (
+	"context"
+	"simplecrud/pkg/logging"
+)
+
+// Message is a notification addressed to a single user.
+type Message struct {
+	To      string // Email address of the recipient
+	Subject string
+	Body    string
+}
+
+// Notifier delivers messages to users, for example by email.
+type Notifier interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// LogNotifier writes messages to the log instead of delivering them.
+// It is meant for development only: messages may contain secrets such as password reset links,
+// which redacting loggers mask.
+type LogNotifier struct{}
+
+// Send logs the message.
+func (LogNotifier) Send(ctx context.Context, msg Message) error {
+	logging.FromContext(ctx).With(logging.Fields{
+		"to":      msg.To,
+		"subject": msg.Subject,
+		"body":    msg.Body,
+	}).Info("Notification not delivered, logged instead")
+	return nil
+}
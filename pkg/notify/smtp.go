@@ -0,0 +1,133 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Environment variables used to configure the SMTP notifier.
+const (
+	SMTPHostKey     = "SMTP_HOST"
+	SMTPPortKey     = "SMTP_PORT"
+	DefaultSMTPPort = "587"
+	SMTPUsernameKey = "SMTP_USERNAME"
+	SMTPPasswordKey = "SMTP_PASSWORD"
+	SMTPFromKey     = "SMTP_FROM"
+)
+
+// ErrInvalidHeader is returned when a message field would break out of its email header.
+var ErrInvalidHeader = errors.New("invalid character in email header")
+
+// SMTPConfig holds the settings of the SMTP server used to send emails.
+type SMTPConfig struct {
+	Host     string // Host name of the SMTP server
+	Port     string // Port of the SMTP server, usually 587 for STARTTLS
+	Username string // Username to authenticate with; no authentication when empty
+	Password string // Password to authenticate with
+	From     string // Sender address of every email
+}
+
+// SMTPNotifier delivers messages as plain text emails through an SMTP server.
+// It upgrades the connection with STARTTLS whenever the server supports it.
+type SMTPNotifier struct {
+	config    SMTPConfig
+	tlsConfig *tls.Config
+	timeout   time.Duration
+}
+
+// NewSMTPNotifier creates a new SMTPNotifier for the given server.
+func NewSMTPNotifier(config SMTPConfig) *SMTPNotifier {
+	return &SMTPNotifier{
+		config:    config,
+		tlsConfig: &tls.Config{ServerName: config.Host, MinVersion: tls.VersionTLS12},
+		timeout:   30 * time.Second,
+	}
+}
+
+// Send delivers the message as an email to msg.To.
+func (n *SMTPNotifier) Send(ctx context.Context, msg Message) error {
+	body, err := n.format(msg)
+	if err != nil {
+		return err
+	}
+
+	// Bound the whole conversation by the context deadline, or by the default timeout.
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(n.timeout)
+	}
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(n.config.Host, n.config.Port))
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, n.config.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start SMTP session: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(n.tlsConfig); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	if n.config.Username != "" {
+		// PlainAuth refuses to send the password over an unencrypted connection, except to localhost.
+		if err := client.Auth(smtp.PlainAuth("", n.config.Username, n.config.Password, n.config.Host)); err != nil {
+			return fmt.Errorf("failed to authenticate with SMTP server: %w", err)
+		}
+	}
+
+	if err := client.Mail(n.config.From); err != nil {
+		return fmt.Errorf("failed to set sender: %w", err)
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("failed to set recipient: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if _, err := w.Write(body); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return client.Quit()
+}
+
+// format renders the message as an RFC 5322 email with CRLF line endings.
+func (n *SMTPNotifier) format(msg Message) ([]byte, error) {
+	for _, value := range []string{n.config.From, msg.To, msg.Subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("\r\n")
+	body := strings.ReplaceAll(msg.Body, "\r\n", "\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,137 @@
+package notify
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTPServer is a minimal SMTP server that accepts every message and keeps what it received.
+type fakeSMTPServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	auth     string   // Decoded AUTH PLAIN credentials
+	from     string   // MAIL FROM argument
+	rcpt     []string // RCPT TO arguments
+	data     string   // Message content, without the terminating dot
+}
+
+// startFakeSMTPServer listens on a random local port and serves one connection at a time.
+func startFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &fakeSMTPServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.serve(conn)
+		}
+	}()
+	return server
+}
+
+// serve speaks just enough SMTP for net/smtp to deliver a message.
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost fake SMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		s.mu.Lock()
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			decoded, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			s.auth = string(decoded)
+			text.PrintfLine("235 Authenticated")
+		case "MAIL":
+			s.from = arg
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			s.rcpt = append(s.rcpt, arg)
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			lines, _ := text.ReadDotLines()
+			s.data = strings.Join(lines, "\n")
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			s.mu.Unlock()
+			return
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+		s.mu.Unlock()
+	}
+}
+
+// port returns the port the server listens on.
+func (s *fakeSMTPServer) port() string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return port
+}
+
+// TestSMTPNotifier checks that a message is delivered with authentication, headers and body.
+func TestSMTPNotifier(t *testing.T) {
+	server := startFakeSMTPServer(t)
+	notifier := NewSMTPNotifier(SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     server.port(),
+		Username: "mailer",
+		Password: "secret",
+		From:     "noreply@example.com",
+	})
+
+	err := notifier.Send(context.Background(), Message{
+		To:      "alice@example.com",
+		Subject: "Verify your email address",
+		Body:    "Open this link:\n\nhttp://localhost:8080/auth/verify?token=abc\n",
+	})
+	require.NoError(t, err)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Equal(t, "\x00mailer\x00secret", server.auth)
+	assert.Equal(t, "FROM:<noreply@example.com>", server.from)
+	assert.Equal(t, []string{"TO:<alice@example.com>"}, server.rcpt)
+	assert.Contains(t, server.data, "To: alice@example.com")
+	assert.Contains(t, server.data, "Subject: Verify your email address")
+	assert.Contains(t, server.data, "http://localhost:8080/auth/verify?token=abc")
+}
+
+// TestSMTPNotifierHeaderInjection checks that line breaks cannot add headers to the email.
+func TestSMTPNotifierHeaderInjection(t *testing.T) {
+	notifier := NewSMTPNotifier(SMTPConfig{Host: "127.0.0.1", Port: "1", From: "noreply@example.com"})
+	err := notifier.Send(context.Background(), Message{To: "alice@example.com\r\nBcc: eve@example.com", Subject: "Hi"})
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
+
+// TestSMTPNotifierUnreachable checks that connection failures are reported.
+func TestSMTPNotifierUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	notifier := NewSMTPNotifier(SMTPConfig{Host: "127.0.0.1", Port: port, From: "noreply@example.com"})
+	assert.Error(t, notifier.Send(context.Background(), Message{To: "alice@example.com", Subject: "Hi"}))
+}
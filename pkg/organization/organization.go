@@ -0,0 +1,314 @@
+package organization
+
+import (
+	"context"
+	"regexp"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/tenant"
+	"simplecrud/pkg/user"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrNotFound is returned when an organization is not found.
+	ErrNotFound error = &user.Error{Kind: user.KindNotFound, Message: "organization not found", Detail: "Organization not found"}
+	// ErrNotMember is returned when changing the membership of a user who does not belong to the organization.
+	ErrNotMember error = &user.Error{Kind: user.KindNotFound, Message: "user is not a member of the organization", Detail: "User not found"}
+	// ErrLastAdmin is returned when removing or demoting the last admin of an organization.
+	ErrLastAdmin error = &user.Error{Kind: user.KindConflict, Message: "organization must keep at least one admin",
+		Detail: "The organization must keep at least one admin"}
+)
+
+// maxNameLength is the longest organization name accepted.
+const maxNameLength = 100
+
+// isDomain matches lowercase DNS domain names such as "example.com".
+var isDomain = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+
+// Service defines the operations on organizations and their members.
+type Service interface {
+	ListOrganizations(ctx context.Context) ([]models.Organization, error)
+	GetOrganization(ctx context.Context, id string) (models.Organization, error)
+	CreateOrganization(ctx context.Context, org models.Organization) (models.Organization, error)
+	UpdateOrganization(ctx context.Context, id string, org models.Organization) (models.Organization, error)
+	DeleteOrganization(ctx context.Context, id string) error
+	ListMembers(ctx context.Context, id string) ([]models.User, error)
+	SetMember(ctx context.Context, id, userID, role string) error
+	RemoveMember(ctx context.Context, id, userID string) error
+}
+
+// Repository defines the storage operations on organizations.
+type Repository interface {
+	FindAll(ctx context.Context) ([]models.Organization, error)
+	FindByIds(ctx context.Context, ids []string) ([]models.Organization, error)
+	FindById(ctx context.Context, id string) (models.Organization, error)
+	Create(ctx context.Context, org models.Organization) (models.Organization, error)
+	Update(ctx context.Context, id string, org models.Organization) (models.Organization, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// MemberRepository defines the user storage operations needed to manage the members of organizations.
+type MemberRepository interface {
+	FindById(ctx context.Context, id string) (models.User, error)
+	FindAllInOrganization(ctx context.Context, orgID string) ([]models.User, error)
+	// SetMembership adds the user to the organization of the membership, or changes their role in it.
+	SetMembership(ctx context.Context, userID string, membership models.Membership) error
+	RemoveMembership(ctx context.Context, userID, orgID string) error
+	// RemoveOrganization removes every membership in the organization.
+	RemoveOrganization(ctx context.Context, orgID string) error
+}
+
+// OrganizationService implements the Service interface.
+// Admins manage every organization; organization admins manage their own organization and its members.
+type OrganizationService struct {
+	orgs    Repository
+	members MemberRepository
+	tenants tenant.Registry
+	now     func() time.Time
+}
+
+// NewService creates a new OrganizationService. The tenants of deleted organizations are removed from
+// tenants; it is nil when organizations share the database.
+func NewService(orgs Repository, members MemberRepository, tenants tenant.Registry) *OrganizationService {
+	return &OrganizationService{
+		orgs:    orgs,
+		members: members,
+		tenants: tenants,
+		now:     time.Now,
+	}
+}
+
+// ListOrganizations returns every organization to admins, and the organizations of the caller to other users.
+func (s *OrganizationService) ListOrganizations(ctx context.Context) ([]models.Organization, error) {
+	p, ok := user.PrincipalFromContext(ctx)
+	if !ok {
+		return nil, user.ErrForbidden
+	}
+	if p.IsAdmin() {
+		return s.orgs.FindAll(ctx)
+	}
+	caller, err := s.members.FindById(ctx, p.UserID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(caller.Memberships))
+	for _, membership := range caller.Memberships {
+		ids = append(ids, membership.OrganizationID.Hex())
+	}
+	return s.orgs.FindByIds(ctx, ids)
+}
+
+// GetOrganization returns an organization to admins and to its members.
+// Organizations the caller does not belong to are reported as not found.
+func (s *OrganizationService) GetOrganization(ctx context.Context, id string) (models.Organization, error) {
+	if _, err := s.roleIn(ctx, id); err != nil {
+		return models.Organization{}, err
+	}
+	return s.orgs.FindById(ctx, id)
+}
+
+// CreateOrganization validates and stores a new organization. Only admins may create organizations.
+func (s *OrganizationService) CreateOrganization(ctx context.Context, org models.Organization) (models.Organization, error) {
+	if p, ok := user.PrincipalFromContext(ctx); !ok || !p.IsAdmin() {
+		return models.Organization{}, user.ErrForbidden
+	}
+	org, err := normalize(org)
+	if err != nil {
+		return models.Organization{}, err
+	}
+	org.ID = primitive.NilObjectID
+	org.CreatedAt = s.now().UTC()
+	return s.orgs.Create(ctx, org)
+}
+
+// UpdateOrganization replaces the name and settings of an organization. Admins and the admins of the
+// organization may update it. New allowed email domains only apply to members added or changing
+// their email afterwards.
+func (s *OrganizationService) UpdateOrganization(ctx context.Context, id string, org models.Organization) (models.Organization, error) {
+	if err := s.requireAdmin(ctx, id); err != nil {
+		return models.Organization{}, err
+	}
+	org, err := normalize(org)
+	if err != nil {
+		return models.Organization{}, err
+	}
+	return s.orgs.Update(ctx, id, org)
+}
+
+// DeleteOrganization deletes an organization, every membership in it and its tenant, so requests can no
+// longer name it. The users themselves, and the database of the tenant, are kept.
+// Only admins may delete organizations.
+func (s *OrganizationService) DeleteOrganization(ctx context.Context, id string) error {
+	if p, ok := user.PrincipalFromContext(ctx); !ok || !p.IsAdmin() {
+		return user.ErrForbidden
+	}
+	if _, err := s.orgs.FindById(ctx, id); err != nil {
+		return err
+	}
+	if err := s.members.RemoveOrganization(ctx, id); err != nil {
+		return err
+	}
+	if err := s.orgs.Delete(ctx, id); err != nil {
+		return err
+	}
+	if s.tenants != nil {
+		return s.tenants.Remove(ctx, id)
+	}
+	return nil
+}
+
+// ListMembers returns the members of an organization to admins and to the admins of the organization.
+func (s *OrganizationService) ListMembers(ctx context.Context, id string) ([]models.User, error) {
+	if err := s.requireAdmin(ctx, id); err != nil {
+		return nil, err
+	}
+	return s.members.FindAllInOrganization(ctx, id)
+}
+
+// SetMember gives a user the role in the organization. Admins may add any user whose email uses one of
+// the domains the organization allows. Organization admins may only change the role of existing members;
+// they add members by creating users while acting in the organization.
+func (s *OrganizationService) SetMember(ctx context.Context, id, userID, role string) error {
+	if !user.IsValidOrgRole(role) {
+		return &user.ValidationError{Errors: []user.FieldError{
+			{Field: "role", Code: "invalid_role", Message: "must be one of " + user.OrgRoleAdmin + ", " + user.OrgRoleMember},
+		}}
+	}
+	if err := s.requireAdmin(ctx, id); err != nil {
+		return err
+	}
+	org, err := s.orgs.FindById(ctx, id)
+	if err != nil {
+		return err
+	}
+	target, err := s.members.FindById(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	current, member := user.MembershipIn(target, id)
+	if !member {
+		if p, _ := user.PrincipalFromContext(ctx); !p.IsAdmin() {
+			return ErrNotMember
+		}
+		if err := user.CheckEmailDomain(target.Email, org); err != nil {
+			return err
+		}
+	}
+	if current.Role == user.OrgRoleAdmin && role != user.OrgRoleAdmin {
+		if err := s.keepAnAdmin(ctx, id); err != nil {
+			return err
+		}
+	}
+	return s.members.SetMembership(ctx, userID, models.Membership{OrganizationID: org.ID, Role: role})
+}
+
+// RemoveMember removes a user from the organization. The user account is kept.
+// Admins and the admins of the organization may remove members.
+func (s *OrganizationService) RemoveMember(ctx context.Context, id, userID string) error {
+	if err := s.requireAdmin(ctx, id); err != nil {
+		return err
+	}
+	target, err := s.members.FindById(ctx, userID)
+	if err != nil {
+		return err
+	}
+	current, member := user.MembershipIn(target, id)
+	if !member {
+		return ErrNotMember
+	}
+	if current.Role == user.OrgRoleAdmin {
+		if err := s.keepAnAdmin(ctx, id); err != nil {
+			return err
+		}
+	}
+	return s.members.RemoveMembership(ctx, userID, id)
+}
+
+// keepAnAdmin returns ErrLastAdmin unless the organization has more than one admin.
+func (s *OrganizationService) keepAnAdmin(ctx context.Context, id string) error {
+	members, err := s.members.FindAllInOrganization(ctx, id)
+	if err != nil {
+		return err
+	}
+	admins := 0
+	for _, member := range members {
+		if membership, _ := user.MembershipIn(member, id); membership.Role == user.OrgRoleAdmin {
+			admins++
+		}
+	}
+	if admins <= 1 {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// roleIn returns the role of the caller in the organization with the given ID. Admins have the admin
+// role in every organization. It returns ErrNotFound if the caller does not belong to the organization,
+// so that callers cannot find out which organizations exist.
+func (s *OrganizationService) roleIn(ctx context.Context, id string) (string, error) {
+	p, ok := user.PrincipalFromContext(ctx)
+	if !ok {
+		return "", user.ErrForbidden
+	}
+	if p.IsAdmin() {
+		return user.OrgRoleAdmin, nil
+	}
+	// The stored membership is checked rather than the token, which may predate a change of role.
+	caller, err := s.members.FindById(ctx, p.UserID)
+	if err != nil {
+		return "", err
+	}
+	membership, ok := user.MembershipIn(caller, id)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return membership.Role, nil
+}
+
+// requireAdmin returns nil if the caller is an admin or an admin of the organization with the given ID.
+func (s *OrganizationService) requireAdmin(ctx context.Context, id string) error {
+	role, err := s.roleIn(ctx, id)
+	if err != nil {
+		return err
+	}
+	if role != user.OrgRoleAdmin {
+		return user.ErrForbidden
+	}
+	return nil
+}
+
+// normalize trims the name of the organization and lowercases its allowed email domains.
+// It returns a ValidationError listing every invalid field.
+func normalize(org models.Organization) (models.Organization, error) {
+	var errs []user.FieldError
+	org.Name = strings.TrimSpace(org.Name)
+	if org.Name == "" {
+		errs = append(errs, user.FieldError{Field: "name", Code: "required", Message: "is required"})
+	} else if len(org.Name) > maxNameLength {
+		errs = append(errs, user.FieldError{Field: "name", Code: user.ViolationTooLong, Message: "must be at most 100 characters long"})
+	}
+
+	domains := make([]string, 0, len(org.Settings.AllowedEmailDomains))
+	seen := make(map[string]bool)
+	for _, domain := range org.Settings.AllowedEmailDomains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if !isDomain.MatchString(domain) {
+			errs = append(errs, user.FieldError{Field: "settings.allowed_email_domains", Code: "invalid_domain", Message: "must only contain domain names, such as example.com"})
+			break
+		}
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	org.Settings.AllowedEmailDomains = domains
+
+	if len(errs) > 0 {
+		return models.Organization{}, &user.ValidationError{Errors: errs}
+	}
+	return org, nil
+}
@@ -0,0 +1,254 @@
+package organization
+
+import (
+	"context"
+	"errors"
+	"simplecrud/pkg/models"
+	"simplecrud/pkg/tenant"
+	"simplecrud/pkg/user"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryRepository is an in-memory Repository.
+type memoryRepository struct {
+	orgs []models.Organization
+}
+
+func (m *memoryRepository) FindAll(ctx context.Context) ([]models.Organization, error) {
+	return m.orgs, nil
+}
+
+func (m *memoryRepository) FindByIds(ctx context.Context, ids []string) ([]models.Organization, error) {
+	var orgs []models.Organization
+	for _, id := range ids {
+		if org, err := m.FindById(ctx, id); err == nil {
+			orgs = append(orgs, org)
+		}
+	}
+	return orgs, nil
+}
+
+func (m *memoryRepository) FindById(ctx context.Context, id string) (models.Organization, error) {
+	for _, org := range m.orgs {
+		if org.ID.Hex() == id {
+			return org, nil
+		}
+	}
+	return models.Organization{}, ErrNotFound
+}
+
+func (m *memoryRepository) Create(ctx context.Context, org models.Organization) (models.Organization, error) {
+	org.ID = primitive.NewObjectID()
+	m.orgs = append(m.orgs, org)
+	return org, nil
+}
+
+func (m *memoryRepository) Update(ctx context.Context, id string, org models.Organization) (models.Organization, error) {
+	for i := range m.orgs {
+		if m.orgs[i].ID.Hex() == id {
+			m.orgs[i].Name, m.orgs[i].Settings = org.Name, org.Settings
+			return m.orgs[i], nil
+		}
+	}
+	return models.Organization{}, ErrNotFound
+}
+
+func (m *memoryRepository) Delete(ctx context.Context, id string) error {
+	for i := range m.orgs {
+		if m.orgs[i].ID.Hex() == id {
+			m.orgs = append(m.orgs[:i], m.orgs[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// memoryMembers is an in-memory MemberRepository.
+type memoryMembers struct {
+	users []models.User
+}
+
+func (m *memoryMembers) FindById(ctx context.Context, id string) (models.User, error) {
+	for _, u := range m.users {
+		if u.ID.Hex() == id {
+			return u, nil
+		}
+	}
+	return models.User{}, user.ErrNotFound
+}
+
+func (m *memoryMembers) FindAllInOrganization(ctx context.Context, orgID string) ([]models.User, error) {
+	var members []models.User
+	for _, u := range m.users {
+		if _, ok := user.MembershipIn(u, orgID); ok {
+			members = append(members, u)
+		}
+	}
+	return members, nil
+}
+
+func (m *memoryMembers) SetMembership(ctx context.Context, userID string, membership models.Membership) error {
+	for i := range m.users {
+		if m.users[i].ID.Hex() != userID {
+			continue
+		}
+		for j := range m.users[i].Memberships {
+			if m.users[i].Memberships[j].OrganizationID == membership.OrganizationID {
+				m.users[i].Memberships[j].Role = membership.Role
+				return nil
+			}
+		}
+		m.users[i].Memberships = append(m.users[i].Memberships, membership)
+		return nil
+	}
+	return user.ErrNotFound
+}
+
+func (m *memoryMembers) RemoveMembership(ctx context.Context, userID, orgID string) error {
+	for i := range m.users {
+		if m.users[i].ID.Hex() != userID {
+			continue
+		}
+		var kept []models.Membership
+		for _, membership := range m.users[i].Memberships {
+			if membership.OrganizationID.Hex() != orgID {
+				kept = append(kept, membership)
+			}
+		}
+		m.users[i].Memberships = kept
+		return nil
+	}
+	return user.ErrNotFound
+}
+
+func (m *memoryMembers) RemoveOrganization(ctx context.Context, orgID string) error {
+	for _, u := range m.users {
+		if _, ok := user.MembershipIn(u, orgID); ok {
+			if err := m.RemoveMembership(ctx, u.ID.Hex(), orgID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// as returns a context whose caller is the given user.
+func as(u models.User) context.Context {
+	return user.WithPrincipal(context.Background(), user.Principal{UserID: u.ID.Hex(), Role: u.Role})
+}
+
+// memoryTenants is an in-memory tenant.Registry holding the databases of tenants by ID.
+type memoryTenants map[string]string
+
+// Database returns the database of the tenant.
+func (m memoryTenants) Database(ctx context.Context, id string) (string, error) {
+	name, ok := m[id]
+	if !ok {
+		return "", tenant.ErrUnknownTenant
+	}
+	return name, nil
+}
+
+// Remove forgets the tenant.
+func (m memoryTenants) Remove(ctx context.Context, id string) error {
+	delete(m, id)
+	return nil
+}
+
+// TestOrganizationCRUD checks who may create, read, update and delete organizations, and the validation of their settings.
+func TestOrganizationCRUD(t *testing.T) {
+	admin := models.User{ID: primitive.NewObjectID(), Role: user.RoleAdmin}
+	alice := models.User{ID: primitive.NewObjectID(), Email: "alice@acme.com", Role: user.RoleUser}
+	bob := models.User{ID: primitive.NewObjectID(), Email: "bob@acme.com", Role: user.RoleUser}
+	members := &memoryMembers{users: []models.User{admin, alice, bob}}
+	tenants := memoryTenants{}
+	service := NewService(&memoryRepository{}, members, tenants)
+
+	// Only admins create organizations; names are required and domains normalized
+	_, err := service.CreateOrganization(as(alice), models.Organization{Name: "Acme"})
+	assert.ErrorIs(t, err, user.ErrForbidden)
+	_, err = service.CreateOrganization(as(admin), models.Organization{Name: " ", Settings: models.OrganizationSettings{AllowedEmailDomains: []string{"@acme"}}})
+	var validationErr *user.ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	assert.Len(t, validationErr.Errors, 2)
+	acme, err := service.CreateOrganization(as(admin), models.Organization{Name: " Acme ", Settings: models.OrganizationSettings{AllowedEmailDomains: []string{"ACME.com", "acme.com"}}})
+	require.NoError(t, err)
+	assert.Equal(t, "Acme", acme.Name)
+	assert.Equal(t, []string{"acme.com"}, acme.Settings.AllowedEmailDomains)
+	assert.False(t, acme.CreatedAt.IsZero())
+
+	require.NoError(t, service.SetMember(as(admin), acme.ID.Hex(), alice.ID.Hex(), user.OrgRoleAdmin))
+	require.NoError(t, service.SetMember(as(admin), acme.ID.Hex(), bob.ID.Hex(), user.OrgRoleMember))
+	alice, bob = members.users[1], members.users[2]
+
+	// Members read their organizations; outsiders do not learn they exist
+	orgs, err := service.ListOrganizations(as(bob))
+	require.NoError(t, err)
+	assert.Len(t, orgs, 1)
+	_, err = service.GetOrganization(as(bob), acme.ID.Hex())
+	assert.NoError(t, err)
+	outsider := models.User{ID: primitive.NewObjectID(), Role: user.RoleUser}
+	members.users = append(members.users, outsider)
+	_, err = service.GetOrganization(as(outsider), acme.ID.Hex())
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Organization admins update their organization, members do not
+	_, err = service.UpdateOrganization(as(bob), acme.ID.Hex(), models.Organization{Name: "Bob Corp"})
+	assert.ErrorIs(t, err, user.ErrForbidden)
+	updated, err := service.UpdateOrganization(as(alice), acme.ID.Hex(), models.Organization{Name: "Acme Inc"})
+	require.NoError(t, err)
+	assert.Equal(t, "Acme Inc", updated.Name)
+
+	// Only admins delete organizations, which removes the memberships and the tenant
+	tenants[acme.ID.Hex()] = "tenant_" + acme.ID.Hex()
+	assert.ErrorIs(t, service.DeleteOrganization(as(alice), acme.ID.Hex()), user.ErrForbidden)
+	require.NoError(t, service.DeleteOrganization(as(admin), acme.ID.Hex()))
+	assert.Empty(t, members.users[1].Memberships)
+	_, err = tenants.Database(context.Background(), acme.ID.Hex())
+	assert.ErrorIs(t, err, tenant.ErrUnknownTenant)
+	assert.ErrorIs(t, service.DeleteOrganization(as(admin), acme.ID.Hex()), ErrNotFound)
+}
+
+// TestMembers checks adding, changing and removing members, and the rules protecting organizations.
+func TestMembers(t *testing.T) {
+	acme := models.Organization{ID: primitive.NewObjectID(), Name: "Acme", Settings: models.OrganizationSettings{AllowedEmailDomains: []string{"acme.com"}}}
+	inAcme := func(role string) []models.Membership {
+		return []models.Membership{{OrganizationID: acme.ID, Role: role}}
+	}
+	admin := models.User{ID: primitive.NewObjectID(), Role: user.RoleAdmin}
+	alice := models.User{ID: primitive.NewObjectID(), Email: "alice@acme.com", Role: user.RoleUser, Memberships: inAcme(user.OrgRoleAdmin)}
+	bob := models.User{ID: primitive.NewObjectID(), Email: "bob@acme.com", Role: user.RoleUser, Memberships: inAcme(user.OrgRoleMember)}
+	carol := models.User{ID: primitive.NewObjectID(), Email: "carol@acme.com", Role: user.RoleUser}
+	eve := models.User{ID: primitive.NewObjectID(), Email: "eve@gmail.com", Role: user.RoleUser}
+	members := &memoryMembers{users: []models.User{admin, alice, bob, carol, eve}}
+	service := NewService(&memoryRepository{orgs: []models.Organization{acme}}, members, nil)
+	id := acme.ID.Hex()
+
+	listed, err := service.ListMembers(as(alice), id)
+	require.NoError(t, err)
+	assert.Len(t, listed, 2)
+	_, err = service.ListMembers(as(bob), id)
+	assert.ErrorIs(t, err, user.ErrForbidden)
+
+	// Roles are validated, and only admins add outside users, within the allowed domains
+	var validationErr *user.ValidationError
+	assert.True(t, errors.As(service.SetMember(as(alice), id, bob.ID.Hex(), "owner"), &validationErr))
+	assert.ErrorIs(t, service.SetMember(as(alice), id, carol.ID.Hex(), user.OrgRoleMember), ErrNotMember)
+	assert.True(t, errors.As(service.SetMember(as(admin), id, eve.ID.Hex(), user.OrgRoleMember), &validationErr))
+	assert.Equal(t, user.ViolationDomainNotAllowed, validationErr.Errors[0].Code)
+	require.NoError(t, service.SetMember(as(admin), id, carol.ID.Hex(), user.OrgRoleMember))
+
+	// The last admin cannot be demoted or removed
+	assert.ErrorIs(t, service.SetMember(as(alice), id, alice.ID.Hex(), user.OrgRoleMember), ErrLastAdmin)
+	assert.ErrorIs(t, service.RemoveMember(as(alice), id, alice.ID.Hex()), ErrLastAdmin)
+	require.NoError(t, service.SetMember(as(alice), id, bob.ID.Hex(), user.OrgRoleAdmin))
+	require.NoError(t, service.RemoveMember(as(bob), id, alice.ID.Hex()))
+	assert.Empty(t, members.users[1].Memberships)
+
+	assert.ErrorIs(t, service.RemoveMember(as(bob), id, eve.ID.Hex()), ErrNotMember)
+	assert.ErrorIs(t, service.RemoveMember(as(alice), id, carol.ID.Hex()), ErrNotFound, "former members lose access")
+}
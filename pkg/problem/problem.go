@@ -0,0 +1,55 @@
+package problem
+
+import (
+	"net/http"
+
+	"simplecrud/pkg/user"
+)
+
+// ContentType is the media type of the problem details answered for every failed request (RFC 7807).
+const ContentType = "application/problem+json"
+
+// Types of problems. Problems of TypeBlank carry no meaning beyond their status.
+const (
+	TypeBlank       = "about:blank"
+	TypeValidation  = "/problems/validation-error"     // Some fields were rejected; see Problem.Errors
+	TypeInvalidBody = "/problems/invalid-request-body" // The request body could not be decoded
+	TypeInternal    = "/problems/internal-error"       // The request failed for a reason the client cannot fix
+)
+
+// Problem describes why a request failed, in the problem details format of RFC 7807. It implements
+// error, so handlers can record it with gin.Context.Error for the error middleware to send.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// RequestID identifies the request in the logs, so clients can quote it when reporting a problem.
+	RequestID string `json:"request_id,omitempty"`
+	// Errors lists every rejected field of a validation problem.
+	Errors []user.FieldError `json:"errors,omitempty"`
+}
+
+// New creates a problem of TypeBlank with the given status and detail. Its title is the status text.
+func New(status int, detail string) *Problem {
+	return &Problem{Type: TypeBlank, Title: http.StatusText(status), Status: status, Detail: detail}
+}
+
+// Validation creates a 400 Bad Request problem listing the rejected fields.
+func Validation(errs []user.FieldError) *Problem {
+	return &Problem{
+		Type:   TypeValidation,
+		Title:  "Validation failed",
+		Status: http.StatusBadRequest,
+		Detail: "Some fields of the request were rejected",
+		Errors: errs,
+	}
+}
+
+// Error returns the title and detail of the problem.
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return p.Title
+	}
+	return p.Title + ": " + p.Detail
+}
@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the memory store forgets the buckets that filled up again.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps the token buckets in memory, so every instance of the API limits clients on its own.
+// It is safe for concurrent use.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time // Returns the current time; replaced by tests
+}
+
+// bucket holds the tokens of one client under one policy.
+type bucket struct {
+	tokens  float64   // Tokens left as of updated
+	updated time.Time // When tokens was last computed
+	full    time.Time // When the bucket is full again, after which it can be forgotten
+}
+
+// NewMemoryStore creates an empty memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// Take takes a token from the bucket with the given key.
+func (s *MemoryStore) Take(ctx context.Context, key string, policy Policy) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(policy.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(policy.Burst), b.tokens+now.Sub(b.updated).Seconds()*policy.Rate)
+	b.updated = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	result := NewResult(policy, b.tokens, allowed)
+	b.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// sweep forgets the buckets that are full again, since they behave like new ones.
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
@@ -0,0 +1,276 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"simplecrud/pkg/auth"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/problem"
+	"simplecrud/pkg/user"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// RateKey (requests per second) and BurstKey configure the default policy of every route.
+	RateKey      = "RATE_LIMIT_RATE"
+	DefaultRate  = 1.0
+	BurstKey     = "RATE_LIMIT_BURST"
+	DefaultBurst = 1
+	// IPRateKey and IPBurstKey configure the policy limiting every IP address before authentication on
+	// the authenticated routes. By default it allows DefaultIPRate and DefaultIPBurst, or more if another
+	// policy does; see Config.IPPolicy.
+	IPRateKey      = "RATE_LIMIT_IP_RATE"
+	DefaultIPRate  = 10.0
+	IPBurstKey     = "RATE_LIMIT_IP_BURST"
+	DefaultIPBurst = 20
+	// RoutesKey configures the policies of single routes, as comma separated "METHOD /route=RATE:BURST"
+	// entries, for example "GET /users=5:10,POST /users=0.5:2". Routes are named by their pattern.
+	RoutesKey = "RATE_LIMIT_ROUTES"
+	// PrincipalsKey configures the policies of single callers on every route, as comma separated
+	// "user:ID=RATE:BURST" or "apikey:ID=RATE:BURST" entries.
+	PrincipalsKey = "RATE_LIMIT_PRINCIPALS"
+	// StoreKey selects where the buckets are kept: StoreMemory keeps them in each instance, and
+	// StoreMongoDB shares them between every instance of the API.
+	StoreKey     = "RATE_LIMIT_STORE"
+	StoreMemory  = "memory"
+	StoreMongoDB = "mongodb"
+	DefaultStore = StoreMemory
+)
+
+// Headers describing the rate limit of the request, as drafted by the IETF HTTP API working group.
+const (
+	HeaderLimit     = "RateLimit-Limit"     // Requests allowed in a burst
+	HeaderRemaining = "RateLimit-Remaining" // Requests allowed right now
+	HeaderReset     = "RateLimit-Reset"     // Seconds until the full burst is allowed again
+	HeaderPolicy    = "RateLimit-Policy"    // Burst and the seconds it takes to refill, as "10;w=10"
+)
+
+// Policy is a token bucket: every request takes a token, and Rate tokens are added per second up to
+// Burst. A client can make Burst requests at once, then Rate requests per second.
+type Policy struct {
+	Name  string  // Identifies the buckets of the policy in the store
+	Rate  float64 // Tokens added per second
+	Burst int     // Tokens the bucket holds when full
+}
+
+// window returns the time an empty bucket takes to fill up.
+func (p Policy) window() time.Duration {
+	return time.Duration(float64(p.Burst) / p.Rate * float64(time.Second))
+}
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	Allowed    bool          // Whether a token was taken
+	Remaining  int           // Tokens left in the bucket
+	Reset      time.Duration // Time until the bucket is full again
+	RetryAfter time.Duration // Time until the next token, when none was taken
+}
+
+// NewResult returns the result of taking a token from a bucket of the policy, which holds the given
+// number of tokens once the token was taken.
+func NewResult(policy Policy, tokens float64, allowed bool) Result {
+	result := Result{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(policy.Burst) - tokens) / policy.Rate * float64(time.Second)),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / policy.Rate * float64(time.Second))
+	}
+	return result
+}
+
+// Store keeps the token buckets.
+type Store interface {
+	// Take takes a token from the bucket with the given key, refilled according to the policy since it
+	// was last used. Unknown buckets start full.
+	Take(ctx context.Context, key string, policy Policy) (Result, error)
+}
+
+// Config describes the policies of a limiter.
+type Config struct {
+	Default    Policy            // Applies to the routes and callers without a policy of their own
+	Routes     map[string]Policy // Policies of single routes, by "METHOD /route" pattern
+	Principals map[string]Policy // Policies of single callers, by "user:ID" or "apikey:ID"
+	ByIP       bool              // Whether callers are limited by IP address even once authenticated
+}
+
+// IPPolicy returns the default policy limiting every IP address before authentication: DefaultIPRate and
+// DefaultIPBurst, raised to the rate and the burst of the most generous policy of the config. Every
+// caller passes the IP limit before its own, so a lower IP limit would cap the callers and routes given
+// more than the default policy.
+func (c Config) IPPolicy() Policy {
+	policy := Policy{Name: "ip", Rate: DefaultIPRate, Burst: DefaultIPBurst}
+	raise := func(other Policy) {
+		policy.Rate = math.Max(policy.Rate, other.Rate)
+		if other.Burst > policy.Burst {
+			policy.Burst = other.Burst
+		}
+	}
+	raise(c.Default)
+	for _, route := range c.Routes {
+		raise(route)
+	}
+	for _, principal := range c.Principals {
+		raise(principal)
+	}
+	return policy
+}
+
+// Limiter limits the rate of requests of every client, identified by the API key or the user they
+// authenticated with, or by IP address.
+type Limiter struct {
+	name   string
+	config Config
+	store  Store
+}
+
+// New creates a limiter keeping its buckets in the store. The name identifies the limiter in the
+// metrics and the logs.
+func New(name string, config Config, store Store) *Limiter {
+	return &Limiter{name: name, config: config, store: store}
+}
+
+// Handler returns a gin middleware taking a token for every request, and answering 429 Too Many
+// Requests with a Retry-After header when none is left. The RateLimit headers report the most limiting
+// bucket of the request. It must run after the authentication middleware to limit callers by principal.
+// rejected, if not nil, is called for every rejected request. Requests are let through if the store
+// fails, so an unavailable store does not take the API down.
+func (l *Limiter) Handler(rejected func()) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := l.client(c)
+		policy := l.policy(c, client)
+		result, err := l.store.Take(c.Request.Context(), policy.Name+"|"+client, policy)
+		if err != nil {
+			logging.FromContext(c.Request.Context()).WithError(err).WithField("limiter", l.name).Error("Failed to apply rate limit")
+			c.Next()
+			return
+		}
+
+		setHeaders(c, policy, result)
+		if !result.Allowed {
+			if rejected != nil {
+				rejected()
+			}
+			c.Header("Retry-After", strconv.Itoa(seconds(result.RetryAfter)))
+			c.Error(problem.New(http.StatusTooManyRequests, "Rate limit exceeded, retry after the number of seconds in the Retry-After header"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// client returns the key identifying the caller: their API key or user ID once authenticated, and
+// their IP address otherwise.
+func (l *Limiter) client(c *gin.Context) string {
+	if !l.config.ByIP {
+		if key, ok := auth.APIKeyFromContext(c.Request.Context()); ok {
+			return "apikey:" + key.ID.Hex()
+		}
+		if p, ok := user.PrincipalFromContext(c.Request.Context()); ok && p.UserID != "" {
+			return "user:" + p.UserID
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// policy returns the policy of the client, falling back to the policy of the route and the default one.
+func (l *Limiter) policy(c *gin.Context, client string) Policy {
+	if policy, ok := l.config.Principals[client]; ok {
+		return policy
+	}
+	if policy, ok := l.config.Routes[c.Request.Method+" "+c.FullPath()]; ok {
+		return policy
+	}
+	return l.config.Default
+}
+
+// setHeaders sets the RateLimit headers of the result, unless a bucket with fewer tokens left already
+// set them for the request.
+func setHeaders(c *gin.Context, policy Policy, result Result) {
+	if current, err := strconv.Atoi(c.Writer.Header().Get(HeaderRemaining)); err == nil && current <= result.Remaining {
+		return
+	}
+	c.Header(HeaderLimit, strconv.Itoa(policy.Burst))
+	c.Header(HeaderRemaining, strconv.Itoa(result.Remaining))
+	c.Header(HeaderReset, strconv.Itoa(seconds(result.Reset)))
+	c.Header(HeaderPolicy, fmt.Sprintf("%d;w=%d", policy.Burst, seconds(policy.window())))
+}
+
+// seconds rounds the duration up to whole seconds, as the headers expect.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// NewPolicy returns the policy with the given name, rate and burst. It returns an error unless the
+// rate and the burst are positive.
+func NewPolicy(name string, rate float64, burst int) (Policy, error) {
+	if !(rate > 0) || math.IsInf(rate, 0) {
+		return Policy{}, fmt.Errorf("rate limit %s: rate must be positive", name)
+	}
+	if burst < 1 {
+		return Policy{}, fmt.Errorf("rate limit %s: burst must be at least 1", name)
+	}
+	return Policy{Name: name, Rate: rate, Burst: burst}, nil
+}
+
+// ParseRoutes parses the route policies configured with RoutesKey. Every route has buckets of its own.
+func ParseRoutes(spec string) (map[string]Policy, error) {
+	return parse(spec, func(route string) string { return "route:" + route })
+}
+
+// ParsePrincipals parses the principal policies configured with PrincipalsKey. The buckets of a
+// principal are shared by every route.
+func ParsePrincipals(spec string) (map[string]Policy, error) {
+	policies, err := parse(spec, func(string) string { return "principal" })
+	if err != nil {
+		return nil, err
+	}
+	for principal := range policies {
+		if !strings.HasPrefix(principal, "user:") && !strings.HasPrefix(principal, "apikey:") {
+			return nil, fmt.Errorf("rate limit %s: principal must start with user: or apikey:", principal)
+		}
+	}
+	return policies, nil
+}
+
+// parse parses comma separated "KEY=RATE:BURST" entries. The burst defaults to the rate rounded up.
+func parse(spec string, name func(key string) string) (map[string]Policy, error) {
+	policies := make(map[string]Policy)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		key = strings.Join(strings.Fields(key), " ")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("rate limit %q: expected KEY=RATE:BURST", entry)
+		}
+		rateText, burstText, hasBurst := strings.Cut(value, ":")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateText), 64)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit %s: invalid rate %q", key, rateText)
+		}
+		burst := int(math.Ceil(rate))
+		if hasBurst {
+			if burst, err = strconv.Atoi(strings.TrimSpace(burstText)); err != nil {
+				return nil, fmt.Errorf("rate limit %s: invalid burst %q", key, burstText)
+			}
+		}
+		policy, err := NewPolicy(name(key), rate, burst)
+		if err != nil {
+			return nil, err
+		}
+		policies[key] = policy
+	}
+	return policies, nil
+}
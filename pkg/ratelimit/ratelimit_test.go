@@ -0,0 +1,191 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"simplecrud/pkg/middleware"
+	"simplecrud/pkg/problem"
+	"simplecrud/pkg/user"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingStore is a Store that is always unavailable.
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, policy Policy) (Result, error) {
+	return Result{}, errors.New("store unavailable")
+}
+
+// TestMemoryStore checks that buckets allow a burst, refill at the rate of the policy, and are
+// forgotten once full again.
+func TestMemoryStore(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	policy, err := NewPolicy("test", 2, 3)
+	require.NoError(t, err)
+	take := func(key string) Result {
+		result, err := store.Take(context.Background(), key, policy)
+		require.NoError(t, err)
+		return result
+	}
+
+	for remaining := 2; remaining >= 0; remaining-- {
+		result := take("a")
+		assert.True(t, result.Allowed)
+		assert.Equal(t, remaining, result.Remaining)
+	}
+	result := take("a")
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 500*time.Millisecond, result.RetryAfter)
+	assert.Equal(t, 1500*time.Millisecond, result.Reset)
+
+	// Other keys have buckets of their own
+	assert.True(t, take("b").Allowed)
+
+	// Half a second later a token was added
+	now = now.Add(500 * time.Millisecond)
+	result = take("a")
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+
+	// Full buckets are forgotten by the next sweep
+	now = now.Add(sweepInterval)
+	take("c")
+	assert.Len(t, store.buckets, 1)
+}
+
+// TestHandler checks that requests are limited by principal with the policy of the caller or the
+// route, that the RateLimit headers are set, and that rejected requests are answered as problems.
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	routes, err := ParseRoutes("GET /reports/:id=1:1")
+	require.NoError(t, err)
+	principals, err := ParsePrincipals("user:vip=10:5")
+	require.NoError(t, err)
+	config := Config{Default: Policy{Name: "default", Rate: 1, Burst: 2}, Routes: routes, Principals: principals}
+
+	rejections := 0
+	router := gin.New()
+	router.Use(middleware.Errors(), func(c *gin.Context) {
+		// Stands in for the authentication middleware
+		if id := c.GetHeader("X-User"); id != "" {
+			c.Request = c.Request.WithContext(user.WithPrincipal(c.Request.Context(), user.Principal{UserID: id}))
+		}
+	})
+	router.Use(New("global", config, NewMemoryStore()).Handler(func() { rejections++ }))
+	router.GET("/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/reports/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := func(path, userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if userID != "" {
+			req.Header.Set("X-User", userID)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := request("/users", "alice")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "2", response.Header().Get(HeaderLimit))
+	assert.Equal(t, "1", response.Header().Get(HeaderRemaining))
+	assert.Equal(t, "1", response.Header().Get(HeaderReset))
+	assert.Equal(t, "2;w=2", response.Header().Get(HeaderPolicy))
+	assert.Equal(t, http.StatusOK, request("/users", "alice").Code)
+
+	response = request("/users", "alice")
+	assert.Equal(t, http.StatusTooManyRequests, response.Code)
+	assert.Equal(t, "1", response.Header().Get("Retry-After"))
+	assert.Equal(t, "0", response.Header().Get(HeaderRemaining))
+	assert.Equal(t, problem.ContentType, response.Header().Get("Content-Type"))
+	var p problem.Problem
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &p))
+	assert.Equal(t, http.StatusTooManyRequests, p.Status)
+	assert.Equal(t, 1, rejections)
+
+	// Other users and anonymous callers from the same address have buckets of their own
+	assert.Equal(t, http.StatusOK, request("/users", "bob").Code)
+	assert.Equal(t, http.StatusOK, request("/users", "").Code)
+
+	// Routes with a policy of their own use separate buckets
+	response = request("/reports/1", "alice")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "1", response.Header().Get(HeaderLimit))
+	assert.Equal(t, http.StatusTooManyRequests, request("/reports/2", "alice").Code)
+
+	// Principal policies apply to every route
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, request("/reports/1", "vip").Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, request("/users", "vip").Code)
+}
+
+// TestHandlerByIP checks that limiters keyed by IP address ignore the principal, and that requests
+// are let through when the store fails.
+func TestHandlerByIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	config := Config{Default: Policy{Name: "login", Rate: 1, Burst: 1}, ByIP: true}
+	router := gin.New()
+	router.GET("/limited", middleware.Errors(), New("login", config, NewMemoryStore()).Handler(nil), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.GET("/failing", New("login", config, failingStore{}).Handler(nil), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	request := func(path string, ctx context.Context) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		return response.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("/limited", user.WithPrincipal(context.Background(), user.Principal{UserID: "alice"})))
+	assert.Equal(t, http.StatusTooManyRequests, request("/limited", user.WithPrincipal(context.Background(), user.Principal{UserID: "bob"})))
+	assert.Equal(t, http.StatusOK, request("/failing", context.Background()))
+	assert.Equal(t, http.StatusOK, request("/failing", context.Background()))
+}
+
+// TestParse checks the parsing of route and principal policies.
+func TestParse(t *testing.T) {
+	routes, err := ParseRoutes(" GET  /users = 5:10 , POST /users=0.5,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Policy{
+		"GET /users":  {Name: "route:GET /users", Rate: 5, Burst: 10},
+		"POST /users": {Name: "route:POST /users", Rate: 0.5, Burst: 1},
+	}, routes)
+
+	principals, err := ParsePrincipals("apikey:64b7f0c2a1e4d3b2c1a09f8e=100:200")
+	require.NoError(t, err)
+	assert.Equal(t, Policy{Name: "principal", Rate: 100, Burst: 200}, principals["apikey:64b7f0c2a1e4d3b2c1a09f8e"])
+
+	for _, spec := range []string{"GET /users", "=1:1", "GET /users=fast", "GET /users=1:many", "GET /users=0:1", "GET /users=1:0"} {
+		_, err := ParseRoutes(spec)
+		assert.Error(t, err, spec)
+	}
+	_, err = ParsePrincipals("alice=1:1")
+	assert.Error(t, err)
+}
+
+// TestIPPolicy checks that the default IP policy is never stricter than another policy of the config.
+func TestIPPolicy(t *testing.T) {
+	assert.Equal(t, Policy{Name: "ip", Rate: DefaultIPRate, Burst: DefaultIPBurst}, Config{Default: Policy{Rate: 1, Burst: 1}}.IPPolicy())
+
+	config := Config{
+		Default:    Policy{Rate: 1, Burst: 1},
+		Routes:     map[string]Policy{"GET /users": {Rate: 5, Burst: 50}},
+		Principals: map[string]Policy{"user:alice": {Rate: 100, Burst: 10}},
+	}
+	assert.Equal(t, Policy{Name: "ip", Rate: 100, Burst: 50}, config.IPPolicy())
+}
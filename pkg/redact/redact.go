@@ -0,0 +1,174 @@
+package redact
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// FieldsKey configures the comma separated names of the sensitive fields. A field is sensitive when
+	// its name contains one of them, so "token" covers "refresh_token" too.
+	FieldsKey     = "REDACT_FIELDS"
+	DefaultFields = "password,email,address,token,secret,authorization,cookie"
+
+	// Mask replaces sensitive values.
+	Mask = "[REDACTED]"
+)
+
+// Patterns of sensitive values, masked wherever they appear in text.
+var (
+	emailPattern  = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	jwtPattern    = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	bearerPattern = regexp.MustCompile(`(?i)(bearer\s+)\S+`)
+	apiKeyPattern = regexp.MustCompile(`sck_[0-9a-f]+_[A-Za-z0-9_-]+`)
+)
+
+// Redactor masks personal data and credentials in log fields and error messages.
+type Redactor struct {
+	fields   []string       // Lowercase names of the sensitive fields
+	keyValue *regexp.Regexp // Matches key=value and key: value pairs of sensitive fields in text; nil without fields
+}
+
+// New creates a redactor masking the fields with the given names, and the email addresses, access
+// tokens and API keys found in any text.
+func New(fields ...string) *Redactor {
+	r := &Redactor{}
+	var quoted []string
+	for _, field := range fields {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field == "" {
+			continue
+		}
+		r.fields = append(r.fields, field)
+		quoted = append(quoted, regexp.QuoteMeta(field))
+	}
+	if len(quoted) > 0 {
+		r.keyValue = regexp.MustCompile(`(?i)(\b\w*(?:` + strings.Join(quoted, "|") + `)\w*"?\s*[=:]\s*(?:(?:bearer|basic)\s+)?)("[^"]*"|[^\s&,;"}]+)`)
+	}
+	return r
+}
+
+// ParseFields splits a comma separated list of field names.
+func ParseFields(list string) []string {
+	return strings.Split(list, ",")
+}
+
+// Sensitive reports whether the field with the given name holds sensitive data.
+func (r *Redactor) Sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, field := range r.fields {
+		if strings.Contains(key, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// String masks the sensitive values found in the text.
+func (r *Redactor) String(s string) string {
+	if r.keyValue != nil {
+		s = r.keyValue.ReplaceAllString(s, "${1}"+Mask)
+	}
+	s = jwtPattern.ReplaceAllString(s, Mask)
+	s = bearerPattern.ReplaceAllString(s, "${1}"+Mask)
+	s = apiKeyPattern.ReplaceAllString(s, Mask)
+	return emailPattern.ReplaceAllString(s, Mask)
+}
+
+// Error returns the message of the error with its sensitive values masked.
+func (r *Redactor) Error(err error) string {
+	return r.String(err.Error())
+}
+
+// Value returns the value of the field with the given name, masked entirely if the field is sensitive.
+// Numbers and booleans of other fields are returned unchanged. Any other value is formatted as text
+// with the sensitive values it contains masked; the fields of structs and the entries of maps are
+// masked by name first, so logging a whole user does not reveal its email, address or password.
+func (r *Redactor) Value(key string, value interface{}) interface{} {
+	if r.Sensitive(key) {
+		return Mask
+	}
+	switch v := value.(type) {
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return value
+	case string:
+		return r.String(v)
+	case []byte:
+		return r.String(string(v))
+	case error:
+		return r.String(v.Error())
+	case fmt.Stringer:
+		return r.String(v.String())
+	default:
+		return r.String(fmt.Sprintf("%+v", r.structured(key, reflect.ValueOf(value))))
+	}
+}
+
+// structured returns the value with the fields of structs and the entries of maps replaced by their
+// redacted values, keyed by name. Slices keep the name of the field holding them.
+func (r *Redactor) structured(key string, v reflect.Value) interface{} {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		fields := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Type().Field(i); field.IsExported() {
+				fields[field.Name] = r.Value(field.Name, v.Field(i).Interface())
+			}
+		}
+		return fields
+	case reflect.Map:
+		entries := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			name := fmt.Sprint(iter.Key().Interface())
+			entries[name] = r.Value(name, iter.Value().Interface())
+		}
+		return entries
+	case reflect.Slice, reflect.Array:
+		elems := make([]interface{}, v.Len())
+		for i := range elems {
+			elems[i] = r.Value(key, v.Index(i).Interface())
+		}
+		return elems
+	}
+	if v.IsValid() && v.CanInterface() {
+		return v.Interface()
+	}
+	return nil
+}
+
+// defaultRedactor is used by the logs and the error messages returned to clients.
+var defaultRedactor atomic.Pointer[Redactor]
+
+func init() {
+	SetDefault(New(ParseFields(DefaultFields)...))
+}
+
+// Default returns the default redactor.
+func Default() *Redactor {
+	return defaultRedactor.Load()
+}
+
+// SetDefault replaces the default redactor. It returns the previous one, so tests can restore it.
+func SetDefault(r *Redactor) *Redactor {
+	return defaultRedactor.Swap(r)
+}
+
+// String masks the sensitive values found in the text with the default redactor.
+func String(s string) string {
+	return Default().String(s)
+}
+
+// Error returns the message of the error with its sensitive values masked by the default redactor.
+func Error(err error) string {
+	return Default().Error(err)
+}
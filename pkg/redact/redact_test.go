@@ -0,0 +1,72 @@
+package redact
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestString checks that personal data and credentials are masked wherever they appear in text.
+func TestString(t *testing.T) {
+	r := New(ParseFields(DefaultFields)...)
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{
+			`E11000 duplicate key error collection: devenv.users index: email_1 dup key: { email: "alice@example.com" }`,
+			`E11000 duplicate key error collection: devenv.users index: email_1 dup key: { email: [REDACTED] }`,
+		},
+		{"failed to notify bob@example.com", "failed to notify [REDACTED]"},
+		{`{"name":"Bob","password":"P@ssword123"}`, `{"name":"Bob","password":[REDACTED]}`},
+		{"https://app/reset?token=abc123&lang=en", "https://app/reset?token=[REDACTED]&lang=en"},
+		{"Authorization: Bearer abc.def", "Authorization: Bearer [REDACTED]"},
+		{"rejected Bearer abc.def", "rejected Bearer [REDACTED]"},
+		{"token eyJhbGciOiJFUzI1NiJ9.eyJzdWIiOiIxIn0.c2ln expired", "token [REDACTED] expired"},
+		{"unknown key sck_0a1b2c_s3cr3t", "unknown key [REDACTED]"},
+		{"invalid email or password", "invalid email or password"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, r.String(test.text))
+	}
+}
+
+// TestValue checks that sensitive fields are masked entirely, and that other fields keep their values.
+func TestValue(t *testing.T) {
+	r := New("password", "email", "token")
+	assert.Equal(t, Mask, r.Value("email", "alice@example.com"))
+	assert.Equal(t, Mask, r.Value("Refresh_Token", "opaque"))
+	assert.Equal(t, Mask, r.Value("password", errors.New("secret")))
+	assert.Equal(t, "sent to [REDACTED]", r.Value("error", errors.New("sent to alice@example.com")))
+	assert.Equal(t, "GET", r.Value("method", "GET"))
+	assert.Equal(t, true, r.Value("verified", true))
+	assert.Equal(t, 42, r.Value("status", 42))
+	assert.Equal(t, "1m0s", r.Value("retry_in", time.Minute))
+
+	// Sensitive fields are masked whatever their type
+	assert.Equal(t, Mask, r.Value("email_verified", true))
+	assert.Equal(t, Mask, r.Value("password", []string{"P@ssword123"}))
+
+	// Structs and maps are masked field by field, including values spanning several words
+	type account struct {
+		Name     string
+		Email    string
+		Password string
+		Address  string
+		Tags     []string
+		secret   string
+	}
+	r = New("password", "email", "address")
+	value := r.Value("user", &account{Name: "Alice", Email: "alice@example.com", Password: "$2a$12$hash", Address: "1 Main St", Tags: []string{"vip"}, secret: "s"})
+	assert.Equal(t, "map[Address:[REDACTED] Email:[REDACTED] Name:Alice Password:[REDACTED] Tags:[vip]]", value)
+	value = r.Value("fields", map[string]string{"address": "Rua Romao Batista", "note": "contact bob@example.com"})
+	assert.Equal(t, "map[address:[REDACTED] note:contact [REDACTED]]", value)
+
+	// Without fields, only the values found in text are masked
+	r = New(ParseFields("")...)
+	assert.False(t, r.Sensitive("password"))
+	assert.Equal(t, "plain", r.Value("password", "plain"))
+	assert.Equal(t, Mask, r.Value("to", "alice@example.com"))
+}
@@ -0,0 +1,41 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+)
+
+// Header is the request and response header carrying the ID of a request.
+const Header = "X-Request-ID"
+
+// isValid matches the IDs accepted from clients. Other values are replaced, so IDs are safe to log.
+var isValid = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// idKey is the context key under which the ID of a request is stored.
+type idKey struct{}
+
+// New generates a random request ID.
+func New() string {
+	b := make([]byte, 16)
+	// crypto/rand does not fail on supported platforms.
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Valid reports whether id may be used as a request ID.
+func Valid(id string) bool {
+	return isValid.MatchString(id)
+}
+
+// NewContext returns a copy of ctx carrying the request ID.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey{}, id)
+}
+
+// FromContext returns the ID of the request the context belongs to, if any.
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(idKey{}).(string)
+	return id, ok
+}
@@ -0,0 +1,73 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	// Header is the request header naming the tenant of requests made before logging in.
+	Header = "X-Tenant-ID"
+	// QueryParam names the tenant in links opened in a browser, which cannot send headers.
+	QueryParam = "tenant"
+)
+
+var (
+	// ErrUnknownTenant is returned when no tenant exists with the given ID.
+	ErrUnknownTenant = errors.New("unknown tenant")
+	// ErrTenantMismatch is returned when binding a request to a tenant other than the one it is bound to.
+	ErrTenantMismatch = errors.New("request is bound to another tenant")
+)
+
+// Registry maps tenants to their databases.
+type Registry interface {
+	// Database returns the name of the database holding the data of the tenant with the given ID.
+	Database(ctx context.Context, id string) (string, error)
+	// Remove forgets the tenant with the given ID after its organization was deleted.
+	Remove(ctx context.Context, id string) error
+}
+
+// scope is the tenant an isolated request works on. A request bound to no tenant works on the
+// platform database, which holds the users outside organizations.
+type scope struct {
+	id    string // ID of the tenant; empty for the platform
+	bound bool   // Whether the tenant is final
+}
+
+// scopeKey is the context key under which the scope of an isolated request is stored.
+type scopeKey struct{}
+
+// Isolate returns a copy of ctx marking the request as isolated to a single tenant.
+// A non-empty id binds the request to that tenant right away; otherwise it is bound later,
+// when the caller is authenticated.
+func Isolate(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, scopeKey{}, scope{id: id, bound: id != ""})
+}
+
+// Isolated reports whether the request is isolated to a single tenant.
+func Isolated(ctx context.Context) bool {
+	_, ok := ctx.Value(scopeKey{}).(scope)
+	return ok
+}
+
+// Bind returns a copy of ctx binding an isolated request to the tenant with the given ID,
+// or to the platform for an empty ID. It returns ErrTenantMismatch if the request is already
+// bound to another tenant: once bound, a request cannot move to another tenant.
+// Requests that are not isolated are returned unchanged.
+func Bind(ctx context.Context, id string) (context.Context, error) {
+	s, ok := ctx.Value(scopeKey{}).(scope)
+	if !ok {
+		return ctx, nil
+	}
+	if s.bound && s.id != id {
+		return ctx, ErrTenantMismatch
+	}
+	return context.WithValue(ctx, scopeKey{}, scope{id: id, bound: true}), nil
+}
+
+// FromContext returns the ID of the tenant an isolated request is bound to.
+// It reports false for requests that are not isolated or work on the platform.
+func FromContext(ctx context.Context) (string, bool) {
+	s, ok := ctx.Value(scopeKey{}).(scope)
+	return s.id, ok && s.id != ""
+}
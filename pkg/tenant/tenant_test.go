@@ -0,0 +1,43 @@
+package tenant
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBind checks that a request is bound to a tenant once, and cannot move to another one.
+func TestBind(t *testing.T) {
+	// Requests that are not isolated are never bound
+	ctx, err := Bind(context.Background(), "acme")
+	require.NoError(t, err)
+	assert.False(t, Isolated(ctx))
+	_, ok := FromContext(ctx)
+	assert.False(t, ok)
+
+	// An isolated request naming no tenant is bound when the caller is authenticated
+	ctx = Isolate(context.Background(), "")
+	assert.True(t, Isolated(ctx))
+	_, ok = FromContext(ctx)
+	assert.False(t, ok)
+	ctx, err = Bind(ctx, "acme")
+	require.NoError(t, err)
+	id, ok := FromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "acme", id)
+
+	_, err = Bind(ctx, "acme")
+	assert.NoError(t, err)
+	_, err = Bind(ctx, "globex")
+	assert.ErrorIs(t, err, ErrTenantMismatch)
+	_, err = Bind(ctx, "")
+	assert.ErrorIs(t, err, ErrTenantMismatch)
+
+	// A request bound to the platform cannot move to a tenant
+	ctx, err = Bind(Isolate(context.Background(), ""), "")
+	require.NoError(t, err)
+	_, err = Bind(ctx, "acme")
+	assert.ErrorIs(t, err, ErrTenantMismatch)
+}
@@ -0,0 +1,82 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// ExporterKey selects where spans are sent: ExporterOTLP sends them to an OpenTelemetry collector
+	// configured with the standard OTEL_EXPORTER_OTLP_* variables, and ExporterNone disables tracing.
+	// ExporterStdout and ExporterFile write every span as JSON, so traces can be checked without a collector.
+	ExporterKey     = "OTEL_TRACES_EXPORTER"
+	ExporterNone    = "none"
+	ExporterOTLP    = "otlp"
+	ExporterStdout  = "stdout"
+	ExporterFile    = "file"
+	DefaultExporter = ExporterNone
+	// FileKey configures the file the spans are appended to with ExporterFile.
+	FileKey     = "OTEL_TRACES_FILE"
+	DefaultFile = "traces.json"
+
+	// ServiceName identifies the API in the spans.
+	ServiceName = "simplecrud"
+)
+
+// Setup creates the tracer provider exporting spans with the given exporter, and installs it globally
+// together with the W3C trace context propagator, so incoming traceparent headers continue the caller's
+// trace. It returns a nil provider when tracing is disabled. The provider must be shut down to flush
+// the spans still buffered.
+func Setup(ctx context.Context, exporter, file string) (*sdktrace.TracerProvider, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case ExporterNone:
+		return nil, nil
+	case ExporterOTLP:
+		spanExporter, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		var f *os.File
+		if f, err = os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600); err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, fmt.Errorf("unknown %s %q", ExporterKey, exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider, nil
+}
+
+// End ends the span, recording err as its error if it is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
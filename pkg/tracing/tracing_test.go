@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+)
+
+// exportedSpan holds the fields of a span written by the file exporter that the tests check.
+type exportedSpan struct {
+	Name        string
+	SpanContext struct{ TraceID, SpanID string }
+	Parent      struct{ TraceID, SpanID string }
+}
+
+// TestFileExporterContinuesTrace checks that a request carrying a traceparent header is traced as part of
+// the caller's trace, and that spans started from the request context become children of the request span.
+func TestFileExporterContinuesTrace(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "traces.json")
+	provider, err := Setup(context.Background(), ExporterFile, file)
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(otelgin.Middleware(ServiceName, otelgin.WithTracerProvider(provider)))
+	router.GET("/users/:id", func(c *gin.Context) {
+		_, span := otel.Tracer("test").Start(c.Request.Context(), "UserService.GetUser")
+		span.End()
+		c.Status(http.StatusNoContent)
+	})
+	request := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	require.NoError(t, provider.Shutdown(context.Background()))
+
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+	spans := make(map[string]exportedSpan)
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for decoder.More() {
+		var span exportedSpan
+		require.NoError(t, decoder.Decode(&span))
+		spans[span.Name] = span
+	}
+
+	server, service := spans["/users/:id"], spans["UserService.GetUser"]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent.SpanID)
+	assert.Equal(t, server.SpanContext.TraceID, service.SpanContext.TraceID)
+	assert.Equal(t, server.SpanContext.SpanID, service.Parent.SpanID)
+}
+
+// TestSetupRejectsUnknownExporter checks that tracing is disabled by ExporterNone, and that unknown
+// exporters are refused.
+func TestSetupRejectsUnknownExporter(t *testing.T) {
+	provider, err := Setup(context.Background(), ExporterNone, "")
+	assert.NoError(t, err)
+	assert.Nil(t, provider)
+
+	_, err = Setup(context.Background(), "jaeger", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,256 @@
+package user
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Environment variables used to configure the breached password check.
+const (
+	// PwnedPasswordsFileKey is the path of a Have I Been Pwned password corpus. See OpenPwnedPasswords.
+	PwnedPasswordsFileKey = "PWNED_PASSWORDS_FILE"
+	// PwnedPasswordsMinCountKey is how often a password must have been seen in breaches to be rejected.
+	PwnedPasswordsMinCountKey     = "PWNED_PASSWORDS_MIN_COUNT"
+	DefaultPwnedPasswordsMinCount = 1
+)
+
+// ErrMalformedCorpus is returned when a line of the breached password corpus cannot be parsed.
+var ErrMalformedCorpus = errors.New("malformed breached password corpus")
+
+// BreachedPasswords reports whether a password is known from data breaches.
+type BreachedPasswords interface {
+	Contains(password string) (bool, error)
+}
+
+// sha1HexLength is the length of a hex encoded SHA-1 hash, and prefixLength the length of
+// the hash prefix Have I Been Pwned groups the hashes by.
+const (
+	sha1HexLength = 40
+	prefixLength  = 5
+)
+
+// maxCorpusLine is the longest corpus line read; real lines are under 60 bytes.
+const maxCorpusLine = 256
+
+// PwnedPasswords looks passwords up in a Have I Been Pwned SHA-1 corpus on disk without loading it
+// into memory. The corpus is either a single file of "HASH:COUNT" lines sorted by hash, which is
+// searched with a binary search, or a directory of "PREFIX.txt" files holding the "SUFFIX:COUNT"
+// lines of every hash starting with that 5 character prefix, as written by the official downloader.
+type PwnedPasswords struct {
+	file     *os.File // Sorted corpus file; nil in directory mode
+	size     int64    // Size of the corpus file
+	dir      string   // Directory of prefix files; empty in file mode
+	minCount int      // Fewest breaches a hash must appear in to count
+}
+
+// OpenPwnedPasswords opens the corpus at path, which may be a file or a directory of prefix files.
+// Hashes seen fewer than minCount times are ignored.
+func OpenPwnedPasswords(path string, minCount int) (*PwnedPasswords, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password corpus: %w", err)
+	}
+	if info.IsDir() {
+		return &PwnedPasswords{dir: path, minCount: minCount}, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password corpus: %w", err)
+	}
+	return &PwnedPasswords{file: file, size: info.Size(), minCount: minCount}, nil
+}
+
+// Close closes the corpus file.
+func (p *PwnedPasswords) Close() error {
+	if p.file == nil {
+		return nil
+	}
+	return p.file.Close()
+}
+
+// Contains reports whether the SHA-1 hash of the password appears in the corpus at least minCount times.
+func (p *PwnedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := []byte(strings.ToUpper(hex.EncodeToString(sum[:])))
+
+	var count int
+	var err error
+	if p.file != nil {
+		count, err = p.searchFile(hash)
+	} else {
+		count, err = p.searchBucket(hash)
+	}
+	if err != nil {
+		return false, err
+	}
+	return count > 0 && count >= p.minCount, nil
+}
+
+// searchFile binary searches the sorted corpus file for the hash and returns its count,
+// or 0 if it is not listed. Only a few short reads are needed per lookup.
+func (p *PwnedPasswords) searchFile(hash []byte) (int, error) {
+	// Every line starting at an offset in [lo, hi) may still hold the hash.
+	lo, hi := int64(0), p.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		line, next, err := p.lineAt(mid)
+		if err != nil {
+			return 0, err
+		}
+		if line == nil {
+			hi = mid
+			continue
+		}
+
+		lineHash, count, err := parseCorpusLine(line)
+		if err != nil {
+			return 0, err
+		}
+		switch cmp := bytes.Compare(lineHash, hash); {
+		case cmp == 0:
+			return count, nil
+		case cmp < 0:
+			lo = next
+		default:
+			hi = mid
+		}
+	}
+	return 0, nil
+}
+
+// lineAt returns the first line starting at or after offset, and the offset of the line after it.
+// It returns a nil line if no line starts at or after offset.
+func (p *PwnedPasswords) lineAt(offset int64) ([]byte, int64, error) {
+	// Read from the byte before offset, so a line starting exactly at offset is found too.
+	start := offset
+	if start > 0 {
+		start--
+	}
+	buf := make([]byte, 2*maxCorpusLine)
+	n, err := p.file.ReadAt(buf, start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, 0, fmt.Errorf("failed to read breached password corpus: %w", err)
+	}
+	buf = buf[:n]
+
+	if offset > 0 {
+		newline := bytes.IndexByte(buf, '\n')
+		if newline < 0 {
+			return nil, 0, nil
+		}
+		buf = buf[newline+1:]
+		start += int64(newline) + 1
+	}
+	if len(buf) == 0 {
+		return nil, 0, nil
+	}
+
+	end := bytes.IndexByte(buf, '\n')
+	if end < 0 {
+		if start+int64(len(buf)) < p.size {
+			return nil, 0, ErrMalformedCorpus
+		}
+		return buf, p.size, nil
+	}
+	return buf[:end], start + int64(end) + 1, nil
+}
+
+// searchBucket scans the prefix file of the hash and returns its count, or 0 if it is not listed.
+func (p *PwnedPasswords) searchBucket(hash []byte) (int, error) {
+	prefix, suffix := hash[:prefixLength], hash[prefixLength:]
+	file, err := os.Open(filepath.Join(p.dir, string(prefix)+".txt"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open breached password bucket: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineSuffix, count, err := parseCorpusLine(scanner.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		if bytes.Equal(lineSuffix, suffix) {
+			return count, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read breached password bucket: %w", err)
+	}
+	return 0, nil
+}
+
+// parseCorpusLine splits a "HASH:COUNT" line. The hash is returned uppercased.
+// Lines without a count, as in hash-only lists, count as seen once.
+func parseCorpusLine(line []byte) ([]byte, int, error) {
+	line = bytes.TrimRight(line, "\r")
+	hash, countText, hasCount := bytes.Cut(line, []byte(":"))
+	if len(hash) == 0 || len(hash) > sha1HexLength {
+		return nil, 0, ErrMalformedCorpus
+	}
+	if !hasCount {
+		return bytes.ToUpper(hash), 1, nil
+	}
+	count, err := strconv.Atoi(string(bytes.TrimSpace(countText)))
+	if err != nil {
+		return nil, 0, ErrMalformedCorpus
+	}
+	return bytes.ToUpper(hash), count, nil
+}
+
+// commonPasswordList is the bundled list of common passwords, one base word per line.
+//
+//go:embed commonpasswords.txt
+var commonPasswordList string
+
+var (
+	commonPasswordsOnce sync.Once
+	commonPasswords     map[string]struct{}
+)
+
+// leetReplacer undoes common character substitutions, such as "p@ssw0rd" for "password".
+var leetReplacer = strings.NewReplacer("@", "a", "4", "a", "3", "e", "1", "i", "!", "i", "0", "o", "$", "s", "5", "s", "7", "t")
+
+// isCommonPassword reports whether the password is a common password, also when it is only
+// disguised with character substitutions or leading and trailing digits and symbols.
+func isCommonPassword(password string) bool {
+	commonPasswordsOnce.Do(func() {
+		commonPasswords = make(map[string]struct{})
+		for _, line := range strings.Split(commonPasswordList, "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				commonPasswords[line] = struct{}{}
+			}
+		}
+	})
+
+	isNotLetter := func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}
+	lowered := strings.ToLower(password)
+	for _, base := range []string{lowered, strings.TrimFunc(lowered, isNotLetter)} {
+		decoded := leetReplacer.Replace(base)
+		for _, word := range []string{base, decoded, strings.TrimFunc(decoded, isNotLetter)} {
+			if _, ok := commonPasswords[word]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package user
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"simplecrud/pkg/models"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pwnedHash returns the uppercase hex SHA-1 hash of a password, as listed in the corpus.
+func pwnedHash(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// writeCorpusFile writes a sorted "HASH:COUNT" corpus with the given passwords and filler hashes.
+func writeCorpusFile(t *testing.T, counts map[string]int, newline string) string {
+	var lines []string
+	for password, count := range counts {
+		lines = append(lines, fmt.Sprintf("%s:%d", pwnedHash(password), count))
+	}
+	for i := 0; i < 500; i++ {
+		lines = append(lines, fmt.Sprintf("%s:%d", pwnedHash(fmt.Sprintf("filler-%d", i)), i+1))
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned-passwords.txt")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, newline)), 0o600))
+	return path
+}
+
+// TestPwnedPasswordsFile checks lookups in a single sorted corpus file.
+func TestPwnedPasswordsFile(t *testing.T) {
+	counts := map[string]int{"Tr0ub4dor&3x": 42, "Rare#Passw0rd": 1}
+	for _, newline := range []string{"\n", "\r\n"} {
+		corpus, err := OpenPwnedPasswords(writeCorpusFile(t, counts, newline), 1)
+		require.NoError(t, err)
+
+		for password := range counts {
+			found, err := corpus.Contains(password)
+			require.NoError(t, err)
+			assert.True(t, found, password)
+		}
+		for i := 0; i < 500; i += 7 {
+			found, err := corpus.Contains(fmt.Sprintf("filler-%d", i))
+			require.NoError(t, err)
+			assert.True(t, found, "filler %d", i)
+		}
+		found, err := corpus.Contains("N3w@Passw0rd")
+		require.NoError(t, err)
+		assert.False(t, found)
+		require.NoError(t, corpus.Close())
+	}
+
+	// Rarely breached passwords can be allowed
+	corpus, err := OpenPwnedPasswords(writeCorpusFile(t, counts, "\n"), 10)
+	require.NoError(t, err)
+	defer corpus.Close()
+	found, err := corpus.Contains("Rare#Passw0rd")
+	require.NoError(t, err)
+	assert.False(t, found)
+	found, err = corpus.Contains("Tr0ub4dor&3x")
+	require.NoError(t, err)
+	assert.True(t, found)
+}
+
+// TestPwnedPasswordsDirectory checks lookups in a directory of prefix bucket files.
+func TestPwnedPasswordsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	hash := pwnedHash("Tr0ub4dor&3x")
+	bucket := fmt.Sprintf("%s:3\r\n%s:42\r\n", strings.Repeat("0", 35), hash[prefixLength:])
+	require.NoError(t, os.WriteFile(filepath.Join(dir, hash[:prefixLength]+".txt"), []byte(bucket), 0o600))
+
+	corpus, err := OpenPwnedPasswords(dir, 1)
+	require.NoError(t, err)
+	found, err := corpus.Contains("Tr0ub4dor&3x")
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = corpus.Contains("N3w@Passw0rd")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	_, err = OpenPwnedPasswords(filepath.Join(dir, "missing"), 1)
+	assert.Error(t, err)
+}
+
+// TestPwnedPasswordsMalformed checks that unreadable corpus lines are reported.
+func TestPwnedPasswordsMalformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pwned-passwords.txt")
+	require.NoError(t, os.WriteFile(path, []byte("not a corpus line at all, much longer than any sha-1 hash:x\n"), 0o600))
+	corpus, err := OpenPwnedPasswords(path, 1)
+	require.NoError(t, err)
+	defer corpus.Close()
+
+	_, err = corpus.Contains("N3w@Passw0rd")
+	assert.ErrorIs(t, err, ErrMalformedCorpus)
+}
+
+// TestIsCommonPassword checks that disguised common passwords are recognized.
+func TestIsCommonPassword(t *testing.T) {
+	for _, password := range []string{"password", "Password1!", "P@ssw0rd", "P@ssw0rd1", "!!Qwerty2024", "iloveyou", "123456", "Dr4g0n#"} {
+		assert.True(t, isCommonPassword(password), password)
+	}
+	for _, password := range []string{"N3w@Passw0rd", "Tr0ub4dor&3x", "correct horse battery staple"} {
+		assert.False(t, isCommonPassword(password), password)
+	}
+}
+
+// TestPasswordPolicyBreached checks that the policy rejects common and breached passwords.
+func TestPasswordPolicyBreached(t *testing.T) {
+	corpus, err := OpenPwnedPasswords(writeCorpusFile(t, map[string]int{"Tr0ub4dor&3x": 42}, "\n"), 1)
+	require.NoError(t, err)
+	defer corpus.Close()
+
+	owner := models.User{Name: "Alice", Email: "alice@example.com"}
+	policy := DefaultPasswordPolicy()
+	assert.Equal(t, []string{ViolationCommon}, violationCodes(policy.Check("Password1!", owner)))
+
+	policy.Breached = corpus
+	assert.Equal(t, []string{ViolationBreached}, violationCodes(policy.Check("Tr0ub4dor&3x", owner)))
+	assert.Empty(t, policy.Check("N3w@Passw0rd", owner))
+}
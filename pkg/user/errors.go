@@ -0,0 +1,46 @@
+package user
+
+import "errors"
+
+// Kind classifies the errors of the user service, so callers can answer them without matching
+// their messages.
+type Kind int
+
+// Kinds of errors. Errors of no known kind, such as database failures, are KindInternal.
+const (
+	KindInternal        Kind = iota // Unexpected failure, not caused by the caller
+	KindInvalid                     // The input breaks validation rules; see ValidationError
+	KindUnauthenticated             // The credentials given by the caller are wrong
+	KindForbidden                   // The caller is not allowed to perform the operation
+	KindNotFound                    // The user does not exist, or is hidden from the caller
+	KindConflict                    // The operation conflicts with the current state, such as removing the last admin
+)
+
+// Error is an error of a known kind. Other packages use it for their own errors, so the error
+// middleware can answer them without knowing each of them.
+type Error struct {
+	Kind    Kind
+	Message string
+	// Detail is answered to clients instead of the default detail of the kind. Like the message, it is
+	// fixed text that never carries values sent by the client.
+	Detail string
+}
+
+// Error returns the message of the error.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// KindOf returns the kind of the first Error or ValidationError wrapped by err, or KindInternal if
+// it wraps neither.
+func KindOf(err error) Kind {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return KindInvalid
+	}
+	var kindErr *Error
+	if errors.As(err, &kindErr) {
+		return kindErr.Kind
+	}
+	return KindInternal
+}
@@ -0,0 +1,257 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"simplecrud/utils"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Environment variables and defaults used to configure password hashing.
+// The Argon2id defaults follow the OWASP recommendation of 19 MiB of memory, 2 iterations and 1 thread.
+const (
+	HashAlgorithmKey         = "PASSWORD_HASH_ALGORITHM"
+	AlgorithmBcrypt          = "bcrypt"
+	AlgorithmArgon2id        = "argon2id"
+	DefaultHashAlgorithm     = AlgorithmArgon2id
+	BcryptCostKey            = "BCRYPT_COST"
+	DefaultBcryptCost        = 12
+	Argon2MemoryKey          = "ARGON2_MEMORY" // In KiB
+	DefaultArgon2Memory      = 19 * 1024
+	Argon2IterationsKey      = "ARGON2_ITERATIONS"
+	DefaultArgon2Iterations  = 2
+	Argon2ParallelismKey     = "ARGON2_PARALLELISM"
+	DefaultArgon2Parallelism = 1
+)
+
+// Argon2id output sizes, in bytes.
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var (
+	// ErrUnknownHashFormat is returned when a stored hash was not produced by a known algorithm.
+	ErrUnknownHashFormat = errors.New("unknown password hash format")
+	// ErrMalformedHash is returned when a stored hash has the right algorithm but cannot be parsed.
+	ErrMalformedHash = errors.New("malformed password hash")
+)
+
+// PasswordHasher hashes passwords and verifies them against stored hashes.
+// Hashes are self-describing strings recording the algorithm and its parameters.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password with the current parameters.
+	Hash(password string) (string, error)
+	// Verify reports whether the password matches the encoded hash.
+	// It returns ErrUnknownHashFormat if the hash was not produced by this hasher's algorithm.
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash reports whether the encoded hash should be replaced by one with the current
+	// algorithm and parameters.
+	NeedsRehash(encoded string) bool
+}
+
+// bcryptMaxPasswordBytes is the longest password bcrypt can hash; longer passwords are rejected by it.
+const bcryptMaxPasswordBytes = 72
+
+// BcryptHasher hashes passwords with bcrypt. Its hashes use bcrypt's own "$2a$<cost>$..." format.
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash returns the bcrypt hash of the password.
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// Verify reports whether the password matches the bcrypt hash.
+func (h BcryptHasher) Verify(password, encoded string) (bool, error) {
+	if !isBcryptHash(encoded) {
+		return false, ErrUnknownHashFormat
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrMalformedHash, err)
+	}
+	return true, nil
+}
+
+// NeedsRehash reports whether the hash is not a bcrypt hash or has a different cost.
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	if !isBcryptHash(encoded) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// MaxPasswordBytes returns the longest password in bytes bcrypt can hash.
+func (h BcryptHasher) MaxPasswordBytes() int {
+	return bcryptMaxPasswordBytes
+}
+
+// isBcryptHash reports whether the encoded hash uses one of the bcrypt prefixes.
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// Argon2idHasher hashes passwords with Argon2id. Its hashes use the PHC string format:
+// "$argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>".
+type Argon2idHasher struct {
+	Memory      uint32 // Memory in KiB
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// argon2Params are the parameters recorded in an Argon2id hash.
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// Hash returns the Argon2id hash of the password with a random salt.
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify reports whether the password matches the Argon2id hash, using the parameters recorded in it.
+func (h Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	params, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(password), params.salt, params.iterations, params.memory, params.parallelism, uint32(len(params.key)))
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+// NeedsRehash reports whether the hash is not an Argon2id hash or has different parameters.
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.memory != h.Memory || params.iterations != h.Iterations || params.parallelism != h.Parallelism
+}
+
+// parseArgon2id decodes an Argon2id PHC string.
+func parseArgon2id(encoded string) (argon2Params, error) {
+	var params argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != AlgorithmArgon2id {
+		return params, ErrUnknownHashFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, fmt.Errorf("%w: unsupported argon2 version", ErrMalformedHash)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, fmt.Errorf("%w: %v", ErrMalformedHash, err)
+	}
+	if params.iterations == 0 || params.parallelism == 0 {
+		return params, fmt.Errorf("%w: invalid argon2 parameters", ErrMalformedHash)
+	}
+
+	var err error
+	if params.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, fmt.Errorf("%w: %v", ErrMalformedHash, err)
+	}
+	if params.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(params.key) == 0 {
+		return params, fmt.Errorf("%w: invalid key", ErrMalformedHash)
+	}
+	return params, nil
+}
+
+// maxPasswordBytes returns the longest password in bytes the hasher can hash, or 0 if it has no limit.
+// Hashers with a limit, such as bcrypt, implement MaxPasswordBytes.
+func maxPasswordBytes(hasher PasswordHasher) int {
+	if limited, ok := hasher.(interface{ MaxPasswordBytes() int }); ok {
+		return limited.MaxPasswordBytes()
+	}
+	return 0
+}
+
+// hasherChain hashes new passwords with its first hasher and verifies hashes of any of its hashers.
+type hasherChain []PasswordHasher
+
+// NewPasswordHasher returns a PasswordHasher that hashes with current and still verifies hashes made by
+// the legacy hashers. Hashes not made by current with its current parameters need a rehash.
+func NewPasswordHasher(current PasswordHasher, legacy ...PasswordHasher) PasswordHasher {
+	return append(hasherChain{current}, legacy...)
+}
+
+// Hash hashes the password with the current hasher.
+func (c hasherChain) Hash(password string) (string, error) {
+	return c[0].Hash(password)
+}
+
+// MaxPasswordBytes returns the longest password in bytes the current hasher can hash, or 0 if it has
+// no limit.
+func (c hasherChain) MaxPasswordBytes() int {
+	return maxPasswordBytes(c[0])
+}
+
+// Verify verifies the password with the first hasher that knows the hash format.
+func (c hasherChain) Verify(password, encoded string) (bool, error) {
+	for _, hasher := range c {
+		ok, err := hasher.Verify(password, encoded)
+		if errors.Is(err, ErrUnknownHashFormat) {
+			continue
+		}
+		return ok, err
+	}
+	return false, ErrUnknownHashFormat
+}
+
+// NeedsRehash reports whether the hash differs from what the current hasher would produce.
+func (c hasherChain) NeedsRehash(encoded string) bool {
+	return c[0].NeedsRehash(encoded)
+}
+
+// PasswordHasherFromEnv returns the password hasher configured by the environment.
+// New hashes use PASSWORD_HASH_ALGORITHM with its configured parameters; hashes made with the
+// other algorithm are still accepted and get replaced on the next login.
+func PasswordHasherFromEnv() (PasswordHasher, error) {
+	bcryptHasher := BcryptHasher{Cost: utils.GetEnvInt(BcryptCostKey, DefaultBcryptCost)}
+	if bcryptHasher.Cost < bcrypt.MinCost || bcryptHasher.Cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	argon2Hasher := Argon2idHasher{
+		Memory:      uint32(utils.GetEnvInt(Argon2MemoryKey, DefaultArgon2Memory)),
+		Iterations:  uint32(utils.GetEnvInt(Argon2IterationsKey, DefaultArgon2Iterations)),
+		Parallelism: uint8(utils.GetEnvInt(Argon2ParallelismKey, DefaultArgon2Parallelism)),
+	}
+	if argon2Hasher.Iterations == 0 || argon2Hasher.Parallelism == 0 || argon2Hasher.Memory < 8*uint32(argon2Hasher.Parallelism) {
+		return nil, errors.New("invalid argon2 parameters")
+	}
+
+	switch algorithm := utils.GetEnv(HashAlgorithmKey, DefaultHashAlgorithm); algorithm {
+	case AlgorithmArgon2id:
+		return NewPasswordHasher(argon2Hasher, bcryptHasher), nil
+	case AlgorithmBcrypt:
+		return NewPasswordHasher(bcryptHasher, argon2Hasher), nil
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", algorithm)
+	}
+}
@@ -0,0 +1,103 @@
+package user
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2 uses small Argon2id parameters to keep the tests fast.
+var testArgon2 = Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1}
+
+// TestPasswordHashers checks that every hasher verifies its own hashes and rejects wrong passwords.
+func TestPasswordHashers(t *testing.T) {
+	for _, hasher := range []PasswordHasher{testHasher, testArgon2} {
+		encoded, err := hasher.Hash("P@ssword123")
+		require.NoError(t, err)
+
+		ok, err := hasher.Verify("P@ssword123", encoded)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = hasher.Verify("wrong", encoded)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		assert.False(t, hasher.NeedsRehash(encoded))
+
+		other, err := hasher.Hash("P@ssword123")
+		require.NoError(t, err)
+		assert.NotEqual(t, encoded, other, "hashes are salted")
+	}
+}
+
+// TestArgon2idFormat checks the PHC string layout and parameter parsing.
+func TestArgon2idFormat(t *testing.T) {
+	encoded, err := testArgon2.Hash("P@ssword123")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$"))
+
+	// Hashes made with other parameters are still verified, but need a rehash
+	stronger := Argon2idHasher{Memory: 128, Iterations: 2, Parallelism: 1}
+	ok, err := stronger.Verify("P@ssword123", encoded)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, stronger.NeedsRehash(encoded))
+
+	// Foreign and broken hashes are reported
+	_, err = testArgon2.Verify("P@ssword123", "$2a$10$abcdefghijklmnopqrstuv")
+	assert.ErrorIs(t, err, ErrUnknownHashFormat)
+	_, err = testArgon2.Verify("P@ssword123", "$argon2id$v=19$m=64,t=1,p=1$!!$!!")
+	assert.ErrorIs(t, err, ErrMalformedHash)
+	_, err = testArgon2.Verify("P@ssword123", "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5")
+	assert.ErrorIs(t, err, ErrMalformedHash)
+}
+
+// TestPasswordHasherChain checks that legacy hashes are verified and flagged for rehash.
+func TestPasswordHasherChain(t *testing.T) {
+	hasher := NewPasswordHasher(testArgon2, testHasher)
+	legacy, err := bcrypt.GenerateFromPassword([]byte("P@ssword123"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	ok, err := hasher.Verify("P@ssword123", string(legacy))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, hasher.NeedsRehash(string(legacy)))
+
+	current, err := hasher.Hash("P@ssword123")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(current, "$argon2id$"))
+	assert.False(t, hasher.NeedsRehash(current))
+
+	_, err = hasher.Verify("P@ssword123", "plaintext")
+	assert.ErrorIs(t, err, ErrUnknownHashFormat)
+}
+
+// TestPasswordHasherFromEnv checks the configured algorithm and the rejection of invalid settings.
+func TestPasswordHasherFromEnv(t *testing.T) {
+	t.Setenv(Argon2MemoryKey, "64")
+	t.Setenv(Argon2IterationsKey, "1")
+	hasher, err := PasswordHasherFromEnv()
+	require.NoError(t, err)
+	encoded, err := hasher.Hash("P@ssword123")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$"))
+
+	t.Setenv(HashAlgorithmKey, AlgorithmBcrypt)
+	t.Setenv(BcryptCostKey, "5")
+	hasher, err = PasswordHasherFromEnv()
+	require.NoError(t, err)
+	encoded, err = hasher.Hash("P@ssword123")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$2a$05$"))
+
+	t.Setenv(BcryptCostKey, "40")
+	_, err = PasswordHasherFromEnv()
+	assert.Error(t, err)
+
+	t.Setenv(BcryptCostKey, "5")
+	t.Setenv(HashAlgorithmKey, "md5")
+	_, err = PasswordHasherFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,70 @@
+package user
+
+import (
+	"context"
+	"simplecrud/pkg/models"
+	"strings"
+)
+
+// Roles a user can have within an organization. Organization admins manage the members of their
+// organization; members only their own account.
+const (
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// ViolationDomainNotAllowed is the code of the field error returned when an email address is
+// outside the domains an organization allows.
+const ViolationDomainNotAllowed = "domain_not_allowed"
+
+// OrganizationFinder looks up organizations, to apply their settings to their members.
+type OrganizationFinder interface {
+	FindById(ctx context.Context, id string) (models.Organization, error)
+}
+
+// IsValidOrgRole reports whether the role is one of the known organization roles.
+func IsValidOrgRole(role string) bool {
+	return role == OrgRoleAdmin || role == OrgRoleMember
+}
+
+// MembershipIn returns the membership of the user in the organization with the given ID, if any.
+func MembershipIn(u models.User, orgID string) (models.Membership, bool) {
+	for _, membership := range u.Memberships {
+		if membership.OrganizationID.Hex() == orgID {
+			return membership, true
+		}
+	}
+	return models.Membership{}, false
+}
+
+// EmailDomainAllowed reports whether the domain of the email address is one of the allowed domains.
+// Domains are compared case-insensitively, and an empty list allows every domain.
+func EmailDomainAllowed(email string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := email[at+1:]
+	for _, allowed := range domains {
+		if strings.EqualFold(domain, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckEmailDomain returns a ValidationError if the email address is outside the domains
+// the organization allows.
+func CheckEmailDomain(email string, org models.Organization) error {
+	if EmailDomainAllowed(email, org.Settings.AllowedEmailDomains) {
+		return nil
+	}
+	return &ValidationError{Errors: []FieldError{{
+		Field:   "email",
+		Code:    ViolationDomainNotAllowed,
+		Message: "must use one of the email domains allowed by " + org.Name + ": " + strings.Join(org.Settings.AllowedEmailDomains, ", "),
+	}}}
+}
@@ -0,0 +1,218 @@
+package user
+
+import (
+	"fmt"
+	"simplecrud/pkg/logging"
+	"simplecrud/pkg/models"
+	"simplecrud/utils"
+	"strings"
+	"unicode"
+)
+
+// Environment variables used to configure the password policy. See DefaultPasswordPolicy for the defaults.
+const (
+	PasswordMinLengthKey        = "PASSWORD_MIN_LENGTH"
+	PasswordMaxLengthKey        = "PASSWORD_MAX_LENGTH"
+	PasswordRequireUpperKey     = "PASSWORD_REQUIRE_UPPER"
+	PasswordRequireLowerKey     = "PASSWORD_REQUIRE_LOWER"
+	PasswordRequireDigitKey     = "PASSWORD_REQUIRE_DIGIT"
+	PasswordRequireSpecialKey   = "PASSWORD_REQUIRE_SPECIAL"
+	PasswordSpecialsKey         = "PASSWORD_SPECIALS"
+	PasswordMaxRepeatedKey      = "PASSWORD_MAX_REPEATED"
+	PasswordDisallowPersonalKey = "PASSWORD_DISALLOW_PERSONAL"
+	PasswordRejectCommonKey     = "PASSWORD_REJECT_COMMON"
+	PasswordHistorySizeKey      = "PASSWORD_HISTORY_SIZE"
+)
+
+// DefaultPasswordSpecials are the special characters allowed by default: ASCII punctuation and space.
+const DefaultPasswordSpecials = " !\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// minPersonalPartLength is the shortest name or email part that passwords may not contain.
+// Shorter parts, such as initials, would reject too many good passwords.
+const minPersonalPartLength = 3
+
+// Codes of the password policy violations.
+const (
+	ViolationTooShort         = "too_short"
+	ViolationTooLong          = "too_long"
+	ViolationMissingUpper     = "missing_uppercase"
+	ViolationMissingLower     = "missing_lowercase"
+	ViolationMissingDigit     = "missing_digit"
+	ViolationMissingSpecial   = "missing_special"
+	ViolationInvalidCharacter = "invalid_character"
+	ViolationRepeated         = "too_many_repeated"
+	ViolationPersonalInfo     = "contains_personal_info"
+	ViolationCommon           = "common_password"
+	ViolationBreached         = "breached_password"
+	ViolationReused           = "password_reused"
+	ViolationNotUpdatable     = "not_updatable"
+)
+
+// PasswordPolicy holds the rules new passwords must follow.
+type PasswordPolicy struct {
+	MinLength       int    // Minimum length in characters
+	MaxLength       int    // Maximum length in characters; 0 for no limit
+	MaxBytes        int    // Maximum length in bytes, set by NewService for hashers with a limit; 0 for no limit
+	RequireUpper    bool   // Require an uppercase letter
+	RequireLower    bool   // Require a lowercase letter
+	RequireDigit    bool   // Require a digit
+	RequireSpecial  bool   // Require one of the allowed special characters
+	AllowedSpecials string // Characters besides letters and digits that passwords may contain
+	MaxRepeated     int    // Maximum number of identical consecutive characters; 0 for no limit
+	// DisallowPersonal rejects passwords containing the user's name or parts of their email address.
+	DisallowPersonal bool
+	// RejectCommon rejects passwords from the bundled list of common passwords.
+	RejectCommon bool
+	// Breached, if set, rejects passwords known from data breaches.
+	Breached BreachedPasswords
+	// HistorySize is how many previous password hashes are kept per user. A new password may match
+	// neither the current one nor any kept one; 0 turns the reuse check off.
+	HistorySize int
+}
+
+// DefaultPasswordPolicy returns the policy used when nothing is configured:
+// 8 to 128 characters with upper and lowercase letters, a digit and a special character,
+// no more than 3 identical characters in a row, no name or email parts, no common passwords
+// and none of the last 5 passwords. No breached password corpus is configured by default.
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:        8,
+		MaxLength:        128,
+		RequireUpper:     true,
+		RequireLower:     true,
+		RequireDigit:     true,
+		RequireSpecial:   true,
+		AllowedSpecials:  DefaultPasswordSpecials,
+		MaxRepeated:      3,
+		DisallowPersonal: true,
+		RejectCommon:     true,
+		HistorySize:      5,
+	}
+}
+
+// PasswordPolicyFromEnv returns the default policy with the values set in the environment applied.
+// If PWNED_PASSWORDS_FILE is set, the breached password corpus is opened; it stays open for the
+// lifetime of the process.
+func PasswordPolicyFromEnv() (PasswordPolicy, error) {
+	policy := DefaultPasswordPolicy()
+	policy.MinLength = utils.GetEnvInt(PasswordMinLengthKey, policy.MinLength)
+	policy.MaxLength = utils.GetEnvInt(PasswordMaxLengthKey, policy.MaxLength)
+	policy.RequireUpper = utils.GetEnvBool(PasswordRequireUpperKey, policy.RequireUpper)
+	policy.RequireLower = utils.GetEnvBool(PasswordRequireLowerKey, policy.RequireLower)
+	policy.RequireDigit = utils.GetEnvBool(PasswordRequireDigitKey, policy.RequireDigit)
+	policy.RequireSpecial = utils.GetEnvBool(PasswordRequireSpecialKey, policy.RequireSpecial)
+	policy.AllowedSpecials = utils.GetEnv(PasswordSpecialsKey, policy.AllowedSpecials)
+	policy.MaxRepeated = utils.GetEnvInt(PasswordMaxRepeatedKey, policy.MaxRepeated)
+	policy.DisallowPersonal = utils.GetEnvBool(PasswordDisallowPersonalKey, policy.DisallowPersonal)
+	policy.RejectCommon = utils.GetEnvBool(PasswordRejectCommonKey, policy.RejectCommon)
+	policy.HistorySize = utils.GetEnvInt(PasswordHistorySizeKey, policy.HistorySize)
+
+	if path := utils.GetEnv(PwnedPasswordsFileKey, ""); path != "" {
+		breached, err := OpenPwnedPasswords(path, utils.GetEnvInt(PwnedPasswordsMinCountKey, DefaultPwnedPasswordsMinCount))
+		if err != nil {
+			return PasswordPolicy{}, err
+		}
+		policy.Breached = breached
+	}
+	return policy, nil
+}
+
+// Check returns every rule the password of the given user breaks, or nil if it is acceptable.
+// The user is only used to reject passwords containing their name or email.
+func (p PasswordPolicy) Check(password string, user models.User) []FieldError {
+	var violations []FieldError
+	add := func(code, message string) {
+		violations = append(violations, FieldError{Field: "password", Code: code, Message: message})
+	}
+
+	length := len([]rune(password))
+	if length < p.MinLength {
+		add(ViolationTooShort, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add(ViolationTooLong, fmt.Sprintf("must be at most %d characters long", p.MaxLength))
+	} else if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		add(ViolationTooLong, fmt.Sprintf("must be at most %d bytes long", p.MaxBytes))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSpecial, hasInvalid bool
+	repeated, longestRepeat := 0, 0
+	var previous rune
+	for i, r := range []rune(password) {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case strings.ContainsRune(p.AllowedSpecials, r):
+			hasSpecial = true
+		case !unicode.IsLetter(r):
+			hasInvalid = true
+		}
+
+		if i > 0 && r == previous {
+			repeated++
+		} else {
+			repeated = 1
+		}
+		if repeated > longestRepeat {
+			longestRepeat = repeated
+		}
+		previous = r
+	}
+
+	if p.RequireUpper && !hasUpper {
+		add(ViolationMissingUpper, "must contain an uppercase letter")
+	}
+	if p.RequireLower && !hasLower {
+		add(ViolationMissingLower, "must contain a lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		add(ViolationMissingDigit, "must contain a digit")
+	}
+	if p.RequireSpecial && !hasSpecial {
+		add(ViolationMissingSpecial, "must contain one of these special characters: "+p.AllowedSpecials)
+	}
+	if hasInvalid {
+		add(ViolationInvalidCharacter, "may only contain letters, digits and these special characters: "+p.AllowedSpecials)
+	}
+	if p.MaxRepeated > 0 && longestRepeat > p.MaxRepeated {
+		add(ViolationRepeated, fmt.Sprintf("must not repeat the same character more than %d times in a row", p.MaxRepeated))
+	}
+	if p.DisallowPersonal && containsPersonalInfo(password, user) {
+		add(ViolationPersonalInfo, "must not contain your name or email address")
+	}
+	if p.RejectCommon && isCommonPassword(password) {
+		add(ViolationCommon, "is too common")
+	}
+	if p.Breached != nil {
+		// A corpus that cannot be read must not stop users from setting passwords, so the check is skipped.
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			logging.Default().WithError(err).Error("Failed to check password against breached passwords")
+		} else if breached {
+			add(ViolationBreached, "has appeared in a data breach")
+		}
+	}
+	return violations
+}
+
+// containsPersonalInfo reports whether the password contains a word of the user's name
+// or of the local part of their email address, ignoring case.
+func containsPersonalInfo(password string, user models.User) bool {
+	lowered := strings.ToLower(password)
+	localPart, _, _ := strings.Cut(user.Email, "@")
+	isSeparator := func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+
+	parts := append(strings.FieldsFunc(user.Name, isSeparator), strings.FieldsFunc(localPart, isSeparator)...)
+	for _, part := range parts {
+		if len([]rune(part)) >= minPersonalPartLength && strings.Contains(lowered, strings.ToLower(part)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package user
+
+import (
+	"errors"
+	"simplecrud/pkg/models"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// violationCodes returns the codes of the given field errors.
+func violationCodes(violations []FieldError) []string {
+	var codes []string
+	for _, violation := range violations {
+		codes = append(codes, violation.Code)
+	}
+	return codes
+}
+
+// TestPasswordPolicyCheck checks every rule of the default policy.
+func TestPasswordPolicyCheck(t *testing.T) {
+	owner := models.User{Name: "Alice Smith", Email: "alice.smith@example.com"}
+	tests := []struct {
+		name     string
+		password string
+		expected []string
+	}{
+		{"strong", "N3w@Passw0rd", nil},
+		{"short", "Aa1!", []string{ViolationTooShort}},
+		{"no uppercase", "n3w@passw0rd", []string{ViolationMissingUpper}},
+		{"no lowercase", "N3W@PASSW0RD", []string{ViolationMissingLower}},
+		{"no digit", "New@Password", []string{ViolationMissingDigit}},
+		{"no special", "N3wPassw0rd", []string{ViolationMissingSpecial}},
+		{"invalid character", "N3w@Passw0rd\t", []string{ViolationInvalidCharacter}},
+		{"repeated", "N3w@Paaaaw0rd", []string{ViolationRepeated}},
+		{"name", "Xy1!alice", []string{ViolationPersonalInfo}},
+		{"email", "Xy1!SMITHS", []string{ViolationPersonalInfo}},
+		{"several", "aaaa", []string{ViolationTooShort, ViolationMissingUpper, ViolationMissingDigit, ViolationMissingSpecial, ViolationRepeated}},
+	}
+
+	policy := DefaultPasswordPolicy()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			violations := policy.Check(test.password, owner)
+			assert.Equal(t, test.expected, violationCodes(violations))
+			for _, violation := range violations {
+				assert.Equal(t, "password", violation.Field)
+				assert.NotEmpty(t, violation.Message)
+			}
+		})
+	}
+}
+
+// TestPasswordPolicyOptions checks that the rules can be relaxed and tightened.
+func TestPasswordPolicyOptions(t *testing.T) {
+	owner := models.User{Name: "Al", Email: "al@example.com"}
+
+	relaxed := PasswordPolicy{MinLength: 4}
+	assert.Empty(t, relaxed.Check("aaaa", owner))
+	assert.Equal(t, []string{ViolationInvalidCharacter}, violationCodes(relaxed.Check("aaa!", owner)))
+
+	// Name parts shorter than three characters are not checked
+	assert.Empty(t, DefaultPasswordPolicy().Check("Al1!Al1!", owner))
+
+	strict := DefaultPasswordPolicy()
+	strict.MaxLength = 10
+	strict.AllowedSpecials = "#"
+	assert.Equal(t, []string{ViolationTooLong}, violationCodes(strict.Check("N3w#Passw0rd", owner)))
+	assert.Equal(t, []string{ViolationMissingSpecial, ViolationInvalidCharacter}, violationCodes(strict.Check("N3w@Pass0", owner)))
+
+	// Multibyte characters count once for MaxLength but fully for MaxBytes
+	bytes := PasswordPolicy{MaxLength: 10, MaxBytes: 12}
+	assert.Empty(t, bytes.Check("ääääää", owner))
+	assert.Equal(t, []string{ViolationTooLong}, violationCodes(bytes.Check("äääääää", owner)))
+}
+
+// TestPasswordPolicyFromEnv checks that the policy is read from the environment.
+func TestPasswordPolicyFromEnv(t *testing.T) {
+	policy, err := PasswordPolicyFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, DefaultPasswordPolicy(), policy)
+
+	t.Setenv(PasswordMinLengthKey, "12")
+	t.Setenv(PasswordRequireSpecialKey, "false")
+	t.Setenv(PasswordSpecialsKey, "-_")
+	t.Setenv(PasswordMaxRepeatedKey, "0")
+	t.Setenv(PasswordDisallowPersonalKey, "false")
+	t.Setenv(PasswordRejectCommonKey, "false")
+	policy, err = PasswordPolicyFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, 12, policy.MinLength)
+	assert.False(t, policy.RequireSpecial)
+	assert.Equal(t, "-_", policy.AllowedSpecials)
+	assert.Equal(t, 0, policy.MaxRepeated)
+	assert.False(t, policy.DisallowPersonal)
+	assert.False(t, policy.RejectCommon)
+	assert.True(t, policy.RequireDigit)
+	assert.Nil(t, policy.Breached)
+
+	t.Setenv(PwnedPasswordsFileKey, "does-not-exist.txt")
+	_, err = PasswordPolicyFromEnv()
+	assert.Error(t, err)
+}
+
+// TestCreateUserPasswordPolicy checks that CreateUser reports every violation as a ValidationError.
+func TestCreateUserPasswordPolicy(t *testing.T) {
+	mockRepo := new(MockRepository)
+	service := NewService(mockRepo, nil, testHasher, DefaultPasswordPolicy())
+
+	_, err := service.CreateUser(adminContext(), models.User{Name: "Bob", Email: "bob@example.com", Password: "bobbob"})
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, []string{ViolationTooShort, ViolationMissingUpper, ViolationMissingDigit, ViolationMissingSpecial, ViolationPersonalInfo},
+		violationCodes(validationErr.Errors))
+	assert.Contains(t, err.Error(), "password must be at least 8 characters long")
+}
+
+// TestCreateUserBcryptLimit checks that passwords too long for bcrypt break the policy instead of
+// failing to hash.
+func TestCreateUserBcryptLimit(t *testing.T) {
+	mockRepo := new(MockRepository)
+	service := NewService(mockRepo, nil, NewPasswordHasher(testHasher, testArgon2), DefaultPasswordPolicy())
+
+	password := "N3w@Passw0rd" + strings.Repeat("xy", 40)
+	_, err := service.CreateUser(adminContext(), models.User{Name: "Bob", Email: "bob@example.com", Password: password})
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, []string{ViolationTooLong}, violationCodes(validationErr.Errors))
+	assert.Contains(t, err.Error(), "password must be at most 72 bytes long")
+
+	// Argon2id has no such limit
+	service = NewService(mockRepo, nil, NewPasswordHasher(testArgon2, testHasher), DefaultPasswordPolicy())
+	assert.Empty(t, service.policy.Check(password, models.User{}))
+}
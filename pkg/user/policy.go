@@ -0,0 +1,124 @@
+package user
+
+import (
+	"context"
+	"simplecrud/pkg/models"
+)
+
+// Roles a user can have. Admins manage every account; regular users only their own.
+// RoleService is never given to users: API keys act with it, managing users without the
+// admin-only powers of assigning roles and lifting lockouts.
+const (
+	RoleAdmin   = "admin"
+	RoleUser    = "user"
+	RoleService = "service"
+)
+
+// ErrForbidden is returned when the caller is not allowed to perform an operation.
+var ErrForbidden error = &Error{Kind: KindForbidden, Message: "operation not permitted"}
+
+// Principal identifies the caller of a service method.
+type Principal struct {
+	UserID  string // Hex ID of the authenticated user
+	Role    string // Role of the authenticated user
+	OrgID   string // Hex ID of the organization the caller acts in; empty outside organizations
+	OrgRole string // Role of the caller in that organization
+}
+
+// IsAdmin reports whether the principal has the admin role.
+func (p Principal) IsAdmin() bool {
+	return p.Role == RoleAdmin
+}
+
+// IsService reports whether the principal is an API key.
+func (p Principal) IsService() bool {
+	return p.Role == RoleService
+}
+
+// IsOrgAdmin reports whether the principal is an admin of the organization they act in.
+func (p Principal) IsOrgAdmin() bool {
+	return p.OrgID != "" && p.OrgRole == OrgRoleAdmin
+}
+
+// principalKey is the context key under which the caller's principal is stored.
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the principal of the caller.
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal of the caller, if any.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// The policy functions below decide what a principal may do.
+// A context without a principal is never allowed anything.
+// Callers acting in an organization only see its members, see inScope.
+
+// canList reports whether the caller may list users.
+func canList(ctx context.Context) bool {
+	p, ok := PrincipalFromContext(ctx)
+	return ok && (p.IsAdmin() || p.IsOrgAdmin() || p.IsService())
+}
+
+// canAccess reports whether the caller may read or update the user with the given ID.
+func canAccess(ctx context.Context, id string) bool {
+	p, ok := PrincipalFromContext(ctx)
+	return ok && (p.IsAdmin() || p.IsOrgAdmin() || p.IsService() || p.UserID == id)
+}
+
+// isSelf reports whether the caller is the user with the given ID.
+func isSelf(ctx context.Context, id string) bool {
+	p, ok := PrincipalFromContext(ctx)
+	return ok && p.UserID == id
+}
+
+// canManage reports whether the caller may create or delete users.
+func canManage(ctx context.Context) bool {
+	p, ok := PrincipalFromContext(ctx)
+	return ok && (p.IsAdmin() || p.IsOrgAdmin() || p.IsService())
+}
+
+// canAssignRoles reports whether the caller may give users a role other than the regular user role.
+func canAssignRoles(ctx context.Context) bool {
+	p, ok := PrincipalFromContext(ctx)
+	return ok && p.IsAdmin()
+}
+
+// canManageUser reports whether the caller may change or delete another user.
+// Organization admins and API keys cannot manage admins. Organization admins cannot manage the
+// other admins of their organization either, nor members of other organizations too, whose
+// accounts they would otherwise take over beyond their organization.
+func canManageUser(ctx context.Context, target models.User) bool {
+	p, ok := PrincipalFromContext(ctx)
+	if !ok || (!p.IsAdmin() && target.Role == RoleAdmin) {
+		return false
+	}
+	if p.OrgID == "" || p.IsAdmin() {
+		return true
+	}
+	membership, _ := MembershipIn(target, p.OrgID)
+	return membership.Role != OrgRoleAdmin && len(target.Memberships) <= 1
+}
+
+// inScope reports whether the user is visible to the caller. Callers acting in an organization
+// only see its members and themselves; other callers see every user their role allows.
+func inScope(ctx context.Context, target models.User) bool {
+	p, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return false
+	}
+	if p.OrgID == "" || p.UserID == target.ID.Hex() {
+		return true
+	}
+	_, member := MembershipIn(target, p.OrgID)
+	return member
+}
+
+// isValidRole reports whether the role is one of the known roles.
+func isValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleUser
+}
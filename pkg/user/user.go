@@ -4,14 +4,33 @@ import (
 	"context"
 	"errors"
 	"regexp"
+	"simplecrud/pkg/logging"
 	"simplecrud/pkg/models"
-	"simplecrud/utils"
+	"simplecrud/pkg/tracing"
+	"strings"
 
-	"golang.org/x/crypto/bcrypt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel"
 )
 
+// tracer starts the spans of the user service.
+var tracer = otel.Tracer("simplecrud/pkg/user")
+
 // ErrNotFound is returned when a user is not found.
-var ErrNotFound = errors.New("user not found")
+var ErrNotFound error = &Error{Kind: KindNotFound, Message: "user not found"}
+
+// ErrInvalidCredentials is returned when an email and password pair does not match any user.
+var ErrInvalidCredentials error = &Error{Kind: KindUnauthenticated, Message: "invalid email or password"}
+
+// ErrEmailTaken is returned when another user already has the email address.
+var ErrEmailTaken error = &Error{Kind: KindConflict, Message: "email address already in use",
+	Detail: "The email address is already in use"}
+
+// NormalizeEmail returns the form email addresses are stored and looked up in, so that addresses
+// differing only in case or surrounding spaces belong to the same user.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
 
 // Define the Service interface for user operations.
 type Service interface {
@@ -20,20 +39,39 @@ type Service interface {
 	CreateUser(ctx context.Context, user models.User) (models.User, error)
 	UpdateUser(ctx context.Context, id string, user models.User) (models.User, error)
 	DeleteUser(ctx context.Context, id string) error
+	Authenticate(ctx context.Context, email, password string) (models.User, error)
+	BootstrapAdmin(ctx context.Context, admin models.User) (bool, error)
+	SetPassword(ctx context.Context, id, password string) error
+	ChangePassword(ctx context.Context, id, currentPassword, newPassword string) error
 }
 
 // UserService implements the Service interface.
 type UserService struct {
-	userRepo Repository
+	userRepo  Repository
+	orgs      OrganizationFinder
+	hasher    PasswordHasher
+	policy    PasswordPolicy
+	dummyHash string
 }
 
 // Define the Repository interface for database operations.
 type Repository interface {
 	FindAll(ctx context.Context) ([]models.User, error)
+	// FindAllInOrganization returns the members of the organization with the given ID.
+	FindAllInOrganization(ctx context.Context, orgID string) ([]models.User, error)
 	FindById(ctx context.Context, id string) (models.User, error)
+	FindByEmail(ctx context.Context, email string) (models.User, error)
 	Create(ctx context.Context, user models.User) (models.User, error)
 	Update(ctx context.Context, id string, user models.User) (models.User, error)
 	Delete(ctx context.Context, id string) error
+	CountByRole(ctx context.Context, role string) (int64, error)
+	UpdatePassword(ctx context.Context, id, passwordHash string) error
+	// ReplacePassword sets a new password hash and moves the current one to the front of the
+	// password history, which is cut to the given size.
+	ReplacePassword(ctx context.Context, id, passwordHash string, historySize int) error
+	// FindPasswordHistory returns the previous password hashes of a user, most recent first.
+	// The history is never returned by the other read methods.
+	FindPasswordHistory(ctx context.Context, id string) ([]string, error)
 }
 
 // Regular expressions to validate user name and id.
@@ -43,58 +81,394 @@ var (
 	isValidObjectId = regexp.MustCompile(`^[0-9a-fA-F]{24}$`)
 )
 
-// NewService creates a new UserService with the provided user repository.
-func NewService(userRepo Repository) *UserService {
+// NewService creates a new UserService with the provided user repository, organization lookup,
+// password hasher and the policy new passwords must follow. Without an organization lookup,
+// the email domains allowed by organizations are not enforced.
+func NewService(userRepo Repository, orgs OrganizationFinder, hasher PasswordHasher, policy PasswordPolicy) *UserService {
+	// The dummy hash is verified against when no user matches the email during authentication,
+	// so that unknown emails take about as long to reject as wrong passwords.
+	dummyHash, _ := hasher.Hash("dummy-password")
+	// Passwords the hasher cannot hash break the policy, instead of failing when they are hashed.
+	policy.MaxBytes = maxPasswordBytes(hasher)
 	return &UserService{
-		userRepo: userRepo,
+		userRepo:  userRepo,
+		orgs:      orgs,
+		hasher:    hasher,
+		policy:    policy,
+		dummyHash: dummyHash,
 	}
 }
 
 // GetAllUsers retrieves all users from the repository.
-func (s *UserService) GetAllUsers(ctx context.Context) ([]models.User, error) {
+// Only admins, organization admins and API keys may list users. Callers acting in an organization
+// only get its members.
+func (s *UserService) GetAllUsers(ctx context.Context) (_ []models.User, err error) {
+	ctx, span := tracer.Start(ctx, "UserService.GetAllUsers")
+	defer func() { tracing.End(span, err) }()
+
+	if !canList(ctx) {
+		return nil, ErrForbidden
+	}
+	if p, _ := PrincipalFromContext(ctx); p.OrgID != "" {
+		return s.userRepo.FindAllInOrganization(ctx, p.OrgID)
+	}
 	return s.userRepo.FindAll(ctx)
 }
 
 // GetUser retrieves a user by ID from the repository.
-// It checks if the provided ID is a valid UUID.
-func (s *UserService) GetUser(ctx context.Context, id string) (models.User, error) {
-	if !isValidObjectId.MatchString(id) {
-		return models.User{}, errors.New("invalid user ID")
+// It checks if the provided ID is a valid ObjectID. Users may only read themselves; admins may read anyone.
+// Users outside the caller's organization are reported as not found.
+func (s *UserService) GetUser(ctx context.Context, id string) (_ models.User, err error) {
+	ctx, span := tracer.Start(ctx, "UserService.GetUser")
+	defer func() { tracing.End(span, err) }()
+
+	if err := checkID(id); err != nil {
+		return models.User{}, err
+	}
+	if !canAccess(ctx, id) {
+		return models.User{}, ErrForbidden
+	}
+	user, err := s.userRepo.FindById(ctx, id)
+	if err != nil {
+		return models.User{}, err
 	}
-	return s.userRepo.FindById(ctx, id)
+	if !inScope(ctx, user) {
+		return models.User{}, ErrNotFound
+	}
+	return user, nil
 }
 
 // CreateUser creates a new user in the repository.
-// It validates the user name and password before creation, and hashes the password.
-func (s *UserService) CreateUser(ctx context.Context, user models.User) (models.User, error) {
-	// Validate user name length and content
-	if len(user.Name) < 3 || len(user.Name) > 50 || !isAlpha.MatchString(user.Name) {
-		return models.User{}, errors.New("invalid user name")
+// Only admins, organization admins and API keys may create users, and only admins may choose their role.
+// Users without a role get the regular user role. New users start with an unverified email address.
+// Users created by a caller acting in an organization become members of it, and their email
+// must use one of the domains the organization allows.
+func (s *UserService) CreateUser(ctx context.Context, user models.User) (_ models.User, err error) {
+	ctx, span := tracer.Start(ctx, "UserService.CreateUser")
+	defer func() { tracing.End(span, err) }()
+
+	if !canManage(ctx) {
+		return models.User{}, ErrForbidden
+	}
+	if user.Role != "" && user.Role != RoleUser && !canAssignRoles(ctx) {
+		return models.User{}, ErrForbidden
+	}
+	user.EmailVerified = false
+	user.Memberships = nil
+	if p, _ := PrincipalFromContext(ctx); p.OrgID != "" {
+		orgID, err := primitive.ObjectIDFromHex(p.OrgID)
+		if err != nil {
+			return models.User{}, invalidOrganization
+		}
+		user.Memberships = []models.Membership{{OrganizationID: orgID, Role: OrgRoleMember}}
+		if err := s.checkEmailDomain(ctx, user.Email, user.Memberships); err != nil {
+			return models.User{}, err
+		}
+	}
+	return s.create(ctx, user)
+}
+
+// checkEmailDomain checks the email address against the domains allowed by every organization
+// in the memberships. It returns a ValidationError for the first organization refusing it.
+func (s *UserService) checkEmailDomain(ctx context.Context, email string, memberships []models.Membership) error {
+	if s.orgs == nil {
+		return nil
 	}
-	// Validate password length
-	if len(user.Password) < 8 || len(user.Password) > 128 {
-		return models.User{}, errors.New("password must be between 8 and 128 characters")
+	for _, membership := range memberships {
+		org, err := s.orgs.FindById(ctx, membership.OrganizationID.Hex())
+		if err != nil {
+			return err
+		}
+		if err := CheckEmailDomain(email, org); err != nil {
+			return err
+		}
 	}
-	// Check password strength
-	if !utils.IsStrongPassword(user.Password) {
-		return models.User{}, errors.New("password isn't strong enough, it should have at least 8 characters, one uppercase letter, one lowercase letter, one number, and one special character")
+	return nil
+}
+
+// create validates the user name, role and password, hashes the password and stores the user.
+// It does not check permissions; callers are responsible for that.
+func (s *UserService) create(ctx context.Context, user models.User) (models.User, error) {
+	// Default to the least privileged role
+	if user.Role == "" {
+		user.Role = RoleUser
 	}
-	// Hash the password with a custom cost factor
-	cost := 12
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), cost)
+	if !isValidRole(user.Role) {
+		return models.User{}, invalidRole
+	}
+	// Validate user name length and content
+	if len(user.Name) < 3 || len(user.Name) > 50 || !isAlpha.MatchString(user.Name) {
+		return models.User{}, &ValidationError{Errors: []FieldError{
+			{Field: "name", Code: ViolationInvalid, Message: "must be 3 to 50 letters and spaces"},
+		}}
+	}
+	hashedPassword, err := s.hashPassword(ctx, user.Password, user)
 	if err != nil {
 		return models.User{}, err
 	}
-	user.Password = string(hashedPassword)
+	user.Password = hashedPassword
 	return s.userRepo.Create(ctx, user)
 }
 
+// hashPassword checks a new password of the user against the password policy and returns its hash.
+// Policy violations are returned as a ValidationError.
+func (s *UserService) hashPassword(ctx context.Context, password string, user models.User) (string, error) {
+	if violations := s.policy.Check(password, user); len(violations) > 0 {
+		return "", &ValidationError{Errors: violations}
+	}
+	return s.hash(ctx, password)
+}
+
+// hash hashes the password in a span of its own, as hashing takes most of the time of the requests
+// setting a password.
+func (s *UserService) hash(ctx context.Context, password string) (_ string, err error) {
+	_, span := tracer.Start(ctx, "PasswordHasher.Hash")
+	defer func() { tracing.End(span, err) }()
+	return s.hasher.Hash(password)
+}
+
+// verify checks the password against the hash in a span of its own, as verifying takes most of the
+// time of a login.
+func (s *UserService) verify(ctx context.Context, password, hash string) (_ bool, err error) {
+	_, span := tracer.Start(ctx, "PasswordHasher.Verify")
+	defer func() { tracing.End(span, err) }()
+	return s.hasher.Verify(password, hash)
+}
+
 // UpdateUser updates a user by ID in the repository.
-func (s *UserService) UpdateUser(ctx context.Context, id string, user models.User) (models.User, error) {
+// Users may only update themselves; changing a role requires an admin. Organization admins may
+// update the members of their organization, except admins.
+// A new email address must use the domains allowed by every organization of the user.
+// Passwords cannot be updated here, only with SetPassword and ChangePassword.
+func (s *UserService) UpdateUser(ctx context.Context, id string, user models.User) (_ models.User, err error) {
+	ctx, span := tracer.Start(ctx, "UserService.UpdateUser")
+	defer func() { tracing.End(span, err) }()
+
+	if err := checkID(id); err != nil {
+		return models.User{}, err
+	}
+	if !canAccess(ctx, id) {
+		return models.User{}, ErrForbidden
+	}
+	if user.Password != "" {
+		return models.User{}, &ValidationError{Errors: []FieldError{
+			{Field: "password", Code: ViolationNotUpdatable, Message: "can only be changed with the change password endpoint"},
+		}}
+	}
+	if user.Role != "" {
+		if !canAssignRoles(ctx) {
+			return models.User{}, ErrForbidden
+		}
+		if !isValidRole(user.Role) {
+			return models.User{}, invalidRole
+		}
+	}
+	existing, err := s.findManageable(ctx, id)
+	if err != nil {
+		return models.User{}, err
+	}
+	// A new email address has to be verified again.
+	if user.Email != "" {
+		if err := s.checkEmailDomain(ctx, user.Email, existing.Memberships); err != nil {
+			return models.User{}, err
+		}
+		user.EmailVerified = existing.EmailVerified && NormalizeEmail(existing.Email) == NormalizeEmail(user.Email)
+	}
 	return s.userRepo.Update(ctx, id, user)
 }
 
+// findManageable returns the user with the given ID if the caller may change them, see canManageUser.
+// Users outside the caller's organization are reported as not found.
+func (s *UserService) findManageable(ctx context.Context, id string) (models.User, error) {
+	user, err := s.userRepo.FindById(ctx, id)
+	if err != nil {
+		return models.User{}, err
+	}
+	if !inScope(ctx, user) {
+		return models.User{}, ErrNotFound
+	}
+	if !isSelf(ctx, id) && !canManageUser(ctx, user) {
+		return models.User{}, ErrForbidden
+	}
+	return user, nil
+}
+
+// SetPassword checks a new password for the user against the password policy, hashes and stores it.
+// Users may only change their own password; admins may change anyone's, and organization admins
+// those of their members, see canManageUser.
+func (s *UserService) SetPassword(ctx context.Context, id, password string) (err error) {
+	ctx, span := tracer.Start(ctx, "UserService.SetPassword")
+	defer func() { tracing.End(span, err) }()
+
+	if !canAccess(ctx, id) {
+		return ErrForbidden
+	}
+	user, err := s.findManageable(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.replacePassword(ctx, user, password)
+}
+
+// ChangePassword replaces the password of the caller after checking their current password.
+// It returns ErrInvalidCredentials if the current password is wrong or the user has none.
+// Users may only change their own password.
+func (s *UserService) ChangePassword(ctx context.Context, id, currentPassword, newPassword string) (err error) {
+	ctx, span := tracer.Start(ctx, "UserService.ChangePassword")
+	defer func() { tracing.End(span, err) }()
+
+	if !isSelf(ctx, id) {
+		return ErrForbidden
+	}
+	user, err := s.userRepo.FindById(ctx, id)
+	if err != nil {
+		return err
+	}
+	if user.Password == "" {
+		return ErrInvalidCredentials
+	}
+	ok, err := s.verify(ctx, currentPassword, user.Password)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCredentials
+	}
+	return s.replacePassword(ctx, user, newPassword)
+}
+
+// replacePassword checks a new password of the user against the password policy and the password
+// history, then stores its hash and keeps the old hash in the history.
+func (s *UserService) replacePassword(ctx context.Context, user models.User, password string) error {
+	hashedPassword, err := s.hashPassword(ctx, password, user)
+	if err != nil {
+		return err
+	}
+
+	if s.policy.HistorySize > 0 {
+		history, err := s.userRepo.FindPasswordHistory(ctx, user.ID.Hex())
+		if err != nil {
+			return err
+		}
+		reused, err := s.matchesAny(ctx, password, append([]string{user.Password}, history...))
+		if err != nil {
+			return err
+		}
+		if reused {
+			return &ValidationError{Errors: []FieldError{
+				{Field: "password", Code: ViolationReused, Message: "must not be one of your recent passwords"},
+			}}
+		}
+	}
+	return s.userRepo.ReplacePassword(ctx, user.ID.Hex(), hashedPassword, s.policy.HistorySize)
+}
+
+// matchesAny reports whether the password matches one of the given hashes. Empty hashes are skipped.
+func (s *UserService) matchesAny(ctx context.Context, password string, hashes []string) (bool, error) {
+	for _, hash := range hashes {
+		if hash == "" {
+			continue
+		}
+		ok, err := s.verify(ctx, password, hash)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // DeleteUser deletes a user by ID from the repository.
-func (s *UserService) DeleteUser(ctx context.Context, id string) error {
+// Only admins, organization admins and API keys may delete users, and only admins may delete
+// admins. Organization admins may only delete members who belong to their organization alone and
+// are not its admins; members of other organizations have to be removed from the organization instead.
+func (s *UserService) DeleteUser(ctx context.Context, id string) (err error) {
+	ctx, span := tracer.Start(ctx, "UserService.DeleteUser")
+	defer func() { tracing.End(span, err) }()
+
+	if err := checkID(id); err != nil {
+		return err
+	}
+	if !canManage(ctx) {
+		return ErrForbidden
+	}
+	if p, _ := PrincipalFromContext(ctx); p.OrgID != "" || p.IsService() {
+		if _, err := s.findManageable(ctx, id); err != nil {
+			return err
+		}
+	}
 	return s.userRepo.Delete(ctx, id)
 }
+
+// BootstrapAdmin creates the given user as the first admin, unless an admin already exists.
+// It reports whether the admin was created. It is meant to be called once at startup.
+func (s *UserService) BootstrapAdmin(ctx context.Context, admin models.User) (_ bool, err error) {
+	ctx, span := tracer.Start(ctx, "UserService.BootstrapAdmin")
+	defer func() { tracing.End(span, err) }()
+
+	count, err := s.userRepo.CountByRole(ctx, RoleAdmin)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	// The bootstrap admin is configured by the operator, so their email is trusted.
+	admin.Role = RoleAdmin
+	admin.EmailVerified = true
+	if _, err := s.create(ctx, admin); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Authenticate verifies the given email and password against the stored password hash.
+// It returns ErrInvalidCredentials without revealing whether the email or the password was wrong.
+// If the stored hash uses an outdated algorithm or parameters, it is replaced with a current one.
+func (s *UserService) Authenticate(ctx context.Context, email, password string) (_ models.User, err error) {
+	ctx, span := tracer.Start(ctx, "UserService.Authenticate")
+	defer func() { tracing.End(span, err) }()
+
+	user, err := s.userRepo.FindByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			// Spend the same hashing work as a real comparison before rejecting.
+			_, _ = s.verify(ctx, password, s.dummyHash)
+			return models.User{}, ErrInvalidCredentials
+		}
+		return models.User{}, err
+	}
+	// Users provisioned by an identity provider may have no password yet.
+	if user.Password == "" {
+		_, _ = s.verify(ctx, password, s.dummyHash)
+		return models.User{}, ErrInvalidCredentials
+	}
+
+	ok, err := s.verify(ctx, password, user.Password)
+	if err != nil {
+		return models.User{}, err
+	}
+	if !ok {
+		return models.User{}, ErrInvalidCredentials
+	}
+
+	if s.hasher.NeedsRehash(user.Password) {
+		s.rehash(ctx, user, password)
+	}
+	return user, nil
+}
+
+// rehash stores a new hash of the password made with the current algorithm and parameters.
+// The login already succeeded, so failures are only logged and retried on the next login.
+func (s *UserService) rehash(ctx context.Context, user models.User, password string) {
+	hashedPassword, err := s.hash(ctx, password)
+	if err == nil {
+		err = s.userRepo.UpdatePassword(ctx, user.ID.Hex(), hashedPassword)
+	}
+	if err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("Failed to upgrade password hash")
+	}
+}
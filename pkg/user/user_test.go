@@ -3,16 +3,28 @@ package user
 import (
 	"context"
 	"errors"
+	"fmt"
 	"simplecrud/pkg/models"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// testHasher hashes passwords with the cheapest bcrypt cost to keep the tests fast.
+var testHasher = BcryptHasher{Cost: bcrypt.MinCost}
+
 // MockRepository simulates the behavior of a real database repository.
 type MockRepository struct {
-	Users []models.User
+	Users     []models.User
+	Histories map[string][]string // Previous password hashes by user ID
 }
 
 // FindAll returns all users in the mock repository.
@@ -20,6 +32,17 @@ func (m *MockRepository) FindAll(ctx context.Context) ([]models.User, error) {
 	return m.Users, nil
 }
 
+// FindAllInOrganization returns the users of the mock repository who are members of the organization.
+func (m *MockRepository) FindAllInOrganization(ctx context.Context, orgID string) ([]models.User, error) {
+	var members []models.User
+	for _, user := range m.Users {
+		if _, ok := MembershipIn(user, orgID); ok {
+			members = append(members, user)
+		}
+	}
+	return members, nil
+}
+
 // FindById finds a user by its ID in the mock repository.
 // Returns a user if found and an error if not.
 func (m *MockRepository) FindById(ctx context.Context, id string) (models.User, error) {
@@ -32,6 +55,17 @@ func (m *MockRepository) FindById(ctx context.Context, id string) (models.User,
 	return models.User{}, errors.New("user not found")
 }
 
+// FindByEmail finds a user by its email in the mock repository.
+// Returns ErrNotFound if no user has the given email.
+func (m *MockRepository) FindByEmail(ctx context.Context, email string) (models.User, error) {
+	for _, user := range m.Users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return models.User{}, ErrNotFound
+}
+
 // Create adds a new user to the mock repository and returns it.
 func (m *MockRepository) Create(ctx context.Context, user models.User) (models.User, error) {
 	m.Users = append(m.Users, user)
@@ -64,6 +98,61 @@ func (m *MockRepository) Delete(ctx context.Context, id string) error {
 	return errors.New("user not found")
 }
 
+// CountByRole counts the users with the given role in the mock repository.
+func (m *MockRepository) CountByRole(ctx context.Context, role string) (int64, error) {
+	var count int64
+	for _, user := range m.Users {
+		if user.Role == role {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// UpdatePassword replaces the password hash of a user in the mock repository.
+// Returns ErrNotFound if the user is not found.
+func (m *MockRepository) UpdatePassword(ctx context.Context, id, passwordHash string) error {
+	objectID, _ := primitive.ObjectIDFromHex(id)
+	for i, user := range m.Users {
+		if user.ID == objectID {
+			m.Users[i].Password = passwordHash
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// ReplacePassword replaces the password hash of a user and keeps the old one in the history.
+// Returns ErrNotFound if the user is not found.
+func (m *MockRepository) ReplacePassword(ctx context.Context, id, passwordHash string, historySize int) error {
+	objectID, _ := primitive.ObjectIDFromHex(id)
+	for i, user := range m.Users {
+		if user.ID == objectID {
+			if m.Histories == nil {
+				m.Histories = make(map[string][]string)
+			}
+			history := append([]string{user.Password}, m.Histories[id]...)
+			if len(history) > historySize {
+				history = history[:historySize]
+			}
+			m.Histories[id] = history
+			m.Users[i].Password = passwordHash
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// FindPasswordHistory returns the previous password hashes of a user in the mock repository.
+func (m *MockRepository) FindPasswordHistory(ctx context.Context, id string) ([]string, error) {
+	return m.Histories[id], nil
+}
+
+// adminContext returns a context whose caller is an admin.
+func adminContext() context.Context {
+	return WithPrincipal(context.Background(), Principal{UserID: primitive.NewObjectID().Hex(), Role: RoleAdmin})
+}
+
 // TestGetAllUsers tests the GetAllUsers method by asserting that all users are retrieved.
 func TestGetAllUsers(t *testing.T) {
 	id1 := primitive.NewObjectID()
@@ -71,9 +160,9 @@ func TestGetAllUsers(t *testing.T) {
 	mockRepo := &MockRepository{
 		Users: []models.User{{ID: id1, Name: "Alice"}, {ID: id2, Name: "Bob"}},
 	}
-	service := NewService(mockRepo)
+	service := NewService(mockRepo, nil, testHasher, DefaultPasswordPolicy())
 
-	users, err := service.GetAllUsers(context.Background())
+	users, err := service.GetAllUsers(adminContext())
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(users))
 }
@@ -85,14 +174,378 @@ func TestGetUser(t *testing.T) {
 	mockRepo := &MockRepository{
 		Users: []models.User{{ID: id, Name: "Alice"}},
 	}
-	service := NewService(mockRepo)
+	service := NewService(mockRepo, nil, testHasher, DefaultPasswordPolicy())
 
 	// Testing with a valid ID
-	user, err := service.GetUser(context.Background(), id.Hex())
+	user, err := service.GetUser(adminContext(), id.Hex())
 	assert.NoError(t, err)
 	assert.Equal(t, id.Hex(), user.ID.Hex())
 
 	// Testing with an invalid ID
-	user, err = service.GetUser(context.Background(), "invalidID")
-	assert.Error(t, err)
+	user, err = service.GetUser(adminContext(), "invalidID")
+	assert.Equal(t, KindInvalid, KindOf(err))
+}
+
+// TestErrorKinds tests that rejected input is reported as a ValidationError naming the field, and
+// that the kind of the sentinel errors is found even when they are wrapped.
+func TestErrorKinds(t *testing.T) {
+	service := NewService(&MockRepository{}, nil, testHasher, DefaultPasswordPolicy())
+
+	_, err := service.CreateUser(adminContext(), models.User{Name: "Carol", Role: "owner", Password: "Tr0ub4dor&3x"})
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "role", validationErr.Errors[0].Field)
+	_, err = service.CreateUser(adminContext(), models.User{Name: "C4rol", Password: "Tr0ub4dor&3x"})
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "name", validationErr.Errors[0].Field)
+	err = service.DeleteUser(adminContext(), "not-an-id")
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "id", validationErr.Errors[0].Field)
+	orgAdmin := WithPrincipal(context.Background(), Principal{UserID: primitive.NewObjectID().Hex(), Role: RoleUser, OrgID: "not-an-id", OrgRole: OrgRoleAdmin})
+	_, err = service.CreateUser(orgAdmin, models.User{Name: "Carol", Password: "Tr0ub4dor&3x"})
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "organization", validationErr.Errors[0].Field)
+
+	assert.Equal(t, KindNotFound, KindOf(fmt.Errorf("failed to find user: %w", ErrNotFound)))
+	assert.Equal(t, KindForbidden, KindOf(ErrForbidden))
+	assert.Equal(t, KindUnauthenticated, KindOf(ErrInvalidCredentials))
+	assert.Equal(t, KindInternal, KindOf(errors.New("connection refused")))
+}
+
+// TestAuthenticate tests that Authenticate accepts the correct password and rejects
+// a wrong password or an unknown email with ErrInvalidCredentials.
+func TestAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("Tr0ub4dor&3x"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	mockRepo := &MockRepository{
+		Users: []models.User{{ID: primitive.NewObjectID(), Name: "Alice", Email: "alice@example.com", Password: string(hash)}},
+	}
+	service := NewService(mockRepo, nil, testHasher, DefaultPasswordPolicy())
+
+	// Testing with the correct password
+	user, err := service.Authenticate(context.Background(), "alice@example.com", "Tr0ub4dor&3x")
+	assert.NoError(t, err)
+	assert.Equal(t, "Alice", user.Name)
+
+	// Testing with a wrong password
+	_, err = service.Authenticate(context.Background(), "alice@example.com", "wrong")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	// Testing with an unknown email
+	_, err = service.Authenticate(context.Background(), "bob@example.com", "Tr0ub4dor&3x")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	// Testing a user provisioned by an identity provider, without a password
+	mockRepo.Users = append(mockRepo.Users, models.User{ID: primitive.NewObjectID(), Name: "Carol", Email: "carol@example.com"})
+	_, err = service.Authenticate(context.Background(), "carol@example.com", "")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+// TestAuthenticateSpans tests that a login is traced with a span for the password verification,
+// and that a failed login is recorded as an error of the service span.
+func TestAuthenticateSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	hash, err := testHasher.Hash("Tr0ub4dor&3x")
+	assert.NoError(t, err)
+	mockRepo := &MockRepository{
+		Users: []models.User{{ID: primitive.NewObjectID(), Name: "Alice", Email: "alice@example.com", Password: hash}},
+	}
+	service := NewService(mockRepo, nil, testHasher, DefaultPasswordPolicy())
+
+	_, err = service.Authenticate(context.Background(), "alice@example.com", "wrong")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	spans := recorder.Ended()
+	if assert.Len(t, spans, 2) {
+		verify, login := spans[0], spans[1]
+		assert.Equal(t, "PasswordHasher.Verify", verify.Name())
+		assert.Equal(t, "UserService.Authenticate", login.Name())
+		assert.Equal(t, login.SpanContext().SpanID(), verify.Parent().SpanID())
+		assert.Equal(t, codes.Error, login.Status().Code)
+		assert.Equal(t, codes.Unset, verify.Status().Code)
+	}
+}
+
+// TestPolicy tests that regular users can only read and update themselves,
+// while list, create, delete and role changes are reserved to admins.
+func TestPolicy(t *testing.T) {
+	self := primitive.NewObjectID()
+	other := primitive.NewObjectID()
+	mockRepo := &MockRepository{
+		Users: []models.User{{ID: self, Name: "Alice", Role: RoleUser}, {ID: other, Name: "Bob", Role: RoleUser}},
+	}
+	service := NewService(mockRepo, nil, testHasher, DefaultPasswordPolicy())
+	ctx := WithPrincipal(context.Background(), Principal{UserID: self.Hex(), Role: RoleUser})
+
+	// Allowed on themselves
+	_, err := service.GetUser(ctx, self.Hex())
+	assert.NoError(t, err)
+	_, err = service.UpdateUser(ctx, self.Hex(), models.User{ID: self, Name: "Alicia"})
+	assert.NoError(t, err)
+
+	// Forbidden on others and on admin operations
+	_, err = service.GetUser(ctx, other.Hex())
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = service.UpdateUser(ctx, other.Hex(), models.User{Name: "Robert"})
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = service.UpdateUser(ctx, self.Hex(), models.User{Role: RoleAdmin})
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = service.GetAllUsers(ctx)
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = service.CreateUser(ctx, models.User{Name: "Carol", Password: "Tr0ub4dor&3x"})
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.ErrorIs(t, service.DeleteUser(ctx, other.Hex()), ErrForbidden)
+
+	// Anonymous callers are never allowed
+	_, err = service.GetUser(context.Background(), self.Hex())
+	assert.ErrorIs(t, err, ErrForbidden)
+}
+
+// TestBootstrapAdmin tests that the first admin is created once and never again.
+func TestBootstrapAdmin(t *testing.T) {
+	mockRepo := &MockRepository{}
+	service := NewService(mockRepo, nil, testHasher, DefaultPasswordPolicy())
+	admin := models.User{Name: "Administrator", Email: "admin@example.com", Password: "Tr0ub4dor&3x"}
+
+	created, err := service.BootstrapAdmin(context.Background(), admin)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, RoleAdmin, mockRepo.Users[0].Role)
+	assert.NotEqual(t, admin.Password, mockRepo.Users[0].Password)
+
+	created, err = service.BootstrapAdmin(context.Background(), admin)
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.Len(t, mockRepo.Users, 1)
+}
+
+// TestSetPassword tests that a new password is validated, hashed and stored, and only by allowed callers.
+func TestSetPassword(t *testing.T) {
+	self := primitive.NewObjectID()
+	other := primitive.NewObjectID()
+	mockRepo := &MockRepository{
+		Users: []models.User{{ID: self, Name: "Alice", Role: RoleUser}, {ID: other, Name: "Bob", Role: RoleUser}},
+	}
+	service := NewService(mockRepo, nil, testHasher, DefaultPasswordPolicy())
+	ctx := WithPrincipal(context.Background(), Principal{UserID: self.Hex(), Role: RoleUser})
+
+	// Weak passwords are rejected
+	assert.Error(t, service.SetPassword(ctx, self.Hex(), "password"))
+	assert.Empty(t, mockRepo.Users[0].Password)
+
+	// A strong password is stored hashed
+	assert.NoError(t, service.SetPassword(ctx, self.Hex(), "N3w@Passw0rd"))
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(mockRepo.Users[0].Password), []byte("N3w@Passw0rd")))
+
+	// Other users' passwords cannot be changed
+	assert.ErrorIs(t, service.SetPassword(ctx, other.Hex(), "N3w@Passw0rd"), ErrForbidden)
+}
+
+// TestEmailVerificationState tests that new users start unverified, the bootstrap admin is verified,
+// and changing the email address requires verifying it again.
+func TestEmailVerificationState(t *testing.T) {
+	id := primitive.NewObjectID()
+	mockRepo := &MockRepository{
+		Users: []models.User{{ID: id, Name: "Alice", Email: "alice@example.com", EmailVerified: true}},
+	}
+	service := NewService(mockRepo, nil, testHasher, DefaultPasswordPolicy())
+	ctx := WithPrincipal(context.Background(), Principal{UserID: id.Hex(), Role: RoleUser})
+
+	// Keeping the same address keeps it verified
+	_, err := service.UpdateUser(ctx, id.Hex(), models.User{ID: id, Email: "Alice@example.com"})
+	assert.NoError(t, err)
+	assert.True(t, mockRepo.Users[0].EmailVerified)
+
+	// A new address is unverified
+	_, err = service.UpdateUser(ctx, id.Hex(), models.User{ID: id, Email: "alicia@example.com"})
+	assert.NoError(t, err)
+	assert.False(t, mockRepo.Users[0].EmailVerified)
+
+	created, err := service.CreateUser(adminContext(), models.User{Name: "Bob", Email: "bob@example.com", Password: "Tr0ub4dor&3x", EmailVerified: true})
+	assert.NoError(t, err)
+	assert.False(t, created.EmailVerified)
+
+	_, err = service.BootstrapAdmin(context.Background(), models.User{Name: "Admin", Email: "admin@example.com", Password: "Tr0ub4dor&3x"})
+	assert.NoError(t, err)
+	assert.True(t, mockRepo.Users[len(mockRepo.Users)-1].EmailVerified)
+}
+
+// TestAuthenticateRehash tests that a login with an outdated hash replaces it with a current one.
+func TestAuthenticateRehash(t *testing.T) {
+	id := primitive.NewObjectID()
+	legacy, err := bcrypt.GenerateFromPassword([]byte("Tr0ub4dor&3x"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	mockRepo := &MockRepository{
+		Users: []models.User{{ID: id, Email: "alice@example.com", Password: string(legacy)}},
+	}
+	service := NewService(mockRepo, nil, NewPasswordHasher(testArgon2, testHasher), DefaultPasswordPolicy())
+
+	_, err = service.Authenticate(context.Background(), "alice@example.com", "Tr0ub4dor&3x")
+	assert.NoError(t, err)
+	upgraded := mockRepo.Users[0].Password
+	assert.True(t, strings.HasPrefix(upgraded, "$argon2id$"))
+
+	// The new hash works and is kept on the next login
+	_, err = service.Authenticate(context.Background(), "alice@example.com", "Tr0ub4dor&3x")
+	assert.NoError(t, err)
+	assert.Equal(t, upgraded, mockRepo.Users[0].Password)
+}
+
+// TestPasswordHistory tests that recent passwords cannot be reused and that the history is pruned.
+func TestPasswordHistory(t *testing.T) {
+	id := primitive.NewObjectID()
+	mockRepo := &MockRepository{Users: []models.User{{ID: id, Name: "Alice", Role: RoleUser}}}
+	policy := DefaultPasswordPolicy()
+	policy.HistorySize = 2
+	service := NewService(mockRepo, nil, testHasher, policy)
+	ctx := WithPrincipal(context.Background(), Principal{UserID: id.Hex(), Role: RoleUser})
+
+	passwords := []string{"Fir5t#Secret", "Sec0nd#Secret", "Th1rd#Secret", "F0urth#Secret"}
+	for _, password := range passwords[:3] {
+		assert.NoError(t, service.SetPassword(ctx, id.Hex(), password))
+	}
+	assert.Len(t, mockRepo.Histories[id.Hex()], 2, "history is cut to its size")
+
+	// The current and the kept passwords are rejected
+	for _, password := range passwords[:3] {
+		err := service.SetPassword(ctx, id.Hex(), password)
+		var validationErr *ValidationError
+		if assert.True(t, errors.As(err, &validationErr), password) {
+			assert.Equal(t, ViolationReused, validationErr.Errors[0].Code)
+		}
+	}
+
+	// Once a password dropped out of the history it may be used again
+	assert.NoError(t, service.SetPassword(ctx, id.Hex(), passwords[3]))
+	assert.NoError(t, service.SetPassword(ctx, id.Hex(), passwords[0]))
+}
+
+// TestChangePassword tests that users change their own password with their current one.
+func TestChangePassword(t *testing.T) {
+	self := primitive.NewObjectID()
+	other := primitive.NewObjectID()
+	hash, err := testHasher.Hash("Old#Passw0rd")
+	assert.NoError(t, err)
+	mockRepo := &MockRepository{
+		Users: []models.User{{ID: self, Name: "Alice", Password: hash, Role: RoleUser}, {ID: other, Name: "Bob", Role: RoleUser}},
+	}
+	service := NewService(mockRepo, nil, testHasher, DefaultPasswordPolicy())
+	ctx := WithPrincipal(context.Background(), Principal{UserID: self.Hex(), Role: RoleUser})
+
+	assert.ErrorIs(t, service.ChangePassword(ctx, self.Hex(), "wrong", "N3w@Passw0rd"), ErrInvalidCredentials)
+	assert.ErrorIs(t, service.ChangePassword(adminContext(), other.Hex(), "", "N3w@Passw0rd"), ErrForbidden, "admins cannot change others' passwords this way")
+
+	var validationErr *ValidationError
+	assert.True(t, errors.As(service.ChangePassword(ctx, self.Hex(), "Old#Passw0rd", "Old#Passw0rd"), &validationErr))
+
+	assert.NoError(t, service.ChangePassword(ctx, self.Hex(), "Old#Passw0rd", "N3w@Passw0rd"))
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(mockRepo.Users[0].Password), []byte("N3w@Passw0rd")))
+	assert.Equal(t, []string{hash}, mockRepo.Histories[self.Hex()])
+
+	// Passwords cannot be changed through UpdateUser
+	_, err = service.UpdateUser(ctx, self.Hex(), models.User{Password: "An0ther#Passw0rd"})
+	assert.True(t, errors.As(err, &validationErr))
+}
+
+// mockOrganizations is an in-memory OrganizationFinder.
+type mockOrganizations []models.Organization
+
+// FindById returns the organization with the given ID.
+func (m mockOrganizations) FindById(ctx context.Context, id string) (models.Organization, error) {
+	for _, org := range m {
+		if org.ID.Hex() == id {
+			return org, nil
+		}
+	}
+	return models.Organization{}, errors.New("organization not found")
+}
+
+// TestOrganizationScope tests that organization admins manage the members of their organization only,
+// and that the email domains allowed by organizations are enforced.
+func TestOrganizationScope(t *testing.T) {
+	acme := models.Organization{ID: primitive.NewObjectID(), Name: "Acme", Settings: models.OrganizationSettings{AllowedEmailDomains: []string{"acme.com"}}}
+	globex := models.Organization{ID: primitive.NewObjectID(), Name: "Globex"}
+	inAcme := []models.Membership{{OrganizationID: acme.ID, Role: OrgRoleMember}}
+	orgAdmin := models.User{ID: primitive.NewObjectID(), Name: "Alice", Email: "alice@acme.com", Role: RoleUser,
+		Memberships: []models.Membership{{OrganizationID: acme.ID, Role: OrgRoleAdmin}}}
+	member := models.User{ID: primitive.NewObjectID(), Name: "Bob", Email: "bob@acme.com", Role: RoleUser, Memberships: inAcme}
+	shared := models.User{ID: primitive.NewObjectID(), Name: "Carol", Email: "carol@acme.com", Role: RoleUser,
+		Memberships: append([]models.Membership{{OrganizationID: globex.ID, Role: OrgRoleMember}}, inAcme...)}
+	admin := models.User{ID: primitive.NewObjectID(), Name: "Dave", Email: "dave@acme.com", Role: RoleAdmin, Memberships: inAcme}
+	outsider := models.User{ID: primitive.NewObjectID(), Name: "Eve", Email: "eve@globex.com", Role: RoleUser,
+		Memberships: []models.Membership{{OrganizationID: globex.ID, Role: OrgRoleMember}}}
+	mockRepo := &MockRepository{Users: []models.User{orgAdmin, member, shared, admin, outsider}}
+	service := NewService(mockRepo, mockOrganizations{acme, globex}, testHasher, DefaultPasswordPolicy())
+	ctx := WithPrincipal(context.Background(), Principal{UserID: orgAdmin.ID.Hex(), Role: RoleUser, OrgID: acme.ID.Hex(), OrgRole: OrgRoleAdmin})
+
+	// Only the members of the organization are listed and visible
+	users, err := service.GetAllUsers(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, users, 4)
+	_, err = service.GetUser(ctx, member.ID.Hex())
+	assert.NoError(t, err)
+	_, err = service.GetUser(ctx, outsider.ID.Hex())
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = service.UpdateUser(ctx, outsider.ID.Hex(), models.User{Name: "Eva"})
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, service.DeleteUser(ctx, outsider.ID.Hex()), ErrNotFound)
+
+	// New users join the organization and must use its domains
+	created, err := service.CreateUser(ctx, models.User{Name: "Frank", Email: "frank@acme.com", Password: "Tr0ub4dor&3x"})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Membership{{OrganizationID: acme.ID, Role: OrgRoleMember}}, created.Memberships)
+	_, err = service.CreateUser(ctx, models.User{Name: "Grace", Email: "grace@gmail.com", Password: "Tr0ub4dor&3x"})
+	var validationErr *ValidationError
+	if assert.True(t, errors.As(err, &validationErr)) {
+		assert.Equal(t, ViolationDomainNotAllowed, validationErr.Errors[0].Code)
+	}
+	_, err = service.UpdateUser(ctx, member.ID.Hex(), models.User{Email: "bob@gmail.com"})
+	assert.True(t, errors.As(err, &validationErr))
+
+	// Organization admins cannot give roles, manage admins or delete members of other organizations
+	_, err = service.CreateUser(ctx, models.User{Name: "Heidi", Email: "heidi@acme.com", Password: "Tr0ub4dor&3x", Role: RoleAdmin})
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = service.UpdateUser(ctx, admin.ID.Hex(), models.User{Name: "David"})
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.ErrorIs(t, service.SetPassword(ctx, admin.ID.Hex(), "N3w@Passw0rd"), ErrForbidden)
+	assert.ErrorIs(t, service.DeleteUser(ctx, shared.ID.Hex()), ErrForbidden)
+	assert.NoError(t, service.DeleteUser(ctx, member.ID.Hex()))
+
+	// Members of the organization are not organization admins
+	memberCtx := WithPrincipal(context.Background(), Principal{UserID: member.ID.Hex(), Role: RoleUser, OrgID: acme.ID.Hex(), OrgRole: OrgRoleMember})
+	_, err = service.GetAllUsers(memberCtx)
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = service.GetUser(memberCtx, shared.ID.Hex())
+	assert.ErrorIs(t, err, ErrForbidden)
+}
+
+// TestOrganizationAdminTakeover tests that organization admins cannot take over the accounts of other
+// admins of their organization, nor of members who belong to other organizations too.
+func TestOrganizationAdminTakeover(t *testing.T) {
+	acme := models.Organization{ID: primitive.NewObjectID(), Name: "Acme"}
+	globex := models.Organization{ID: primitive.NewObjectID(), Name: "Globex"}
+	orgAdmin := models.User{ID: primitive.NewObjectID(), Name: "Alice", Email: "alice@acme.com", Role: RoleUser,
+		Memberships: []models.Membership{{OrganizationID: acme.ID, Role: OrgRoleAdmin}}}
+	coAdmin := models.User{ID: primitive.NewObjectID(), Name: "Bob", Email: "bob@acme.com", Role: RoleUser,
+		Memberships: []models.Membership{{OrganizationID: acme.ID, Role: OrgRoleAdmin}}}
+	shared := models.User{ID: primitive.NewObjectID(), Name: "Carol", Email: "carol@globex.com", Role: RoleUser,
+		Memberships: []models.Membership{{OrganizationID: globex.ID, Role: OrgRoleAdmin}, {OrganizationID: acme.ID, Role: OrgRoleMember}}}
+	mockRepo := &MockRepository{Users: []models.User{orgAdmin, coAdmin, shared}}
+	service := NewService(mockRepo, mockOrganizations{acme, globex}, testHasher, DefaultPasswordPolicy())
+	ctx := WithPrincipal(context.Background(), Principal{UserID: orgAdmin.ID.Hex(), Role: RoleUser, OrgID: acme.ID.Hex(), OrgRole: OrgRoleAdmin})
+
+	for _, target := range []models.User{coAdmin, shared} {
+		_, err := service.UpdateUser(ctx, target.ID.Hex(), models.User{Email: "mallory@acme.com"})
+		assert.ErrorIs(t, err, ErrForbidden, target.Name)
+		assert.ErrorIs(t, service.SetPassword(ctx, target.ID.Hex(), "N3w@Passw0rd"), ErrForbidden, target.Name)
+		assert.ErrorIs(t, service.DeleteUser(ctx, target.ID.Hex()), ErrForbidden, target.Name)
+	}
+	assert.Equal(t, "carol@globex.com", mockRepo.Users[2].Email)
+
+	// Admins still manage them
+	adminCtx := WithPrincipal(context.Background(), Principal{UserID: primitive.NewObjectID().Hex(), Role: RoleAdmin, OrgID: acme.ID.Hex()})
+	_, err := service.UpdateUser(adminCtx, shared.ID.Hex(), models.User{Name: "Caroline"})
+	assert.NoError(t, err)
+	assert.NoError(t, service.SetPassword(adminCtx, coAdmin.ID.Hex(), "N3w@Passw0rd"))
 }
@@ -0,0 +1,49 @@
+package user
+
+import "strings"
+
+// FieldError describes one reason why the value of an input field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`   // Name of the rejected field, for example "password"
+	Code    string `json:"code"`    // Machine readable reason, for example "too_short"
+	Message string `json:"message"` // Human readable explanation
+}
+
+// ValidationError is returned when input breaks validation rules. It lists every problem found,
+// so clients can show them all at once.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+// Error joins the field names and messages of all field errors.
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, fieldErr := range e.Errors {
+		messages = append(messages, fieldErr.Field+" "+fieldErr.Message)
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+// ViolationInvalid is the code of the field errors of values that are malformed, rather than
+// breaking a more specific rule.
+const ViolationInvalid = "invalid"
+
+// invalidRole is returned when a user is given a role that does not exist.
+var invalidRole = &ValidationError{Errors: []FieldError{
+	{Field: "role", Code: ViolationInvalid, Message: "must be " + RoleAdmin + " or " + RoleUser},
+}}
+
+// invalidOrganization is returned when the caller acts in an organization whose ID is malformed.
+var invalidOrganization = &ValidationError{Errors: []FieldError{
+	{Field: "organization", Code: ViolationInvalid, Message: "must be a 24 character hexadecimal ID"},
+}}
+
+// checkID returns a ValidationError if id is not the hex form of a user ID.
+func checkID(id string) error {
+	if !isValidObjectId.MatchString(id) {
+		return &ValidationError{Errors: []FieldError{
+			{Field: "id", Code: ViolationInvalid, Message: "must be a 24 character hexadecimal ID"},
+		}}
+	}
+	return nil
+}
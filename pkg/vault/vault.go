@@ -1,8 +1,13 @@
 package vault
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"net/http"
+	"simplecrud/pkg/logging"
 	"simplecrud/utils"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
 )
@@ -11,20 +16,28 @@ import (
 // It uses the VAULT_ADDR and VAULT_TOKEN environment variables for configuration.
 // If these variables are not set, it uses default values.
 func NewVaultClient() *vault.Client {
+	return NewInstrumentedVaultClient(nil)
+}
+
+// NewInstrumentedVaultClient function creates and configures a new Vault client like NewVaultClient,
+// sending its requests through the transport returned by wrap, if not nil.
+func NewInstrumentedVaultClient(wrap func(http.RoundTripper) http.RoundTripper) *vault.Client {
 	// Get the Vault address from the environment variable VAULT_ADDR.
 	// If VAULT_ADDR is not set, use "http://localhost:8200" as the default address.
 	vaultAddr := utils.GetEnv("VAULT_ADDR", "http://localhost:8200")
 
 	// Create a new Vault configuration with the retrieved address.
-	vaultConfig := &vault.Config{
-		Address: vaultAddr,
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = vaultAddr
+	if wrap != nil {
+		vaultConfig.HttpClient.Transport = wrap(vaultConfig.HttpClient.Transport)
 	}
 
 	// Create a new Vault client with the configuration.
 	// If there is an error, log it and terminate the program.
 	vaultClient, err := vault.NewClient(vaultConfig)
 	if err != nil {
-		utils.HandleError("E", "Failed to create Vault client", err)
+		logging.Default().WithError(err).Fatal("Failed to create Vault client")
 	}
 
 	// Get the Vault token from the environment variable VAULT_TOKEN.
@@ -39,31 +52,88 @@ func NewVaultClient() *vault.Client {
 
 // GetMongoDBSecret function retrieves MongoDB secrets from Vault.
 // It returns a map where keys are the secret names and values are the secret values.
+// If the secret cannot be read, the problem is logged and an empty map returned.
 func GetMongoDBSecret(vaultClient *vault.Client) map[string]string {
 	// Read the secret from Vault at the path "secret/data/mongodb".
-	// If there is an error, log it and terminate the program.
 	secretValues, err := vaultClient.Logical().Read("secret/data/mongodb")
 	if err != nil {
-		utils.HandleError("E", "Failed to read secret", err)
+		logging.Default().WithError(err).Error("Failed to read secret")
+		return nil
 	}
 
 	// Check if the secret contains data.
 	if secretValues == nil || secretValues.Data == nil || secretValues.Data["data"] == nil {
-		utils.HandleError("E", "No data in secret", nil)
+		logging.Default().Error("No data in secret")
+		return nil
 	}
 
 	// Extract the data from the secret.
 	data, ok := secretValues.Data["data"].(string)
 	if !ok {
-		utils.HandleError("E", "Data is not a string", nil)
+		logging.Default().Error("Data is not a string")
+		return nil
 	}
 
 	// Unmarshal the data into a map.
 	var mongodbCredentials map[string]string
 	err = json.Unmarshal([]byte(data), &mongodbCredentials)
 	if err != nil {
-		utils.HandleError("E", "Failed to unmarshal mongodbCredentials", err)
+		logging.Default().WithError(err).Error("Failed to unmarshal mongodbCredentials")
+		return nil
 	}
 
 	return mongodbCredentials
 }
+
+// GetJWTSigningKey function retrieves the key used to sign JWT access tokens from Vault.
+// The key is stored under the "key" field at the path "secret/data/jwt".
+func GetJWTSigningKey(vaultClient *vault.Client) ([]byte, error) {
+	return readKey(vaultClient, "secret/data/jwt")
+}
+
+// GetMFAEncryptionKey function retrieves the key used to encrypt MFA secrets from Vault.
+// The key is stored under the "key" field at the path "secret/data/mfa".
+func GetMFAEncryptionKey(vaultClient *vault.Client) ([]byte, error) {
+	return readKey(vaultClient, "secret/data/mfa")
+}
+
+// readKey reads the "key" field of the secret at the given path.
+func readKey(vaultClient *vault.Client, path string) ([]byte, error) {
+	// Read the secret from Vault at the given path.
+	secretValues, err := vaultClient.Logical().Read(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the secret contains the key.
+	if secretValues == nil || secretValues.Data == nil {
+		return nil, errors.New("no data in secret " + path)
+	}
+	key, ok := secretValues.Data["key"].(string)
+	if !ok || key == "" {
+		return nil, errors.New("key not found in secret " + path)
+	}
+
+	return []byte(key), nil
+}
+
+// CheckToken function checks that the token of the Vault client is still valid, and returns the time
+// left before it expires. Tokens without a TTL never expire, and 0 is returned for them.
+func CheckToken(ctx context.Context, vaultClient *vault.Client) (time.Duration, error) {
+	secret, err := vaultClient.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if secret == nil || secret.Data == nil {
+		return 0, errors.New("no data in token lookup")
+	}
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return 0, err
+	}
+	// A zero TTL is reported for tokens that never expire, such as root tokens.
+	if expiry, ok := secret.Data["expire_time"]; ok && expiry != nil && ttl <= 0 {
+		return 0, errors.New("vault token expired")
+	}
+	return ttl, nil
+}
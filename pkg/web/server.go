@@ -0,0 +1,107 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"simplecrud/pkg/health"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// ReadinessDelayKey configures how long the server keeps serving after readiness starts failing,
+	// so load balancers stop sending new requests before the listener closes.
+	ReadinessDelayKey     = "SHUTDOWN_READINESS_DELAY"
+	DefaultReadinessDelay = 5 * time.Second
+	// ShutdownTimeoutKey configures how long a shutdown waits for in-flight requests, readiness delay included.
+	ShutdownTimeoutKey     = "SHUTDOWN_TIMEOUT"
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+// Server is a running web server. It is stopped gracefully with Shutdown.
+type Server struct {
+	http           *http.Server
+	listener       net.Listener
+	readinessDelay time.Duration   // How long to keep serving after readiness starts failing
+	monitor        *health.Monitor // Checks the dependencies the server needs to be ready; nil checks none
+	ready          atomic.Bool     // Whether the server accepts new traffic
+	done           chan error      // Receives the error that stopped the server, then is closed
+}
+
+// serve starts serving the router on the listener in the background, and adds the readiness
+// endpoint reporting whether the server accepts new traffic and its dependencies are healthy.
+func serve(router *gin.Engine, listener net.Listener, readinessDelay time.Duration, monitor *health.Monitor) *Server {
+	s := &Server{
+		http:           &http.Server{Handler: router},
+		listener:       listener,
+		readinessDelay: readinessDelay,
+		monitor:        monitor,
+		done:           make(chan error, 1),
+	}
+	router.GET("/readyz", s.readiness)
+	s.ready.Store(true)
+
+	go func() {
+		err := s.http.Serve(listener)
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		s.done <- err
+		close(s.done)
+	}()
+	return s
+}
+
+// readiness answers 200 with the status and latency of every dependency while the server accepts new
+// traffic, and 503 once it is shutting down or while a critical dependency is down.
+func (s *Server) readiness(c *gin.Context) {
+	if !s.ready.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "shutting down"})
+		return
+	}
+	if s.monitor == nil {
+		c.JSON(http.StatusOK, gin.H{"status": health.StatusUp})
+		return
+	}
+
+	report := s.monitor.Check()
+	status := http.StatusOK
+	if !report.Healthy() {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Done returns a channel receiving the error that stopped the server, or nil after a shutdown.
+func (s *Server) Done() <-chan error {
+	return s.done
+}
+
+// Shutdown stops the server gracefully. Readiness starts failing first, and the server keeps serving
+// for the readiness delay. It then stops accepting connections and waits for in-flight requests to
+// complete. If ctx expires first, the remaining connections are closed and the context error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.ready.Store(false)
+	select {
+	case <-time.After(s.readinessDelay):
+	case <-ctx.Done():
+		s.http.Close()
+		return ctx.Err()
+	}
+
+	if err := s.http.Shutdown(ctx); err != nil {
+		s.http.Close()
+		return err
+	}
+	return <-s.done
+}
@@ -0,0 +1,154 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"simplecrud/pkg/health"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIntegrationGracefulShutdown checks that a shutdown fails readiness first, and lets a request
+// that is halfway through writing its response complete before the server stops.
+func TestIntegrationGracefulShutdown(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router := gin.New()
+	router.GET("/slow", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		_, _ = c.Writer.WriteString("first half, ")
+		c.Writer.Flush()
+		close(started)
+		<-release
+		_, _ = c.Writer.WriteString("second half")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := serve(router, listener, 200*time.Millisecond, nil)
+	base := "http://" + server.Addr()
+
+	response, err := http.Get(base + "/readyz")
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	// Start a request and wait until it has written part of its response
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		response, err := http.Get(base + "/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		results <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+
+	// Readiness fails while the server is still serving
+	require.Eventually(t, func() bool {
+		response, err := http.Get(base + "/readyz")
+		if err != nil {
+			return false
+		}
+		response.Body.Close()
+		return response.StatusCode == http.StatusServiceUnavailable
+	}, time.Second, 10*time.Millisecond)
+
+	// The shutdown waits for the in-flight request, which completes its response
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before the in-flight request completed: %v", err)
+	default:
+	}
+	close(release)
+	got := <-results
+	require.NoError(t, got.err)
+	assert.Equal(t, "first half, second half", got.body)
+	require.NoError(t, <-shutdown)
+
+	// New connections are refused once the server stopped
+	_, err = http.Get(base + "/readyz")
+	assert.Error(t, err)
+}
+
+// TestShutdownDeadline checks that a shutdown gives up on requests still running when its context expires.
+func TestShutdownDeadline(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	started := make(chan struct{})
+	router := gin.New()
+	router.GET("/stuck", func(c *gin.Context) {
+		close(started)
+		<-c.Request.Context().Done()
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := serve(router, listener, 0, nil)
+	go func() {
+		if response, err := http.Get("http://" + server.Addr() + "/stuck"); err == nil {
+			response.Body.Close()
+		}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+}
+
+// TestReadinessReportsDependencies checks that /readyz reports every dependency, and fails while a critical one is down.
+func TestReadinessReportsDependencies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var mongoErr error
+	monitor := health.NewMonitor(0, time.Second,
+		health.Dependency{Name: "mongodb", Critical: true, Checker: health.CheckerFunc(func(ctx context.Context) error { return mongoErr })},
+		health.Dependency{Name: "vault", Checker: health.CheckerFunc(func(ctx context.Context) error { return errors.New("permission denied") })},
+	)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := serve(gin.New(), listener, 0, monitor)
+	defer server.Shutdown(context.Background())
+
+	readiness := func() (int, health.Report) {
+		response, err := http.Get("http://" + server.Addr() + "/readyz")
+		require.NoError(t, err)
+		defer response.Body.Close()
+		var report health.Report
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&report))
+		return response.StatusCode, report
+	}
+
+	status, report := readiness()
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, health.StatusUp, report.Checks["mongodb"].Status)
+	assert.Equal(t, health.StatusDown, report.Checks["vault"].Status)
+
+	mongoErr = errors.New("server selection timeout")
+	status, report = readiness()
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, health.StatusDown, report.Status)
+	assert.Equal(t, "server selection timeout", report.Checks["mongodb"].Error)
+}
@@ -1,34 +1,89 @@
 package web
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 
+	"simplecrud/pkg/audit"
+	"simplecrud/pkg/auth"
 	"simplecrud/pkg/handlers"
+	"simplecrud/pkg/health"
+	"simplecrud/pkg/metrics"
+	"simplecrud/pkg/middleware"
+	"simplecrud/pkg/organization"
+	"simplecrud/pkg/ratelimit"
+	"simplecrud/pkg/tenant"
+	"simplecrud/pkg/tracing"
 	"simplecrud/pkg/user"
 	"simplecrud/utils"
 
-	"github.com/didip/tollbooth"
-	"github.com/didip/tollbooth/limiter"
-	"github.com/didip/tollbooth_gin"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Define constants for logging levels, Gin mode, and server port.
+// Define constants for Gin mode and server port.
 const (
-	InfoLogLevel   = "I"
-	ErrorLogLevel  = "E"
 	GinModeKey     = "GIN_MODE"
 	DefaultGinMode = gin.DebugMode
 	PortKey        = "PORT"
 	DefaultPort    = "8080"
+	// LoginIPRateKey (requests per second) and LoginIPBurstKey configure the per-IP login throttle.
+	LoginIPRateKey      = "LOGIN_IP_RATE"
+	DefaultLoginIPRate  = 0.2
+	LoginIPBurstKey     = "LOGIN_IP_BURST"
+	DefaultLoginIPBurst = 5
 )
 
-// StartServer function initializes and starts the web server.
-func StartServer(userRepo user.Repository) {
+// Dependencies groups the repositories and services the web server is built from.
+type Dependencies struct {
+	UserRepo       user.Repository               // Repository for user documents
+	Organizations  organization.Repository       // Repository for organizations
+	Members        organization.MemberRepository // Manages the memberships of users in organizations
+	Hasher         user.PasswordHasher           // Hashes and verifies passwords
+	PasswordPolicy user.PasswordPolicy           // Rules new passwords must follow
+	Tokens         *auth.TokenManager            // Issues and validates access tokens
+	Sessions       *auth.SessionService          // Issues and rotates refresh tokens
+	Guard          *auth.LoginGuard              // Throttles and locks accounts after failed logins
+	MFA            *auth.MFAService              // Enrolls and verifies TOTP second factors
+	Resets         *auth.PasswordResetService    // Issues and redeems password reset tokens
+	Verification   *auth.VerificationService     // Sends and redeems email verification tokens
+	APIKeys        *auth.APIKeyService           // Creates and authenticates API keys
+	OIDC           *auth.OIDCService             // Logs users in with an identity provider; nil disables it
+	Impersonation  *auth.ImpersonationService    // Issues tokens letting admins act as users
+	Audit          audit.Recorder                // Records impersonated requests
+	Tenants        tenant.Registry               // Isolates every request to one tenant database; nil shares one database
+	Health         *health.Monitor               // Checks the dependencies reported by /readyz; nil checks none
+	Metrics        *metrics.Metrics              // Counts and times requests; nil disables the metrics
+	Tracer         trace.TracerProvider          // Traces requests; nil disables tracing
+	RateLimits     ratelimit.Store               // Shares the rate limit buckets between instances; nil keeps them in memory
+}
+
+// StartServer function initializes the web server and starts serving in the background.
+// It returns the running server, to be stopped with Shutdown, or an error if the port cannot be opened.
+func StartServer(deps Dependencies) (*Server, error) {
 	// Create a new user service with the provided repository.
-	userService := user.NewService(userRepo)
+	userService := user.NewService(deps.UserRepo, deps.Organizations, deps.Hasher, deps.PasswordPolicy)
 	// Create a new user handler with the created user service.
-	userHandler := handlers.NewUserHandler(userService)
+	userHandler := handlers.NewUserHandler(userService, deps.Verification)
+	// Create a new auth handler that issues access and refresh tokens.
+	authHandler := handlers.NewAuthHandler(userService, deps.Tokens, deps.Sessions, deps.Guard, deps.MFA)
+	// Create a new password handler for password changes and resets.
+	passwordHandler := handlers.NewPasswordHandler(userService, deps.Resets, deps.Sessions)
+	// Create a new verification handler for email verification links.
+	verificationHandler := handlers.NewVerificationHandler(deps.Verification)
+	// Create a new API key handler for admins managing service access.
+	apiKeyHandler := handlers.NewAPIKeyHandler(deps.APIKeys)
+	// Create an impersonation handler for support staff acting as users.
+	impersonationHandler := handlers.NewImpersonationHandler(deps.Impersonation)
+	// Create an organization handler for managing organizations and their members.
+	organizationHandler := handlers.NewOrganizationHandler(organization.NewService(deps.Organizations, deps.Members, deps.Tenants))
+	// Create an OIDC handler for logins through the identity provider, if one is configured.
+	var oidcHandler *handlers.OIDCHandler
+	if deps.OIDC != nil {
+		oidcHandler = handlers.NewOIDCHandler(deps.OIDC, deps.Tokens, deps.Sessions)
+	}
 
 	// Set the gin mode. This can be either debug or release.
 	gin.SetMode(utils.GetEnv(GinModeKey, DefaultGinMode))
@@ -36,6 +91,24 @@ func StartServer(userRepo user.Repository) {
 	// Create a new gin engine. Use gin.New() to have more control over the middleware.
 	r := gin.New()
 
+	// Let the gin context fall back to the request context, so values set by middleware
+	// (such as the authenticated caller) reach the service and repository layers.
+	r.ContextWithFallback = true
+
+	// Start a span for every request, continuing the trace of the caller if it sent a traceparent header.
+	// The span travels in the request context through the services and the repositories.
+	if deps.Tracer != nil {
+		r.Use(otelgin.Middleware(tracing.ServiceName, otelgin.WithTracerProvider(deps.Tracer)))
+	}
+
+	// Give every request an ID, and log every request once handled, including the ones ending in a panic.
+	r.Use(middleware.RequestID(), middleware.AccessLog())
+
+	// Count and time every request, including the ones ending in a panic, which Recovery turns into a 500.
+	if deps.Metrics != nil {
+		r.Use(deps.Metrics.Middleware())
+	}
+
 	// Use the Recovery middleware to recover from any panics and write a 500 if it happens.
 	r.Use(gin.Recovery())
 
@@ -49,34 +122,198 @@ func StartServer(userRepo user.Repository) {
 		c.Next()
 	})
 
-	// Create a new rate limiter. This will limit to 1 request/second.
-	limiter := tollbooth.NewLimiter(1, nil)
+	// Log and audit every request made with an impersonation token, including rejected ones.
+	r.Use(middleware.AuditImpersonation(deps.Audit))
+
+	// Answer the errors recorded by the middleware and handlers below as problem details. It runs inside
+	// the middleware above, so they log and count the status it answers.
+	r.Use(middleware.Errors())
+
+	// Keep every request to the database of a single tenant when each organization has its own.
+	if deps.Tenants != nil {
+		r.Use(middleware.IsolateTenants(deps.Tenants))
+	}
+
+	// Limit every client, identified by its API key or user once authenticated and by IP otherwise, to
+	// its own policy, the policy of the route, or the default policy.
+	limits, err := rateLimitConfig()
+	if err != nil {
+		return nil, err
+	}
+	store := deps.RateLimits
+	if store == nil {
+		store = ratelimit.NewMemoryStore()
+	}
+	limiter := ratelimit.New("global", limits, store)
+
+	// Create a separate, stricter per-IP limiter for login, so password guessing from one address
+	// is slowed down independently of the global limit and of the per-account lockout.
+	loginPolicy, err := ratelimit.NewPolicy("login", utils.GetEnvFloat(LoginIPRateKey, DefaultLoginIPRate), utils.GetEnvInt(LoginIPBurstKey, DefaultLoginIPBurst))
+	if err != nil {
+		return nil, err
+	}
+	loginLimiter := ratelimit.New("login", ratelimit.Config{Default: loginPolicy, ByIP: true}, store)
+
+	// Authenticated routes are also limited by IP before authentication, so requests with bad credentials,
+	// which never reach the per-principal limit, are throttled as well.
+	ipDefault := limits.IPPolicy()
+	ipPolicy, err := ratelimit.NewPolicy(ipDefault.Name, utils.GetEnvFloat(ratelimit.IPRateKey, ipDefault.Rate), utils.GetEnvInt(ratelimit.IPBurstKey, ipDefault.Burst))
+	if err != nil {
+		return nil, err
+	}
+	ipLimiter := ratelimit.New("ip", ratelimit.Config{Default: ipPolicy, ByIP: true}, store)
+	var rejected, ipRejected, loginRejected func()
+	if deps.Metrics != nil {
+		rejected, ipRejected, loginRejected = deps.Metrics.RateLimited("global"), deps.Metrics.RateLimited("ip"), deps.Metrics.RateLimited("login")
+	}
+	limit, ipLimit, loginLimit := limiter.Handler(rejected), ipLimiter.Handler(ipRejected), loginLimiter.Handler(loginRejected)
+
+	// Restrict what users with an unverified email may do.
+	requireVerified := middleware.RequireVerifiedEmail(utils.GetEnv(middleware.UnverifiedAccessKey, middleware.DefaultUnverifiedAccess))
 
 	// Setup the routes for the server.
-	setupRoutes(r, limiter, userHandler)
+	setupRoutes(r, routes{
+		limit:           limit,
+		ipLimit:         ipLimit,
+		loginLimit:      loginLimit,
+		requireVerified: requireVerified,
+		users:           userHandler,
+		auth:            authHandler,
+		passwords:       passwordHandler,
+		verification:    verificationHandler,
+		apiKeys:         apiKeyHandler,
+		impersonation:   impersonationHandler,
+		organizations:   organizationHandler,
+		oidc:            oidcHandler,
+		tokens:          deps.Tokens,
+		apiKeyService:   deps.APIKeys,
+	})
 
 	// Get the port from environment variables or use the default port.
 	port := utils.GetEnv(PortKey, DefaultPort)
 
-	// Run the server on the defined port. If there is an error, log it.
-	if err := r.Run(":" + port); err != nil {
-		utils.HandleError(ErrorLogLevel, "Failed to run server", err)
+	// Open the port before returning, so a port that is already in use is reported to the caller.
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %s: %w", port, err)
+	}
+	return serve(r, listener, utils.GetEnvDuration(ReadinessDelayKey, DefaultReadinessDelay), deps.Health), nil
+}
+
+// rateLimitConfig reads the policies of the global rate limiter from the environment.
+func rateLimitConfig() (ratelimit.Config, error) {
+	var config ratelimit.Config
+	var err error
+	config.Default, err = ratelimit.NewPolicy("default", utils.GetEnvFloat(ratelimit.RateKey, ratelimit.DefaultRate), utils.GetEnvInt(ratelimit.BurstKey, ratelimit.DefaultBurst))
+	if err != nil {
+		return config, err
 	}
+	if config.Routes, err = ratelimit.ParseRoutes(utils.GetEnv(ratelimit.RoutesKey, "")); err != nil {
+		return config, err
+	}
+	config.Principals, err = ratelimit.ParsePrincipals(utils.GetEnv(ratelimit.PrincipalsKey, ""))
+	return config, err
+}
+
+// routes holds the handlers and middleware the routes of the server are set up with.
+type routes struct {
+	limit           gin.HandlerFunc // Limits every client to its own policy, the policy of the route, or the default policy
+	ipLimit         gin.HandlerFunc // Limits authenticated routes by IP, before authentication
+	loginLimit      gin.HandlerFunc // Limits login and the other routes checking secrets or sending emails by IP
+	requireVerified gin.HandlerFunc // Restricts users who did not verify their email yet
+
+	users         *handlers.UserHandler
+	auth          *handlers.AuthHandler
+	passwords     *handlers.PasswordHandler
+	verification  *handlers.VerificationHandler
+	apiKeys       *handlers.APIKeyHandler
+	impersonation *handlers.ImpersonationHandler
+	organizations *handlers.OrganizationHandler
+	oidc          *handlers.OIDCHandler // nil when no identity provider is configured
+
+	tokens        *auth.TokenManager  // Validates access tokens
+	apiKeyService *auth.APIKeyService // Authenticates API keys
 }
 
 // setupRoutes function sets up all the routes for the server.
-func setupRoutes(router *gin.Engine, limiter *limiter.Limiter, userHandler *handlers.UserHandler) {
+func setupRoutes(router *gin.Engine, rt routes) {
+	limit, ipLimit, loginLimit, requireVerified := rt.limit, rt.ipLimit, rt.loginLimit, rt.requireVerified
+
 	// Health check endpoint
 	router.GET("/ping", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "pong",
 		})
 	})
+	// Liveness endpoint: the process is up and serving. Readiness, which checks the dependencies, is /readyz.
+	router.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": health.StatusUp})
+	})
+
+	// Auth routes. Login is rate limited like every other route to slow down password guessing.
+	router.POST("/auth/login", limit, loginLimit, rt.auth.Login)        // Exchange email and password for tokens
+	router.POST("/auth/login/mfa", limit, loginLimit, rt.auth.LoginMFA) // Complete a login with a second factor
+	router.POST("/auth/refresh", limit, rt.auth.Refresh)                // Rotate a refresh token for new tokens
+	router.POST("/auth/logout", limit, rt.auth.Logout)                  // Revoke the session of a refresh token
+
+	// OIDC login routes, only available when an identity provider is configured. The callback shares the
+	// stricter login limit, since it creates sessions.
+	if rt.oidc != nil {
+		router.GET("/auth/oidc/login", limit, rt.oidc.Login)                   // Redirect to the identity provider
+		router.GET("/auth/oidc/callback", limit, loginLimit, rt.oidc.Callback) // Complete the login and issue tokens
+	}
+
+	// Password reset routes. They share the stricter login limit, since both send emails or check secrets.
+	router.POST("/auth/password-reset", limit, loginLimit, rt.passwords.RequestPasswordReset)         // Send a password reset token
+	router.POST("/auth/password-reset/confirm", limit, loginLimit, rt.passwords.ConfirmPasswordReset) // Choose a new password with the token
+
+	// Email verification routes. Resending shares the stricter login limit, since it sends emails.
+	router.GET("/auth/verify", limit, rt.verification.VerifyEmail)                            // Verify an email address with the emailed link
+	router.POST("/auth/verify/resend", limit, loginLimit, rt.verification.ResendVerification) // Send a new verification email
+
+	// User routes. These routes require a valid access token. They are rate limited by IP before authentication,
+	// and after it so every user and API key has buckets of its own.
+	// Users who did not verify their email yet are restricted according to UNVERIFIED_EMAIL_ACCESS.
+	// Listing, creating and deleting users is reserved to admins and organization admins. Reading and updating
+	// a single user is also allowed to the user themselves, which the user service checks. Callers acting in
+	// an organization only see its members.
+	// Routes taking a scope also accept API keys granted that scope.
+	requireAuth := middleware.RequireAuth(rt.tokens)
+	requireAdmin := middleware.RequireRole(user.RoleAdmin)
+	requireUserManager := middleware.RequireUserManager()
+	// Impersonation tokens let admins see the API as a user, but not change the user's credentials.
+	forbidImpersonation := middleware.ForbidImpersonation()
+	readUsers := middleware.RequireAuthOrAPIKey(rt.tokens, rt.apiKeyService, auth.ScopeUsersRead)
+	writeUsers := middleware.RequireAuthOrAPIKey(rt.tokens, rt.apiKeyService, auth.ScopeUsersWrite)
+	router.POST("/auth/mfa/enroll", ipLimit, requireAuth, limit, forbidImpersonation, requireVerified, rt.auth.EnrollMFA)   // Start TOTP enrollment for the caller
+	router.POST("/auth/mfa/confirm", ipLimit, requireAuth, limit, forbidImpersonation, requireVerified, rt.auth.ConfirmMFA) // Enable MFA with a first code
+	router.GET("/users", ipLimit, readUsers, limit, requireVerified, requireUserManager, rt.users.GetAllUsers)              // Get all users
+	router.GET("/users/:id", ipLimit, readUsers, limit, requireVerified, rt.users.GetUser)                                  // Get a single user by ID
+	router.POST("/users", ipLimit, writeUsers, limit, requireVerified, requireUserManager, rt.users.CreateUser)             // Create a new user
+	router.PUT("/users/:id", ipLimit, writeUsers, limit, requireVerified, rt.users.UpdateUser)                              // Update a user by ID
+	router.DELETE("/users/:id", ipLimit, writeUsers, limit, requireVerified, requireUserManager, rt.users.DeleteUser)       // Delete a user by ID
+	router.POST("/users/:id/unlock", ipLimit, writeUsers, limit, requireVerified, requireAdmin, rt.auth.UnlockUser)         // Lift a login lockout
+	// Changing a password checks the current one, so it is throttled like login.
+	router.PUT("/users/:id/password", loginLimit, requireAuth, limit, forbidImpersonation, requireVerified, rt.passwords.ChangePassword) // Change one's own password
+
+	// Organization routes. Creating and deleting organizations is reserved to admins; the organization service
+	// lets organization admins manage their own organization and its members, and members read it.
+	// Switching organization is refused to impersonation tokens, since the new token would not name the admin.
+	router.POST("/auth/organization", ipLimit, requireAuth, limit, forbidImpersonation, rt.auth.SwitchOrganization)                      // Get an access token for another organization
+	router.GET("/organizations", ipLimit, requireAuth, limit, requireVerified, rt.organizations.ListOrganizations)                       // List the caller's organizations
+	router.POST("/organizations", ipLimit, requireAuth, limit, requireVerified, requireAdmin, rt.organizations.CreateOrganization)       // Create an organization
+	router.GET("/organizations/:id", ipLimit, requireAuth, limit, requireVerified, rt.organizations.GetOrganization)                     // Get an organization by ID
+	router.PUT("/organizations/:id", ipLimit, requireAuth, limit, requireVerified, rt.organizations.UpdateOrganization)                  // Update the name and settings of an organization
+	router.DELETE("/organizations/:id", ipLimit, requireAuth, limit, requireVerified, requireAdmin, rt.organizations.DeleteOrganization) // Delete an organization
+	router.GET("/organizations/:id/members", ipLimit, requireAuth, limit, requireVerified, rt.organizations.ListMembers)                 // List the members of an organization
+	router.PUT("/organizations/:id/members/:userId", ipLimit, requireAuth, limit, requireVerified, rt.organizations.SetMember)           // Add a member or change their role
+	router.DELETE("/organizations/:id/members/:userId", ipLimit, requireAuth, limit, requireVerified, rt.organizations.RemoveMember)     // Remove a member from an organization
+
+	// Impersonation, reserved to admins logged in as themselves. Every request made with the token is audited.
+	router.POST("/users/:id/impersonate", ipLimit, requireAuth, limit, forbidImpersonation, requireVerified, requireAdmin, rt.impersonation.Impersonate) // Act as a user for a short time
 
-	// User routes. These routes are wrapped with a rate limiter middleware.
-	router.GET("/users", tollbooth_gin.LimitHandler(limiter), userHandler.GetAllUsers)       // Get all users
-	router.GET("/users/:id", tollbooth_gin.LimitHandler(limiter), userHandler.GetUser)       // Get a single user by ID
-	router.POST("/users", tollbooth_gin.LimitHandler(limiter), userHandler.CreateUser)       // Create a new user
-	router.PUT("/users/:id", tollbooth_gin.LimitHandler(limiter), userHandler.UpdateUser)    // Update a user by ID
-	router.DELETE("/users/:id", tollbooth_gin.LimitHandler(limiter), userHandler.DeleteUser) // Delete a user by ID
+	// API key routes, reserved to admins logged in as themselves: API keys cannot manage API keys.
+	router.POST("/api-keys", ipLimit, requireAuth, limit, forbidImpersonation, requireVerified, requireAdmin, rt.apiKeys.CreateAPIKey)       // Create an API key, shown once
+	router.GET("/api-keys", ipLimit, requireAuth, limit, requireVerified, requireAdmin, rt.apiKeys.ListAPIKeys)                              // List API keys
+	router.DELETE("/api-keys/:id", ipLimit, requireAuth, limit, forbidImpersonation, requireVerified, requireAdmin, rt.apiKeys.RevokeAPIKey) // Revoke an API key
 }
@@ -6,21 +6,30 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"simplecrud/pkg/auth"
 	"simplecrud/pkg/database"
 	"simplecrud/pkg/handlers"
+	"simplecrud/pkg/middleware"
 	"simplecrud/pkg/models"
+	"simplecrud/pkg/notify"
+	"simplecrud/pkg/organization"
+	"simplecrud/pkg/ratelimit"
 	"simplecrud/pkg/user"
 	"testing"
 	"time"
 
 	mim "github.com/ONSdigital/dp-mongodb-in-memory"
-	"github.com/didip/tollbooth"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// testHasher hashes passwords with the cheapest bcrypt cost to keep the tests fast.
+var testHasher = user.BcryptHasher{Cost: bcrypt.MinCost}
+
 func startInMemoryMongoDB() (*mim.Server, string, error) {
 	// Start in-memory MongoDB using dp-mongodb-in-memory
 	mongoServer, err := mim.Start(context.Background(), "5.0.2") // Change the version if needed
@@ -48,31 +57,54 @@ func TestIntegrationCRUDOperations(t *testing.T) {
 	}
 
 	dbName := "testdb" // you can specify the database name here
-	userRepo := database.NewUserRepository(db, dbName)
+	userRepo := database.NewUserRepository(db, database.SingleDatabase(dbName))
+	sessionRepo := database.NewSessionRepository(db, dbName)
+	require.NoError(t, sessionRepo.EnsureIndexes(context.Background()))
+	attemptRepo := database.NewAttemptRepository(db, dbName)
+	tokenRepo := database.NewActionTokenRepository(db, dbName)
+	require.NoError(t, tokenRepo.EnsureIndexes(context.Background()))
+	apiKeyRepo := database.NewAPIKeyRepository(db, dbName)
+	require.NoError(t, apiKeyRepo.EnsureIndexes(context.Background()))
 
 	// Set up the router specifically for the test
-	router := setupTestRouter(userRepo)
+	router := setupTestRouter(t, userRepo, sessionRepo, attemptRepo, tokenRepo, apiKeyRepo, database.NewOrganizationRepository(db, dbName))
+
+	// Bootstrap an admin and log in as them to manage users
+	admin := models.User{Name: "Admin", Email: "admin@example.com", Password: "Adm1n@Passw0rd"}
+	created, err := user.NewService(userRepo, nil, testHasher, user.DefaultPasswordPolicy()).BootstrapAdmin(context.Background(), admin)
+	require.NoError(t, err)
+	require.True(t, created)
+	adminBearer := "Bearer " + login(t, router, admin.Email, admin.Password).AccessToken
 
 	// Test Create
 	userToCreate := models.User{
 		Name:     "JohnDoe",
 		Age:      25,
 		Email:    "john.doe@example.com",
-		Password: "P@ssword123",
+		Password: "Tr0ub4dor&3x",
 		Address:  "123 Main St",
 	}
 	userJSON, _ := json.Marshal(userToCreate)
 	req, err := http.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(userJSON))
 	require.NoError(t, err)
+	req.Header.Set("Authorization", adminBearer)
 	resp := httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 	require.Equal(t, http.StatusCreated, resp.Code)
 	var createdUser models.User
 	_ = json.Unmarshal(resp.Body.Bytes(), &createdUser)
 
+	// Test that protected routes reject anonymous requests
+	req, err = http.NewRequest(http.MethodGet, "/users", nil)
+	require.NoError(t, err)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusUnauthorized, resp.Code)
+
 	// Test Get All Users
 	req, err = http.NewRequest(http.MethodGet, "/users", nil)
 	require.NoError(t, err)
+	req.Header.Set("Authorization", adminBearer)
 	resp = httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 	require.Equal(t, http.StatusOK, resp.Code)
@@ -82,9 +114,31 @@ func TestIntegrationCRUDOperations(t *testing.T) {
 	// Assuming the newly created user is the last one, or you can find it with specific logic
 	createdUser = users[len(users)-1]
 
+	// Test Login as the created user
+	tokens := login(t, router, userToCreate.Email, userToCreate.Password)
+	bearer := "Bearer " + tokens.AccessToken
+
+	// Test that a regular user cannot list users
+	req, err = http.NewRequest(http.MethodGet, "/users", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", bearer)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusForbidden, resp.Code)
+
+	// Test Refresh
+	refreshJSON, _ := json.Marshal(map[string]string{"refresh_token": tokens.RefreshToken})
+	req, err = http.NewRequest(http.MethodPost, "/auth/refresh", bytes.NewBuffer(refreshJSON))
+	require.NoError(t, err)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tokens))
+
 	// Test Get by ID
 	req, err = http.NewRequest(http.MethodGet, "/users/"+createdUser.ID.Hex(), nil)
 	require.NoError(t, err)
+	req.Header.Set("Authorization", bearer)
 	resp = httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 	require.Equal(t, http.StatusOK, resp.Code)
@@ -96,6 +150,7 @@ func TestIntegrationCRUDOperations(t *testing.T) {
 	userJSON, _ = json.Marshal(userToUpdate)
 	req, err = http.NewRequest(http.MethodPut, "/users/"+createdUser.ID.Hex(), bytes.NewBuffer(userJSON))
 	require.NoError(t, err)
+	req.Header.Set("Authorization", bearer)
 	resp = httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 	require.Equal(t, http.StatusOK, resp.Code)
@@ -103,6 +158,58 @@ func TestIntegrationCRUDOperations(t *testing.T) {
 	// Test Delete
 	req, err = http.NewRequest(http.MethodDelete, "/users/"+createdUser.ID.Hex(), nil)
 	require.NoError(t, err)
+	req.Header.Set("Authorization", adminBearer)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusNoContent, resp.Code)
+
+	// Test API keys: an admin creates a read-only key, which can list but not create users
+	keyJSON, _ := json.Marshal(map[string]interface{}{"name": "batch", "scopes": []string{auth.ScopeUsersRead}})
+	req, err = http.NewRequest(http.MethodPost, "/api-keys", bytes.NewBuffer(keyJSON))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", adminBearer)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusCreated, resp.Code)
+	var createdKey struct {
+		Key    string        `json:"key"`
+		APIKey models.APIKey `json:"api_key"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &createdKey))
+
+	req, err = http.NewRequest(http.MethodGet, "/users", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "ApiKey "+createdKey.Key)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	req, err = http.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(userJSON))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "ApiKey "+createdKey.Key)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusForbidden, resp.Code)
+
+	// Revoked keys stop working
+	req, err = http.NewRequest(http.MethodDelete, "/api-keys/"+createdKey.APIKey.ID.Hex(), nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", adminBearer)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusNoContent, resp.Code)
+
+	req, err = http.NewRequest(http.MethodGet, "/users", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "ApiKey "+createdKey.Key)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Test Logout
+	refreshJSON, _ = json.Marshal(map[string]string{"refresh_token": tokens.RefreshToken})
+	req, err = http.NewRequest(http.MethodPost, "/auth/logout", bytes.NewBuffer(refreshJSON))
+	require.NoError(t, err)
 	resp = httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 	require.Equal(t, http.StatusNoContent, resp.Code)
@@ -113,6 +220,26 @@ func TestIntegrationCRUDOperations(t *testing.T) {
 	}
 }
 
+// loginResponse holds the tokens returned by the login and refresh endpoints.
+type loginResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// login logs in through the router and returns the issued tokens.
+func login(t *testing.T, router *gin.Engine, email, password string) loginResponse {
+	loginJSON, _ := json.Marshal(map[string]string{"email": email, "password": password})
+	req, err := http.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(loginJSON))
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	var tokens loginResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &tokens))
+	return tokens
+}
+
 func InitializeDatabaseConnection(mongoURI string) (*mongo.Client, error) {
 	// Set client options
 	clientOptions := options.Client().ApplyURI(mongoURI)
@@ -135,20 +262,126 @@ func InitializeDatabaseConnection(mongoURI string) (*mongo.Client, error) {
 	return client, nil
 }
 
-func setupTestRouter(userRepo user.Repository) *gin.Engine {
+func setupTestRouter(t *testing.T, userRepo *database.UserRepository, sessionRepo auth.SessionRepository, attemptRepo auth.AttemptRepository, tokenRepo auth.ActionTokenRepository, apiKeyRepo auth.APIKeyRepository, orgRepo organization.Repository) *gin.Engine {
+	// Create a token manager and MFA secret box with fixed keys for the test.
+	tokens, err := auth.NewTokenManager([]byte("0123456789abcdef0123456789abcdef"), time.Minute)
+	require.NoError(t, err)
+	box, err := auth.NewSecretBox([]byte("fedcba9876543210fedcba9876543210"))
+	require.NoError(t, err)
+
 	// Create a new user service with the provided repository.
-	userService := user.NewService(userRepo)
+	userService := user.NewService(userRepo, orgRepo, testHasher, user.DefaultPasswordPolicy())
 	// Create a new user handler with the created user service.
-	userHandler := handlers.NewUserHandler(userService)
+	verification := auth.NewVerificationService(userRepo, tokenRepo, notify.LogNotifier{}, time.Hour, time.Minute, auth.DefaultEmailVerificationURL)
+	userHandler := handlers.NewUserHandler(userService, verification)
+	// Create a new auth handler with the created user service.
+	guard := auth.NewLoginGuard(attemptRepo, auth.LockoutPolicy{Threshold: 5, LockoutDuration: time.Minute}, nil)
+	sessions := auth.NewSessionService(sessionRepo, time.Hour)
+	authHandler := handlers.NewAuthHandler(userService, tokens, sessions, guard, auth.NewMFAService(userRepo, box))
+	// Create a new password handler whose reset tokens are only logged.
+	resets := auth.NewPasswordResetService(userRepo, tokenRepo, notify.LogNotifier{}, time.Hour, "")
+	passwordHandler := handlers.NewPasswordHandler(userService, resets, sessions)
+	verificationHandler := handlers.NewVerificationHandler(verification)
+	apiKeys := auth.NewAPIKeyService(apiKeyRepo, nil)
+	apiKeyHandler := handlers.NewAPIKeyHandler(apiKeys)
+	impersonationHandler := handlers.NewImpersonationHandler(auth.NewImpersonationService(tokens, userRepo, nil, time.Minute, false))
+	organizationHandler := handlers.NewOrganizationHandler(organization.NewService(orgRepo, userRepo, nil))
 
 	// Create a new gin engine.
 	r := gin.New()
+	r.ContextWithFallback = true
+	r.Use(middleware.Errors())
 
-	// Create a new rate limiter. This will limit to 1 request/second.
-	limiter := tollbooth.NewLimiter(1, nil)
+	// Create rate limiters generous enough for the tests.
+	policy, err := ratelimit.NewPolicy("test", 1000, 1000)
+	require.NoError(t, err)
+	store := ratelimit.NewMemoryStore()
+	limiter := ratelimit.New("global", ratelimit.Config{Default: policy}, store)
+	loginLimiter := ratelimit.New("login", ratelimit.Config{Default: policy, ByIP: true}, store)
+	ipLimiter := ratelimit.New("ip", ratelimit.Config{Default: policy, ByIP: true}, store)
 
 	// Setup the routes for the server.
-	setupRoutes(r, limiter, userHandler)
+	setupRoutes(r, routes{
+		limit:           limiter.Handler(nil),
+		ipLimit:         ipLimiter.Handler(nil),
+		loginLimit:      loginLimiter.Handler(nil),
+		requireVerified: middleware.RequireVerifiedEmail(middleware.UnverifiedAccessFull),
+		users:           userHandler,
+		auth:            authHandler,
+		passwords:       passwordHandler,
+		verification:    verificationHandler,
+		apiKeys:         apiKeyHandler,
+		impersonation:   impersonationHandler,
+		organizations:   organizationHandler,
+		tokens:          tokens,
+		apiKeyService:   apiKeys,
+	})
 
 	return r
 }
+
+// TestRateLimitBeforeAuthentication checks that requests with missing or bad credentials are rate
+// limited by IP address, although they never reach the per-principal limit.
+func TestRateLimitBeforeAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	generous, err := ratelimit.NewPolicy("test", 1000, 1000)
+	require.NoError(t, err)
+	strict, err := ratelimit.NewPolicy("ip", 0.01, 2)
+	require.NoError(t, err)
+	store := ratelimit.NewMemoryStore()
+	limit := ratelimit.New("global", ratelimit.Config{Default: generous}, store).Handler(nil)
+	ipLimit := ratelimit.New("ip", ratelimit.Config{Default: strict, ByIP: true}, store).Handler(nil)
+	tokens, err := auth.NewTokenManager([]byte("0123456789abcdef0123456789abcdef"), time.Minute)
+	require.NoError(t, err)
+
+	// No handler is reached, since every request fails authentication.
+	r := gin.New()
+	r.Use(middleware.Errors())
+	setupRoutes(r, routes{
+		limit:           limit,
+		ipLimit:         ipLimit,
+		loginLimit:      limit,
+		requireVerified: middleware.RequireVerifiedEmail(middleware.UnverifiedAccessFull),
+		tokens:          tokens,
+	})
+
+	get := func(path, authorization string) int {
+		response := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", authorization)
+		r.ServeHTTP(response, req)
+		return response.Code
+	}
+	require.Equal(t, http.StatusUnauthorized, get("/users", ""))
+	require.Equal(t, http.StatusUnauthorized, get("/organizations", "Bearer forged"))
+	require.Equal(t, http.StatusTooManyRequests, get("/users", "Bearer forged"))
+}
+
+// TestRateLimitBeforeAuthenticationHonorsPrincipals checks that the default IP policy lets a caller use
+// a principal policy above the default policy, although the IP limit is passed first.
+func TestRateLimitBeforeAuthenticationHonorsPrincipals(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	id := primitive.NewObjectID()
+	principals, err := ratelimit.ParsePrincipals("user:" + id.Hex() + "=100:100")
+	require.NoError(t, err)
+	limits := ratelimit.Config{Default: ratelimit.Policy{Name: "default", Rate: 1, Burst: 1}, Principals: principals}
+	store := ratelimit.NewMemoryStore()
+	limit := ratelimit.New("global", limits, store).Handler(nil)
+	ipLimit := ratelimit.New("ip", ratelimit.Config{Default: limits.IPPolicy(), ByIP: true}, store).Handler(nil)
+	tokens, err := auth.NewTokenManager([]byte("0123456789abcdef0123456789abcdef"), time.Minute)
+	require.NoError(t, err)
+	token, _, err := tokens.Issue(models.User{ID: id, Role: user.RoleUser})
+	require.NoError(t, err)
+
+	r := gin.New()
+	r.Use(middleware.Errors())
+	r.GET("/probe", ipLimit, middleware.RequireAuth(tokens), limit, func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	for i := 0; i < 50; i++ {
+		response := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/probe", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(response, req)
+		require.Equal(t, http.StatusNoContent, response.Code, "request %d", i+1)
+	}
+}
@@ -2,26 +2,11 @@ package utils
 
 import (
 	"os"
-	"regexp"
-
-	log "github.com/sirupsen/logrus"
-)
-
-// Regular expressions to match password requirements
-var (
-	uppercaseRegex = regexp.MustCompile(`[A-Z]`)
-	lowercaseRegex = regexp.MustCompile(`[a-z]`)
-	numberRegex    = regexp.MustCompile(`[0-9]`)
-	specialRegex   = regexp.MustCompile(`[!@#$%^&*-]`)
+	"simplecrud/pkg/logging"
+	"strconv"
+	"time"
 )
 
-// Initialize logger with JSON formatter, standard output and info log level
-func init() {
-	log.SetFormatter(&log.JSONFormatter{})
-	log.SetOutput(os.Stdout)
-	log.SetLevel(log.InfoLevel)
-}
-
 // GetEnv retrieves the value of the environment variable named by the key.
 // If the environment variable is not set, it returns the provided fallback value.
 func GetEnv(key, fallback string) string {
@@ -31,38 +16,62 @@ func GetEnv(key, fallback string) string {
 	return fallback
 }
 
-// HandleError logs the error based on the provided log level: "I" for Info, "E" for Error, and "W" for Warning.
-// If the error is not nil, it logs the error and the associated message at the given log level.
-func HandleError(logLevel, msg string, err error) {
+// GetEnvDuration retrieves the environment variable named by the key and parses it as a duration
+// (for example "15m" or "1h30m"). If the variable is not set or cannot be parsed, it returns the fallback value.
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
 	if err != nil {
-		// Create an entry for the error
-		entry := log.WithFields(log.Fields{
-			"error": err,
-		})
+		logging.Default().WithError(err).Warn("Invalid duration in environment variable " + key)
+		return fallback
+	}
+	return duration
+}
 
-		// Log the error at the appropriate level
-		switch logLevel {
-		case "I":
-			entry.Info(msg)
-		case "E":
-			entry.Error(msg)
-		case "W":
-			entry.Warn(msg)
-		default:
-			entry.Info(msg)
-		}
+// GetEnvInt retrieves the environment variable named by the key and parses it as an integer.
+// If the variable is not set or cannot be parsed, it returns the fallback value.
+func GetEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
 	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		logging.Default().WithError(err).Warn("Invalid integer in environment variable " + key)
+		return fallback
+	}
+	return number
 }
 
-// IsStrongPassword checks whether the provided password string fulfills all password requirements.
-// It checks for minimum length of 8, at least one uppercase letter, one lowercase letter,
-// one digit and one special character. It returns true if all requirements are met, false otherwise.
-func IsStrongPassword(password string) bool {
-	hasMinLength := len(password) >= 8
-	hasUppercase := uppercaseRegex.MatchString(password)
-	hasLowercase := lowercaseRegex.MatchString(password)
-	hasNumber := numberRegex.MatchString(password)
-	hasSpecial := specialRegex.MatchString(password)
+// GetEnvFloat retrieves the environment variable named by the key and parses it as a float.
+// If the variable is not set or cannot be parsed, it returns the fallback value.
+func GetEnvFloat(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		logging.Default().WithError(err).Warn("Invalid number in environment variable " + key)
+		return fallback
+	}
+	return number
+}
 
-	return hasMinLength && hasUppercase && hasLowercase && hasNumber && hasSpecial
+// GetEnvBool retrieves the environment variable named by the key and parses it as a boolean
+// ("true", "false", "1", "0", ...). If the variable is not set or cannot be parsed, it returns the fallback value.
+func GetEnvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		logging.Default().WithError(err).Warn("Invalid boolean in environment variable " + key)
+		return fallback
+	}
+	return b
 }
@@ -1,49 +1,58 @@
 package utils
 
 import (
-	"bytes"
-	"fmt"
-	"os"
 	"testing"
-
-	log "github.com/sirupsen/logrus"
+	"time"
 )
 
-func TestHandleError(t *testing.T) {
-	var buffer bytes.Buffer
-	log.SetOutput(&buffer)
+func TestGetEnvDuration(t *testing.T) {
+	t.Setenv("TEST_DURATION", "90s")
+	if got := GetEnvDuration("TEST_DURATION", time.Minute); got != 90*time.Second {
+		t.Errorf("Expected 90s, got '%v'", got)
+	}
+
+	t.Setenv("TEST_DURATION", "not-a-duration")
+	if got := GetEnvDuration("TEST_DURATION", time.Minute); got != time.Minute {
+		t.Errorf("Expected fallback for invalid value, got '%v'", got)
+	}
+
+	if got := GetEnvDuration("TEST_DURATION_UNSET", time.Minute); got != time.Minute {
+		t.Errorf("Expected fallback for unset variable, got '%v'", got)
+	}
+}
+
+func TestGetEnvInt(t *testing.T) {
+	t.Setenv("TEST_INT", "7")
+	if got := GetEnvInt("TEST_INT", 3); got != 7 {
+		t.Errorf("Expected 7, got '%v'", got)
+	}
 
-	HandleError("I", "Info Message", nil)
-	if buffer.Len() != 0 {
-		t.Errorf("Expected no log entry, got '%s'", buffer.String())
+	t.Setenv("TEST_INT", "seven")
+	if got := GetEnvInt("TEST_INT", 3); got != 3 {
+		t.Errorf("Expected fallback for invalid value, got '%v'", got)
 	}
+}
 
-	err := os.ErrNotExist
-	HandleError("E", "Error Message", err)
-	if !bytes.Contains(buffer.Bytes(), []byte("\"error\":\"file does not exist\"")) || !bytes.Contains(buffer.Bytes(), []byte("\"level\":\"error\"")) {
-		t.Errorf("Expected error log entry, got '%s'", buffer.String())
+func TestGetEnvFloat(t *testing.T) {
+	t.Setenv("TEST_FLOAT", "0.5")
+	if got := GetEnvFloat("TEST_FLOAT", 1); got != 0.5 {
+		t.Errorf("Expected 0.5, got '%v'", got)
+	}
+
+	t.Setenv("TEST_FLOAT", "half")
+	if got := GetEnvFloat("TEST_FLOAT", 1); got != 1 {
+		t.Errorf("Expected fallback for invalid value, got '%v'", got)
 	}
 }
 
-func TestIsStrongPassword(t *testing.T) {
-	tests := []struct {
-		password string
-		expected bool
-	}{
-		{"Password1!", true},
-		{"weak", false},
-		{"NoSpecialChar1", false},
-		{"Nouppercase1!", true},
-		{"NOLOWERCASE1!", false},
-		{"NoNumber!", false},
-	}
-
-	for _, test := range tests {
-		actual := IsStrongPassword(test.password)
-		if actual != test.expected {
-			t.Errorf("For password '%s', expected '%v', got '%v'", test.password, test.expected, actual)
-		} else {
-			fmt.Printf("Password '%s' is strong: %v\n", test.password, actual)
-		}
+func TestGetEnvBool(t *testing.T) {
+	t.Setenv("TEST_BOOL", "false")
+	if got := GetEnvBool("TEST_BOOL", true); got != false {
+		t.Errorf("Expected false, got '%v'", got)
+	}
+
+	t.Setenv("TEST_BOOL", "maybe")
+	if got := GetEnvBool("TEST_BOOL", true); got != true {
+		t.Errorf("Expected fallback for invalid value, got '%v'", got)
 	}
 }